@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A db listed in ordered-databases gets a B+tree index instead of the hash
+// index when its first key is written. The tree maps keys to their eles in
+// order, so the keys can be walked from any key on, which SCAN and RANGE do.
+//
+// The nodes are pages of IndexEles. A leaf holds the eles of its keys sorted by
+// key, and a branch holds its children with, from the second one on, the ele
+// of a key which is not above any key of that child. The keys are not copied
+// into the nodes, they are read from the eles, which are never moved.
+//
+// The nodes are copied on write: a put writes the changed leaf and the
+// branches above it to new pages, and only switches the root in the header
+// when all of them are written. The old pages go to the free list of the tree
+// after that. Like in the hash index, a key is deleted by flagging its ele,
+// and the entries of deleted eles are dropped when their leaf is copied.
+
+const (
+	btreePageFlag  = 0x20
+	branchPageFlag = 0x40
+	leafPageFlag   = 0x80
+
+	// pages added to the free list of a tree when it has none left.
+	btreeGrowPages = 16
+)
+
+// btreeHeader is kept in the first page of a B+tree index, dbMeta.indexPgid
+// points to it.
+type btreeHeader struct {
+	root     uint64
+	height   uint64 // 1 if the root is a leaf
+	freePgid uint64 // first free page, each one holds the next in its first 8 bytes
+}
+
+type branchEntry struct {
+	child uint64
+	key   IndexEle // unused in the first entry
+}
+
+// node is a copy of a node page which is being changed.
+type node struct {
+	leaf     bool
+	ies      []IndexEle
+	children []uint64
+}
+
+func (p *page) btreeHeader() *btreeHeader {
+	return (*btreeHeader)(unsafe.Pointer(&p.ptr))
+}
+
+func (p *page) leafEntries() []IndexEle {
+	return (*[maxAllocSize / unsafe.Sizeof(IndexEle{})]IndexEle)(unsafe.Pointer(&p.ptr))[:p.count:p.count]
+}
+
+func (p *page) branchEntries() []branchEntry {
+	return (*[maxAllocSize / unsafe.Sizeof(branchEntry{})]branchEntry)(unsafe.Pointer(&p.ptr))[:p.count:p.count]
+}
+
+// ordered tells if db has a B+tree index, or gets one with its first key.
+func (db *DB) ordered() bool {
+	pgid := db.dbMeta().indexPgid
+	if pgid == 0 {
+		return db.cfg.OrderedDatabases&(1<<uint(db.num)) != 0
+	}
+	return db.page(pgid).flags == btreePageFlag
+}
+
+func (db *DB) btreeHeader() *btreeHeader {
+	return db.page(db.dbMeta().indexPgid).btreeHeader()
+}
+
+func (db *DB) leafCap() int {
+	return int((db.pageSize - uint64(unsafe.Offsetof(page{}.ptr))) / uint64(unsafe.Sizeof(IndexEle{})))
+}
+
+func (db *DB) branchCap() int {
+	return int((db.pageSize - uint64(unsafe.Offsetof(page{}.ptr))) / uint64(unsafe.Sizeof(branchEntry{})))
+}
+
+// allocBtree creates the B+tree index of db with an empty leaf as root.
+func (db *DB) allocBtree() error {
+	pgid, err := db.allocPages(1 + btreeGrowPages)
+	if err != nil {
+		return err
+	}
+
+	pg := db.page(pgid)
+	pg.id = int(pgid)
+	pg.flags = btreePageFlag
+	db.dbMeta().indexPgid = pgid
+
+	for i := uint64(btreeGrowPages); i > 0; i-- {
+		db.freeNode(pgid + i)
+	}
+
+	root, err := db.writeNode(&node{leaf: true})
+	if err != nil {
+		return err
+	}
+	hdr := db.btreeHeader()
+	hdr.root = root
+	hdr.height = 1
+
+	logrus.Infof("B+tree index of db %d allocated at page %d", db.num, pgid)
+	return nil
+}
+
+func (db *DB) freeNode(pgid uint64) {
+	hdr := db.btreeHeader()
+	pg := db.page(pgid)
+	pg.id = int(pgid)
+	pg.flags = 0
+	pg.count = 0
+	*(*uint64)(unsafe.Pointer(&pg.ptr)) = hdr.freePgid
+	hdr.freePgid = pgid
+}
+
+func (db *DB) allocNode() (uint64, error) {
+	if db.btreeHeader().freePgid == 0 {
+		pgid, err := db.allocPages(btreeGrowPages)
+		if err != nil {
+			return 0, err
+		}
+		for i := uint64(btreeGrowPages); i > 0; i-- {
+			db.freeNode(pgid + i - 1)
+		}
+	}
+
+	hdr := db.btreeHeader()
+	pgid := hdr.freePgid
+	hdr.freePgid = *(*uint64)(unsafe.Pointer(&db.page(pgid).ptr))
+	return pgid, nil
+}
+
+func (db *DB) readNode(pgid uint64) *node {
+	pg := db.page(pgid)
+	if pg.flags == leafPageFlag {
+		return &node{leaf: true, ies: append([]IndexEle{}, pg.leafEntries()...)}
+	}
+
+	n := &node{}
+	for _, be := range pg.branchEntries() {
+		n.children = append(n.children, be.child)
+		n.ies = append(n.ies, be.key)
+	}
+	return n
+}
+
+// writeNode writes n to a new page.
+func (db *DB) writeNode(n *node) (uint64, error) {
+	pgid, err := db.allocNode()
+	if err != nil {
+		return 0, err
+	}
+
+	pg := db.page(pgid)
+	pg.id = int(pgid)
+	pg.count = uint16(len(n.ies))
+	if n.leaf {
+		pg.flags = leafPageFlag
+		copy(pg.leafEntries(), n.ies)
+		return pgid, nil
+	}
+
+	pg.flags = branchPageFlag
+	bes := pg.branchEntries()
+	for i := range bes {
+		bes[i] = branchEntry{child: n.children[i], key: n.ies[i]}
+	}
+	return pgid, nil
+}
+
+func (db *DB) compareKey(ie *IndexEle, key []byte) int {
+	return bytes.Compare(db.ele(ie).key(), key)
+}
+
+// searchLeaf returns the position of the first entry not below key.
+func (db *DB) searchLeaf(ies []IndexEle, key []byte) int {
+	return sort.Search(len(ies), func(i int) bool {
+		return db.compareKey(&ies[i], key) >= 0
+	})
+}
+
+// searchBranch returns the child whose keys key is in the range of.
+func (db *DB) searchBranch(bes []branchEntry, key []byte) int {
+	i := sort.Search(len(bes)-1, func(i int) bool {
+		return db.compareKey(&bes[i+1].key, key) > 0
+	})
+	return i
+}
+
+// btreeGet returns the ele of key, an empty one if key does not exist.
+func (db *DB) btreeGet(key []byte) *IndexEle {
+	hdr := db.btreeHeader()
+	pgid := hdr.root
+	for h := hdr.height; h > 1; h-- {
+		bes := db.page(pgid).branchEntries()
+		pgid = bes[db.searchBranch(bes, key)].child
+	}
+
+	ies := db.page(pgid).leafEntries()
+	i := db.searchLeaf(ies, key)
+	if i < len(ies) && db.compareKey(&ies[i], key) == 0 {
+		ie := ies[i]
+		return &ie
+	}
+	return &IndexEle{}
+}
+
+// btreePut points key to the ele at ie.
+func (db *DB) btreePut(key []byte, ie IndexEle) error {
+	hdr := db.btreeHeader()
+	var old []uint64
+	left, right, sep, err := db.putNode(hdr.root, hdr.height, key, ie, &old)
+	if err != nil {
+		return err
+	}
+
+	hdr = db.btreeHeader()
+	height := hdr.height
+	if right != 0 {
+		left, err = db.writeNode(&node{ies: []IndexEle{{}, sep}, children: []uint64{left, right}})
+		if err != nil {
+			return err
+		}
+		height++
+	}
+
+	// the new pages are all written, the tree is switched to them here.
+	hdr = db.btreeHeader()
+	hdr.root = left
+	hdr.height = height
+	for _, pgid := range old {
+		db.freeNode(pgid)
+	}
+	return nil
+}
+
+// putNode puts key in a copy of the subtree at pgid. It returns the copy, and
+// if it is split, its right half and the key between the two.
+func (db *DB) putNode(pgid, height uint64, key []byte, ie IndexEle, old *[]uint64) (left, right uint64, sep IndexEle, err error) {
+	n := db.readNode(pgid)
+	*old = append(*old, pgid)
+
+	if height == 1 {
+		i := db.searchLeaf(n.ies, key)
+		if i < len(n.ies) && db.compareKey(&n.ies[i], key) == 0 {
+			n.ies[i] = ie
+		} else {
+			n.ies = append(n.ies, IndexEle{})
+			copy(n.ies[i+1:], n.ies[i:])
+			n.ies[i] = ie
+		}
+
+		live := n.ies[:0]
+		for _, e := range n.ies {
+			if !db.ele(&e).isDeleted() {
+				live = append(live, e)
+			}
+		}
+		n.ies = live
+	} else {
+		bes := db.page(pgid).branchEntries()
+		i := db.searchBranch(bes, key)
+		l, r, s, err := db.putNode(n.children[i], height-1, key, ie, old)
+		if err != nil {
+			return 0, 0, IndexEle{}, err
+		}
+
+		n.children[i] = l
+		if r != 0 {
+			n.children = append(n.children, 0)
+			copy(n.children[i+2:], n.children[i+1:])
+			n.children[i+1] = r
+			n.ies = append(n.ies, IndexEle{})
+			copy(n.ies[i+2:], n.ies[i+1:])
+			n.ies[i+1] = s
+		}
+	}
+
+	capacity := db.branchCap()
+	if n.leaf {
+		capacity = db.leafCap()
+	}
+	if len(n.ies) <= capacity {
+		left, err = db.writeNode(n)
+		return left, 0, IndexEle{}, err
+	}
+
+	half := len(n.ies) / 2
+	rn := &node{leaf: n.leaf, ies: append([]IndexEle{}, n.ies[half:]...)}
+	n.ies = n.ies[:half]
+	if !n.leaf {
+		rn.children = append([]uint64{}, n.children[half:]...)
+		n.children = n.children[:half]
+	}
+	// the first key of a branch is unused, it moves up as the separator.
+	sep = rn.ies[0]
+
+	left, err = db.writeNode(n)
+	if err != nil {
+		return 0, 0, IndexEle{}, err
+	}
+	right, err = db.writeNode(rn)
+	return left, right, sep, err
+}
+
+// btreeRefs returns the entries of the tree which point to the ele at ie, whose
+// key is key: the leaf with the position of its entry in it, -1 if it has none,
+// and the separators on the way to the leaf.
+func (db *DB) btreeRefs(ie IndexEle, key []byte) (leaf *page, at int, seps []*IndexEle) {
+	hdr := db.btreeHeader()
+	pgid := hdr.root
+	for h := hdr.height; h > 1; h-- {
+		bes := db.page(pgid).branchEntries()
+		for i := range bes {
+			if bes[i].key == ie {
+				seps = append(seps, &bes[i].key)
+			}
+		}
+		pgid = bes[db.searchBranch(bes, key)].child
+	}
+
+	leaf = db.page(pgid)
+	ies := leaf.leafEntries()
+	at = db.searchLeaf(ies, key)
+	if at == len(ies) || ies[at] != ie {
+		at = -1
+	}
+	return leaf, at, seps
+}
+
+// btreeRemoveAt removes the entry at of leaf in place, which only compaction
+// does, to drop the entry of a deleted ele.
+func (db *DB) btreeRemoveAt(leaf *page, at int) {
+	ies := leaf.leafEntries()
+	copy(ies[at:], ies[at+1:])
+	leaf.count--
+}
+
+// btreeWalk calls fn for the live keys from the first one not below from on,
+// in order, until fn returns false. fn must not change the tree.
+func (db *DB) btreeWalk(from []byte, now int64, fn func(ele *Ele) bool) {
+	hdr := db.btreeHeader()
+	db.walkNode(hdr.root, hdr.height, from, now, fn)
+}
+
+func (db *DB) walkNode(pgid, height uint64, from []byte, now int64, fn func(ele *Ele) bool) bool {
+	pg := db.page(pgid)
+	if height == 1 {
+		ies := pg.leafEntries()
+		i := 0
+		if from != nil {
+			i = db.searchLeaf(ies, from)
+		}
+		for ; i < len(ies); i++ {
+			ele := db.ele(&ies[i])
+			if ele.isDeleted() || ele.isExpired(now) {
+				continue
+			}
+			if !fn(ele) {
+				return false
+			}
+		}
+		return true
+	}
+
+	bes := pg.branchEntries()
+	i := 0
+	if from != nil {
+		i = db.searchBranch(bes, from)
+	}
+	for ; i < len(bes); i++ {
+		if !db.walkNode(bes[i].child, height-1, from, now, fn) {
+			return false
+		}
+		// the keys of the next children are all above from.
+		from = nil
+	}
+	return true
+}
+
+// btreeSample calls fn for the eles of a random leaf which are not deleted,
+// the expired ones included.
+func (db *DB) btreeSample(fn func(ele *Ele)) {
+	hdr := db.btreeHeader()
+	pgid := hdr.root
+	for h := hdr.height; h > 1; h-- {
+		bes := db.page(pgid).branchEntries()
+		pgid = bes[rand.Intn(len(bes))].child
+	}
+
+	ies := db.page(pgid).leafEntries()
+	for i := range ies {
+		ele := db.ele(&ies[i])
+		if !ele.isDeleted() {
+			fn(ele)
+		}
+	}
+}
+
+// btreeReset frees all the nodes of the tree, which gets an empty leaf as root.
+func (db *DB) btreeReset() error {
+	hdr := db.btreeHeader()
+	var pgids []uint64
+	var collect func(pgid, height uint64)
+	collect = func(pgid, height uint64) {
+		pgids = append(pgids, pgid)
+		if height > 1 {
+			for _, be := range db.page(pgid).branchEntries() {
+				collect(be.child, height-1)
+			}
+		}
+	}
+	collect(hdr.root, hdr.height)
+
+	root, err := db.writeNode(&node{leaf: true})
+	if err != nil {
+		return err
+	}
+	hdr = db.btreeHeader()
+	hdr.root = root
+	hdr.height = 1
+	for _, pgid := range pgids {
+		db.freeNode(pgid)
+	}
+	return nil
+}
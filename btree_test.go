@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newOrderedTestDB returns a test db whose dbs 0 and 1 are ordered.
+func newOrderedTestDB(t *testing.T) *DB {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	cfg := defaultConfig()
+	cfg.Dir = path
+	cfg.OrderedDatabases = 1<<0 | 1<<1
+	db, err := LoadOrCreateDbWithConfig(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+// btreePages returns the number of nodes in the tree of db and of pages in its
+// free list.
+func btreePages(db *DB) (nodes, free int) {
+	var count func(pgid, height uint64)
+	count = func(pgid, height uint64) {
+		nodes++
+		if height > 1 {
+			for _, be := range db.page(pgid).branchEntries() {
+				count(be.child, height-1)
+			}
+		}
+	}
+	hdr := db.btreeHeader()
+	count(hdr.root, hdr.height)
+
+	for pgid := hdr.freePgid; pgid != 0; pgid = *(*uint64)(unsafe.Pointer(&db.page(pgid).ptr)) {
+		free++
+	}
+	return nodes, free
+}
+
+func Test_btreePutGet(t *testing.T) {
+	db := newOrderedTestDB(t)
+
+	n := 3000
+	for _, i := range rand.Perm(n) {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprint(i))))
+	}
+
+	assert.True(t, db.ordered())
+	assert.Nil(t, db.indexDir())
+	assert.Greater(t, db.btreeHeader().height, uint64(1))
+	assert.Equal(t, int64(n), db.DBSize())
+
+	for i := 0; i < n; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%05d", i)))
+		assert.Nil(t, err, i)
+		assert.Equal(t, fmt.Sprint(i), string(val))
+	}
+	_, err := db.Get([]byte("key-"))
+	assert.Equal(t, NotFoundError, err)
+
+	keys := db.Keys("*")
+	assert.Equal(t, n, len(keys))
+	assert.True(t, sort.SliceIsSorted(keys, func(i, j int) bool {
+		return string(keys[i]) < string(keys[j])
+	}))
+
+	// db 2 is not ordered.
+	assert.Nil(t, db.dbs[2].Set(nil, []byte("k"), []byte("v")))
+	assert.False(t, db.dbs[2].ordered())
+	assert.NotNil(t, db.dbs[2].indexDir())
+}
+
+func Test_btreeCopyOnWrite(t *testing.T) {
+	db := newOrderedTestDB(t)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%05d", i)), []byte("v")))
+	}
+	nodes, free := btreePages(db)
+
+	// each put copies a path of the tree, whose old pages are used again.
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2000; i += 7 {
+			val := []byte(fmt.Sprintf("value of round %d", round))
+			assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%05d", i)), val))
+		}
+	}
+	n, f := btreePages(db)
+	assert.Equal(t, nodes, n)
+	assert.LessOrEqual(t, n+f, nodes+free+btreeGrowPages)
+
+	// deleted keys are dropped from a leaf when it is copied.
+	for i := 0; i < 2000; i++ {
+		if i%10 != 0 {
+			_, err := db.Delete(nil, []byte(fmt.Sprintf("key-%05d", i)))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, db.Set(nil, []byte("key-00001"), []byte("again")))
+	leaf := db.btreeHeader().root
+	for h := db.btreeHeader().height; h > 1; h-- {
+		leaf = db.page(leaf).branchEntries()[0].child
+	}
+	assert.Equal(t, []string{"key-00000", "key-00001", "key-00010"}, leafKeys(db, leaf)[:3])
+
+	keys := db.Keys("*")
+	assert.Equal(t, 201, len(keys))
+}
+
+func leafKeys(db *DB, pgid uint64) []string {
+	var keys []string
+	for _, ie := range db.page(pgid).leafEntries() {
+		keys = append(keys, string(db.ele(&ie).key()))
+	}
+	return keys
+}
+
+func Test_orderedScan(t *testing.T) {
+	db := newOrderedTestDB(t)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("a:%02d", i)), []byte("v")))
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("b:%02d", i)), []byte("v")))
+	}
+
+	var keys [][]byte
+	var from []byte
+	calls := 0
+	for {
+		var got [][]byte
+		from, got = db.ScanOrdered(from, scanOptions{pattern: "*", count: 30, typ: -1})
+		keys = append(keys, got...)
+		calls++
+		// keys before the cursor do not change the scan.
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("0:%d", calls)), []byte("v")))
+		if from == nil {
+			break
+		}
+	}
+	assert.Equal(t, 7, calls)
+	assert.Equal(t, 200, len(keys))
+	assert.Equal(t, "a:00", string(keys[0]))
+	assert.Equal(t, "b:99", string(keys[199]))
+
+	// a pattern with a prefix walks only the keys with it.
+	next, keys := db.ScanOrdered(nil, scanOptions{pattern: "b:5*", count: 5, typ: -1})
+	assert.Equal(t, "b:55", string(next))
+	assert.Equal(t, 5, len(keys))
+	assert.Equal(t, "b:50", string(keys[0]))
+	next, keys = db.ScanOrdered(next, scanOptions{pattern: "b:5*", count: 10, typ: -1})
+	assert.Nil(t, next)
+	assert.Equal(t, 5, len(keys))
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"scan", "0", "match", "a:0*", "count", "3"}, "*2\r\n$8\r\n613a3033\r\n*3\r\n$4\r\na:00\r\n$4\r\na:01\r\n$4\r\na:02\r\n"},
+		{[]string{"scan", "613a3039", "match", "a:0*"}, "*2\r\n$1\r\n0\r\n*1\r\n$4\r\na:09\r\n"},
+		{[]string{"scan", "613a3938", "type", "list"}, "*2\r\n$8\r\n623a3038\r\n*0\r\n"},
+		{[]string{"scan", "xyz"}, "-ERR invalid cursor\r\n"},
+		{[]string{"scan", "0", "count", "0"}, "-ERR syntax error\r\n"},
+	}
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_rangeCommand(t *testing.T) {
+	db := newOrderedTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"range", "-", "+"}, "*0\r\n"},
+		{[]string{"mset", "b", "1", "a", "1", "d", "1", "c", "1", "e", "1"}, "+OK\r\n"},
+		{[]string{"set", "cc", "1"}, "+OK\r\n"},
+		{[]string{"pexpireat", "cc", "1"}, ":1\r\n"},
+		{[]string{"range", "-", "+"}, "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{[]string{"range", "[b", "(d"}, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"range", "(b", "+"}, "*3\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{[]string{"range", "-", "+", "limit", "1", "2"}, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"range", "-", "+", "limit", "3", "-1"}, "*2\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{[]string{"range", "-", "+", "limit", "-1", "2"}, "*0\r\n"},
+		{[]string{"range", "+", "-"}, "*0\r\n"},
+		{[]string{"range", "[d", "[b"}, "*0\r\n"},
+		{[]string{"range", "b", "+"}, "-ERR min or max not valid string range item\r\n"},
+		{[]string{"range", "-", "+", "limit", "x", "1"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"range", "-", "+", "limit", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"select", "2"}, "+OK\r\n"},
+		{[]string{"range", "-", "+"}, "-ERR the selected database is not ordered, see ordered-databases\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_orderedFlushAndExpire(t *testing.T) {
+	db := newOrderedTestDB(t)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%04d", i)), []byte("v")))
+	}
+	assert.Nil(t, db.FlushDB())
+	assert.Equal(t, int64(0), db.DBSize())
+	assert.Equal(t, uint64(1), db.btreeHeader().height)
+	_, err := db.RandomKey()
+	assert.Equal(t, NotFoundError, err)
+
+	for i := 0; i < 100; i++ {
+		_, _, err = db.SetWithOptions(nil, []byte(fmt.Sprintf("ttl-%02d", i)), []byte("v"), setOptions{expireAt: nowMillis() + 10})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Set(nil, []byte("stay"), []byte("v")))
+	time.Sleep(20 * time.Millisecond)
+
+	key, err := db.RandomKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "stay", string(key))
+
+	// the keys of a sampled leaf are expired together.
+	db.serving = true
+	for i := 0; i < 100 && db.DBSize() > 1; i++ {
+		db.activeExpireCycle()
+	}
+	assert.Equal(t, int64(1), db.DBSize())
+}
+
+func Test_recoverOrderedDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	cfg := defaultConfig()
+	cfg.Dir = path
+	cfg.OrderedDatabases = 1 << 1
+	db, err := LoadOrCreateDbWithConfig(cfg)
+	assert.Nil(t, err)
+	db.serving = true
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("select", "1"))
+	for i := 50; i > 0; i-- {
+		input += string(encodeCommand("set", fmt.Sprintf("key-%02d", i), "v"))
+	}
+	runCommands(t, db, cmdhdr, input)
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// the file keeps the index, whatever the config says now.
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	assert.True(t, db.dbs[1].ordered())
+	keys, err := db.dbs[1].Range(lexBound{inf: -1}, lexBound{member: []byte("key-03")}, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("key-01"), []byte("key-02"), []byte("key-03")}, keys)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// the wal alone builds the same tree.
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+	db, err = LoadOrCreateDbWithConfig(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.True(t, db.dbs[1].ordered())
+	assert.Equal(t, int64(50), db.dbs[1].DBSize())
+	keys = db.dbs[1].Keys("*")
+	assert.Equal(t, "key-01", string(keys[0]))
+	assert.Equal(t, "key-50", string(keys[49]))
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// flags of a command, reported by COMMAND.
+const (
+	cmdWrite = 1 << iota
+	cmdReadonly
+	cmdFast
+	cmdAdmin
+	cmdBlocking
+)
+
+var commandFlagNames = []struct {
+	flag int
+	name string
+}{
+	{cmdWrite, "write"},
+	{cmdReadonly, "readonly"},
+	{cmdFast, "fast"},
+	{cmdAdmin, "admin"},
+	{cmdBlocking, "blocking"},
+}
+
+// commandFunc runs cmd and writes its reply. The returned error is replied as
+// an error, connection errors are returned as they are by the reply methods.
+type commandFunc func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error
+
+type command struct {
+	name string
+	// number of arguments, the name included. A negative arity -n means at
+	// least n arguments, the same as redis.
+	arity int
+	flags int
+	// positions of the keys in the arguments, 0 if there is no key. A negative
+	// lastKey counts from the end, -1 is the last argument.
+	firstKey int
+	lastKey  int
+	step     int
+	handler  commandFunc
+
+	// conn commands change the state of the connection. They are neither
+	// queued by MULTI nor run in a db transaction.
+	conn bool
+
+	group   string // reported by COMMAND DOCS
+	summary string
+}
+
+// commandTable holds the commands by lower case name.
+var commandTable map[string]*command
+
+func init() {
+	commands := []*command{
+		{name: "get", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: getCmd,
+			group: "string", summary: "Get the value of a key"},
+		{name: "set", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: setCmd,
+			group: "string", summary: "Set the string value of a key"},
+		{name: "setnx", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: setnxCmd,
+			group: "string", summary: "Set the string value of a key only if the key does not exist"},
+		{name: "mset", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, step: 2, handler: msetCmd,
+			group: "string", summary: "Set the string values of multiple keys"},
+		{name: "msetnx", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, step: 2, handler: msetnxCmd,
+			group: "string", summary: "Set the string values of multiple keys only if none of the keys exist"},
+		{name: "mget", arity: -2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: -1, step: 1, handler: mgetCmd,
+			group: "string", summary: "Get the values of multiple keys"},
+		{name: "incr", arity: 2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: incrCmd,
+			group: "string", summary: "Increment the integer value of a key by one"},
+		{name: "decr", arity: 2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: incrCmd,
+			group: "string", summary: "Decrement the integer value of a key by one"},
+		{name: "incrby", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: incrCmd,
+			group: "string", summary: "Increment the integer value of a key by a number"},
+		{name: "decrby", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: incrCmd,
+			group: "string", summary: "Decrement the integer value of a key by a number"},
+		{name: "incrbyfloat", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: incrbyfloatCmd,
+			group: "string", summary: "Increment the float value of a key by a number"},
+		{name: "append", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: appendCmd,
+			group: "string", summary: "Append a value to the string value of a key"},
+		{name: "getset", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: getsetCmd,
+			group: "string", summary: "Set the string value of a key and return its old value"},
+		{name: "getdel", arity: 2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: getdelCmd,
+			group: "string", summary: "Get the string value of a key and delete the key"},
+		{name: "strlen", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: strlenCmd,
+			group: "string", summary: "Get the length of the string value of a key"},
+		{name: "setrange", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: setrangeCmd,
+			group: "string", summary: "Overwrite part of the string value of a key at an offset"},
+		{name: "getrange", arity: 4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: getrangeCmd,
+			group: "string", summary: "Get a substring of the string value of a key"},
+		{name: "del", arity: -2, flags: cmdWrite, firstKey: 1, lastKey: -1, step: 1, handler: delCmd,
+			group: "generic", summary: "Delete a key"},
+
+		{name: "expire", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return expireCmd(cmdhdr, db, cmd, 1000, false)
+			},
+			group: "generic", summary: "Set a key's time to live in seconds"},
+		{name: "pexpire", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return expireCmd(cmdhdr, db, cmd, 1, false)
+			},
+			group: "generic", summary: "Set a key's time to live in milliseconds"},
+		{name: "expireat", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return expireCmd(cmdhdr, db, cmd, 1000, true)
+			},
+			group: "generic", summary: "Set the expiration for a key as a UNIX timestamp"},
+		{name: "pexpireat", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return expireCmd(cmdhdr, db, cmd, 1, true)
+			},
+			group: "generic", summary: "Set the expiration for a key as a UNIX timestamp specified in milliseconds"},
+		{name: "ttl", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return ttlCmd(cmdhdr, db, cmd, 1000)
+			},
+			group: "generic", summary: "Get the time to live for a key in seconds"},
+		{name: "pttl", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return ttlCmd(cmdhdr, db, cmd, 1)
+			},
+			group: "generic", summary: "Get the time to live for a key in milliseconds"},
+		{name: "persist", arity: 2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: persistCmd,
+			group: "generic", summary: "Remove the expiration from a key"},
+
+		{name: "type", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: typeCmd,
+			group: "generic", summary: "Determine the type stored at key"},
+		{name: "scan", arity: -2, flags: cmdReadonly, handler: scanCmd,
+			group: "generic", summary: "Incrementally iterate the keys space"},
+		{name: "keys", arity: 2, flags: cmdReadonly, handler: keysCmd,
+			group: "generic", summary: "Find all keys matching the given pattern"},
+		{name: "dbsize", arity: 1, flags: cmdReadonly | cmdFast, handler: dbsizeCmd,
+			group: "server", summary: "Return the number of keys in the selected database"},
+		{name: "move", arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: moveKeyCmd,
+			group: "generic", summary: "Move a key to another database"},
+		{name: "select", arity: 2, flags: cmdFast, handler: selectCmd,
+			group: "connection", summary: "Change the selected database for the current connection"},
+		{name: "swapdb", arity: 3, flags: cmdWrite | cmdFast, handler: swapdbCmd,
+			group: "server", summary: "Swaps two Redis databases"},
+		{name: "flushdb", arity: -1, flags: cmdWrite, handler: flushdbCmd,
+			group: "server", summary: "Remove all keys from the current database"},
+		{name: "flushall", arity: -1, flags: cmdWrite, handler: flushallCmd,
+			group: "server", summary: "Remove all keys from all databases"},
+		{name: "randomkey", arity: 1, flags: cmdReadonly, handler: randomkeyCmd,
+			group: "generic", summary: "Return a random key from the keyspace"},
+		{name: "range", arity: -3, flags: cmdReadonly, handler: rangeCmd,
+			group: "generic", summary: "Return the keys of an ordered database between two keys"},
+
+		{name: "hset", arity: -4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hsetCmd,
+			group: "hash", summary: "Set the values of fields in a hash"},
+		{name: "hmset", arity: -4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hsetCmd,
+			group: "hash", summary: "Set the values of fields in a hash"},
+		{name: "hsetnx", arity: 4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hsetnxCmd,
+			group: "hash", summary: "Set the value of a field in a hash, only if the field does not exist"},
+		{name: "hget", arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hgetCmd,
+			group: "hash", summary: "Get the value of a field in a hash"},
+		{name: "hmget", arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hmgetCmd,
+			group: "hash", summary: "Get the values of fields in a hash"},
+		{name: "hdel", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hdelCmd,
+			group: "hash", summary: "Delete fields from a hash"},
+		{name: "hlen", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hlenCmd,
+			group: "hash", summary: "Get the number of fields in a hash"},
+		{name: "hexists", arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hexistsCmd,
+			group: "hash", summary: "Determine if a field exists in a hash"},
+		{name: "hstrlen", arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hstrlenCmd,
+			group: "hash", summary: "Get the length of the value of a field in a hash"},
+		{name: "hgetall", arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: hgetallCmd,
+			group: "hash", summary: "Get all the fields and values in a hash"},
+		{name: "hkeys", arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: hgetallCmd,
+			group: "hash", summary: "Get all the fields in a hash"},
+		{name: "hvals", arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: hgetallCmd,
+			group: "hash", summary: "Get all the values in a hash"},
+		{name: "hincrby", arity: 4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hincrbyCmd,
+			group: "hash", summary: "Increment the integer value of a field in a hash"},
+		{name: "hincrbyfloat", arity: 4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: hincrbyfloatCmd,
+			group: "hash", summary: "Increment the float value of a field in a hash"},
+		{name: "hscan", arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: hscanCmd,
+			group: "hash", summary: "Incrementally iterate the fields of a hash"},
+
+		{name: "lpush", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: pushCmd,
+			group: "list", summary: "Prepend elements to a list"},
+		{name: "rpush", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: pushCmd,
+			group: "list", summary: "Append elements to a list"},
+		{name: "lpushx", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: pushCmd,
+			group: "list", summary: "Prepend elements to a list only when the list exists"},
+		{name: "rpushx", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: pushCmd,
+			group: "list", summary: "Append elements to a list only when the list exists"},
+		{name: "lpop", arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: popCmd,
+			group: "list", summary: "Remove and get the first elements of a list"},
+		{name: "rpop", arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: popCmd,
+			group: "list", summary: "Remove and get the last elements of a list"},
+		{name: "llen", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: llenCmd,
+			group: "list", summary: "Get the length of a list"},
+		{name: "lrange", arity: 4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: lrangeCmd,
+			group: "list", summary: "Get a range of elements from a list"},
+		{name: "lindex", arity: 3, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: lindexCmd,
+			group: "list", summary: "Get an element from a list by its index"},
+		{name: "lset", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: lsetCmd,
+			group: "list", summary: "Set the value of an element in a list by its index"},
+		{name: "linsert", arity: 5, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: linsertCmd,
+			group: "list", summary: "Insert an element before or after another element in a list"},
+		{name: "lrem", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: lremCmd,
+			group: "list", summary: "Remove elements from a list"},
+		{name: "ltrim", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: ltrimCmd,
+			group: "list", summary: "Trim a list to the specified range"},
+		{name: "lmove", arity: 5, flags: cmdWrite, firstKey: 1, lastKey: 2, step: 1, handler: moveCmd,
+			group: "list", summary: "Pop an element from a list, push it to another list and return it"},
+		{name: "rpoplpush", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 2, step: 1, handler: moveCmd,
+			group: "list", summary: "Remove the last element in a list, prepend it to another list and return it"},
+		{name: "blpop", arity: -3, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: -2, step: 1, handler: bpopCmd,
+			group: "list", summary: "Remove and get the first element in a list, or block until one is available"},
+		{name: "brpop", arity: -3, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: -2, step: 1, handler: bpopCmd,
+			group: "list", summary: "Remove and get the last element in a list, or block until one is available"},
+		{name: "blmove", arity: 6, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: 2, step: 1, handler: moveCmd,
+			group: "list", summary: "Pop an element from a list, push it to another list and return it; or block until one is available"},
+		{name: "brpoplpush", arity: 4, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: 2, step: 1, handler: moveCmd,
+			group: "list", summary: "Pop an element from a list, push it to another list and return it; or block until one is available"},
+
+		{name: "sadd", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: saddCmd,
+			group: "set", summary: "Add members to a set"},
+		{name: "srem", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: sremCmd,
+			group: "set", summary: "Remove members from a set"},
+		{name: "smembers", arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: smembersCmd,
+			group: "set", summary: "Get all the members in a set"},
+		{name: "scard", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: scardCmd,
+			group: "set", summary: "Get the number of members in a set"},
+		{name: "sismember", arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: sismemberCmd,
+			group: "set", summary: "Determine if a given value is a member of a set"},
+		{name: "smismember", arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: smismemberCmd,
+			group: "set", summary: "Determine if the given values are members of a set"},
+		{name: "spop", arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: spopCmd,
+			group: "set", summary: "Remove and return random members from a set"},
+		{name: "srandmember", arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: srandmemberCmd,
+			group: "set", summary: "Get random members from a set"},
+		{name: "smove", arity: 4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 2, step: 1, handler: smoveCmd,
+			group: "set", summary: "Move a member from one set to another"},
+		{name: "sinter", arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, step: 1, handler: setOpCmd,
+			group: "set", summary: "Intersect multiple sets"},
+		{name: "sunion", arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, step: 1, handler: setOpCmd,
+			group: "set", summary: "Add multiple sets"},
+		{name: "sdiff", arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, step: 1, handler: setOpCmd,
+			group: "set", summary: "Subtract multiple sets"},
+		{name: "sinterstore", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, step: 1, handler: setOpStoreCmd,
+			group: "set", summary: "Intersect multiple sets and store the resulting set in a key"},
+		{name: "sunionstore", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, step: 1, handler: setOpStoreCmd,
+			group: "set", summary: "Add multiple sets and store the resulting set in a key"},
+		{name: "sdiffstore", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, step: 1, handler: setOpStoreCmd,
+			group: "set", summary: "Subtract multiple sets and store the resulting set in a key"},
+		{name: "sscan", arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: sscanCmd,
+			group: "set", summary: "Incrementally iterate the members of a set"},
+
+		{name: "zadd", arity: -4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zaddCmd,
+			group: "sorted-set", summary: "Add members to a sorted set, or update their scores"},
+		{name: "zincrby", arity: 4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zincrbyCmd,
+			group: "sorted-set", summary: "Increment the score of a member in a sorted set"},
+		{name: "zrem", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zremCmd,
+			group: "sorted-set", summary: "Remove members from a sorted set"},
+		{name: "zcard", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zcardCmd,
+			group: "sorted-set", summary: "Get the number of members in a sorted set"},
+		{name: "zscore", arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zscoreCmd,
+			group: "sorted-set", summary: "Get the score associated with the given member in a sorted set"},
+		{name: "zmscore", arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zmscoreCmd,
+			group: "sorted-set", summary: "Get the score associated with the given members in a sorted set"},
+		{name: "zrank", arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zrankCmd,
+			group: "sorted-set", summary: "Determine the index of a member in a sorted set"},
+		{name: "zrevrank", arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zrankCmd,
+			group: "sorted-set", summary: "Determine the index of a member in a sorted set, with scores ordered from high to low"},
+		{name: "zcount", arity: 4, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zcountCmd,
+			group: "sorted-set", summary: "Count the members in a sorted set with scores within the given values"},
+		{name: "zlexcount", arity: 4, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zcountCmd,
+			group: "sorted-set", summary: "Count the number of members in a sorted set between a given lexicographical range"},
+		{name: "zrange", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zrangeCmd,
+			group: "sorted-set", summary: "Return a range of members in a sorted set"},
+		{name: "zrevrange", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zrangeCmd,
+			group: "sorted-set", summary: "Return a range of members in a sorted set, by index, with scores ordered from high to low"},
+		{name: "zrangebyscore", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zrangeCmd,
+			group: "sorted-set", summary: "Return a range of members in a sorted set, by score"},
+		{name: "zrevrangebyscore", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zrangeCmd,
+			group: "sorted-set", summary: "Return a range of members in a sorted set, by score, with scores ordered from high to low"},
+		{name: "zrangebylex", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zrangeCmd,
+			group: "sorted-set", summary: "Return a range of members in a sorted set, by lexicographical range"},
+		{name: "zrevrangebylex", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zrangeCmd,
+			group: "sorted-set", summary: "Return a range of members in a sorted set, by lexicographical range, ordered from higher to lower strings"},
+		{name: "zrangestore", arity: -5, flags: cmdWrite, firstKey: 1, lastKey: 2, step: 1, handler: zrangestoreCmd,
+			group: "sorted-set", summary: "Store a range of members from sorted set into another key"},
+		{name: "zremrangebyrank", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: zremrangeCmd,
+			group: "sorted-set", summary: "Remove all members in a sorted set within the given indexes"},
+		{name: "zremrangebyscore", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: zremrangeCmd,
+			group: "sorted-set", summary: "Remove all members in a sorted set within the given scores"},
+		{name: "zremrangebylex", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: zremrangeCmd,
+			group: "sorted-set", summary: "Remove all members in a sorted set between the given lexicographical range"},
+		{name: "zpopmin", arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zpopCmd,
+			group: "sorted-set", summary: "Remove and return members with the lowest scores in a sorted set"},
+		{name: "zpopmax", arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: zpopCmd,
+			group: "sorted-set", summary: "Remove and return members with the highest scores in a sorted set"},
+		{name: "zscan", arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: zscanCmd,
+			group: "sorted-set", summary: "Incrementally iterate sorted sets elements and associated scores"},
+
+		{name: "xadd", arity: -5, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: xaddCmd,
+			group: "stream", summary: "Appends a new entry to a stream"},
+		{name: "xlen", arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: xlenCmd,
+			group: "stream", summary: "Return the number of entries in a stream"},
+		{name: "xrange", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: xrangeCmd,
+			group: "stream", summary: "Return a range of elements in a stream, with IDs matching the specified IDs interval"},
+		{name: "xrevrange", arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: xrangeCmd,
+			group: "stream", summary: "Return a range of elements in a stream, with IDs matching the specified IDs interval, in reverse order"},
+		{name: "xdel", arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: xdelCmd,
+			group: "stream", summary: "Removes the specified entries from the stream"},
+		{name: "xtrim", arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, handler: xtrimCmd,
+			group: "stream", summary: "Trims the stream to the given number of items or to the given minimum ID"},
+		// the keys of XREAD and XREADGROUP follow STREAMS, they have no fixed position.
+		{name: "xread", arity: -4, flags: cmdReadonly | cmdBlocking, handler: xreadCmd,
+			group: "stream", summary: "Return never seen elements in multiple streams, with IDs greater than the ones reported by the caller for each stream"},
+		{name: "xreadgroup", arity: -7, flags: cmdWrite | cmdBlocking, handler: xreadCmd,
+			group: "stream", summary: "Return new entries from a stream using a consumer group, or access the history of the pending entries for a given consumer"},
+		{name: "xgroup", arity: -2, flags: cmdWrite, firstKey: 2, lastKey: 2, step: 1, handler: xgroupCmd,
+			group: "stream", summary: "Create, destroy and manage consumer groups"},
+		{name: "xack", arity: -4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, step: 1, handler: xackCmd,
+			group: "stream", summary: "Marks pending messages as correctly processed, removing them from the pending entries list of the consumer group"},
+		{name: "xpending", arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, step: 1, handler: xpendingCmd,
+			group: "stream", summary: "Return information and entries from a stream consumer group pending entries list"},
+
+		{name: "config", arity: -2, flags: cmdAdmin,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return configCmd(cmdhdr, db, cmd)
+			},
+			group: "server", summary: "Get, set or rewrite the configuration parameters"},
+		{name: "command", arity: -1, handler: commandCmd,
+			group: "server", summary: "Get details about the commands"},
+
+		{name: "multi", arity: 1, flags: cmdFast, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return multiCmd(cmdhdr)
+			},
+			group: "transactions", summary: "Mark the start of a transaction block"},
+		{name: "exec", arity: 1, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return execCmd(cmdhdr, db)
+			},
+			group: "transactions", summary: "Execute all commands issued after MULTI"},
+		{name: "discard", arity: 1, flags: cmdFast, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return discardCmd(cmdhdr, db)
+			},
+			group: "transactions", summary: "Discard all commands issued after MULTI"},
+		{name: "watch", arity: -2, flags: cmdFast, firstKey: 1, lastKey: -1, step: 1, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return watchCmd(cmdhdr, db, cmd[1:])
+			},
+			group: "transactions", summary: "Watch keys to determine execution of the MULTI/EXEC block"},
+		{name: "unwatch", arity: 1, flags: cmdFast, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				cmdhdr.unwatchAll(db)
+				return cmdhdr.replyOK()
+			},
+			group: "transactions", summary: "Forget about all watched keys"},
+		{name: "ping", arity: -1, flags: cmdFast, handler: pingCmd,
+			group: "connection", summary: "Ping the server"},
+		{name: "echo", arity: 2, flags: cmdFast,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return cmdhdr.replyBulk(cmd[1])
+			},
+			group: "connection", summary: "Echo the given string"},
+		{name: "quit", arity: -1, flags: cmdFast, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return quitCmd(cmdhdr)
+			},
+			group: "connection", summary: "Close the connection"},
+		{name: "hello", arity: -1, flags: cmdFast, conn: true,
+			handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+				return helloCmd(cmdhdr, cmd)
+			},
+			group: "connection", summary: "Handshake with the server and switch the protocol"},
+	}
+
+	commandTable = make(map[string]*command, len(commands))
+	for _, c := range commands {
+		commandTable[c.name] = c
+	}
+}
+
+// lookupCommand finds the command of cmd by name in any case. The returned
+// string is the error message if cmd is unknown or has a wrong number of
+// arguments.
+func lookupCommand(cmd []string) (*command, string) {
+	c, ok := commandTable[strings.ToLower(cmd[0])]
+	if !ok {
+		var args string
+		for _, arg := range cmd[1:] {
+			args += fmt.Sprintf("'%s' ", arg)
+		}
+		return nil, fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", cmd[0], args)
+	}
+
+	if !c.arityOK(len(cmd)) {
+		return nil, errWrongArgs(c.name)
+	}
+	return c, ""
+}
+
+func (c *command) arityOK(n int) bool {
+	if c.arity > 0 {
+		return n == c.arity
+	}
+	return n >= -c.arity
+}
+
+// keys returns the keys in cmd, which has passed the arity check.
+func (c *command) keys(cmd []string) []string {
+	if c.firstKey == 0 {
+		return nil
+	}
+
+	last := c.lastKey
+	if last < 0 {
+		last += len(cmd)
+	}
+
+	keys := make([]string, 0, last-c.firstKey+1)
+	for i := c.firstKey; i <= last && i < len(cmd); i += c.step {
+		keys = append(keys, cmd[i])
+	}
+	return keys
+}
+
+// commandCmd handles COMMAND, COMMAND COUNT, COMMAND INFO [name ...],
+// COMMAND DOCS [name ...] and COMMAND GETKEYS command [arg ...].
+func commandCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd) == 1 {
+		names := sortedCommandNames()
+		err := cmdhdr.replyArrayLen(len(names))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = replyCommandInfo(cmdhdr, commandTable[name])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch strings.ToLower(cmd[1]) {
+	case "count":
+		if len(cmd) != 2 {
+			return cmdhdr.replyError(errWrongArgs("command|count"))
+		}
+		return cmdhdr.replyInt(int64(len(commandTable)))
+	case "info":
+		names := cmd[2:]
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+
+		err := cmdhdr.replyArrayLen(len(names))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			c, ok := commandTable[strings.ToLower(name)]
+			if !ok {
+				err = cmdhdr.replyNull()
+			} else {
+				err = replyCommandInfo(cmdhdr, c)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "docs":
+		var found []*command
+		if len(cmd) == 2 {
+			for _, name := range sortedCommandNames() {
+				found = append(found, commandTable[name])
+			}
+		}
+		for _, name := range cmd[2:] {
+			// unknown commands are left out like redis does.
+			if c, ok := commandTable[strings.ToLower(name)]; ok {
+				found = append(found, c)
+			}
+		}
+
+		err := cmdhdr.replyMapLen(len(found))
+		if err != nil {
+			return err
+		}
+		for _, c := range found {
+			err = replyCommandDocs(cmdhdr, c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "getkeys":
+		if len(cmd) < 3 {
+			return cmdhdr.replyError(errWrongArgs("command|getkeys"))
+		}
+
+		args := cmd[2:]
+		c, ok := commandTable[strings.ToLower(args[0])]
+		if !ok {
+			return cmdhdr.replyError("ERR Invalid command specified")
+		}
+		if !c.arityOK(len(args)) {
+			return cmdhdr.replyError("ERR Invalid number of arguments specified for command")
+		}
+
+		keys := c.keys(args)
+		if len(keys) == 0 {
+			return cmdhdr.replyError("ERR The command has no key arguments")
+		}
+
+		err := cmdhdr.replyArrayLen(len(keys))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err = cmdhdr.replyBulk(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return cmdhdr.replyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", cmd[1]))
+}
+
+// replyCommandInfo writes the info of c as redis does, an array of name,
+// arity, flags, first key, last key and step.
+func replyCommandInfo(cmdhdr *commandHandler, c *command) error {
+	err := cmdhdr.replyArrayLen(6)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk(c.name)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyInt(int64(c.arity))
+	if err != nil {
+		return err
+	}
+
+	var flags []string
+	for _, f := range commandFlagNames {
+		if c.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	err = cmdhdr.replySetLen(len(flags))
+	if err != nil {
+		return err
+	}
+	for _, flag := range flags {
+		err = cmdhdr.replySimple(flag)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, n := range []int{c.firstKey, c.lastKey, c.step} {
+		err = cmdhdr.replyInt(int64(n))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replyCommandDocs writes the name of c and a map of its summary and group.
+func replyCommandDocs(cmdhdr *commandHandler, c *command) error {
+	err := cmdhdr.replyBulk(c.name)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyMapLen(2)
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range [][2]string{{"summary", c.summary}, {"group", c.group}} {
+		err = cmdhdr.replyBulk(kv[0])
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(kv[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_commandCaseInsensitive(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("SET", "k", "v")) +
+		string(encodeCommand("Get", "k")) +
+		string(encodeCommand("MULTI")) +
+		string(encodeCommand("DEL", "k")) +
+		string(encodeCommand("Exec")) +
+		"GET k\r\n"
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n+OK\r\n+QUEUED\r\n*1\r\n:1\r\n$-1\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("GET")))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", out)
+}
+
+func Test_commandCmd(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("command", "count")))
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", len(commandTable)), out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("command", "info", "GET", "del", "nosuch")))
+	assert.Equal(t, "*3\r\n"+
+		"*6\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n"+
+		"*6\r\n$3\r\ndel\r\n:-2\r\n*1\r\n+write\r\n:1\r\n:-1\r\n:1\r\n"+
+		"$-1\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("command")))
+	assert.Contains(t, out, fmt.Sprintf("*%d\r\n", len(commandTable)))
+	assert.Contains(t, out, "*6\r\n$6\r\nconfig\r\n:-2\r\n*1\r\n+admin\r\n:0\r\n:0\r\n:0\r\n")
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("command", "docs", "get", "nosuch")))
+	assert.Equal(t, "*2\r\n$3\r\nget\r\n*4\r\n$7\r\nsummary\r\n$22\r\nGet the value of a key\r\n$5\r\ngroup\r\n$6\r\nstring\r\n", out)
+
+	// flags are a set in RESP3.
+	cmdhdr.proto = resp3
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("command", "info", "set")))
+	assert.Equal(t, "*1\r\n*6\r\n$3\r\nset\r\n:-3\r\n~1\r\n+write\r\n:1\r\n:1\r\n:1\r\n", out)
+	cmdhdr.proto = resp2
+}
+
+func Test_commandGetKeys(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"command", "getkeys", "set", "k", "v", "ex", "10"}, "*1\r\n$1\r\nk\r\n"},
+		{[]string{"command", "getkeys", "DEL", "k1", "k2", "k3"}, "*3\r\n$2\r\nk1\r\n$2\r\nk2\r\n$2\r\nk3\r\n"},
+		{[]string{"command", "getkeys", "watch", "k1", "k2"}, "*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n"},
+		{[]string{"command", "getkeys", "config", "get", "port"}, "-ERR The command has no key arguments\r\n"},
+		{[]string{"command", "getkeys", "get"}, "-ERR Invalid number of arguments specified for command\r\n"},
+		{[]string{"command", "getkeys", "nosuch", "k"}, "-ERR Invalid command specified\r\n"},
+		{[]string{"command", "getkeys"}, "-ERR wrong number of arguments for 'command|getkeys' command\r\n"},
+		{[]string{"command", "foo"}, "-ERR unknown subcommand 'foo'. Try COMMAND HELP.\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Deleting a key, or moving its value to another ele when it does not fit in
+// its page, only flags the old ele, whose space stays taken. Compaction walks
+// the element pages of the file a few at a time, like active expire walks the
+// index, and rewrites a page when enough of it is garbage: the deleted eles are
+// unlinked from the indexes, the others are packed at the start of the page,
+// and the links to them, chain heads, next fields and B+tree entries, are
+// pointed to their new slots. An ele which a B+tree still has as a separator
+// is kept even if it is deleted, its key is needed to find the way.
+//
+// A rewritten page goes back to the freelist, as it has room again, and an
+// empty page of several pages is split into single ones. When a pass reaches
+// the end of the file, the empty pages it ends with are cut off. Like an update
+// in place, a rewrite is not in the wal, the file is synced after each cycle.
+//
+// The pass also puts in the freelist the pages with room which are not there,
+// and counts the free and the garbage space of the file, which it publishes
+// as fragmentation stats at its end. With compact-garbage-percent 0 the pages
+// are walked for this but none is rewritten.
+
+const (
+	compactInterval = 100 * time.Millisecond
+	// pages looked at by one cycle, most of them are not rewritten.
+	compactPagesPerCycle = 256
+	// the cycle stops when it takes longer than this.
+	compactTimeLimit = 10 * time.Millisecond
+)
+
+// fragStats is the space of the element pages seen by a pass.
+type fragStats struct {
+	elePages     uint64 // the pages of several are counted once
+	emptyPages   uint64
+	size         uint64 // of the pages which are not empty
+	freeBytes    uint64 // left at the end of the pages which are not empty
+	garbageBytes uint64 // of the keys and values of deleted eles
+}
+
+// ratio returns the part of the space of the pages which are not empty that
+// is free or garbage.
+func (s fragStats) ratio() float64 {
+	if s.size == 0 {
+		return 0
+	}
+	return float64(s.freeBytes+s.garbageBytes) / float64(s.size)
+}
+
+func (s *fragStats) add(pg *page, pageSize uint64) {
+	s.elePages++
+	if pg.count == 0 {
+		s.emptyPages++
+		return
+	}
+
+	size := uint64(pg.overflow) * pageSize
+	s.size += size
+	s.freeBytes += size - uint64(pg.usedSize())
+
+	es := pg.elements()
+	for i := 0; i < int(pg.count); i++ {
+		if es.eles[i].isDeleted() {
+			s.garbageBytes += uint64(es.eles[i].kSize + es.eles[i].vSize)
+		}
+	}
+}
+
+// eleRef is a link to an ele. owner is the slot of the ele whose next field
+// the link is if that ele is in the page being compacted, -1 otherwise.
+type eleRef struct {
+	ie    *IndexEle
+	owner int
+}
+
+func (db *DB) startCompaction() {
+	go func() {
+		tick := time.NewTicker(compactInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+				db.compactCycle()
+			case <-db.closing:
+				return
+			}
+		}
+	}()
+}
+
+// compactCycle goes on with the compaction pass over the file.
+func (db *DB) compactCycle() {
+	// the undo images of a running transaction are by key, but a rollback
+	// must not find its eles moved under it.
+	db.txMu.RLock()
+	defer db.txMu.RUnlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	percent := db.cfg.CompactGarbagePercent
+	start := time.Now()
+	for time.Now().Sub(start) < compactTimeLimit {
+		done, err := db.compactPages(compactPagesPerCycle, percent)
+		if err != nil {
+			logrus.Errorf("compaction error. %s", err.Error())
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// Compact runs a whole compaction pass over the file, rewriting the pages of
+// which at least percent is garbage, none if percent is 0.
+func (db *DB) Compact(percent int) (err error) {
+	db.txMu.RLock()
+	defer db.txMu.RUnlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.compactPgid = 0
+	db.compactTailPgid = 0
+	db.compactStats = fragStats{}
+	for {
+		done, err := db.compactPages(compactPagesPerCycle, percent)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// compactPages looks at the next n pages of the pass. It returns true when
+// the pass has reached the end of the file, the next call starts a new one.
+func (db *DB) compactPages(n int, percent int) (bool, error) {
+	changed := false
+	defer func() {
+		if changed {
+			err := db.flush()
+			if err != nil {
+				logrus.Errorf("compaction flush error. %s", err.Error())
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		pages := uint64(len(db.data)) / db.pageSize
+		pgid := db.compactPgid
+		if pgid >= pages {
+			err := db.shrinkFile(db.compactTailPgid)
+			db.compactPgid = 0
+			db.compactTailPgid = 0
+			db.publishFragStats()
+			compactProgressMetric.Set(1)
+			return true, err
+		}
+
+		db.compactPgid = pgid + 1
+		if !db.isElePage(pgid) {
+			db.compactTailPgid = 0
+			continue
+		}
+
+		pg := db.page(pgid)
+		db.compactPgid = pgid + uint64(pg.overflow)
+		dead, used := pageGarbage(pg)
+		if percent > 0 && dead > 0 && dead*100 >= used*uint64(percent) {
+			err := db.compactPage(pgid)
+			if err != nil {
+				return false, err
+			}
+			changed = true
+		}
+
+		pg = db.page(pgid)
+		if pg.flags&listedPageFlag == 0 && db.pageHasRoom(pg) {
+			// left out when the freelist was full or by an older version.
+			err := db.addUnfullPgid(pgid)
+			if err != nil {
+				return false, err
+			}
+			changed = true
+			pg = db.page(pgid)
+		}
+		if pg.flags&^listedPageFlag != elePageFlag {
+			// it became a page of the freelist.
+			db.compactTailPgid = 0
+			continue
+		}
+		db.compactStats.add(pg, db.pageSize)
+
+		if pg.count == 0 && pg.overflow == 1 {
+			if db.compactTailPgid == 0 {
+				db.compactTailPgid = pgid
+			}
+		} else {
+			db.compactTailPgid = 0
+		}
+	}
+
+	compactProgressMetric.Set(float64(db.compactPgid) / float64(uint64(len(db.data))/db.pageSize))
+	return false, nil
+}
+
+// isElePage tells if pgid is the first page of element pages. The pages after
+// it hold its data and are skipped, so the header of such a page is never
+// looked at, and a page of the hash index can not point to itself.
+func (db *DB) isElePage(pgid uint64) bool {
+	pg := db.page(pgid)
+	return pg.flags&^listedPageFlag == elePageFlag && uint64(pg.id) == pgid && pg.overflow >= 1 &&
+		uint32(pg.count) <= elementsCountInOnePage
+}
+
+// pageGarbage returns the bytes of the deleted eles in pg, slots included, and
+// of all its eles.
+func pageGarbage(pg *page) (dead, used uint64) {
+	es := pg.elements()
+	for i := 0; i < int(pg.count); i++ {
+		ele := &es.eles[i]
+		size := uint64(ele.kSize+ele.vSize) + uint64(unsafe.Sizeof(Ele{}))
+		used += size
+		if ele.isDeleted() {
+			dead += size
+		}
+	}
+	return dead, used
+}
+
+// compactPage rewrites the element page pgid without its deleted eles.
+func (db *DB) compactPage(pgid uint64) error {
+	pg := db.page(pgid)
+	es := pg.elements()
+	before := pg.usedSize()
+	count := int(pg.count)
+
+	// the deleted eles are unlinked first, one after the other, so that the
+	// chains are whole at each step.
+	newSlot := make([]int, count)
+	kept := 0
+	for i := 0; i < count; i++ {
+		ie := IndexEle{pgid: pgid, at: uint16(i)}
+		if !es.eles[i].isDeleted() || db.unlinkEle(ie) {
+			newSlot[i] = kept
+			kept++
+		} else {
+			newSlot[i] = -1
+		}
+	}
+	if kept == count {
+		// all of them are still separators.
+		return nil
+	}
+
+	// the links to the eles which move are found before the page changes.
+	refs := make([][]eleRef, count)
+	for i := 0; i < count; i++ {
+		if newSlot[i] >= 0 && newSlot[i] != i {
+			refs[i] = db.eleRefs(IndexEle{pgid: pgid, at: uint16(i)})
+		}
+	}
+
+	eles := make([]Ele, 0, kept)
+	var data []byte
+	for i := 0; i < count; i++ {
+		if newSlot[i] >= 0 {
+			ele := &es.eles[i]
+			eles = append(eles, *ele)
+			data = append(data, ele.key()...)
+			data = append(data, ele.val()...)
+		}
+	}
+
+	var off uint32
+	for j := range eles {
+		ele := eles[j]
+		ele.pos = off + (elementsCountInOnePage-uint32(j))*uint32(unsafe.Sizeof(Ele{}))
+		es.eles[j] = ele
+		off += ele.kSize + ele.vSize
+	}
+	copy(es.data[:], data)
+	pg.count = uint16(kept)
+
+	for i := range refs {
+		moved := IndexEle{pgid: pgid, at: uint16(newSlot[i])}
+		for _, ref := range refs[i] {
+			if ref.owner >= 0 {
+				es.eles[newSlot[ref.owner]].next = moved
+			} else {
+				*ref.ie = moved
+			}
+		}
+	}
+
+	reclaimed := before - pg.usedSize()
+	compactedPagesMetric.Inc()
+	compactReclaimedBytesMetric.Add(float64(reclaimed))
+	logrus.Debugf("compacted page %d, %d of %d eles kept, %d bytes reclaimed", pgid, kept, count, reclaimed)
+
+	if kept == 0 && pg.overflow > 1 {
+		// the data pages become pages of their own.
+		for i := uint64(1); i < uint64(pg.overflow); i++ {
+			p := db.page(pgid + i)
+			p.id = int(pgid + i)
+			p.flags = elePageFlag
+			p.count = 0
+			p.overflow = 1
+			err := db.addUnfullPgid(pgid + i)
+			if err != nil {
+				return err
+			}
+		}
+		pg = db.page(pgid)
+		pg.overflow = 1
+	}
+	return db.addUnfullPgid(pgid)
+}
+
+// unlinkEle removes the deleted ele at ie from the index it is in. It returns
+// true if the ele is still a separator of a B+tree and is kept.
+func (db *DB) unlinkEle(ie IndexEle) bool {
+	ele := db.ele(&ie)
+	key := ele.key()
+
+	for _, d := range db.dbs {
+		if d.dbMeta().indexPgid == 0 {
+			continue
+		}
+
+		if d.ordered() {
+			leaf, at, seps := d.btreeRefs(ie, key)
+			if len(seps) > 0 {
+				return true
+			}
+			if at >= 0 {
+				d.btreeRemoveAt(leaf, at)
+				return false
+			}
+			continue
+		}
+
+		ref, _ := d.chainRef(ie, key)
+		if ref != nil {
+			*ref = ele.next
+			return false
+		}
+	}
+	// it is not linked any more, a split dropped it.
+	return false
+}
+
+// eleRefs returns the links to the ele at ie.
+func (db *DB) eleRefs(ie IndexEle) []eleRef {
+	key := db.ele(&ie).key()
+
+	var refs []eleRef
+	for _, d := range db.dbs {
+		if d.dbMeta().indexPgid == 0 {
+			continue
+		}
+
+		if d.ordered() {
+			leaf, at, seps := d.btreeRefs(ie, key)
+			for _, sep := range seps {
+				refs = append(refs, eleRef{ie: sep, owner: -1})
+			}
+			if at >= 0 {
+				refs = append(refs, eleRef{ie: &leaf.leafEntries()[at], owner: -1})
+			}
+			continue
+		}
+
+		ref, owner := d.chainRef(ie, key)
+		if ref != nil {
+			r := eleRef{ie: ref, owner: -1}
+			if owner.pgid == ie.pgid {
+				r.owner = int(owner.at)
+			}
+			refs = append(refs, r)
+		}
+	}
+	if len(refs) == 0 {
+		logrus.Warnf("ele at page %d slot %d is not in any index", ie.pgid, ie.at)
+	}
+	return refs
+}
+
+// chainRef returns the link to the ele at ie in the chain of key, nil if it is
+// not there, and the ele the link is the next field of, empty if the link is
+// the head of the chain.
+func (db *DB) chainRef(ie IndexEle, key []byte) (*IndexEle, IndexEle) {
+	var owner IndexEle
+	cur := db.keyIndexEle(key)
+	for cur.pgid > 0 {
+		if *cur == ie {
+			return cur, owner
+		}
+		owner = *cur
+		cur = &db.ele(cur).next
+	}
+	return nil, IndexEle{}
+}
+
+// publishFragStats keeps the stats of the pass which has ended and starts
+// over for the next one.
+func (db *DB) publishFragStats() {
+	s := db.compactStats
+	db.fragStats = s
+	db.compactStats = fragStats{}
+
+	meta := db.page(0).meta()
+	freelistPagesMetric.Set(float64(meta.freePages))
+	freeElePagesMetric.Set(float64(meta.freeCount))
+	emptyElePagesMetric.Set(float64(s.emptyPages))
+	eleFreeBytesMetric.Set(float64(s.freeBytes))
+	eleGarbageBytesMetric.Set(float64(s.garbageBytes))
+	fragmentationRatioMetric.Set(s.ratio())
+	logrus.Debugf("compaction pass done, %d element pages, %d empty, fragmentation %.2f", s.elePages, s.emptyPages, s.ratio())
+}
+
+// shrinkFile cuts off the empty element pages from pgid to the end of the
+// file, but for the ones the file grows by at a time, which the next writes
+// would add again.
+func (db *DB) shrinkFile(pgid uint64) error {
+	if pgid == 0 {
+		return nil
+	}
+
+	pages := uint64(len(db.data)) / db.pageSize
+	cut := pgid + uint64(db.cfg.ElePageIncrementCount)
+	if cut >= pages {
+		return nil
+	}
+
+	// pages may have been used or added since the pass went by, the file is
+	// cut after the last of them.
+	for p := pages - 1; p >= cut; p-- {
+		pg := db.page(p)
+		if !db.isElePage(p) || pg.count != 0 || pg.overflow != 1 {
+			cut = p + 1
+			break
+		}
+	}
+	if cut >= pages {
+		return nil
+	}
+
+	db.removeFreePgidsFrom(cut)
+	meta := db.page(0).meta()
+	meta.elePageCount -= pages - cut
+
+	err := db.resizeFile(int64(cut * db.pageSize))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("db file shrunk by %d pages to %d pages", pages-cut, cut)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deletedEles counts the deleted eles left in the element pages of db.
+func deletedEles(db *DB) int {
+	n := 0
+	pages := uint64(len(db.data)) / db.pageSize
+	for pgid := uint64(0); pgid < pages; pgid++ {
+		if !db.isElePage(pgid) {
+			continue
+		}
+		pg := db.page(pgid)
+		es := pg.elements()
+		for i := 0; i < int(pg.count); i++ {
+			if es.eles[i].isDeleted() {
+				n++
+			}
+		}
+		pgid += uint64(pg.overflow) - 1
+	}
+	return n
+}
+
+func fileSize(t *testing.T, db *DB) int64 {
+	fstat, err := db.file.Stat()
+	assert.Nil(t, err)
+	return fstat.Size()
+}
+
+func Test_compactPages(t *testing.T) {
+	db := newTestDB(t)
+
+	n := 2000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("val-%d", i))))
+		assert.Nil(t, db.dbs[3].Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("three")))
+	}
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			_, err := db.Delete(nil, []byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+		case 1:
+			_, err := db.dbs[3].Delete(nil, []byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+		case 2:
+			// too large for its page now and then, the old ele is deleted.
+			val := strings.Repeat("v", 200)
+			assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(val)))
+		}
+	}
+	assert.NotZero(t, deletedEles(db))
+
+	assert.Nil(t, db.Compact(1))
+	assert.Zero(t, deletedEles(db))
+	assert.Equal(t, uint64(0), db.compactPgid)
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		val, err := db.Get(key)
+		switch i % 4 {
+		case 0:
+			assert.Equal(t, NotFoundError, err, i)
+		case 2:
+			assert.Nil(t, err, i)
+			assert.Equal(t, strings.Repeat("v", 200), string(val))
+		default:
+			assert.Nil(t, err, i)
+			assert.Equal(t, fmt.Sprintf("val-%d", i), string(val))
+		}
+
+		val, err = db.dbs[3].Get(key)
+		if i%4 == 1 {
+			assert.Equal(t, NotFoundError, err, i)
+		} else {
+			assert.Nil(t, err, i)
+			assert.Equal(t, "three", string(val))
+		}
+	}
+	assert.Equal(t, uint64(n*3/4), db.countKeys())
+	assert.Equal(t, uint64(n*3/4), db.dbs[3].countKeys())
+
+	// the space is used again.
+	size := fileSize(t, db)
+	for i := 0; i < n; i += 4 {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("again")))
+	}
+	assert.Equal(t, size, fileSize(t, db))
+}
+
+func Test_compactOrdered(t *testing.T) {
+	db := newOrderedTestDB(t)
+
+	n := 3000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%05d", i)), []byte("v")))
+	}
+	// the separators of the tree are among the deleted keys.
+	for i := 0; i < n; i++ {
+		if i%3 != 0 {
+			_, err := db.Delete(nil, []byte(fmt.Sprintf("key-%05d", i)))
+			assert.Nil(t, err)
+		}
+	}
+
+	assert.Nil(t, db.Compact(1))
+	assert.Less(t, deletedEles(db), n/10)
+
+	keys := db.Keys("*")
+	assert.Equal(t, n/3, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, fmt.Sprintf("key-%05d", i*3), string(key))
+	}
+	for i := 0; i < n; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key-%05d", i)))
+		if i%3 == 0 {
+			assert.Nil(t, err, i)
+		} else {
+			assert.Equal(t, NotFoundError, err, i)
+		}
+	}
+
+	// the tree goes on working on the moved eles.
+	for i := 0; i < n; i++ {
+		if i%3 == 1 {
+			assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%05d", i)), []byte("back")))
+		}
+	}
+	keys, err := db.Range(lexBound{member: []byte("key-00000")}, lexBound{member: []byte("key-00004")}, 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("key-00000"), []byte("key-00001"), []byte("key-00003"), []byte("key-00004")}, keys)
+}
+
+func Test_compactShrinksFile(t *testing.T) {
+	db := newTestDB(t)
+
+	assert.Nil(t, db.Set(nil, []byte("first"), []byte("v")))
+	size := fileSize(t, db)
+
+	// not enough keys for the index to grow, whose pages would stay at the
+	// end of the file.
+	val := strings.Repeat("x", 1000)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(val)))
+	}
+	// a value of several pages.
+	assert.Nil(t, db.Set(nil, []byte("big"), []byte(strings.Repeat("b", 3*os.Getpagesize()))))
+	grown := fileSize(t, db)
+	assert.Greater(t, grown, size)
+
+	for i := 0; i < 1000; i++ {
+		_, err := db.Delete(nil, []byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+	_, err := db.Delete(nil, []byte("big"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Compact(50))
+	assert.Less(t, fileSize(t, db), grown/2)
+	assert.Equal(t, int64(1), db.DBSize())
+	// the file is mapped again at its new size.
+	assert.Equal(t, fileSize(t, db), int64(len(db.data)))
+
+	// the pages cut off are not in the freelist any more.
+	pages := uint64(fileSize(t, db)) / db.pageSize
+	for _, pgid := range freelistIds(db) {
+		assert.Less(t, pgid, pages)
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(val)))
+	}
+	got, err := db.Get([]byte("key-99"))
+	assert.Nil(t, err)
+	assert.Equal(t, val, string(got))
+	got, err = db.Get([]byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v", string(got))
+}
+
+func Test_compactCycle(t *testing.T) {
+	db := newTestDB(t)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+	for i := 0; i < 500; i += 2 {
+		_, err := db.Delete(nil, []byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+
+	// disabled.
+	db.cfg.CompactGarbagePercent = 0
+	db.compactCycle()
+	assert.NotZero(t, deletedEles(db))
+
+	// enabled, the cycles go over the file as the background does.
+	db.cfg.CompactGarbagePercent = 1
+	for i := 0; i < 100 && deletedEles(db) > 0; i++ {
+		db.compactCycle()
+	}
+	assert.Zero(t, deletedEles(db))
+	assert.Equal(t, int64(250), db.DBSize())
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds the server settings. They are resolved in this order, later
+// ones win: built-in defaults, the config file, the command-line flags.
+type Config struct {
+	file string // path of the config file, empty if none
+
+	Bind                  string
+	Port                  int
+	MetricsPort           int
+	Dir                   string
+	LogLevel              logrus.Level
+	WalMaxSize            int64
+	AppendFsync           string
+	ElePageIncrementCount int
+	ConnectionBufSize     int
+	FlushAllOnStart       bool
+	SetMaxIntsetEntries   int
+	Databases             int
+	OrderedDatabases      uint64 // bit n is set if db n gets a B+tree index
+	CompactGarbagePercent int
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                  6379,
+		MetricsPort:           8082,
+		Dir:                   "data",
+		LogLevel:              logrus.DebugLevel,
+		WalMaxSize:            1024 * 1024,
+		AppendFsync:           fsyncAlways,
+		ElePageIncrementCount: 64,
+		ConnectionBufSize:     1024,
+		SetMaxIntsetEntries:   512,
+		Databases:             16,
+		CompactGarbagePercent: 50,
+	}
+}
+
+func (cfg *Config) addr() string {
+	return fmt.Sprintf("%s:%d", cfg.Bind, cfg.Port)
+}
+
+const configRewriteSignature = "# Generated by CONFIG REWRITE"
+
+type configParam struct {
+	name      string
+	usage     string
+	isBool    bool
+	immutable bool // can not be changed by CONFIG SET
+	noRewrite bool // left untouched by CONFIG REWRITE
+	get       func(cfg *Config) string
+	set       func(cfg *Config, val string) error
+	apply     func(cfg *Config) // makes a change by CONFIG SET take effect
+}
+
+var configParams = []*configParam{
+	{
+		name:      "bind",
+		immutable: true,
+		usage:     "address to listen on, all interfaces if empty",
+		get:       func(cfg *Config) string { return cfg.Bind },
+		set: func(cfg *Config, val string) error {
+			cfg.Bind = val
+			return nil
+		},
+	},
+	{
+		name:      "port",
+		immutable: true,
+		usage:     "port to listen on",
+		get:       func(cfg *Config) string { return strconv.Itoa(cfg.Port) },
+		set: func(cfg *Config, val string) error {
+			return parsePort(val, &cfg.Port)
+		},
+	},
+	{
+		name:      "metrics-port",
+		immutable: true,
+		usage:     "port of the prometheus metrics http server",
+		get:       func(cfg *Config) string { return strconv.Itoa(cfg.MetricsPort) },
+		set: func(cfg *Config, val string) error {
+			return parsePort(val, &cfg.MetricsPort)
+		},
+	},
+	{
+		name:      "dir",
+		immutable: true,
+		usage:     "data directory",
+		get:       func(cfg *Config) string { return cfg.Dir },
+		set: func(cfg *Config, val string) error {
+			if val == "" {
+				return fmt.Errorf("dir can not be empty")
+			}
+			cfg.Dir = val
+			return nil
+		},
+	},
+	{
+		name:  "loglevel",
+		usage: "log level, one of debug, verbose, info, notice, warning, error",
+		get:   func(cfg *Config) string { return cfg.LogLevel.String() },
+		set: func(cfg *Config, val string) error {
+			level, err := parseLogLevel(val)
+			if err != nil {
+				return err
+			}
+			cfg.LogLevel = level
+			return nil
+		},
+		apply: func(cfg *Config) {
+			logrus.SetLevel(cfg.LogLevel)
+		},
+	},
+	{
+		name:  "wal-max-size",
+		usage: "size of wal file that triggers rotation, e.g. 1mb",
+		get:   func(cfg *Config) string { return strconv.FormatInt(cfg.WalMaxSize, 10) },
+		set: func(cfg *Config, val string) error {
+			size, err := parseMemory(val)
+			if err != nil {
+				return err
+			}
+			cfg.WalMaxSize = size
+			return nil
+		},
+	},
+	{
+		name:  "appendfsync",
+		usage: "when wal is fsynced: always, everysec or no",
+		get:   func(cfg *Config) string { return cfg.AppendFsync },
+		set: func(cfg *Config, val string) error {
+			switch strings.ToLower(val) {
+			case fsyncAlways, fsyncEverysec, fsyncNo:
+				cfg.AppendFsync = strings.ToLower(val)
+				return nil
+			}
+			return fmt.Errorf("argument must be one of always, everysec or no, got %s", val)
+		},
+	},
+	{
+		name:  "page-increment-count",
+		usage: "element pages added each time the db file grows",
+		get:   func(cfg *Config) string { return strconv.Itoa(cfg.ElePageIncrementCount) },
+		set: func(cfg *Config, val string) error {
+			return parsePositive(val, &cfg.ElePageIncrementCount)
+		},
+	},
+	{
+		name:  "compact-garbage-percent",
+		usage: "element pages are compacted when at least this percent of them is deleted elements, 0 disables compaction but not the fragmentation stats",
+		get:   func(cfg *Config) string { return strconv.Itoa(cfg.CompactGarbagePercent) },
+		set: func(cfg *Config, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 || n > 100 {
+				return fmt.Errorf("argument must be a percent between 0 and 100, got %s", val)
+			}
+			cfg.CompactGarbagePercent = n
+			return nil
+		},
+	},
+	{
+		name:  "connection-buf-size",
+		usage: "read buffer size of a client connection",
+		get:   func(cfg *Config) string { return strconv.Itoa(cfg.ConnectionBufSize) },
+		set: func(cfg *Config, val string) error {
+			return parsePositive(val, &cfg.ConnectionBufSize)
+		},
+	},
+	{
+		name:  "set-max-intset-entries",
+		usage: "sets of integers up to this size are kept in the compact intset encoding",
+		get:   func(cfg *Config) string { return strconv.Itoa(cfg.SetMaxIntsetEntries) },
+		set: func(cfg *Config, val string) error {
+			return parsePositive(val, &cfg.SetMaxIntsetEntries)
+		},
+	},
+	{
+		name:      "databases",
+		immutable: true,
+		usage:     fmt.Sprintf("number of databases, at most %d", maxDatabases),
+		get:       func(cfg *Config) string { return strconv.Itoa(cfg.Databases) },
+		set: func(cfg *Config, val string) error {
+			var n int
+			err := parsePositive(val, &n)
+			if err != nil {
+				return err
+			}
+			if n > maxDatabases {
+				return fmt.Errorf("at most %d databases are supported, got %s", maxDatabases, val)
+			}
+			cfg.Databases = n
+			return nil
+		},
+	},
+	{
+		name:      "ordered-databases",
+		immutable: true,
+		usage:     "comma separated databases which keep their keys in a B+tree index, for RANGE and ordered SCAN. It is chosen when a database gets its first key",
+		get: func(cfg *Config) string {
+			dbs := make([]string, 0)
+			for i := 0; i < maxDatabases; i++ {
+				if cfg.OrderedDatabases&(1<<uint(i)) != 0 {
+					dbs = append(dbs, strconv.Itoa(i))
+				}
+			}
+			return strings.Join(dbs, ",")
+		},
+		set: func(cfg *Config, val string) error {
+			var dbs uint64
+			for _, s := range strings.Split(val, ",") {
+				if strings.TrimSpace(s) == "" {
+					continue
+				}
+				n, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil || n < 0 || n >= maxDatabases {
+					return fmt.Errorf("invalid database %s", s)
+				}
+				dbs |= 1 << uint(n)
+			}
+			cfg.OrderedDatabases = dbs
+			return nil
+		},
+	},
+	{
+		name:      "flushall-on-start",
+		usage:     "remove all data in the data directory before start",
+		isBool:    true,
+		immutable: true,
+		noRewrite: true,
+		get:       func(cfg *Config) string { return formatYesNo(cfg.FlushAllOnStart) },
+		set: func(cfg *Config, val string) error {
+			b, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+			cfg.FlushAllOnStart = b
+			return nil
+		},
+	},
+}
+
+func lookupConfigParam(name string) *configParam {
+	for _, p := range configParams {
+		if p.name == strings.ToLower(name) {
+			return p
+		}
+	}
+	return nil
+}
+
+// getParams returns name, value pairs of the params matching any of the glob patterns.
+func (cfg *Config) getParams(patterns ...string) [][2]string {
+	result := make([][2]string, 0)
+	for _, p := range configParams {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern), p.name) {
+				result = append(result, [2]string{p.name, p.get(cfg)})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// setParams changes the params in pairs at runtime. Either all of them are set
+// or none of them.
+func (cfg *Config) setParams(pairs [][2]string) error {
+	params := make([]*configParam, len(pairs))
+	for i, pair := range pairs {
+		p := lookupConfigParam(pair[0])
+		if p == nil {
+			return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", pair[0])
+		}
+		if p.immutable {
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", p.name)
+		}
+		params[i] = p
+	}
+
+	olds := make([]string, len(pairs))
+	for i, p := range params {
+		olds[i] = p.get(cfg)
+		err := p.set(cfg, pairs[i][1])
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				params[j].set(cfg, olds[j])
+			}
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", p.name, err.Error())
+		}
+	}
+
+	for _, p := range params {
+		if p.apply != nil {
+			p.apply(cfg)
+		}
+	}
+
+	return nil
+}
+
+// rewrite writes the current settings to the config file. Comments and the
+// order of directives are kept, settings missing in the file are appended if
+// they differ from the defaults.
+func (cfg *Config) rewrite() error {
+	if cfg.file == "" {
+		return fmt.Errorf("The server is running without a config file")
+	}
+
+	content, err := ioutil.ReadFile(cfg.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := make([]string, 0)
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	written := make(map[string]bool)
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			result = append(result, line)
+			continue
+		}
+
+		var p *configParam
+		args, err := splitConfigLine(trimmed)
+		if err == nil {
+			p = lookupConfigParam(args[0])
+		}
+		if p == nil || p.noRewrite {
+			result = append(result, line)
+			continue
+		}
+
+		if written[p.name] {
+			// duplicated directive, the first one holds the value now.
+			continue
+		}
+		written[p.name] = true
+		result = append(result, formatConfigLine(p.name, p.get(cfg)))
+	}
+
+	def := defaultConfig()
+	generated := strings.Contains(string(content), configRewriteSignature)
+	for _, p := range configParams {
+		if written[p.name] || p.noRewrite || p.get(cfg) == p.get(def) {
+			continue
+		}
+		if !generated {
+			result = append(result, configRewriteSignature)
+			generated = true
+		}
+		result = append(result, formatConfigLine(p.name, p.get(cfg)))
+	}
+
+	tmp := cfg.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(strings.Join(result, "\n") + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, cfg.file)
+}
+
+func formatConfigLine(name, val string) string {
+	if val == "" || strings.ContainsAny(val, " \t") {
+		val = `"` + val + `"`
+	}
+	return name + " " + val
+}
+
+// loadConfig builds the config from args, the command line without the program
+// name: [config-file] [--name value ...].
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("mini-redis", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path of the config file")
+
+	overrides := make([][2]string, 0)
+	for _, p := range configParams {
+		fs.Var(&configFlag{param: p, overrides: &overrides}, p.name, p.usage)
+	}
+
+	// the config file can also be given as the first argument like redis-server does.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		*configFile = args[0]
+		args = args[1:]
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %s", fs.Arg(0))
+	}
+
+	if *configFile != "" {
+		err = cfg.loadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range overrides {
+		err = lookupConfigParam(o[0]).set(cfg, o[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid flag --%s: %s", o[0], err.Error())
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = cfg.parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	cfg.file = path
+	return nil
+}
+
+// parse reads redis.conf style directives, one "name value" per line.
+func (cfg *Config) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args, err := splitConfigLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+
+		p := lookupConfigParam(args[0])
+		if p == nil {
+			return fmt.Errorf("line %d: unknown directive '%s'", lineNum, args[0])
+		}
+		if len(args) != 2 {
+			return fmt.Errorf("line %d: wrong number of arguments for '%s'", lineNum, args[0])
+		}
+
+		err = p.set(cfg, args[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+	}
+
+	return scanner.Err()
+}
+
+// splitConfigLine splits a line by spaces, double quoted arguments may contain spaces.
+func splitConfigLine(line string) ([]string, error) {
+	args := make([]string, 0, 2)
+
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		if line[i] == '"' {
+			end := strings.IndexByte(line[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unbalanced quotes")
+			}
+			args = append(args, line[i+1:i+1+end])
+			i += end + 2
+			continue
+		}
+
+		end := strings.IndexAny(line[i:], " \t")
+		if end == -1 {
+			end = len(line) - i
+		}
+		args = append(args, line[i:i+end])
+		i += end
+	}
+
+	return args, nil
+}
+
+// configFlag records a command-line flag so that it is applied after the config file.
+type configFlag struct {
+	param     *configParam
+	overrides *[][2]string
+}
+
+func (f *configFlag) String() string {
+	return ""
+}
+
+func (f *configFlag) Set(val string) error {
+	if f.param.isBool {
+		b, err := strconv.ParseBool(val)
+		if err == nil {
+			val = formatYesNo(b)
+		}
+	}
+	*f.overrides = append(*f.overrides, [2]string{f.param.name, val})
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.param.isBool
+}
+
+func parsePort(val string, port *int) error {
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %s", val)
+	}
+	*port = n
+	return nil
+}
+
+func parsePositive(val string, dst *int) error {
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("argument must be a positive integer, got %s", val)
+	}
+	*dst = n
+	return nil
+}
+
+func parseYesNo(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no', got %s", val)
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory parses sizes like 1024, 1k, 1kb, 2m, 2mb, 1g or 1gb.
+func parseMemory(val string) (int64, error) {
+	s := strings.ToLower(val)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			mul = u.mul
+			s = strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("invalid memory size %s", val)
+	}
+	return n * mul, nil
+}
+
+func parseLogLevel(val string) (logrus.Level, error) {
+	switch strings.ToLower(val) {
+	case "verbose":
+		return logrus.DebugLevel, nil
+	case "notice":
+		return logrus.InfoLevel, nil
+	case "warning":
+		return logrus.WarnLevel, nil
+	}
+	return logrus.ParseLevel(val)
+}
+
+// the live config is guarded by db.mu, every reader of a setting that can be
+// changed by CONFIG SET holds it.
+
+func (db *DB) configGet(patterns ...string) [][2]string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.cfg.getParams(patterns...)
+}
+
+func (db *DB) configSet(pairs [][2]string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.cfg.setParams(pairs)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("config changed: %v", pairs)
+	return nil
+}
+
+func (db *DB) configRewrite() error {
+	db.rewriteMu.Lock()
+	defer db.rewriteMu.Unlock()
+
+	// the file is written from a snapshot so that commands are not blocked by the I/O.
+	db.mu.Lock()
+	cfg := *db.cfg
+	db.mu.Unlock()
+
+	return cfg.rewrite()
+}
+
+func (db *DB) connectionBufSize() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.cfg.ConnectionBufSize
+}
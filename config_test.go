@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	err := ioutil.WriteFile(path, []byte(`
+# comment
+port 6380
+dir "/tmp/mini redis"
+loglevel warning
+wal-max-size 2mb
+flushall-on-start yes
+`), 0644)
+	assert.Nil(t, err)
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := loadConfig(nil)
+		assert.Nil(t, err)
+		assert.Equal(t, defaultConfig(), cfg)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		cfg, err := loadConfig([]string{path})
+		assert.Nil(t, err)
+		assert.Equal(t, 6380, cfg.Port)
+		assert.Equal(t, "/tmp/mini redis", cfg.Dir)
+		assert.Equal(t, logrus.WarnLevel, cfg.LogLevel)
+		assert.Equal(t, int64(2*1024*1024), cfg.WalMaxSize)
+		assert.True(t, cfg.FlushAllOnStart)
+		assert.Equal(t, 8082, cfg.MetricsPort)
+	})
+
+	t.Run("flags override file", func(t *testing.T) {
+		cfg, err := loadConfig([]string{path, "--port", "6381", "--flushall-on-start=false", "--wal-max-size", "10k", "--ordered-databases", "1, 3"})
+		assert.Nil(t, err)
+		assert.Equal(t, 6381, cfg.Port)
+		assert.Equal(t, uint64(1<<1|1<<3), cfg.OrderedDatabases)
+		assert.False(t, cfg.FlushAllOnStart)
+		assert.Equal(t, int64(10000), cfg.WalMaxSize)
+		assert.Equal(t, "/tmp/mini redis", cfg.Dir)
+
+		cfg, err = loadConfig([]string{"--flushall-on-start", "--config", path, "--dir", "data2"})
+		assert.Nil(t, err)
+		assert.True(t, cfg.FlushAllOnStart)
+		assert.Equal(t, "data2", cfg.Dir)
+		assert.Equal(t, 6380, cfg.Port)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := loadConfig([]string{"--port", "abc"})
+		assert.NotNil(t, err)
+		_, err = loadConfig([]string{"--ordered-databases", "64"})
+		assert.NotNil(t, err)
+		_, err = loadConfig([]string{"--compact-garbage-percent", "101"})
+		assert.NotNil(t, err)
+
+		cfg := defaultConfig()
+		err = cfg.parse(strings.NewReader("unknown 1\n"))
+		assert.Equal(t, "line 1: unknown directive 'unknown'", err.Error())
+
+		err = cfg.parse(strings.NewReader("port 1 2\n"))
+		assert.Equal(t, "line 1: wrong number of arguments for 'port'", err.Error())
+
+		err = cfg.parse(strings.NewReader("dir \"data\n"))
+		assert.Equal(t, "line 1: unbalanced quotes", err.Error())
+
+		// the size would wrap around to a negative one.
+		err = cfg.parse(strings.NewReader("wal-max-size 9999999999gb\n"))
+		assert.Equal(t, "line 1: invalid memory size 9999999999gb", err.Error())
+	})
+}
+
+func Test_exampleConfig(t *testing.T) {
+	cfg, err := loadConfig([]string{"redis.conf"})
+	assert.Nil(t, err)
+
+	def := defaultConfig()
+	def.file = "redis.conf"
+	assert.Equal(t, def, cfg)
+}
+
+func Test_configCmd(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	defer logrus.SetLevel(logrus.DebugLevel)
+
+	input := string(encodeCommand("config", "get", "port")) +
+		string(encodeCommand("config", "get", "wal-*", "log*")) +
+		string(encodeCommand("config", "set", "loglevel", "warning", "wal-max-size", "2mb")) +
+		string(encodeCommand("config", "get", "wal-max-size")) +
+		string(encodeCommand("config", "set", "port", "6380")) +
+		string(encodeCommand("config", "set", "loglevel", "info", "wal-max-size", "abc")) +
+		string(encodeCommand("config", "set", "nosuch", "1")) +
+		string(encodeCommand("config", "set", "loglevel")) +
+		string(encodeCommand("config", "rewrite"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "*2\r\n$4\r\nport\r\n$4\r\n6379\r\n"+
+		"*4\r\n$8\r\nloglevel\r\n$5\r\ndebug\r\n$12\r\nwal-max-size\r\n$7\r\n1048576\r\n"+
+		"+OK\r\n"+
+		"*2\r\n$12\r\nwal-max-size\r\n$7\r\n2097152\r\n"+
+		"-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config\r\n"+
+		"-ERR CONFIG SET failed (possibly related to argument 'wal-max-size') - invalid memory size abc\r\n"+
+		"-ERR Unknown option or number of arguments for CONFIG SET - 'nosuch'\r\n"+
+		"-ERR wrong number of arguments for 'config|set' command\r\n"+
+		"-ERR The server is running without a config file\r\n", out)
+
+	// the failed CONFIG SET changed nothing.
+	assert.Equal(t, logrus.WarnLevel, db.cfg.LogLevel)
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+}
+
+func Test_configRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	err := ioutil.WriteFile(path, []byte("# my comment\nport 6380\nloglevel debug\nloglevel info\nflushall-on-start yes\n"), 0644)
+	assert.Nil(t, err)
+
+	cfg, err := loadConfig([]string{path, "--dir", "my data"})
+	assert.Nil(t, err)
+
+	err = cfg.setParams([][2]string{{"loglevel", "warning"}, {"wal-max-size", "2mb"}})
+	assert.Nil(t, err)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	err = cfg.rewrite()
+	assert.Nil(t, err)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "# my comment\nport 6380\nloglevel warning\nflushall-on-start yes\n"+
+		"# Generated by CONFIG REWRITE\ndir \"my data\"\nwal-max-size 2097152\n", string(content))
+
+	// rewriting again keeps the file stable.
+	err = cfg.rewrite()
+	assert.Nil(t, err)
+	again, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), string(again))
+
+	reloaded, err := loadConfig([]string{path})
+	assert.Nil(t, err)
+	assert.Equal(t, "my data", reloaded.Dir)
+	assert.Equal(t, int64(2*1024*1024), reloaded.WalMaxSize)
+	assert.Equal(t, logrus.WarnLevel, reloaded.LogLevel)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The logical databases are views of one store. Each db has its own index
+// region in the db file, which is allocated by its first write and recorded in
+// meta.dbs, while the element pages and the freelist are shared. SWAPDB swaps
+// the meta entries of two dbs, which is why it is cheap.
+
+var (
+	errDBIndexOutOfRange = "ERR DB index is out of range"
+	errSameObject        = "ERR source and destination objects are the same"
+)
+
+// parseDBIndex parses the db number s. The wal may select a db beyond the
+// databases configured now, so replaying accepts every db the file can hold.
+func (db *DB) parseDBIndex(s string) (int, string) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	limit := db.cfg.Databases
+	if !db.serving {
+		limit = maxDatabases
+	}
+	if n < 0 || n >= limit {
+		return 0, errDBIndexOutOfRange
+	}
+	return n, ""
+}
+
+// swapIndexes swaps the keys of the dbs a and b. Watchers of keys in either
+// db see them modified and blocked readers check their keys again. db.mu must
+// be held.
+func (db *DB) swapIndexes(a, b int) {
+	dbs := &db.page(0).meta().dbs
+	dbs[a], dbs[b] = dbs[b], dbs[a]
+
+	prefixes := []string{db.dbs[a].dbKey(""), db.dbs[b].dbKey("")}
+	hasPrefix := func(key string) bool {
+		return strings.HasPrefix(key, prefixes[0]) || strings.HasPrefix(key, prefixes[1])
+	}
+
+	for key, wk := range db.watched {
+		if hasPrefix(key) {
+			db.watchVersion++
+			wk.version = db.watchVersion
+		}
+	}
+
+	for _, key := range db.blocked.Keys() {
+		if hasPrefix(key) {
+			db.blocked.Signal(key, math.MaxInt32)
+		}
+	}
+	blockedClientsMetric.Set(float64(db.blocked.Len()))
+}
+
+// SwapDB swaps the dbs a and b, connections using one of them see the keys of
+// the other right away.
+func (db *DB) SwapDB(a, b int) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	if a == b {
+		return nil
+	}
+
+	err = db.saveSwapUndo(a, b)
+	if err != nil {
+		return err
+	}
+	db.swapIndexes(a, b)
+
+	return db.persist(encodeCommand("swapdb", strconv.Itoa(a), strconv.Itoa(b)))
+}
+
+// MoveKey moves key with its expire time to the db dst. It returns false if key
+// does not exist or dst has key already.
+func (db *DB) MoveKey(key []byte, dst int) (_ bool, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid == 0 {
+		return false, nil
+	}
+
+	to := db.dbs[dst]
+	_, dstIe := to.findIndexEleInChain(key)
+	if dstIe.pgid != 0 {
+		return false, nil
+	}
+
+	// setValue may remap the file, ele is not valid after it.
+	ele := db.ele(ie)
+	typ, expireAt := ele.typ(), ele.expireAt
+	val := append([]byte{}, ele.val()...)
+
+	err = to.setValue(key, val, typ, expireAt)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = db.del(key)
+	if err != nil {
+		return false, err
+	}
+
+	if typ == typeList || typ == typeStream {
+		to.signalStream(key)
+	}
+
+	return true, db.persist(encodeCommand("move", string(key), strconv.Itoa(dst)))
+}
+
+// flushDB deletes all keys of db without locking and without writing wal.
+func (db *DB) flushDB() error {
+	if db.dbMeta().indexPgid == 0 {
+		return nil
+	}
+
+	// no key is expired at 0, del looks each one up again, which deletes the
+	// expired ones as well, and it deals with transactions.
+	var err error
+	db.eachKey(0, func(ele *Ele) {
+		if err == nil {
+			_, err = db.del(append([]byte{}, ele.key()...))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if db.ordered() {
+		// the leaves only have entries of deleted eles now.
+		return db.btreeReset()
+	}
+	return nil
+}
+
+// FlushDB deletes all keys of db.
+func (db *DB) FlushDB() (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	err = db.flushDB()
+	if err != nil {
+		return err
+	}
+	return db.persist(encodeCommand("flushdb"))
+}
+
+// FlushAll deletes all keys of all dbs.
+func (db *DB) FlushAll() (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	for _, d := range db.dbs {
+		err = d.flushDB()
+		if err != nil {
+			return err
+		}
+	}
+	return db.persist(encodeCommand("flushall"))
+}
+
+// selectCmd switches the db of the connection. It is queued by MULTI, the
+// commands after it in the transaction run in the selected db.
+func selectCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	n, errMsg := db.parseDBIndex(cmd[1])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	cmdhdr.db = n
+	return cmdhdr.replyOK()
+}
+
+func swapdbCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	a, errMsg := db.parseDBIndex(cmd[1])
+	if errMsg != "" {
+		return cmdhdr.replyError("ERR invalid first DB index")
+	}
+	b, errMsg := db.parseDBIndex(cmd[2])
+	if errMsg != "" {
+		return cmdhdr.replyError("ERR invalid second DB index")
+	}
+
+	err := db.SwapDB(a, b)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
+
+func moveKeyCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	dst, errMsg := db.parseDBIndex(cmd[2])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+	if dst == db.num {
+		return cmdhdr.replyError(errSameObject)
+	}
+
+	ok, err := db.MoveKey([]byte(cmd[1]), dst)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return cmdhdr.replyInt(1)
+	}
+	return cmdhdr.replyInt(0)
+}
+
+// flushOptionOK checks the optional ASYNC or SYNC of FLUSHDB and FLUSHALL.
+// Both flush right away, there is no background freeing here.
+func flushOptionOK(cmd []string) bool {
+	if len(cmd) == 1 {
+		return true
+	}
+	if len(cmd) > 2 {
+		return false
+	}
+	opt := strings.ToLower(cmd[1])
+	return opt == "async" || opt == "sync"
+}
+
+func flushdbCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if !flushOptionOK(cmd) {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	err := db.FlushDB()
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
+
+func flushallCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if !flushOptionOK(cmd) {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	err := db.FlushAll()
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
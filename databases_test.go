@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_databaseCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"set", "k", "zero"}, "+OK\r\n"},
+		{[]string{"select", "1"}, "+OK\r\n"},
+		{[]string{"get", "k"}, "$-1\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"set", "k", "one"}, "+OK\r\n"},
+		{[]string{"rpush", "l", "a", "b"}, ":2\r\n"},
+		{[]string{"set", "ttl", "v", "ex", "100"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":3\r\n"},
+
+		{[]string{"move", "k", "0"}, ":0\r\n"},
+		{[]string{"move", "nosuch", "0"}, ":0\r\n"},
+		{[]string{"move", "l", "0"}, ":1\r\n"},
+		{[]string{"move", "ttl", "2"}, ":1\r\n"},
+		{[]string{"move", "k", "1"}, "-ERR source and destination objects are the same\r\n"},
+		{[]string{"move", "k", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"dbsize"}, ":1\r\n"},
+		{[]string{"select", "2"}, "+OK\r\n"},
+		{[]string{"ttl", "ttl"}, ":100\r\n"},
+
+		{[]string{"select", "0"}, "+OK\r\n"},
+		{[]string{"lrange", "l", "0", "-1"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"swapdb", "0", "1"}, "+OK\r\n"},
+		{[]string{"get", "k"}, "$3\r\none\r\n"},
+		{[]string{"dbsize"}, ":1\r\n"},
+		{[]string{"swapdb", "0", "0"}, "+OK\r\n"},
+		{[]string{"swapdb", "x", "0"}, "-ERR invalid first DB index\r\n"},
+		{[]string{"swapdb", "0", "64"}, "-ERR invalid second DB index\r\n"},
+		{[]string{"select", "64"}, "-ERR DB index is out of range\r\n"},
+		{[]string{"select", "-1"}, "-ERR DB index is out of range\r\n"},
+
+		{[]string{"flushdb", "now"}, "-ERR syntax error\r\n"},
+		{[]string{"flushdb", "async"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"select", "1"}, "+OK\r\n"},
+		{[]string{"get", "k"}, "$4\r\nzero\r\n"},
+		{[]string{"flushall", "sync"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"select", "2"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"set", "k", "again"}, "+OK\r\n"},
+		{[]string{"get", "k"}, "$5\r\nagain\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_selectInMulti(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("multi")) +
+		string(encodeCommand("select", "3")) +
+		string(encodeCommand("set", "k", "v")) +
+		string(encodeCommand("exec")) +
+		string(encodeCommand("get", "k"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n+OK\r\n$1\r\nv\r\n", out)
+	assert.Equal(t, int64(0), db.DBSize())
+	assert.Equal(t, int64(1), db.dbs[3].DBSize())
+}
+
+func Test_watchAcrossDBs(t *testing.T) {
+	db := newTestDB(t)
+	c1 := newCommandHandler(nil, nil, nil)
+	c2 := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k", "mine")) +
+		string(encodeCommand("exec"))
+
+	// the same key in another db is another key.
+	out := runCommands(t, db, c1, string(encodeCommand("select", "1"))+string(encodeCommand("watch", "k")))
+	assert.Equal(t, "+OK\r\n+OK\r\n", out)
+	out = runCommands(t, db, c2, string(encodeCommand("set", "k", "other")))
+	assert.Equal(t, "+OK\r\n", out)
+	out = runCommands(t, db, c1, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n", out)
+
+	// SWAPDB modifies all keys of both dbs.
+	out = runCommands(t, db, c1, string(encodeCommand("watch", "k")))
+	assert.Equal(t, "+OK\r\n", out)
+	out = runCommands(t, db, c2, string(encodeCommand("swapdb", "0", "1")))
+	assert.Equal(t, "+OK\r\n", out)
+	out = runCommands(t, db, c1, input+string(encodeCommand("get", "k")))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*-1\r\n$5\r\nother\r\n", out)
+}
+
+func Test_rollbackSwapDB(t *testing.T) {
+	db := newTestDB(t)
+
+	assert.Nil(t, db.Set(nil, []byte("k"), []byte("zero")))
+	assert.Nil(t, db.dbs[1].Set(nil, []byte("k"), []byte("one")))
+
+	err := db.Transaction(func(ctx context.Context, txid uint64) error {
+		assert.Nil(t, db.dbs[1].Set(nil, []byte("k"), []byte("changed")))
+		assert.Nil(t, db.SwapDB(0, 1))
+		assert.Nil(t, db.dbs[1].Set(nil, []byte("k2"), []byte("v")))
+		return errors.New("rollback")
+	})
+	assert.NotNil(t, err)
+
+	val, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "zero", string(val))
+	val, err = db.dbs[1].Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "one", string(val))
+	assert.Equal(t, int64(1), db.DBSize())
+	assert.Equal(t, int64(1), db.dbs[1].DBSize())
+}
+
+func Test_recoverDatabases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("set", "k", "zero")) +
+		string(encodeCommand("select", "1")) +
+		string(encodeCommand("set", "k", "one")) +
+		string(encodeCommand("set", "k2", "one")) +
+		string(encodeCommand("move", "k2", "2")) +
+		string(encodeCommand("select", "0")) +
+		string(encodeCommand("swapdb", "0", "1")) +
+		string(encodeCommand("multi")) +
+		string(encodeCommand("select", "3")) +
+		string(encodeCommand("set", "k3", "three")) +
+		string(encodeCommand("exec")) +
+		string(encodeCommand("select", "0")) +
+		string(encodeCommand("set", "k0", "zero"))
+	runCommands(t, db, cmdhdr, input)
+
+	// a record of another db than the one before it is preceded by a SELECT.
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(encodeCommand("set", "k", "zero"))+
+		string(encodeCommand("select", "1"))+
+		string(encodeCommand("set", "k", "one"))+
+		string(encodeCommand("set", "k2", "one"))+
+		string(encodeCommand("move", "k2", "2"))+
+		string(encodeCommand("select", "0"))+
+		string(encodeCommand("swapdb", "0", "1"))+
+		string(encodeCommand("multi"))+
+		string(encodeCommand("select", "3"))+
+		string(encodeCommand("set", "k3", "three"))+
+		string(encodeCommand("exec"))+
+		string(encodeCommand("select", "0"))+
+		string(encodeCommand("set", "k0", "zero")), string(wal))
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	val, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "one", string(val))
+	val, err = db.dbs[1].Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "zero", string(val))
+	val, err = db.dbs[2].Get([]byte("k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "one", string(val))
+	val, err = db.dbs[3].Get([]byte("k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, "three", string(val))
+	assert.Equal(t, int64(2), db.DBSize())
+}
+
+func Test_databasesUpgradeFromV1(t *testing.T) {
+	path := openFixtureDir(t, "v1.db.gz")
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+
+	// the keys of a file of the first version are in db 0.
+	assert.Equal(t, int64(232), db.DBSize())
+	assert.Equal(t, int64(0), db.dbs[1].DBSize())
+	moved, err := db.MoveKey([]byte("small-001"), 1)
+	assert.Nil(t, err)
+	assert.True(t, moved)
+	assert.Nil(t, db.SwapDB(0, 1))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Equal(t, int64(1), db.DBSize())
+	val, err := db.Get([]byte("small-001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v-001", string(val))
+	assert.Equal(t, int64(231), db.dbs[1].DBSize())
+	val, err = db.dbs[1].Get([]byte("small-005"))
+	assert.Nil(t, err)
+	assert.Equal(t, "w-005", string(val))
+	_, err = db.dbs[1].Get([]byte("small-001"))
+	assert.Equal(t, NotFoundError, err)
+}
@@ -2,15 +2,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
-	"encoding/binary"
 	"errors"
 	"github.com/sirupsen/logrus"
+	"github.com/xumc/miniRedis/queue"
 	"golang.org/x/sys/unix"
-	"math/rand"
 	"os"
-	"path/filepath"
-	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -22,36 +18,93 @@ const (
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
 
-	metaPageCount         = 1
-	freelistPageCount     = 1
-	elePageIncrementCount = 64
+	// set on an element page while it is in the freelist.
+	listedPageFlag = 0x100
+
+	metaPageCount     = 1
+	freelistPageCount = 1
+
+	// version of the db file. Files of version 1 have eles without expireAt,
+	// files of version 2 have no meta.keyCount, files of version 3 have db 0
+	// only, files of version 4 have the fixed md5 index and files of version 5
+	// have a freelist of a single page.
+	dbVersion = 6
+
+	// logical databases a db file can hold, limited by the size of the meta page.
+	maxDatabases = 64
 
-	walMaxSize            = 1024 * 1024
 	maxAllocSize = 0x7FFFFFFF
 )
 
 var (
-	indexPageCount = 1 << 16 * int(unsafe.Sizeof(IndexEle{})) / os.Getpagesize()
-
 	NotFoundError = errors.New("not found")
+	// WrongTypeError is returned when a command is run on a key of another type.
+	WrongTypeError = commandError("WRONGTYPE Operation against a key holding the wrong kind of value")
 
 	insufficientFreeSpaceInPageError = errors.New("insufficient free space")
 
 	noUnfullPageError = errors.New("no unfull page error")
 )
 
+// DB is one of the logical databases in the db file, selected by its number.
+// They share the file, the wal and the locks in store, and each of them has an
+// index of its own.
 type DB struct {
+	*store
+	num int
+}
+
+// store is the db file with its wal and undo log.
+type store struct {
+	dbs []*DB // the logical databases by number
+
 	file     *os.File
 	data     []byte
 	pageSize uint64
 
-	wal *os.File
+	wal  *os.File
 	undo *os.File
 
-	mu       sync.Mutex
-	serving  bool
-	crashKey []byte // used for UT testing only
-	dataDir  string
+	// wal writer state, see wal.go. walBuf, walAppended and walFileBase are
+	// guarded by mu, walWritten, walSynced, walDirtySince and walErr by walMu.
+	walBuf        []byte
+	walSpare      []byte
+	walAppended   int64
+	walFileBase   int64
+	walPending    *sync.Cond // signaled when records are appended to walBuf
+	walMu         sync.Mutex
+	walCond       *sync.Cond // broadcast when walWritten or walSynced moves
+	walWritten    int64
+	walSynced     int64
+	walDirtySince time.Time // when the oldest unsynced record was written
+	walErr        error
+	walWriterDone chan struct{}
+	syncMu        sync.Mutex // held while wal is fsynced
+	walDB         int        // the db which the records appended to wal are for, guarded by mu
+	txFirstDB     int        // the db of the first record in txWal
+	txWalDB       int        // the db of the last record in txWal
+
+	// compaction state, see compact.go, guarded by mu.
+	compactPgid     uint64    // the next page the pass looks at
+	compactTailPgid uint64    // the first of the empty pages the pass has seen last, 0 if none
+	compactStats    fragStats // of the pages the pass has seen so far
+	fragStats       fragStats // of the file, as the last whole pass has seen it
+
+	mu            sync.Mutex
+	txMu          sync.RWMutex // held exclusively by a running transaction
+	transactionID uint64
+	activeTx      uint64      // id of the running transaction, 0 if none
+	txImages      []undoImage // before-images of the running transaction
+	txWal         []byte      // wal records buffered until the running transaction commits
+	watched       map[string]*watchedKey
+	watchVersion  uint64
+	blocked       *queue.Queue // connections blocked on lists and streams
+	serving       bool
+	closing       chan struct{}
+	crashKey      []byte // used for UT testing only
+	dataDir       string
+	cfg           *Config
+	rewriteMu     sync.Mutex // serializes CONFIG REWRITE, which writes the config file without mu
 }
 
 type IndexEle struct {
@@ -59,23 +112,42 @@ type IndexEle struct {
 	at   uint16
 }
 
+// types of the value of an ele, kept in bits 1-3 of Ele.flags. Files written
+// before types were added hold strings only, which is type 0.
+const (
+	typeString = 0
+	typeHash   = 1
+	typeList   = 2
+	typeSet    = 3
+	typeZset   = 4
+	typeStream = 5
+)
+
+var typeNames = map[byte]string{
+	typeString: "string",
+	typeHash:   "hash",
+	typeList:   "list",
+	typeSet:    "set",
+	typeZset:   "zset",
+	typeStream: "stream",
+}
+
 type Ele struct {
-	flags byte // 76543210, 0=delete
-	next  IndexEle
-	pos   uint32
-	kSize uint32
-	vSize uint32
+	flags    byte // 76543210, 0=delete, 1-3=type
+	next     IndexEle
+	pos      uint32
+	kSize    uint32
+	vSize    uint32
+	expireAt int64 // unix time in milliseconds, 0 means never expire
 }
 
 func (e *Ele) key() []byte {
-	p := uintptr(unsafe.Pointer(e)) + uintptr(e.pos)
-	bs := (*[maxAllocSize]byte)(unsafe.Pointer(p))
+	bs := (*[maxAllocSize]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(e)) + uintptr(e.pos)))
 	return (*bs)[:e.kSize]
 }
 
 func (e *Ele) val() []byte {
-	p := uintptr(unsafe.Pointer(e)) + uintptr(e.pos)
-	bs := (*[maxAllocSize]byte)(unsafe.Pointer(p))
+	bs := (*[maxAllocSize]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(e)) + uintptr(e.pos)))
 	return (*bs)[e.kSize:(e.kSize + e.vSize)]
 }
 
@@ -91,13 +163,40 @@ func (e *Ele) delete() {
 	e.flags |= 1
 }
 
+func (e *Ele) typ() byte {
+	return (e.flags >> 1) & 0x07
+}
+
+func (e *Ele) setType(typ byte) {
+	e.flags = e.flags&^(0x07<<1) | (typ&0x07)<<1
+}
+
+func (e *Ele) isExpired(now int64) bool {
+	return e.expireAt > 0 && e.expireAt <= now
+}
+
 type Elements struct {
 	eles [elementsCountInOnePage]Ele
 	data [maxAllocSize]byte
 }
 
 func (db *DB) Close() error {
-	err := unix.Munmap(db.data)
+	close(db.closing)
+
+	err := db.closeWal()
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err = db.flush()
+	if err != nil {
+		return err
+	}
+
+	err = unix.Munmap(db.data)
 	if err != nil {
 		return err
 	}
@@ -107,7 +206,7 @@ func (db *DB) Close() error {
 		return err
 	}
 
-	err = db.wal.Close()
+	err = db.undo.Close()
 	if err != nil {
 		return err
 	}
@@ -119,47 +218,130 @@ func (db *DB) SetString(originCmd []byte, key, val string) error {
 	return db.Set(originCmd, []byte(key), []byte(val))
 }
 
-func (db *DB) Set(originCmd []byte, key, val []byte) error {
+func (db *DB) Set(originCmd []byte, key, val []byte) (err error) {
 	lstart := time.Now()
 	db.mu.Lock()
 	defer func() {
-		db.mu.Unlock()
+		db.unlockAndWaitWal(&err)
 		lockSetDurationMetric.Set(time.Now().Sub(lstart).Seconds())
 	}()
 
 	start := time.Now()
 
+	err = db.set(key, val, 0)
+	if err != nil {
+		return err
+	}
+
+	err = db.persist(originCmd)
+	if err != nil {
+		return err
+	}
+
+	pureSetDurationMetric.Set(time.Now().Sub(start).Seconds())
+	return err
+}
+
+// set writes the string key => val without locking and without writing wal.
+// expireAt is the new expire time of key, or keepTTL to leave it unchanged.
+func (db *DB) set(key, val []byte, expireAt int64) error {
+	return db.setValue(key, val, typeString, expireAt)
+}
+
+// setValue is set for a value of any type, val is the encoding of the value.
+func (db *DB) setValue(key, val []byte, typ byte, expireAt int64) error {
+	err := db.saveUndo(key)
+	if err != nil {
+		return err
+	}
+	db.touch(key)
+
+	if db.dbMeta().indexPgid == 0 {
+		err = db.allocIndex()
+		if err != nil {
+			return err
+		}
+	}
+
 	preIe, ie := db.findIndexEleInChain(key)
+	// createEle may map the file again, preIe and ie point into the old
+	// mapping after it. The ele before key is kept to find ie again.
+	var prev IndexEle
+	if preIe != nil {
+		prev = *preIe
+	}
 
 	if ie.pgid == 0 {
 		// no found in index
-		err := db.createEle(key, val, preIe, ie)
+		var created IndexEle
+		err = db.createEle(key, val, preIe, &created)
 		if err != nil {
 			return err
 		}
-	} else {
-		// found in index
-		err := db.updateExistingEle(key, val, ie)
-		if err == insufficientFreeSpaceInPageError {
-			// remove the ele and then create new one.
-			pg := db.page(ie.pgid)
-			es := pg.elements()
-			ele := &es.eles[ie.at]
-			ele.delete()
-			err = db.createEle(key, val, preIe, ie)
+		if !db.ordered() {
+			*db.chainSlot(key, prev) = created
 		}
+		db.dbMeta().keyCount++
+
+		db.ele(&created).setType(typ)
+		if expireAt != keepTTL {
+			db.ele(&created).expireAt = expireAt
+		}
+		return db.indexAdd(key, created)
+	}
+
+	db.ele(ie).setType(typ)
+	if expireAt != keepTTL {
+		db.ele(ie).expireAt = expireAt
+	}
+
+	// found in index
+	err = db.updateExistingEle(key, val, ie)
+	if err == insufficientFreeSpaceInPageError {
+		// remove the ele and then create new one.
+		pg := db.page(ie.pgid)
+		es := pg.elements()
+		ele := &es.eles[ie.at]
+		ele.delete()
+		next := ele.next
+		oldExpireAt := ele.expireAt
+		var created IndexEle
+		err = db.createEle(key, val, preIe, &created)
 		if err != nil {
 			return err
 		}
+
+		// keep the rest of the chain linked after the new ele.
+		newEle := db.ele(&created)
+		newEle.next = next
+		newEle.expireAt = oldExpireAt
+		newEle.setType(typ)
+		if db.ordered() {
+			return db.btreePut(key, created)
+		}
+		*db.chainSlot(key, prev) = created
+		return nil
 	}
+	return err
+}
 
-	err := db.persist(originCmd)
-	if err != nil {
-		return err
+// chainSlot returns the link in the hash index which follows the ele at prev
+// in the chain of key, the head of the chain if prev is empty.
+func (db *DB) chainSlot(key []byte, prev IndexEle) *IndexEle {
+	if prev.pgid == 0 {
+		return db.keyIndexEle(key)
 	}
+	return &db.ele(&prev).next
+}
 
-	pureSetDurationMetric.Set(time.Now().Sub(start).Seconds())
-	return err
+// lookup finds key of type typ. ie.pgid is 0 if key does not exist, and
+// WrongTypeError is returned if it holds a value of another type.
+func (db *DB) lookup(key []byte, typ byte) (*IndexEle, error) {
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid != 0 && db.ele(ie).typ() != typ {
+		return nil, WrongTypeError
+	}
+	return ie, nil
 }
 
 func (db *DB) GetString(key string) (string, error) {
@@ -177,7 +359,10 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	}()
 
 	start := time.Now()
-	_, ie := db.findIndexEleInChain(key)
+	ie, err := db.lookup(key, typeString)
+	if err != nil {
+		return nil, err
+	}
 
 	if ie.pgid == 0 {
 		return nil, NotFoundError
@@ -189,7 +374,20 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	ele := &es.eles[ie.at]
 
 	pureGetDurationMetric.Set(time.Now().Sub(start).Seconds())
-	return ele.val(), nil
+	// the page may be rewritten by compaction once mu is released.
+	return append([]byte{}, ele.val()...), nil
+}
+
+// Type returns the type of the value in key.
+func (db *DB) Type(key []byte) (byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid == 0 {
+		return 0, NotFoundError
+	}
+	return db.ele(ie).typ(), nil
 }
 
 func (db *DB) DeleteString(originCmd []byte, keys ...string) ([]bool, error) {
@@ -200,12 +398,12 @@ func (db *DB) DeleteString(originCmd []byte, keys ...string) ([]bool, error) {
 	return db.Delete(originCmd, bsKeys...)
 }
 
-func (db *DB) Delete(originCmd []byte, keys ...[]byte) ([]bool, error) {
+func (db *DB) Delete(originCmd []byte, keys ...[]byte) (_ []bool, err error) {
 	lstart := time.Now()
 
 	db.mu.Lock()
 	defer func() {
-		db.mu.Unlock()
+		db.unlockAndWaitWal(&err)
 		lockDelDurationMetric.Set(time.Now().Sub(lstart).Seconds())
 	}()
 
@@ -213,27 +411,133 @@ func (db *DB) Delete(originCmd []byte, keys ...[]byte) ([]bool, error) {
 
 	result := make([]bool, len(keys))
 	for i, key := range keys {
+		deleted, err := db.del(key)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = deleted
+	}
+
+	err = db.persist(originCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	pureDelDurationMetric.Set(time.Now().Sub(start).Seconds())
+	return result, nil
+}
+
+// MSet sets keys[i] => vals[i] for all keys under one lock, and logs them to
+// wal as one record. The expire times of the keys are removed like Set does.
+func (db *DB) MSet(originCmd []byte, keys, vals [][]byte) (err error) {
+	lstart := time.Now()
+	db.mu.Lock()
+	defer func() {
+		db.unlockAndWaitWal(&err)
+		lockSetDurationMetric.Set(time.Now().Sub(lstart).Seconds())
+	}()
+
+	start := time.Now()
+
+	for i, key := range keys {
+		err = db.set(key, vals[i], 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.persist(originCmd)
+	if err != nil {
+		return err
+	}
+
+	pureSetDurationMetric.Set(time.Now().Sub(start).Seconds())
+	return nil
+}
+
+// MSetNX is MSet which sets nothing if any of keys exists. It returns whether
+// the keys are set. It is logged to wal as MSET, so nothing is logged when
+// the keys are not set.
+func (db *DB) MSetNX(keys, vals [][]byte) (_ bool, err error) {
+	lstart := time.Now()
+	db.mu.Lock()
+	defer func() {
+		db.unlockAndWaitWal(&err)
+		lockSetDurationMetric.Set(time.Now().Sub(lstart).Seconds())
+	}()
+
+	start := time.Now()
+
+	for _, key := range keys {
 		_, ie := db.findIndexEleInChain(key)
-		if ie.pgid == 0 {
-			result[i] = false
+		if ie.pgid != 0 {
+			return false, nil
+		}
+	}
+
+	record := []string{"mset"}
+	for i, key := range keys {
+		err = db.set(key, vals[i], 0)
+		if err != nil {
+			return false, err
+		}
+		record = append(record, string(key), string(vals[i]))
+	}
+
+	err = db.persist(encodeCommand(record...))
+	if err != nil {
+		return false, err
+	}
+
+	pureSetDurationMetric.Set(time.Now().Sub(start).Seconds())
+	return true, nil
+}
+
+// MGet returns the values of keys under one lock. The value is nil for a key
+// which does not exist or does not hold a string.
+func (db *DB) MGet(keys ...[]byte) [][]byte {
+	lstart := time.Now()
+	db.mu.Lock()
+	defer func() {
+		db.mu.Unlock()
+		lockGetDurationMetric.Set(time.Now().Sub(lstart).Seconds())
+	}()
+
+	start := time.Now()
+
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		_, ie := db.findIndexEleInChain(key)
+		if ie.pgid == 0 || db.ele(ie).typ() != typeString {
 			continue
 		}
+		vals[i] = append([]byte{}, db.ele(ie).val()...)
+	}
 
-		pg := db.page(ie.pgid)
-		es := pg.elements()
-		ele := &es.eles[ie.at]
+	pureGetDurationMetric.Set(time.Now().Sub(start).Seconds())
+	return vals
+}
 
-		ele.delete()
-		result[i] = true
+// del removes key without locking and without writing wal.
+func (db *DB) del(key []byte) (bool, error) {
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid == 0 {
+		return false, nil
 	}
 
-	err := db.persist(originCmd)
+	err := db.saveUndo(key)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
+	db.touch(key)
 
-	pureDelDurationMetric.Set(time.Now().Sub(start).Seconds())
-	return result, nil
+	pg := db.page(ie.pgid)
+	es := pg.elements()
+	ele := &es.eles[ie.at]
+
+	ele.delete()
+	db.dbMeta().keyCount--
+	return true, nil
 }
 
 func (db *DB) createEleInPage(key, val []byte, ie *IndexEle, pg *page) error {
@@ -275,6 +579,9 @@ func (db *DB) createEleInPage(key, val []byte, ie *IndexEle, pg *page) error {
 	return nil
 }
 
+// createEle creates the ele key => val and stores where it is in ie, which
+// must not point into the mapping as the file may be mapped again. The page of
+// preIe is tried first.
 func (db *DB) createEle(key, val []byte, preIe, ie *IndexEle) error {
 	var pgid uint64
 
@@ -296,7 +603,7 @@ func (db *DB) createEle(key, val []byte, preIe, ie *IndexEle) error {
 				pgid = firstPgid
 			} else {
 				var err error
-				pgid, err = db.getUnfullPgid()
+				pgid, err = db.getUnfullPgid(uint64(firstEleLen))
 				if err != nil {
 					if err == noUnfullPageError {
 						pgid, err = db.growPages(firstEleLen)
@@ -312,18 +619,22 @@ func (db *DB) createEle(key, val []byte, preIe, ie *IndexEle) error {
 		}
 
 		pg := db.page(pgid)
-		if uint32(pg.count) >= elementsCountInOnePage {
-			db.removeFullPgid(pgid)
-		} else {
+		if uint32(pg.count) < elementsCountInOnePage {
 			err := db.createEleInPage(key, val, ie, pg)
-			if err != nil {
-				if err != insufficientFreeSpaceInPageError {
-					return err
+			if err != nil && err != insufficientFreeSpaceInPageError {
+				return err
+			}
+			if err == nil {
+				if db.pageHasRoom(pg) {
+					return db.addUnfullPgid(pgid)
 				}
-			} else {
+				db.removeFullPgid(pgid)
 				return nil
 			}
 		}
+		if !db.pageHasRoom(pg) {
+			db.removeFullPgid(pgid)
+		}
 
 		pgid = 0
 	}
@@ -332,6 +643,27 @@ func (db *DB) createEle(key, val []byte, preIe, ie *IndexEle) error {
 	return errors.New("unreachable code")
 }
 
+// patchValue overwrites the value of key, whose ele is at ie, with val of the
+// same size. Only the bytes which differ are written.
+func (db *DB) patchValue(key []byte, ie *IndexEle, val []byte) error {
+	err := db.saveUndo(key)
+	if err != nil {
+		return err
+	}
+	db.touch(key)
+
+	old := db.ele(ie).val()
+	start, end := 0, len(val)
+	for start < end && old[start] == val[start] {
+		start++
+	}
+	for end > start && old[end-1] == val[end-1] {
+		end--
+	}
+	copy(old[start:end], val[start:end])
+	return nil
+}
+
 func (db *DB) updateExistingEle(key, val []byte, ie *IndexEle) error {
 	pg := db.page(ie.pgid)
 	es := pg.elements()
@@ -353,7 +685,8 @@ func (db *DB) updateExistingEle(key, val []byte, ie *IndexEle) error {
 	kv := append(key, val...)
 	oldKVLen := int(ele.kSize + ele.vSize)
 
-	oldDataLen := int(lastEle.pos + lastEle.kSize + lastEle.vSize - (elementsCountInOnePage-uint32(pg.count))*uint32(unsafe.Sizeof(Ele{})))
+	// the data of the last ele ends at its pos from its own slot.
+	oldDataLen := int(lastEle.pos + lastEle.kSize + lastEle.vSize - (elementsCountInOnePage-uint32(pg.count-1))*uint32(unsafe.Sizeof(Ele{})))
 
 	copy(es.data[(int(ele.pos+ele.kSize+ele.vSize-eleOffsetSize)+kvLen-oldKVLen):], es.data[(ele.pos-eleOffsetSize+ele.kSize+ele.vSize):oldDataLen])
 
@@ -370,11 +703,25 @@ func (db *DB) updateExistingEle(key, val []byte, ie *IndexEle) error {
 }
 
 func (db *DB) findIndexEleInChain(key []byte) (preIe, ie *IndexEle) {
-	hbs := md5.Sum(key)
-	hashedPos := binary.BigEndian.Uint16(hbs[:])
+	if db.ordered() {
+		// a copy of the entry in the tree, it has no chain.
+		ie = db.btreeGet(key)
+		if ie.pgid == 0 {
+			return nil, ie
+		}
+		ele := db.ele(ie)
+		if ele.isDeleted() {
+			return nil, &IndexEle{}
+		}
+		if ele.isExpired(nowMillis()) {
+			ele.delete()
+			db.dbMeta().keyCount--
+			return nil, &IndexEle{}
+		}
+		return nil, ie
+	}
 
-	pos := uint64(hashedPos)*uint64(unsafe.Sizeof(IndexEle{})) + (metaPageCount+freelistPageCount)*db.pageSize
-	ie = (*IndexEle)(unsafe.Pointer(&db.data[pos]))
+	ie = db.keyIndexEle(key)
 
 	if ie.pgid == 0 {
 		// no found in index
@@ -387,10 +734,17 @@ func (db *DB) findIndexEleInChain(key []byte) (preIe, ie *IndexEle) {
 	ele := &es.eles[ie.at]
 
 	// linear search same hash value linklist
+	now := nowMillis()
 	for ie.pgid > 0 {
 		// found in chain
 		if bytes.Equal(ele.key(), key) && !ele.isDeleted() {
-			return preIe, ie
+			if !ele.isExpired(now) {
+				return preIe, ie
+			}
+
+			// lazily expired, it is treated as missing from now on.
+			ele.delete()
+			db.dbMeta().keyCount--
 		}
 
 		preIe = ie
@@ -404,87 +758,69 @@ func (db *DB) findIndexEleInChain(key []byte) (preIe, ie *IndexEle) {
 	return preIe, ie
 }
 
-func (db *DB) getUnfullPgid() (uint64, error) {
-	meta := db.page(0).meta()
-	pg := db.page(meta.freelistPgid)
-	fl := pg.freelist()
-
-	if pg.count == 0 {
-		return 0, noUnfullPageError
+// resizeFile grows the db file to size and maps it again.
+func (db *DB) resizeFile(size int64) error {
+	err := db.file.Truncate(size)
+	if err != nil {
+		return err
 	}
 
-	rand := rand.Intn(int(pg.count))
+	dbFileSizeMetric.Set(float64(size))
 
-	pgid := fl.ids[rand]
-	logrus.Debugf("geted unfull pgid %d, pg.count: %d", pgid, pg.count)
-	return pgid, nil
+	m, err := unix.Mmap(int(db.file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+
+	// pointers into the old mapping must not be used from now on, the
+	// callers get them again from db.data.
+	err = unix.Munmap(db.data)
+	db.data = m
+	return err
 }
 
 func (db *DB) growPages(firstEleLen int) (firstPgid uint64, err error) {
 	meta := db.page(0).meta()
-	flPg := db.page(meta.freelistPgid)
-	fl := flPg.freelist()
 	logrus.Debugf("before grow up pages, elePageCount:%d", meta.elePageCount)
 	fstat, err := db.file.Stat()
 	if err != nil {
 		return 0, err
 	}
 
+	elePageIncrementCount := uint64(db.cfg.ElePageIncrementCount)
 	var incrementalSize = int64(elePageIncrementCount * db.pageSize)
 	incrementalCount := int64(firstEleLen+int(unsafe.Sizeof(page{}))+int(unsafe.Sizeof([elementsCountInOnePage]Ele{})))/incrementalSize + 1
 
 	newFileSize := fstat.Size() + incrementalCount*incrementalSize
-	err = db.file.Truncate(newFileSize)
+	err = db.resizeFile(newFileSize)
 	if err != nil {
 		return 0, err
 	}
+	meta = db.page(0).meta()
 
-	dbFileSizeMetric.Set(float64(newFileSize))
+	incrementPageCount := int(incrementalCount * int64(elePageIncrementCount))
 
-	m, err := unix.Mmap(int(db.file.Fd()), 0, int(newFileSize), unix.PROT_READ|unix.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		return 0, err
-	}
-	db.data = m
-
-	incrementPageCount := int(incrementalCount * elePageIncrementCount)
+	// the indexes of the dbs may be anywhere in the file, the new pages are
+	// at its end.
+	firstNewPage := int(uint64(fstat.Size()) / db.pageSize)
 
+	// the pages the first ele spans are not pages of their own.
 	var overflowPageCount uint32
 	pgids := make([]uint64, 0, incrementPageCount)
-	for i := metaPageCount + freelistPageCount + indexPageCount + int(meta.elePageCount); i < (metaPageCount + freelistPageCount + indexPageCount + int(meta.elePageCount) + incrementPageCount); i++ {
+	for i := firstNewPage; i < firstNewPage+incrementPageCount; i++ {
 		if int64(overflowPageCount)*int64(db.pageSize)-int64(unsafe.Sizeof([elementsCountInOnePage]Ele{})+unsafe.Sizeof(page{})) > int64(firstEleLen) {
 			pg := db.page(uint64(i))
 			pg.id = int(i)
 			pg.flags = elePageFlag
 			pg.count = 0
 			pg.overflow = 1
+			pgids = append(pgids, uint64(i))
 		} else {
 			overflowPageCount++
 		}
-		pgids = append(pgids, uint64(i))
 	}
 
-	maxFreePageCount := (db.pageSize - uint64(unsafe.Sizeof(page{}))) >> 3
-	allFreePagesCount := int(flPg.count) + len(pgids)
-	if uint64(allFreePagesCount) > maxFreePageCount {
-		pgCountMap := make(map[uint64]uint16)
-		for _, pgid := range fl.ids[:flPg.count] {
-			pgCountMap[pgid] = db.page(pgid).count
-		}
-
-		sort.Slice(fl.ids[:flPg.count], func(i, j int) bool {
-			return pgCountMap[fl.ids[:flPg.count][i]] > pgCountMap[fl.ids[:flPg.count][j]]
-		})
-		discardedPages := fl.ids[:len(pgids)]
-		logrus.Infof("pages%v will be discarded even they are not full", discardedPages)
-
-		copy(fl.ids[:len(pgids)], pgids) // discard some pages
-	} else {
-		copy(fl.ids[flPg.count:], pgids)
-		flPg.count += uint16(len(pgids))
-	}
-
-	firstPgid = pgids[0]
+	firstPgid = uint64(firstNewPage)
 	meta.elePageCount += uint64(incrementPageCount)
 
 	pg := db.page(firstPgid)
@@ -493,7 +829,16 @@ func (db *DB) growPages(firstEleLen int) (firstPgid uint64, err error) {
 	pg.count = 0
 	pg.overflow = overflowPageCount
 
-	logrus.Debugf("after grow up pages, elePageCount:%d", meta.elePageCount)
+	// the first page goes to the freelist once the ele is created in it, the
+	// freelist may grow in one of the empty pages.
+	for _, pgid := range pgids {
+		err = db.addUnfullPgid(pgid)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	logrus.Debugf("after grow up pages, elePageCount:%d", db.page(0).meta().elePageCount)
 
 	err = db.flush()
 	if err != nil {
@@ -503,105 +848,19 @@ func (db *DB) growPages(firstEleLen int) (firstPgid uint64, err error) {
 	return firstPgid, nil
 }
 
-func (db *DB) persist(originCmd []byte) error {
-	if !db.serving {
-		return nil
-	}
-	_, err := db.wal.Write(originCmd)
-	if err != nil {
-		return err
-	}
-
-	err = syncFile(db.wal)
-	if err != nil {
-		return err
-	}
-
-	stat, err := db.wal.Stat()
-	if err != nil {
-		return err
-	}
-
-	if len(db.crashKey) > 0 && bytes.Contains(originCmd, db.crashKey) {
-		panic("db crashed")
-	}
-
-	meta := db.page(0).meta()
-	walFileSizeMetric.Set(float64(stat.Size()))
-	walCheckpointMetric.Set(float64(meta.checkpoint))
-
-	checkpoint := stat.Size()
-	if stat.Size() > walMaxSize {
-		err = db.wal.Close()
-		if err != nil {
-			return err
-		}
-
-		walPath := filepath.Join(db.dataDir,stat.Name())
-		wal, err := os.OpenFile(walPath, os.O_RDONLY, 0644)
-		if err != nil {
-			return err
-		}
-		buffer := make([]byte, stat.Size() - int64(meta.checkpoint))
-		n, err := wal.ReadAt(buffer, int64(meta.checkpoint))
-		if err != nil {
-			return err
-		}
-
-		err = wal.Close()
-		if err != nil {
-			return err
-		}
-
-		err = os.Truncate(walPath, 0)
-		if err != nil {
-			return err
-		}
-
-		wal, err = os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			return err
-		}
-
-		_, err = wal.Write(buffer[:n])
-		if err != nil {
-			return err
-		}
-
-		db.wal = wal
-		checkpoint = 0
-	}
-
-	meta.checkpoint = uint64(checkpoint)
-
-	return nil
-}
-
 func (db *DB) flush() error {
 	return unix.Msync(db.data, unix.MS_SYNC)
 }
 
+func (db *DB) ele(ie *IndexEle) *Ele {
+	return &db.page(ie.pgid).elements().eles[ie.at]
+}
+
 func (db *DB) page(pgid uint64) *page {
 	pos := pgid * db.pageSize
 	return (*page)(unsafe.Pointer(&db.data[pos]))
 }
 
-func (db *DB) removeFullPgid(rmPgid uint64) {
-	pgid := db.page(0).meta().freelistPgid
-	pg := db.page(pgid)
-	fl := pg.freelist()
-
-	for i := 0; i < int(pg.count); i++ {
-		if fl.ids[i] == rmPgid && i+1 < int(pg.count) {
-			copy(fl.ids[i:], fl.ids[(i+1):pg.count])
-			pg.count--
-
-			logrus.Infof("remove full pgid %d\n", rmPgid)
-			return
-		}
-	}
-}
-
 func (db *DB) setCrashKey(key []byte) {
 	db.crashKey = key // used for UT testing only
 }
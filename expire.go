@@ -0,0 +1,247 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+const (
+	keepTTL = int64(-1)
+
+	activeExpireInterval = 100 * time.Millisecond
+	// buckets of the index checked by one round of the active expire cycle.
+	activeExpireBucketsPerRound = 64
+	// the cycle stops when it takes longer than this even if many keys are expired.
+	activeExpireTimeLimit = 25 * time.Millisecond
+)
+
+type setOptions struct {
+	nx       bool
+	xx       bool
+	get      bool
+	expireAt int64 // unix time in milliseconds, 0 means no expire, keepTTL keeps the current one
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// SetWithOptions is Set with the options of redis SET command. It returns the old
+// value of key if opts.get is set, and whether val is written.
+func (db *DB) SetWithOptions(originCmd []byte, key, val []byte, opts setOptions) (_ []byte, _ bool, err error) {
+	lstart := time.Now()
+	db.mu.Lock()
+	defer func() {
+		db.unlockAndWaitWal(&err)
+		lockSetDurationMetric.Set(time.Now().Sub(lstart).Seconds())
+	}()
+
+	start := time.Now()
+
+	var old []byte
+	_, ie := db.findIndexEleInChain(key)
+	exists := ie.pgid != 0
+	if exists && opts.get && db.ele(ie).typ() != typeString {
+		return nil, false, WrongTypeError
+	}
+	if exists && opts.get {
+		old = append([]byte{}, db.ele(ie).val()...)
+	}
+
+	if (opts.nx && exists) || (opts.xx && !exists) {
+		return old, false, nil
+	}
+
+	err = db.set(key, val, opts.expireAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = db.persist(originCmd)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pureSetDurationMetric.Set(time.Now().Sub(start).Seconds())
+	return old, true, nil
+}
+
+// Expire sets the expire time of key in unix milliseconds. A key with an expire
+// time in the past is deleted at once. It returns false if key does not exist.
+func (db *DB) Expire(originCmd []byte, key []byte, expireAt int64) (_ bool, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid == 0 {
+		return false, nil
+	}
+
+	if expireAt <= nowMillis() {
+		_, err := db.del(key)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		err := db.setExpire(key, ie, expireAt)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = db.persist(originCmd)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ClearExpire removes the expire time of key. It returns false if key does not
+// exist or has no expire time.
+func (db *DB) ClearExpire(originCmd []byte, key []byte) (_ bool, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid == 0 || db.ele(ie).expireAt == 0 {
+		return false, nil
+	}
+
+	err = db.setExpire(key, ie, 0)
+	if err != nil {
+		return false, err
+	}
+
+	err = db.persist(originCmd)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// TTL returns the remaining time to live of key in milliseconds, or -1 if key
+// has no expire time.
+func (db *DB) TTL(key []byte) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid == 0 {
+		return 0, NotFoundError
+	}
+
+	expireAt := db.ele(ie).expireAt
+	if expireAt == 0 {
+		return -1, nil
+	}
+
+	ttl := expireAt - nowMillis()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
+func (db *DB) setExpire(key []byte, ie *IndexEle, expireAt int64) error {
+	err := db.saveUndo(key)
+	if err != nil {
+		return err
+	}
+	db.touch(key)
+
+	db.ele(ie).expireAt = expireAt
+	return nil
+}
+
+func (db *DB) startActiveExpire() {
+	go func() {
+		tick := time.NewTicker(activeExpireInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+				db.activeExpireCycle()
+			case <-db.closing:
+				return
+			}
+		}
+	}()
+}
+
+// activeExpireCycle deletes expired keys found in randomly sampled index buckets
+// of every db with keys.
+// It keeps sampling while more than a quarter of the sampled keys with an expire
+// time are expired, like redis does.
+func (db *DB) activeExpireCycle() {
+	// a running transaction must not see the deletions.
+	db.txMu.RLock()
+	defer db.txMu.RUnlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	start := time.Now()
+
+	for time.Now().Sub(start) < activeExpireTimeLimit {
+		var volatile, expired int
+		now := nowMillis()
+
+		for _, d := range db.dbs {
+			if d.dbMeta().keyCount == 0 {
+				continue
+			}
+
+			var err error
+			check := func(ele *Ele) {
+				if err != nil || ele.expireAt == 0 {
+					return
+				}
+				volatile++
+				if ele.isExpired(now) {
+					err = d.expireEle(ele)
+					expired++
+				}
+			}
+
+			if d.ordered() {
+				// a leaf has as many keys as lots of buckets.
+				d.btreeSample(check)
+			} else {
+				for i := 0; i < activeExpireBucketsPerRound; i++ {
+					ie := d.indexEle(uint64(rand.Int63n(int64(d.indexBuckets()))))
+					for ie.pgid > 0 {
+						ele := d.ele(ie)
+						if !ele.isDeleted() {
+							check(ele)
+						}
+						ie = &ele.next
+					}
+				}
+			}
+			if err != nil {
+				logrus.Errorf("active expire error. %s", err.Error())
+				return
+			}
+		}
+
+		if volatile == 0 || expired*4 <= volatile {
+			return
+		}
+	}
+}
+
+// expireEle deletes an expired ele and logs the deletion so that replaying the
+// wal gives the same result.
+func (db *DB) expireEle(ele *Ele) error {
+	key := append([]byte{}, ele.key()...)
+	ele.delete()
+	db.dbMeta().keyCount--
+	db.touch(key)
+	expiredKeysMetric.Inc()
+
+	return db.persist(encodeCommand("del", string(key)))
+}
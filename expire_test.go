@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_setOptions(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("set", "k1", "v1", "nx")) +
+		string(encodeCommand("set", "k1", "v2", "nx")) +
+		string(encodeCommand("set", "k2", "v2", "xx")) +
+		string(encodeCommand("set", "k1", "v3", "xx", "get")) +
+		string(encodeCommand("set", "k3", "v3", "get")) +
+		string(encodeCommand("set", "k1", "v4", "nx", "xx")) +
+		string(encodeCommand("set", "k1", "v4", "ex", "0")) +
+		string(encodeCommand("set", "k1", "v4", "ex", "abc")) +
+		string(encodeCommand("get", "k1"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n$-1\r\n$-1\r\n$2\r\nv1\r\n$-1\r\n"+
+		"-ERR syntax error\r\n"+
+		"-ERR invalid expire time in 'set' command\r\n"+
+		"-ERR value is not an integer or out of range\r\n"+
+		"$2\r\nv3\r\n", out)
+}
+
+func Test_expire(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("set", "k1", "v1", "ex", "100")) +
+		string(encodeCommand("ttl", "k1")) +
+		string(encodeCommand("set", "k1", "v2", "keepttl")) +
+		string(encodeCommand("ttl", "k1")) +
+		string(encodeCommand("persist", "k1")) +
+		string(encodeCommand("persist", "k1")) +
+		string(encodeCommand("ttl", "k1")) +
+		string(encodeCommand("expire", "k1", "10")) +
+		string(encodeCommand("set", "k1", "v3")) +
+		string(encodeCommand("ttl", "k1")) +
+		string(encodeCommand("ttl", "k2")) +
+		string(encodeCommand("expire", "k2", "10"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n:100\r\n+OK\r\n:100\r\n:1\r\n:0\r\n:-1\r\n:1\r\n+OK\r\n:-1\r\n:-2\r\n:0\r\n", out)
+
+	input = string(encodeCommand("pexpire", "k1", "50")) +
+		string(encodeCommand("get", "k1"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "$2\r\nv3\r\n", strings.TrimPrefix(out, ":1\r\n"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	input = string(encodeCommand("get", "k1")) +
+		string(encodeCommand("pttl", "k1")) +
+		string(encodeCommand("set", "k2", "v2")) +
+		string(encodeCommand("expireat", "k2", "1")) +
+		string(encodeCommand("get", "k2"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "$-1\r\n:-2\r\n+OK\r\n:1\r\n$-1\r\n", out)
+}
+
+func Test_activeExpireCycle(t *testing.T) {
+	db := newTestDB(t)
+	db.serving = true
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		_, _, err := db.SetWithOptions(nil, []byte(key), []byte("v"), setOptions{expireAt: nowMillis() + 10})
+		assert.Nil(t, err)
+	}
+	err := db.SetString(nil, "k4", "v")
+	assert.Nil(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// sample until all keys are visited.
+	for i := 0; i < 10000; i++ {
+		db.activeExpireCycle()
+	}
+	// active expire does not wait for wal.
+	err = db.waitWal(db.walAppended, fsyncNo)
+	assert.Nil(t, err)
+
+	wal, err := ioutil.ReadFile(filepath.Join(db.dataDir, "wal"))
+	assert.Nil(t, err)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		assert.Contains(t, string(wal), string(encodeCommand("del", key)))
+	}
+	assert.NotContains(t, string(wal), string(encodeCommand("del", "k4")))
+
+	v, err := db.GetString("k4")
+	assert.Nil(t, err)
+	assert.Equal(t, "v", v)
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/xumc/miniRedis/queue"
 	"golang.org/x/sys/unix"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -13,6 +16,13 @@ import (
 )
 
 func LoadOrCreateDbFromDir(path string) (*DB, error) {
+	cfg := defaultConfig()
+	cfg.Dir = path
+	return LoadOrCreateDbWithConfig(cfg)
+}
+
+func LoadOrCreateDbWithConfig(cfg *Config) (*DB, error) {
+	path := cfg.Dir
 	dbPath := filepath.Join(path, "db")
 
 	_, err := os.Stat(dbPath)
@@ -47,7 +57,6 @@ func LoadOrCreateDbFromDir(path string) (*DB, error) {
 	dbFileSizeMetric.Set(float64(fstat.Size()))
 
 	logrus.Infof("os page size: %d", os.Getpagesize())
-	logrus.Infof("index page count: %d", indexPageCount)
 
 	dbPath, err = filepath.Abs(f.Name())
 	if err != nil {
@@ -55,28 +64,134 @@ func LoadOrCreateDbFromDir(path string) (*DB, error) {
 	}
 	logrus.Infof("db path: %s", dbPath)
 
-	db := &DB{
-		dataDir: path,
+	st := &store{
+		dataDir:  path,
+		cfg:      cfg,
 		file:     f,
 		data:     m,
 		pageSize: uint64(os.Getpagesize()),
 
-		mu: sync.Mutex{},
+		mu:      sync.Mutex{},
 		serving: false,
+		closing: make(chan struct{}),
+		blocked: queue.New(),
+	}
+	// SELECT is limited by cfg.Databases, but replay may touch any db the file
+	// has, the number may have been larger before.
+	for i := 0; i < maxDatabases; i++ {
+		st.dbs = append(st.dbs, &DB{store: st, num: i})
 	}
+	db := st.dbs[0]
 
-	err = checkRecoverWal(db, path)
+	version := db.page(0).meta().version
+	if version > dbVersion {
+		return nil, fmt.Errorf("unsupported db file version %d, the newest known version is %d", version, dbVersion)
+	}
+
+	// undo log and wal are replayed on the meta page of this version.
+	err = upgradeDbFile(db)
 	if err != nil {
 		return nil, err
 	}
 
+	// the db file must be back to the state before any unfinished transaction
+	// before the wal is replayed on it.
 	err = checkRollbackUndo(db, path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRecoverWal(db, path)
+	if err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// upgradeDbFile converts a db file written by an older version. Files of
+// version 1 have eles without expireAt and files of version 2 have no key
+// count. A file before version 4 has db 0 only, with its index right after
+// the freelist page, the indexes of a file before version 5 are rehashed into
+// growable ones, and the single freelist page of a file before version 6
+// becomes a chain.
+func upgradeDbFile(db *DB) error {
+	meta := db.page(0).meta()
+	version := meta.version
+	if version >= dbVersion {
+		return nil
+	}
+
+	if version < 2 {
+		logrus.Infof("upgrading eles of db file of version %d", version)
+		err := db.upgradeEles()
+		if err != nil {
+			return err
+		}
+
+		// the eles must not be upgraded twice.
+		meta = db.page(0).meta()
+		meta.version = 2
+		err = db.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the freelist is a chain from now on, the pages left out of the full
+	// single page are put back before the indexes take pages from it.
+	err := db.rebuildFreelist()
+	if err != nil {
+		return err
+	}
+	meta = db.page(0).meta()
+
+	if version < 4 {
+		dbm := db.dbMeta()
+		dbm.indexPgid = metaPageCount + freelistPageCount
+		dbm.keyCount = meta.keyCount
+		meta.keyCount = 0
+		meta.checkpointDB = 0
+	}
+
+	for _, d := range db.dbs {
+		if version >= 5 || d.dbMeta().indexPgid == 0 {
+			continue
+		}
+
+		err := d.migrateIndex()
+		if err != nil {
+			return err
+		}
+		if version < 3 {
+			d.dbMeta().keyCount = d.countKeys()
+		}
+		err = d.growIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the file may be remapped by now.
+	meta = db.page(0).meta()
+	logrus.Infof("db file upgraded from version %d to %d, %d keys in db 0", version, dbVersion, db.dbMeta().keyCount)
+	meta.version = dbVersion
+	return nil
+}
+
 func checkRollbackUndo(db *DB, path string) error {
 	undoPath := filepath.Join(path, "undo")
-	undo, err := os.OpenFile(undoPath, os.O_CREATE|os.O_RDONLY, 0644)
+	undo, err := os.OpenFile(undoPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	undoLog, err := ioutil.ReadAll(undo)
+	if err != nil {
+		return err
+	}
+
+	err = db.rollbackUndoLog(undoLog)
 	if err != nil {
 		return err
 	}
@@ -86,6 +201,17 @@ func checkRollbackUndo(db *DB, path string) error {
 		return err
 	}
 
+	// all transactions in undo log are finished now.
+	err = undo.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	err = undo.Close()
+	if err != nil {
+		return err
+	}
+
 	undo, err = os.OpenFile(undoPath, os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -97,7 +223,7 @@ func checkRollbackUndo(db *DB, path string) error {
 
 func checkRecoverWal(db *DB, path string) error {
 	walPath := filepath.Join(path, "wal")
-	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDONLY, 0644)
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
@@ -124,7 +250,8 @@ func checkRecoverWal(db *DB, path string) error {
 			return err
 		}
 
-		cmdhdr := newCommandHandler(wal, devNull, wal)
+		cmdhdr := newCommandHandler(wal, devNull, ioutil.NopCloser(nil))
+		cmdhdr.db = int(meta.checkpointDB)
 
 		var handledBytesLength = checkpoint
 		for handledBytesLength < walStat.Size() {
@@ -145,15 +272,24 @@ func checkRecoverWal(db *DB, path string) error {
 		if err != nil {
 			logrus.Fatalf("reset wal to zero size error. %s", err.Error())
 		}
+		walStat, err = wal.Stat()
+		if err != nil {
+			return err
+		}
 
 		logrus.Infof("recover from wal done")
 	}
+	// the file may be remapped by the commands replayed.
+	meta = db.page(0).meta()
 
 	err = wal.Close()
 	if err != nil {
 		return err
 	}
 
+	if walStat.Size() == 0 {
+		meta.checkpointDB = 0
+	}
 	meta.checkpoint = uint64(walStat.Size())
 	walFileSizeMetric.Set(float64(walStat.Size()))
 	walCheckpointMetric.Set(float64(meta.checkpoint))
@@ -168,6 +304,8 @@ func checkRecoverWal(db *DB, path string) error {
 		return err
 	}
 	db.wal = wal
+	db.walDB = int(meta.checkpointDB)
+	db.initWal(walStat.Size())
 
 	return nil
 }
@@ -178,15 +316,16 @@ func initDbFile(dbPath string) (*DB, error) {
 		panic(err.Error())
 	}
 
-	buf := make([]byte, os.Getpagesize()*(metaPageCount+freelistPageCount+indexPageCount))
+	buf := make([]byte, os.Getpagesize()*(metaPageCount+freelistPageCount))
 
 	p := pageInBuffer(buf[:], 0)
 	p.id = 0
 	p.flags = metaPageFlag
 	p.count = 0
 	meta := p.meta()
-	meta.version = 1
+	meta.version = dbVersion
 	meta.freelistPgid = 1
+	meta.freePages = 1
 
 	p = pageInBuffer(buf[:], 1)
 	p.id = 1
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"math/rand"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The freelist holds the element pages which have room for more eles. It is a
+// chain of freelist pages starting at meta.freelistPgid, the head, to which
+// new ids are appended. A page of the chain after the head is never empty,
+// when the last id of one is removed the page leaves the chain and becomes an
+// empty element page. An element page in the freelist has listedPageFlag set,
+// which tells if it is there without looking for it.
+//
+// A page with less room than pageMinRoom is taken out of the freelist as no
+// ele would fit in it. Compaction puts back the pages which have room again.
+// As the pages in the freelist may have little room left, a few of them are
+// tried for one the new ele fits in before the file grows.
+
+const (
+	// bytes an element page must have left for it to stay in the freelist.
+	pageMinRoom = 64
+	// pages of the freelist looked at for one with room for an ele.
+	freelistPickTries = 8
+)
+
+// freelistCapacity returns the ids a freelist page holds.
+func (db *DB) freelistCapacity() uint64 {
+	return (db.pageSize - uint64(unsafe.Offsetof(page{}.ptr)) - uint64(unsafe.Offsetof(freelist{}.ids))) >> 3
+}
+
+// pageRoom returns the bytes of key and value an ele created in the element
+// page pg can have.
+func (db *DB) pageRoom(pg *page) uint64 {
+	if uint32(pg.count) >= elementsCountInOnePage {
+		return 0
+	}
+	return uint64(pg.overflow)*db.pageSize - uint64(pg.usedSize())
+}
+
+// pageHasRoom tells if an ele could still be created in the element page pg.
+func (db *DB) pageHasRoom(pg *page) bool {
+	return db.pageRoom(pg) >= pageMinRoom
+}
+
+// getUnfullPgid returns a page of the freelist with room for size bytes.
+func (db *DB) getUnfullPgid(size uint64) (uint64, error) {
+	pg := db.page(db.page(0).meta().freelistPgid)
+	fl := pg.freelist()
+
+	// the head is empty when the page after it is full.
+	if pg.count == 0 && fl.next != 0 {
+		pg = db.page(fl.next)
+		fl = pg.freelist()
+	}
+	if pg.count == 0 {
+		return 0, noUnfullPageError
+	}
+
+	for i := 0; i < freelistPickTries; i++ {
+		rand := rand.Intn(int(pg.count))
+
+		pgid := fl.ids[rand]
+		if db.pageRoom(db.page(pgid)) >= size {
+			logrus.Debugf("geted unfull pgid %d, pg.count: %d", pgid, pg.count)
+			return pgid, nil
+		}
+	}
+	return 0, noUnfullPageError
+}
+
+// addUnfullPgid puts the element page pgid in the freelist if it is not there.
+func (db *DB) addUnfullPgid(pgid uint64) error {
+	pg := db.page(pgid)
+	if pg.flags&listedPageFlag != 0 {
+		return nil
+	}
+
+	meta := db.page(0).meta()
+	head := db.page(meta.freelistPgid)
+	if uint64(head.count) >= db.freelistCapacity() {
+		newPgid, ok := db.takeEmptyPage(head)
+		if !ok {
+			var err error
+			newPgid, err = db.allocPages(1)
+			if err != nil {
+				return err
+			}
+		}
+		db.pushFreelistPage(newPgid)
+		// the file may have been remapped.
+		meta = db.page(0).meta()
+		head = db.page(meta.freelistPgid)
+		pg = db.page(pgid)
+	}
+
+	head.freelist().ids[head.count] = pgid
+	head.count++
+	pg.flags |= listedPageFlag
+	meta.freeCount++
+	freeElePagesMetric.Set(float64(meta.freeCount))
+	return nil
+}
+
+// removeFullPgid takes the element page rmPgid out of the freelist.
+func (db *DB) removeFullPgid(rmPgid uint64) {
+	rmPg := db.page(rmPgid)
+	if rmPg.flags&listedPageFlag == 0 {
+		return
+	}
+
+	meta := db.page(0).meta()
+	var prev *page
+	for pgid := meta.freelistPgid; pgid != 0; {
+		pg := db.page(pgid)
+		fl := pg.freelist()
+		for i := 0; i < int(pg.count); i++ {
+			if fl.ids[i] != rmPgid {
+				continue
+			}
+
+			fl.ids[i] = fl.ids[pg.count-1]
+			pg.count--
+			rmPg.flags &^= listedPageFlag
+			meta.freeCount--
+			freeElePagesMetric.Set(float64(meta.freeCount))
+			logrus.Debugf("remove full pgid %d", rmPgid)
+
+			if pg.count == 0 && (prev != nil || fl.next != 0) {
+				db.unlinkFreelistPage(prev, pgid)
+				db.releaseFreelistPage(pgid)
+			}
+			return
+		}
+		prev = pg
+		pgid = fl.next
+	}
+	logrus.Warnf("listed page %d is not in the freelist", rmPgid)
+	rmPg.flags &^= listedPageFlag
+}
+
+// removeFreePgidsFrom removes the pages from pgid on from the freelist.
+func (db *DB) removeFreePgidsFrom(pgid uint64) {
+	meta := db.page(0).meta()
+	var prev *page
+	var emptied []uint64
+	for cur := meta.freelistPgid; cur != 0; {
+		pg := db.page(cur)
+		fl := pg.freelist()
+		next := fl.next
+
+		ids := fl.ids[:0]
+		for _, id := range fl.ids[:pg.count] {
+			if id < pgid {
+				ids = append(ids, id)
+			} else {
+				meta.freeCount--
+			}
+		}
+		pg.count = uint16(len(ids))
+
+		if pg.count == 0 && (prev != nil || next != 0) {
+			db.unlinkFreelistPage(prev, cur)
+			emptied = append(emptied, cur)
+		} else {
+			prev = pg
+		}
+		cur = next
+	}
+	freeElePagesMetric.Set(float64(meta.freeCount))
+
+	for _, pgid := range emptied {
+		db.releaseFreelistPage(pgid)
+	}
+}
+
+// takeEmptyPage takes out of the freelist page pg an empty element page, which
+// the freelist can grow in rather than at the end of the file. The first one in
+// the file is taken, the empty pages at the end are cut off by compaction.
+func (db *DB) takeEmptyPage(pg *page) (uint64, bool) {
+	fl := pg.freelist()
+	at := -1
+	for i := 0; i < int(pg.count); i++ {
+		ele := db.page(fl.ids[i])
+		if ele.count == 0 && ele.overflow == 1 && (at < 0 || fl.ids[i] < fl.ids[at]) {
+			at = i
+		}
+	}
+	if at < 0 {
+		return 0, false
+	}
+
+	pgid := fl.ids[at]
+	fl.ids[at] = fl.ids[pg.count-1]
+	pg.count--
+	db.page(pgid).flags &^= listedPageFlag
+	meta := db.page(0).meta()
+	meta.freeCount--
+	meta.elePageCount--
+	return pgid, true
+}
+
+// pushFreelistPage makes pgid the new empty head of the freelist.
+func (db *DB) pushFreelistPage(pgid uint64) {
+	meta := db.page(0).meta()
+	pg := db.page(pgid)
+	pg.id = int(pgid)
+	pg.flags = freelistPageFlag
+	pg.count = 0
+	pg.overflow = 0
+	pg.freelist().next = meta.freelistPgid
+
+	meta.freelistPgid = pgid
+	meta.freePages++
+	freelistPagesMetric.Set(float64(meta.freePages))
+	logrus.Debugf("freelist grows to %d pages", meta.freePages)
+}
+
+// unlinkFreelistPage takes the empty freelist page pgid, which follows prev or
+// is the head if prev is nil, out of the chain.
+func (db *DB) unlinkFreelistPage(prev *page, pgid uint64) {
+	meta := db.page(0).meta()
+	next := db.page(pgid).freelist().next
+	if prev == nil {
+		meta.freelistPgid = next
+	} else {
+		prev.freelist().next = next
+	}
+	meta.freePages--
+	freelistPagesMetric.Set(float64(meta.freePages))
+}
+
+// releaseFreelistPage makes the freelist page pgid, out of the chain, an
+// empty element page and puts it in the freelist.
+func (db *DB) releaseFreelistPage(pgid uint64) {
+	meta := db.page(0).meta()
+	if uint64(db.page(meta.freelistPgid).count) >= db.freelistCapacity() {
+		// it is the page the freelist needs to grow.
+		db.pushFreelistPage(pgid)
+		return
+	}
+
+	pg := db.page(pgid)
+	pg.flags = elePageFlag
+	pg.count = 0
+	pg.overflow = 1
+	meta.elePageCount++
+	_ = db.addUnfullPgid(pgid)
+}
+
+// rebuildFreelist makes the single freelist page of a file of version 4 the
+// head of a chain, which holds all the element pages with room.
+func (db *DB) rebuildFreelist() error {
+	meta := db.page(0).meta()
+	pg := db.page(meta.freelistPgid)
+	pg.freelist().next = 0
+	pg.count = 0
+	meta.freeCount = 0
+	meta.freePages = 1
+
+	pages := uint64(len(db.data)) / db.pageSize
+	for pgid := uint64(0); pgid < pages; pgid++ {
+		if !db.isElePage(pgid) {
+			continue
+		}
+
+		ele := db.page(pgid)
+		overflow := uint64(ele.overflow)
+		ele.flags &^= listedPageFlag
+		if db.pageHasRoom(ele) {
+			err := db.addUnfullPgid(pgid)
+			if err != nil {
+				return err
+			}
+		}
+		pgid += overflow - 1
+	}
+	// the freelist may have grown at the end of the file.
+	meta = db.page(0).meta()
+	logrus.Infof("freelist rebuilt, %d element pages in %d pages", meta.freeCount, meta.freePages)
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// freelistIds returns the element pages in the chain of freelist pages.
+func freelistIds(db *DB) []uint64 {
+	var ids []uint64
+	for pgid := db.page(0).meta().freelistPgid; pgid != 0; {
+		pg := db.page(pgid)
+		ids = append(ids, pg.freelist().ids[:pg.count]...)
+		pgid = pg.freelist().next
+	}
+	return ids
+}
+
+// unlistedPages returns the element pages with room which are not in the
+// freelist.
+func unlistedPages(db *DB) []uint64 {
+	var ids []uint64
+	pages := uint64(len(db.data)) / db.pageSize
+	for pgid := uint64(0); pgid < pages; pgid++ {
+		if !db.isElePage(pgid) {
+			continue
+		}
+		pg := db.page(pgid)
+		if db.pageHasRoom(pg) && pg.flags&listedPageFlag == 0 {
+			ids = append(ids, pgid)
+		}
+		pgid += uint64(pg.overflow) - 1
+	}
+	return ids
+}
+
+// checkFreelist checks that the freelist holds element pages only, each once,
+// and that the counters of the meta page agree with it.
+func checkFreelist(t *testing.T, db *DB) {
+	listed := make(map[uint64]bool)
+	for _, pgid := range freelistIds(db) {
+		assert.False(t, listed[pgid], pgid)
+		listed[pgid] = true
+		assert.True(t, db.isElePage(pgid), pgid)
+		assert.NotZero(t, db.page(pgid).flags&listedPageFlag, pgid)
+	}
+
+	meta := db.page(0).meta()
+	assert.Equal(t, uint64(len(listed)), meta.freeCount)
+	n := uint64(0)
+	for pgid := meta.freelistPgid; pgid != 0; pgid = db.page(pgid).freelist().next {
+		assert.Equal(t, uint16(freelistPageFlag), db.page(pgid).flags, pgid)
+		n++
+	}
+	assert.Equal(t, n, meta.freePages)
+}
+
+func Test_freelistChain(t *testing.T) {
+	db := newTestDB(t)
+
+	// three values in a page, the pages keep some room.
+	val := strings.Repeat("v", 300)
+	n := 2000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(val)))
+	}
+	meta := db.page(0).meta()
+	assert.Greater(t, meta.freeCount, db.freelistCapacity())
+	assert.Greater(t, meta.freePages, uint64(1))
+	checkFreelist(t, db)
+	assert.Empty(t, unlistedPages(db))
+
+	// the pages of the freelist become empty element pages when it shrinks.
+	chain := make(map[uint64]bool)
+	for pgid := meta.freelistPgid; pgid != 0; pgid = db.page(pgid).freelist().next {
+		chain[pgid] = true
+	}
+	for _, pgid := range freelistIds(db) {
+		db.removeFullPgid(pgid)
+	}
+	assert.Equal(t, uint64(1), meta.freePages)
+	assert.Equal(t, uint64(len(chain)-1), meta.freeCount)
+	for _, pgid := range freelistIds(db) {
+		assert.True(t, chain[pgid], pgid)
+		assert.True(t, db.isElePage(pgid), pgid)
+	}
+
+	// the pages with room go back to it.
+	assert.NotEmpty(t, unlistedPages(db))
+	assert.Nil(t, db.Compact(0))
+	checkFreelist(t, db)
+	assert.Empty(t, unlistedPages(db))
+
+	for i := 0; i < n; i++ {
+		got, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, val, string(got))
+	}
+}
+
+func Test_freelistRemove(t *testing.T) {
+	db := newTestDB(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := db.growPages(0)
+		assert.Nil(t, err)
+	}
+	// the first page of each is listed once an ele is created in it.
+	ids := freelistIds(db)
+	assert.Equal(t, 3*(db.cfg.ElePageIncrementCount-1), len(ids))
+
+	db.removeFullPgid(ids[10])
+	db.removeFullPgid(ids[10])
+	assert.Zero(t, db.page(ids[10]).flags&listedPageFlag)
+	assert.Equal(t, len(ids)-1, len(freelistIds(db)))
+	checkFreelist(t, db)
+
+	assert.Nil(t, db.addUnfullPgid(ids[10]))
+	assert.Nil(t, db.addUnfullPgid(ids[10]))
+	assert.Equal(t, len(ids), len(freelistIds(db)))
+	checkFreelist(t, db)
+
+	// a page without room for the ele is not picked.
+	pgid, err := db.getUnfullPgid(uint64(db.pageSize))
+	assert.Equal(t, noUnfullPageError, err)
+	assert.Zero(t, pgid)
+	pgid, err = db.getUnfullPgid(10)
+	assert.Nil(t, err)
+	assert.NotZero(t, db.page(pgid).flags&listedPageFlag)
+}
+
+func Test_freelistRecoversLeakedPages(t *testing.T) {
+	db := newTestDB(t)
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+	ids := freelistIds(db)
+	for _, pgid := range ids {
+		db.removeFullPgid(pgid)
+	}
+	assert.Empty(t, freelistIds(db))
+
+	// compaction puts them back, even when it rewrites nothing.
+	assert.Nil(t, db.Compact(0))
+	assert.ElementsMatch(t, ids, freelistIds(db))
+	checkFreelist(t, db)
+	assert.Empty(t, unlistedPages(db))
+}
+
+func Test_freelistUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	val := strings.Repeat("v", 300)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(val)))
+	}
+	ids := freelistIds(db)
+	assert.Greater(t, len(ids), 64)
+
+	// a file of version 5, whose single freelist page has the ids at its
+	// start and lost some pages.
+	pages := uint64(len(db.data)) / db.pageSize
+	for pgid := uint64(0); pgid < pages; pgid++ {
+		if db.isElePage(pgid) {
+			db.page(pgid).flags &^= listedPageFlag
+		}
+	}
+	meta := db.page(0).meta()
+	flPg := db.page(meta.freelistPgid)
+	assert.Equal(t, uint64(1), meta.freelistPgid)
+	old := (*[maxAllocSize]uint64)(unsafe.Pointer(&flPg.ptr))
+	copy(old[:64], ids[:64])
+	flPg.count = 64
+	meta.version = 5
+	meta.freeCount = 0
+	meta.freePages = 0
+	assert.Nil(t, db.Close())
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, uint32(dbVersion), db.page(0).meta().version)
+	assert.ElementsMatch(t, ids, freelistIds(db))
+	checkFreelist(t, db)
+	assert.Empty(t, unlistedPages(db))
+
+	got, err := db.Get([]byte("key-499"))
+	assert.Nil(t, err)
+	assert.Equal(t, val, string(got))
+}
+
+func Test_fragStats(t *testing.T) {
+	db := newTestDB(t)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	for i := 0; i < 1000; i += 2 {
+		_, err := db.Delete(nil, []byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+
+	// walked but not rewritten.
+	assert.Nil(t, db.Compact(0))
+	s := db.fragStats
+	assert.NotZero(t, deletedEles(db))
+	assert.NotZero(t, s.elePages)
+	assert.NotZero(t, s.garbageBytes)
+	assert.NotZero(t, s.freeBytes)
+	assert.Less(t, s.freeBytes+s.garbageBytes, s.size)
+	assert.Greater(t, s.ratio(), 0.0)
+	assert.Less(t, s.ratio(), 1.0)
+
+	assert.Nil(t, db.Compact(1))
+	assert.Zero(t, db.fragStats.garbageBytes)
+	// the pages which lost all their eles are counted as empty from now on.
+	emptied := db.fragStats.emptyPages - s.emptyPages
+	emptyRoom := db.pageSize - uint64((&page{}).usedSize())
+	assert.Equal(t, s.size-emptied*db.pageSize, db.fragStats.size)
+	assert.Equal(t, s.freeBytes+s.garbageBytes, db.fragStats.freeBytes+emptied*emptyRoom)
+}
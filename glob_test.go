@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_globMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"wal-*", "wal-max-size", true},
+		{"user:*:name", "user:1:name", true},
+		{"user:*:name", "user:1:age", false},
+		{"[abc", "a", true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.match, globMatch(c.pattern, c.s), "%s %s", c.pattern, c.s)
+	}
+}
+
+func Test_globPrefix(t *testing.T) {
+	cases := []struct {
+		pattern string
+		prefix  string
+	}{
+		{"*", ""},
+		{"user:*", "user:"},
+		{"user:?", "user:"},
+		{"user:[ab]*", "user:"},
+		{"a\\*b*", "a*b"},
+		{"exact", "exact"},
+		{"end\\", "end\\"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.prefix, globPrefix(c.pattern), c.pattern)
+	}
+}
@@ -1,30 +1,60 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
+	"math"
 	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 const (
-	respOK = "+OK\r\n"
-	respError = "-Error \r\n"
+	errSyntax     = "ERR syntax error"
+	errNotInteger = "ERR value is not an integer or out of range"
+
+	serverVersion = "0.1.0"
 )
 
 var (
-	separator = []byte{13,10}
+	separator         = []byte{13, 10}
 	connectionBufSize = 1024
 
-	invalidFormat = fmt.Errorf("invalid int when parse int.\n")
+	clientID uint64 // id of the last connection
 )
+
 type commandHandler struct {
 	io.Reader
 	io.Writer
 	io.Closer
-	stream []byte
+	reader  *bufio.Reader // reads from Reader, created by the first Next
+	out     *bufio.Writer // buffers replies to a connection until flush
+	stream  []byte
+	bufSize int
+
+	id    uint64
+	proto int    // protocol version of replies, RESP2 until HELLO 3
+	name  string // set by HELLO SETNAME
+	db    int    // number of the db selected by SELECT
+
+	// MULTI/EXEC state of the connection
+	inMulti  bool
+	inExec   bool // queued commands are running, blocking commands do not block
+	multiErr bool // a command was rejected while queueing
+	queued   []queuedCmd
+	watched  map[string]uint64 // watched key => version when it was watched
+}
+
+type queuedCmd struct {
+	c         *command
+	originCmd []byte
+	cmd       []string
 }
 
 func newCommandHandler(r io.Reader, w io.Writer, c io.Closer) *commandHandler {
@@ -33,88 +63,35 @@ func newCommandHandler(r io.Reader, w io.Writer, c io.Closer) *commandHandler {
 		Writer: w,
 		Closer: c,
 		stream: make([]byte, 0),
+		id:     atomic.AddUint64(&clientID, 1),
+		proto:  resp2,
 	}
 }
 
-func (crd *commandHandler) Next() ([]byte, []string, error) {
-	var strLinesCount string
-	var totalArgsCount int64 = -1
-	var argLen int64 = -1
-	var result = make([]string, 0)
-
-	var c int
-
-	for {
-		buf := make([]byte, connectionBufSize)
-		n, err := crd.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				if c >= len(crd.stream) {
-					return nil, nil, err
-				}
-			} else {
-				return nil, nil, err
-			}
-		}
-
-		crd.stream = append(crd.stream, buf[:n]...)
-
-		for {
-			p := bytes.Index(crd.stream[c:], separator)
-			if p == -1 {
-				break
-			}
-
-			if crd.stream[c] == '*' && totalArgsCount == -1 {
-				strLinesCount = string(crd.stream[c+1 : (c + p)])
-				var err error
-				totalArgsCount, err = strconv.ParseInt(strLinesCount, 10, 64)
-				if err != nil {
-					logrus.Errorf("invalid lines count %s. %s\n", strLinesCount, err)
-					return nil, nil, invalidFormat
-				}
-			} else if crd.stream[c] == '$' && totalArgsCount != -1 && argLen == -1 {
-					strArgCount := string(crd.stream[c+1 : (c + p)])
-					var err error
-					argLen, err = strconv.ParseInt(strArgCount, 10, 64)
-					if err != nil {
-						logrus.Errorf("invalid lines count %s. %s\n", strLinesCount, err)
-						return nil, nil, invalidFormat
-					}
-			} else {
-				arg := string(crd.stream[c:(c + int(argLen))])
-				result = append(result, arg)
-				argLen = -1
-			}
-
-			c = c + p + len(separator)
-
-			if int64(len(result)) == totalArgsCount {
-				originCmd := crd.stream[:c]
-				crd.stream = crd.stream[c:]
-				return originCmd, result, nil
-			}
-		}
-	}
+func (cmd *commandHandler) WriteString(str string) error {
+	_, err := io.WriteString(cmd.Writer, str)
+	return err
+}
 
-	originCmd := crd.stream[:c]
-	return originCmd, result, nil
+func (cmd *commandHandler) Write(bs []byte) error {
+	_, err := cmd.Writer.Write(bs)
+	return err
 }
 
-func (cmd *commandHandler) WriteString(str string) error {
-	_, err := cmd.Writer.Write([]byte(str))
-	if err != nil {
-		logrus.Fatalf("write str resp to conn error. %s", err.Error())
+// flush writes the buffered replies to the connection, unless more commands of
+// a pipeline are already read and can be replied together.
+func (cmdhdr *commandHandler) flush() error {
+	if cmdhdr.buffered() {
+		return nil
 	}
-	return nil
+	return cmdhdr.flushAll()
 }
 
-func (cmd *commandHandler) Write(bs []byte) error {
-	_, err := cmd.Writer.Write(bs)
-	if err != nil {
-		logrus.Fatalf("write byte resp to conn error. %s", err.Error())
+func (cmdhdr *commandHandler) flushAll() error {
+	if cmdhdr.out == nil {
+		return nil
 	}
-	return nil
+	return cmdhdr.out.Flush()
 }
 
 func handleConn(conn net.Conn, db *DB) {
@@ -122,16 +99,23 @@ func handleConn(conn net.Conn, db *DB) {
 		if r := recover(); r != nil {
 			logrus.Errorf("connection to %s failed due to reason: %s", conn.RemoteAddr().String(), r)
 		}
+		conn.Close()
 		logrus.Infof("connection closed. remote addr: %s", conn.RemoteAddr().String())
 
 		connCounterMetric.Dec()
 	}()
 
-	cmdhdr := newCommandHandler(conn, conn, conn)
+	bufSize := db.connectionBufSize()
+	out := bufio.NewWriterSize(conn, bufSize)
+	cmdhdr := newCommandHandler(conn, out, conn)
+	cmdhdr.bufSize = bufSize
+	cmdhdr.out = out
+	defer cmdhdr.unwatchAll(db)
 
 	err := executeLoop(cmdhdr, db)
 	if err != nil {
-		logrus.Fatalf("excuteLoop error. err: %s", err.Error())
+		// only this connection is closed, the others go on.
+		logrus.Errorf("connection to %s failed. %s", conn.RemoteAddr().String(), err.Error())
 	}
 }
 
@@ -139,19 +123,30 @@ func executeLoop(cmdhdr *commandHandler, db *DB) error {
 	for {
 		originCmd, cmd, err := cmdhdr.Next()
 		err = executeCmd(cmdhdr, db, originCmd, cmd, err)
+		if err == nil {
+			err = cmdhdr.flush()
+		}
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) || isProtocolError(err) {
+				// closed by peer, by server shutdown or after a protocol error.
 				return nil
-			} else {
-				logrus.Fatalf("executeCmd in net executeLoop error. err : %s", err.Error())
 			}
+			return err
 		}
 	}
 }
 
 func executeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string, err error) error {
 	if err != nil {
-		if err == io.EOF {
+		if isProtocolError(err) {
+			logrus.Warnf("close conn due to %s", err.Error())
+			cmdhdr.replyError("ERR " + err.Error())
+			cmdhdr.flushAll()
+			cmdhdr.Closer.Close()
+			return err
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			err = cmdhdr.Closer.Close()
 			if err != nil {
 				logrus.Errorf("close conn error %s\n", err.Error())
@@ -167,48 +162,649 @@ func executeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string,
 	logrus.Debugf("recv cmd: %s", cmd)
 	recvCmdCountMetric.Inc()
 
-	var switchError error
-	switch cmd[0] {
-	case "set":
-		switchError = db.SetString(originCmd, cmd[1], cmd[2])
-		if switchError == nil {
-			cmdhdr.WriteString(respOK)
+	c, errMsg := lookupCommand(cmd)
+	if errMsg != "" {
+		if cmdhdr.inMulti {
+			// EXEC fails as redis does.
+			cmdhdr.multiErr = true
+		}
+		return cmdhdr.replyError(errMsg)
+	}
+
+	db = db.dbs[cmdhdr.db]
+	if c.conn {
+		return c.handler(cmdhdr, db, originCmd, cmd)
+	}
+
+	if cmdhdr.inMulti {
+		cmdhdr.queued = append(cmdhdr.queued, queuedCmd{
+			c:         c,
+			originCmd: append([]byte{}, originCmd...),
+			cmd:       cmd,
+		})
+		return cmdhdr.replySimple("QUEUED")
+	}
+
+	if c.flags&cmdBlocking != 0 {
+		// the replies held back for the rest of a pipeline must not wait for
+		// a command which may block.
+		err := cmdhdr.flushAll()
+		if err != nil {
+			return err
+		}
+	}
+
+	switchError := func() error {
+		if c.flags&cmdBlocking != 0 {
+			// takes db.txMu itself, but not while it is blocked.
+			return c.handler(cmdhdr, db, originCmd, cmd)
+		}
+
+		// a running transaction must not see commands of other connections.
+		db.txMu.RLock()
+		defer db.txMu.RUnlock()
+		return c.handler(cmdhdr, db, originCmd, cmd)
+	}()
+
+	if switchError != nil {
+		if !isCommandError(switchError) {
+			logrus.Errorf("hanlde cmd error. err %s", switchError.Error())
+		}
+		return cmdhdr.replyError(errorMessage(switchError))
+	}
+
+	return nil
+}
+
+// commandError is the error of a command which was refused because of its
+// arguments or the type of its key before it wrote anything. It is only
+// replied, any other error of a command run by EXEC rolls the transaction back.
+type commandError string
+
+func (e commandError) Error() string {
+	return string(e)
+}
+
+func isCommandError(err error) bool {
+	var cmdErr commandError
+	return errors.As(err, &cmdErr)
+}
+
+// errorMessage is the error reply of a command which failed with err.
+func errorMessage(err error) string {
+	if err == WrongTypeError {
+		// the message starts with the error code already.
+		return err.Error()
+	}
+	return "ERR " + err.Error()
+}
+
+func getCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	val, err := db.GetString(cmd[1])
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replyNull()
+		}
+		return err
+	}
+	return cmdhdr.replyBulk(val)
+}
+
+func setCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd) > 3 {
+		return setWithOptionsCmd(cmdhdr, db, cmd)
+	}
+
+	err := db.SetString(originCmd, cmd[1], cmd[2])
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
+
+func delCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	result, err := db.DeleteString(originCmd, cmd[1:]...)
+	if err != nil {
+		return err
+	}
+
+	var deleteCount int64
+	for _, realDel := range result {
+		if realDel {
+			deleteCount++
+		}
+	}
+	return cmdhdr.replyInt(deleteCount)
+}
+
+// splitPairs splits key value pairs of MSET and MSETNX.
+func splitPairs(args []string) (keys, vals [][]byte) {
+	for i := 0; i+1 < len(args); i += 2 {
+		keys = append(keys, []byte(args[i]))
+		vals = append(vals, []byte(args[i+1]))
+	}
+	return keys, vals
+}
+
+func msetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd)%2 == 0 {
+		return cmdhdr.replyError(errWrongArgs("mset"))
+	}
+
+	keys, vals := splitPairs(cmd[1:])
+	err := db.MSet(originCmd, keys, vals)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
+
+func msetnxCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd)%2 == 0 {
+		return cmdhdr.replyError(errWrongArgs("msetnx"))
+	}
+
+	keys, vals := splitPairs(cmd[1:])
+	ok, err := db.MSetNX(keys, vals)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(boolInt(ok))
+}
+
+func setnxCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	_, written, err := db.SetWithOptions(encodeCommand("set", cmd[1], cmd[2]), []byte(cmd[1]), []byte(cmd[2]), setOptions{nx: true})
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(boolInt(written))
+}
+
+func mgetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	keys := make([][]byte, len(cmd)-1)
+	for i, key := range cmd[1:] {
+		keys[i] = []byte(key)
+	}
+
+	vals := db.MGet(keys...)
+	err := cmdhdr.replyArrayLen(len(vals))
+	if err != nil {
+		return err
+	}
+	for _, val := range vals {
+		if val == nil {
+			err = cmdhdr.replyNull()
+		} else {
+			err = cmdhdr.replyBulk(string(val))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func typeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	typ, err := db.Type([]byte(cmd[1]))
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replySimple("none")
+		}
+		return err
+	}
+	return cmdhdr.replySimple(typeNames[typ])
+}
+
+func persistCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	ok, err := db.ClearExpire(originCmd, []byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(boolInt(ok))
+}
+
+// setWithOptionsCmd handles SET key value [NX|XX] [GET] [EX|PX|EXAT|PXAT time|KEEPTTL].
+// Relative expire times are logged to wal as PXAT so that replay is not
+// affected by the time it happens.
+func setWithOptionsCmd(cmdhdr *commandHandler, db *DB, cmd []string) error {
+	var opts setOptions
+	var hasExpire, keep bool
+
+	for i := 3; i < len(cmd); i++ {
+		switch strings.ToLower(cmd[i]) {
+		case "nx":
+			opts.nx = true
+		case "xx":
+			opts.xx = true
+		case "get":
+			opts.get = true
+		case "keepttl":
+			keep = true
+			opts.expireAt = keepTTL
+		case "ex", "px", "exat", "pxat":
+			if hasExpire || i+1 >= len(cmd) {
+				return cmdhdr.replyError(errSyntax)
+			}
+			hasExpire = true
+
+			unit := int64(1)
+			if opt := strings.ToLower(cmd[i]); opt == "ex" || opt == "exat" {
+				unit = 1000
+			}
+			absolute := strings.HasSuffix(strings.ToLower(cmd[i]), "at")
+
+			i++
+			expireAt, errMsg := parseExpireAt(cmd[i], unit, absolute)
+			if errMsg != "" {
+				return cmdhdr.replyError(errMsg)
+			}
+			if n, _ := strconv.ParseInt(cmd[i], 10, 64); n <= 0 {
+				return cmdhdr.replyError("ERR invalid expire time in 'set' command")
+			}
+			opts.expireAt = expireAt
+		default:
+			return cmdhdr.replyError(errSyntax)
+		}
+	}
+
+	if (opts.nx && opts.xx) || (hasExpire && keep) {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	record := []string{"set", cmd[1], cmd[2]}
+	if hasExpire {
+		record = append(record, "pxat", strconv.FormatInt(opts.expireAt, 10))
+	} else if keep {
+		record = append(record, "keepttl")
+	}
+
+	old, written, err := db.SetWithOptions(encodeCommand(record...), []byte(cmd[1]), []byte(cmd[2]), opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.get {
+		if old == nil {
+			return cmdhdr.replyNull()
+		}
+		return cmdhdr.replyBulk(string(old))
+	}
+	if !written {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyOK()
+}
+
+// parseExpireAt converts an expire time argument to unix milliseconds. The
+// returned string is the error message if the argument is invalid.
+func parseExpireAt(arg string, unit int64, absolute bool) (int64, string) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	var base int64
+	if !absolute {
+		base = nowMillis()
+	}
+
+	if n > (math.MaxInt64-base)/unit || n < (math.MinInt64+base)/unit {
+		return 0, "ERR invalid expire time"
+	}
+	return n*unit + base, ""
+}
+
+// expireCmd handles EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. All of them are
+// logged to wal as PEXPIREAT.
+func expireCmd(cmdhdr *commandHandler, db *DB, cmd []string, unit int64, absolute bool) error {
+	expireAt, errMsg := parseExpireAt(cmd[2], unit, absolute)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	record := encodeCommand("pexpireat", cmd[1], strconv.FormatInt(expireAt, 10))
+	ok, err := db.Expire(record, []byte(cmd[1]), expireAt)
+	if err != nil {
+		return err
+	}
+
+	return cmdhdr.replyInt(boolInt(ok))
+}
+
+func ttlCmd(cmdhdr *commandHandler, db *DB, cmd []string, unit int64) error {
+	ttl, err := db.TTL([]byte(cmd[1]))
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replyInt(-2)
 		}
+		return err
+	}
+
+	if ttl > 0 {
+		ttl = (ttl + unit/2) / unit
+	}
+	return cmdhdr.replyInt(ttl)
+}
+
+// configCmd handles CONFIG GET pattern [pattern ...], CONFIG SET name value
+// [name value ...] and CONFIG REWRITE.
+func configCmd(cmdhdr *commandHandler, db *DB, cmd []string) error {
+	if len(cmd) < 2 {
+		return cmdhdr.replyError(errWrongArgs("config"))
+	}
+
+	switch strings.ToLower(cmd[1]) {
 	case "get":
-		val, err := db.GetString(cmd[1])
+		if len(cmd) < 3 {
+			return cmdhdr.replyError(errWrongArgs("config|get"))
+		}
+
+		pairs := db.configGet(cmd[2:]...)
+		err := cmdhdr.replyMapLen(len(pairs))
 		if err != nil {
-			if err == NotFoundError {
-				cmdhdr.WriteString(fmt.Sprintf("$-1\r\n"))
-			} else {
-				switchError = err
+			return err
+		}
+		for _, pair := range pairs {
+			err = cmdhdr.replyBulk(pair[0])
+			if err != nil {
+				return err
 			}
-		} else {
-			cmdhdr.WriteString(fmt.Sprintf("$%d\r\n%s\r\n",len(val), val))
-		}
-	case "del":
-		var result []bool
-		result, switchError := db.DeleteString(originCmd, cmd[1:]...)
-		if switchError == nil {
-			var deleteCount int
-			for _, realDel := range result {
-				if realDel {
-					deleteCount++
-				}
+			err = cmdhdr.replyBulk(pair[1])
+			if err != nil {
+				return err
 			}
-			cmdhdr.Write([]byte(fmt.Sprintf(":%d\r\n", deleteCount)))
+		}
+		return nil
+	case "set":
+		if len(cmd) < 4 || len(cmd)%2 != 0 {
+			return cmdhdr.replyError(errWrongArgs("config|set"))
+		}
+
+		pairs := make([][2]string, 0, (len(cmd)-2)/2)
+		for i := 2; i < len(cmd); i += 2 {
+			pairs = append(pairs, [2]string{cmd[i], cmd[i+1]})
 		}
 
-	default:
-		logrus.Errorf("unsupport cmd %s", cmd[0])
+		err := db.configSet(pairs)
+		if err != nil {
+			return cmdhdr.replyError("ERR " + err.Error())
+		}
+		return cmdhdr.replyOK()
+	case "rewrite":
+		err := db.configRewrite()
+		if err != nil {
+			logrus.Errorf("config rewrite error. %s", err.Error())
+			return cmdhdr.replyError("ERR " + err.Error())
+		}
+		return cmdhdr.replyOK()
 	}
-	if switchError != nil {
-		logrus.Errorf("hanlde cmd error. err %s", switchError.Error())
-		_, err := cmdhdr.Writer.Write([]byte(respError))
+
+	return cmdhdr.replyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", cmd[1]))
+}
+
+// helloCmd handles HELLO [protover [AUTH username password] [SETNAME clientname]].
+// It switches the protocol of the connection and replies the server info.
+func helloCmd(cmdhdr *commandHandler, cmd []string) error {
+	proto := cmdhdr.proto
+	if len(cmd) > 1 {
+		n, err := strconv.ParseInt(cmd[1], 10, 64)
+		if err != nil {
+			return cmdhdr.replyError("ERR Protocol version is not an integer or out of range")
+		}
+		if n != resp2 && n != resp3 {
+			return cmdhdr.replyError("NOPROTO unsupported protocol version")
+		}
+		proto = int(n)
+	}
+
+	name := cmdhdr.name
+	for i := 2; i < len(cmd); i++ {
+		switch strings.ToLower(cmd[i]) {
+		case "auth":
+			if i+2 >= len(cmd) {
+				return cmdhdr.replyError(errSyntax)
+			}
+			// there is no password, only the default user exists.
+			if cmd[i+1] != "default" {
+				return cmdhdr.replyError("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case "setname":
+			if i+1 >= len(cmd) {
+				return cmdhdr.replyError(errSyntax)
+			}
+			if strings.ContainsAny(cmd[i+1], " \n") {
+				return cmdhdr.replyError("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = cmd[i+1]
+			i++
+		default:
+			return cmdhdr.replyError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", cmd[i]))
+		}
+	}
+
+	cmdhdr.proto = proto
+	cmdhdr.name = name
+
+	info := [][2]string{
+		{"server", "redis"},
+		{"version", serverVersion},
+	}
+	err := cmdhdr.replyMapLen(len(info) + 5)
+	if err != nil {
+		return err
+	}
+	for _, kv := range info {
+		err = cmdhdr.replyBulk(kv[0])
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(kv[1])
 		if err != nil {
-			logrus.Errorf("db error. %s\n", err.Error())
 			return err
 		}
 	}
 
-	return nil
-}
\ No newline at end of file
+	err = cmdhdr.replyBulk("proto")
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyInt(int64(proto))
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk("id")
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyInt(int64(cmdhdr.id))
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range [][2]string{{"mode", "standalone"}, {"role", "master"}} {
+		err = cmdhdr.replyBulk(kv[0])
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(kv[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cmdhdr.replyBulk("modules")
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyArrayLen(0)
+}
+
+// pingCmd handles PING [message]. It replies PONG, or message as a bulk string
+// the same as redis does in both protocols.
+func pingCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	switch len(cmd) {
+	case 1:
+		return cmdhdr.replySimple("PONG")
+	case 2:
+		return cmdhdr.replyBulk(cmd[1])
+	}
+	return cmdhdr.replyError(errWrongArgs("ping"))
+}
+
+// quitCmd handles QUIT. The connection is closed after the reply is sent.
+func quitCmd(cmdhdr *commandHandler) error {
+	err := cmdhdr.replyOK()
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.flushAll()
+	if err != nil {
+		return err
+	}
+
+	err = cmdhdr.Closer.Close()
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func errWrongArgs(name string) string {
+	return fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func multiCmd(cmdhdr *commandHandler) error {
+	if cmdhdr.inMulti {
+		return cmdhdr.replyError("ERR MULTI calls can not be nested")
+	}
+
+	cmdhdr.inMulti = true
+	return cmdhdr.replyOK()
+}
+
+func discardCmd(cmdhdr *commandHandler, db *DB) error {
+	if !cmdhdr.inMulti {
+		return cmdhdr.replyError("ERR DISCARD without MULTI")
+	}
+
+	cmdhdr.resetMulti()
+	cmdhdr.unwatchAll(db)
+	return cmdhdr.replyOK()
+}
+
+func watchCmd(cmdhdr *commandHandler, db *DB, keys []string) error {
+	if cmdhdr.inMulti {
+		return cmdhdr.replyError("ERR WATCH inside MULTI is not allowed")
+	}
+
+	if cmdhdr.watched == nil {
+		cmdhdr.watched = make(map[string]uint64)
+	}
+	for _, key := range keys {
+		key = db.dbKey(key)
+		if _, ok := cmdhdr.watched[key]; ok {
+			continue
+		}
+		cmdhdr.watched[key] = db.watch(key)
+	}
+
+	return cmdhdr.replyOK()
+}
+
+// execCmd runs the queued commands in one db transaction. A command refused
+// with a commandError gets it as its reply, any other error rolls back the
+// transaction. The replies are buffered so that nothing but EXECABORT is sent
+// if it rolls back.
+func execCmd(cmdhdr *commandHandler, db *DB) error {
+	if !cmdhdr.inMulti {
+		return cmdhdr.replyError("ERR EXEC without MULTI")
+	}
+
+	queued := cmdhdr.queued
+	watched := cmdhdr.watched
+	multiErr := cmdhdr.multiErr
+	cmdhdr.resetMulti()
+	defer cmdhdr.unwatchAll(db)
+
+	if multiErr {
+		return cmdhdr.replyError("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	var replies bytes.Buffer
+	w := cmdhdr.Writer
+	cmdhdr.Writer = &replies
+
+	var dirty bool
+	cmdhdr.inExec = true
+	err := db.Transaction(func(ctx context.Context, transactionID uint64) error {
+		if !db.checkWatched(watched) {
+			dirty = true
+			return nil
+		}
+
+		for _, q := range queued {
+			// a queued SELECT changes the db of the commands after it.
+			err := q.c.handler(cmdhdr, db.dbs[cmdhdr.db], q.originCmd, q.cmd)
+			if isCommandError(err) {
+				// the command wrote nothing, the others still run as in redis.
+				err = cmdhdr.replyError(errorMessage(err))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	cmdhdr.inExec = false
+	cmdhdr.Writer = w
+
+	if err != nil {
+		logrus.Errorf("transaction discarded. err %s", err.Error())
+		return cmdhdr.replyError("EXECABORT Transaction discarded because of: " + err.Error())
+	}
+
+	if dirty {
+		return cmdhdr.replyNullArray()
+	}
+
+	err = cmdhdr.replyArrayLen(len(queued))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.Write(replies.Bytes())
+}
+
+func (cmdhdr *commandHandler) resetMulti() {
+	cmdhdr.inMulti = false
+	cmdhdr.multiErr = false
+	cmdhdr.queued = nil
+}
+
+func (cmdhdr *commandHandler) unwatchAll(db *DB) {
+	if len(cmdhdr.watched) == 0 {
+		return
+	}
+
+	db.unwatch(cmdhdr.watched)
+	cmdhdr.watched = nil
+}
+
+// encodeCommand encodes args as a RESP array, the format of wal records.
+func encodeCommand(args ...string) []byte {
+	buf := make([]byte, 0, 16*len(args))
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, separator...)
+	}
+	return buf
+}
@@ -2,31 +2,35 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func Test_commandReader(t *testing.T) {
 	cases := []struct {
-		str string
+		str    string
 		expect []string
 	}{
 		{
 			"*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n",
-			[]string{"set","key","value"},
+			[]string{"set", "key", "value"},
 		},
 		{
 			"*2\r\n$3\r\nget\r\n$3\r\nkey\r\n",
-			[]string{"get","key"},
+			[]string{"get", "key"},
 		},
 		{
 			"*3\r\n$3\r\ndel\r\n$2\r\nk1\r\n$2\r\nk2\r\n",
-			[]string{"del","k1","k2"},
+			[]string{"del", "k1", "k2"},
 		},
 		{
 			"*3\r\n$3\r\nset\r\n$4\r\n*key\r\n$6\r\n$value\r\n",
-			[]string{"set","*key","$value"},
+			[]string{"set", "*key", "$value"},
 		},
 	}
 
@@ -58,3 +62,251 @@ func Test_commandReader(t *testing.T) {
 	}
 }
 
+func newTestDB(t *testing.T) *DB {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+// runCommands executes the commands in input on cmdhdr and returns the replies.
+func runCommands(t *testing.T, db *DB, cmdhdr *commandHandler, input string) string {
+	var out bytes.Buffer
+	cmdhdr.Reader = bytes.NewReader([]byte(input))
+	cmdhdr.reader = nil
+	cmdhdr.Writer = &out
+	cmdhdr.Closer = ioutil.NopCloser(nil)
+
+	for {
+		originCmd, cmd, err := cmdhdr.Next()
+		err = executeCmd(cmdhdr, db, originCmd, cmd, err)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+	}
+
+	return out.String()
+}
+
+func Test_multiExec(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "v1")) +
+		string(encodeCommand("get", "k1")) +
+		string(encodeCommand("del", "k1", "k2")) +
+		string(encodeCommand("exec"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n+OK\r\n$2\r\nv1\r\n:1\r\n", out)
+
+	input = string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "v1")) +
+		string(encodeCommand("discard")) +
+		string(encodeCommand("get", "k1"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+OK\r\n$-1\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("exec"))+string(encodeCommand("discard")))
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n-ERR DISCARD without MULTI\r\n", out)
+}
+
+func Test_watch(t *testing.T) {
+	db := newTestDB(t)
+	c1 := newCommandHandler(nil, nil, nil)
+	c2 := newCommandHandler(nil, nil, nil)
+
+	out := runCommands(t, db, c1, string(encodeCommand("watch", "k1")))
+	assert.Equal(t, "+OK\r\n", out)
+
+	out = runCommands(t, db, c2, string(encodeCommand("set", "k1", "other")))
+	assert.Equal(t, "+OK\r\n", out)
+
+	input := string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "mine")) +
+		string(encodeCommand("exec")) +
+		string(encodeCommand("get", "k1"))
+	out = runCommands(t, db, c1, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*-1\r\n$5\r\nother\r\n", out)
+	assert.Empty(t, db.watched)
+
+	// untouched watched key
+	input = string(encodeCommand("watch", "k1")) +
+		string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "mine")) +
+		string(encodeCommand("exec"))
+	out = runCommands(t, db, c1, input)
+	assert.Equal(t, "+OK\r\n+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n", out)
+}
+
+func Test_recoverMultiExec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// the second transaction is cut off before EXEC.
+	wal := string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "v1")) +
+		string(encodeCommand("set", "k2", "v2")) +
+		string(encodeCommand("exec")) +
+		string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k3", "v3"))
+	err = ioutil.WriteFile(filepath.Join(path, "wal"), []byte(wal), 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	rawExecuteCases(t, db, []op{
+		{"G", "k1", "v1"},
+		{"G", "k2", "v2"},
+		{"G", "k3", "not found"},
+	})
+}
+
+func Test_commandErrors(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"foo"}, "-ERR unknown command 'foo', with args beginning with: \r\n"},
+		{[]string{"foo", "a", "b"}, "-ERR unknown command 'foo', with args beginning with: 'a' 'b' \r\n"},
+		{[]string{"set", "k"}, "-ERR wrong number of arguments for 'set' command\r\n"},
+		{[]string{"get"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"get", "k", "k2"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"del"}, "-ERR wrong number of arguments for 'del' command\r\n"},
+		{[]string{"expire", "k"}, "-ERR wrong number of arguments for 'expire' command\r\n"},
+		{[]string{"ttl"}, "-ERR wrong number of arguments for 'ttl' command\r\n"},
+		{[]string{"persist"}, "-ERR wrong number of arguments for 'persist' command\r\n"},
+		{[]string{"config"}, "-ERR wrong number of arguments for 'config' command\r\n"},
+		{[]string{"watch"}, "-ERR wrong number of arguments for 'watch' command\r\n"},
+		{[]string{"multi", "x"}, "-ERR wrong number of arguments for 'multi' command\r\n"},
+		{[]string{"expire", "k", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"set", "k", "v", "foo"}, "-ERR syntax error\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+
+	// the connection is still usable after the errors.
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("set", "k", "v"))+string(encodeCommand("get", "k")))
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", out)
+
+	assert.Equal(t, "WRONGTYPE Operation against a key holding the wrong kind of value", errorMessage(WrongTypeError))
+	assert.Equal(t, "ERR not found", errorMessage(NotFoundError))
+	assert.True(t, isCommandError(WrongTypeError))
+	assert.False(t, isCommandError(NotFoundError))
+}
+
+func Test_multiCommandError(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "v1")) +
+		string(encodeCommand("get")) +
+		string(encodeCommand("exec")) +
+		string(encodeCommand("get", "k1"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n-ERR wrong number of arguments for 'get' command\r\n"+
+		"-EXECABORT Transaction discarded because of previous errors.\r\n$-1\r\n", out)
+
+	// the error does not leak into the next transaction.
+	input = string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "v1")) +
+		string(encodeCommand("exec"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n", out)
+}
+
+func Test_execCommandErrors(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	// a command refused with a commandError gets it as its reply, the
+	// others still run.
+	input := string(encodeCommand("set", "s", "x")) +
+		string(encodeCommand("hset", "h", "f", "x")) +
+		string(encodeCommand("multi")) +
+		string(encodeCommand("set", "k1", "v1")) +
+		string(encodeCommand("hincrby", "h", "f", "1")) +
+		string(encodeCommand("hset", "s", "f", "v")) +
+		string(encodeCommand("set", "k2", "v2")) +
+		string(encodeCommand("exec")) +
+		string(encodeCommand("get", "k1")) +
+		string(encodeCommand("get", "k2"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n:1\r\n+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*4\r\n+OK\r\n"+
+		"-ERR hash value is not an integer\r\n"+
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n+OK\r\n"+
+		"$2\r\nv1\r\n$2\r\nv2\r\n", out)
+
+	// any other error rolls back the whole transaction, even after the
+	// command wrote part of its keys.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("multi"))+string(encodeCommand("set", "k3", "v3")))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n", out)
+	cmdhdr.queued = append(cmdhdr.queued, queuedCmd{
+		c: &command{name: "fail", handler: func(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+			err := db.Set(nil, []byte("k4"), []byte("v4"))
+			assert.Nil(t, err)
+			return errCorruptHash
+		}},
+	})
+	input = string(encodeCommand("exec")) +
+		string(encodeCommand("get", "k3")) +
+		string(encodeCommand("get", "k4"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "-EXECABORT Transaction discarded because of: corrupt hash encoding\r\n"+
+		"$-1\r\n$-1\r\n", out)
+}
+
+func Test_pingEchoQuit(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	out := runCommands(t, db, cmdhdr, "PING\r\n")
+	assert.Equal(t, "+PONG\r\n", out)
+
+	input := string(encodeCommand("ping", "hi")) +
+		string(encodeCommand("ping", "a", "b")) +
+		string(encodeCommand("echo", "hello"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "$2\r\nhi\r\n-ERR wrong number of arguments for 'ping' command\r\n$5\r\nhello\r\n", out)
+
+	// the commands after QUIT are not run.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("quit"))+string(encodeCommand("ping")))
+	assert.Equal(t, "+OK\r\n", out)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func Test_writeError(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(bytes.NewReader(encodeCommand("get", "k")), failingWriter{}, ioutil.NopCloser(nil))
+
+	err := executeLoop(cmdhdr, db)
+	assert.EqualError(t, err, "broken pipe")
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A hash is kept in the value of its ele as a sequence of fields, each one
+// uvarint(len(field)) field uvarint(len(value)) value, in insertion order.
+// Every write decodes the whole hash. When the encoding keeps its size, as
+// when a field gets a value as long as the one before, only the bytes of the
+// changed fields are written, otherwise the hash is written back whole.
+
+var (
+	errHashNotInteger = commandError("hash value is not an integer")
+	errHashNotFloat   = commandError("hash value is not a float")
+	errOverflow       = commandError("increment or decrement would overflow")
+	errNaNOrInf       = commandError("increment would produce NaN or Infinity")
+
+	errCorruptHash = errors.New("corrupt hash encoding")
+)
+
+type hashField struct {
+	field []byte
+	value []byte
+}
+
+func encodeHash(fields []hashField) []byte {
+	size := 0
+	for _, f := range fields {
+		size += 2*binary.MaxVarintLen32 + len(f.field) + len(f.value)
+	}
+
+	buf := make([]byte, 0, size)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, f := range fields {
+		n := binary.PutUvarint(tmp, uint64(len(f.field)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, f.field...)
+		n = binary.PutUvarint(tmp, uint64(len(f.value)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, f.value...)
+	}
+	return buf
+}
+
+// decodeHash returns the fields of an encoded hash. They point into b.
+func decodeHash(b []byte) ([]hashField, error) {
+	fields := make([]hashField, 0)
+	for len(b) > 0 {
+		var f hashField
+		var ok bool
+
+		f.field, b, ok = decodeString(b)
+		if !ok {
+			return nil, errCorruptHash
+		}
+		f.value, b, ok = decodeString(b)
+		if !ok {
+			return nil, errCorruptHash
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// decodeString returns the uvarint length prefixed string at the start of b
+// and the rest of b, ok is false if b is cut short.
+func decodeString(b []byte) (s []byte, rest []byte, ok bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return nil, nil, false
+	}
+	return b[n : n+int(l)], b[n+int(l):], true
+}
+
+func findHashField(fields []hashField, field []byte) int {
+	for i, f := range fields {
+		if string(f.field) == string(field) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readHash returns a copy of the fields of the hash in key, nil if key does
+// not exist. db.mu must be held.
+func (db *DB) readHash(key []byte) ([]hashField, error) {
+	ie, err := db.lookup(key, typeHash)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+
+	fields, err := decodeHash(db.ele(ie).val())
+	if err != nil {
+		return nil, err
+	}
+	for i := range fields {
+		fields[i].field = append([]byte{}, fields[i].field...)
+		fields[i].value = append([]byte{}, fields[i].value...)
+	}
+	return fields, nil
+}
+
+// writeHash replaces the hash in key with fields, the key is removed if there
+// is no field left. db.mu must be held.
+func (db *DB) writeHash(key []byte, fields []hashField) error {
+	if len(fields) == 0 {
+		_, err := db.del(key)
+		return err
+	}
+
+	val := encodeHash(fields)
+	ie, err := db.lookup(key, typeHash)
+	if err != nil {
+		return err
+	}
+	if ie.pgid != 0 && int(db.ele(ie).vSize) == len(val) {
+		return db.patchValue(key, ie, val)
+	}
+	return db.setValue(key, val, typeHash, keepTTL)
+}
+
+// updateHash runs fn on the fields of the hash in key, writes back the fields
+// it returns and logs the wal record it returns. fn returns nil fields if
+// nothing is changed.
+func (db *DB) updateHash(key []byte, fn func(fields []hashField) ([]hashField, []byte, error)) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	fields, err := db.readHash(key)
+	if err != nil {
+		return err
+	}
+
+	fields, record, err := fn(fields)
+	if err != nil || fields == nil {
+		return err
+	}
+
+	err = db.writeHash(key, fields)
+	if err != nil {
+		return err
+	}
+	return db.persist(record)
+}
+
+// HSet sets the fields of the hash in key, fieldVals holds field and value in
+// turn. It returns the number of fields added. Fields are not overwritten if nx
+// is set.
+func (db *DB) HSet(originCmd []byte, key []byte, nx bool, fieldVals ...[]byte) (added int, err error) {
+	err = db.updateHash(key, func(fields []hashField) ([]hashField, []byte, error) {
+		for i := 0; i+1 < len(fieldVals); i += 2 {
+			at := findHashField(fields, fieldVals[i])
+			if at == -1 {
+				fields = append(fields, hashField{field: fieldVals[i], value: fieldVals[i+1]})
+				added++
+			} else if !nx {
+				fields[at].value = fieldVals[i+1]
+			}
+		}
+
+		if nx && added == 0 {
+			return nil, nil, nil
+		}
+		return fields, originCmd, nil
+	})
+	return added, err
+}
+
+// HGet returns the value of field in the hash in key, NotFoundError if the key
+// or the field does not exist.
+func (db *DB) HGet(key, field []byte) ([]byte, error) {
+	vals, err := db.HMGet(key, field)
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] == nil {
+		return nil, NotFoundError
+	}
+	return vals[0], nil
+}
+
+// HMGet returns the values of fields in the hash in key, nil for the missing ones.
+func (db *DB) HMGet(key []byte, fields ...[]byte) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	hash, err := db.readHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make([][]byte, len(fields))
+	for i, field := range fields {
+		if at := findHashField(hash, field); at != -1 {
+			vals[i] = hash[at].value
+		}
+	}
+	return vals, nil
+}
+
+// HGetAll returns all fields of the hash in key, none if key does not exist.
+func (db *DB) HGetAll(key []byte) ([]hashField, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.readHash(key)
+}
+
+// HDel removes fields from the hash in key and returns the number removed.
+func (db *DB) HDel(originCmd []byte, key []byte, fields ...[]byte) (removed int, err error) {
+	err = db.updateHash(key, func(hash []hashField) ([]hashField, []byte, error) {
+		for _, field := range fields {
+			if at := findHashField(hash, field); at != -1 {
+				hash = append(hash[:at], hash[at+1:]...)
+				removed++
+			}
+		}
+
+		if removed == 0 {
+			return nil, nil, nil
+		}
+		if len(hash) == 0 {
+			// an empty non-nil slice removes the key.
+			hash = []hashField{}
+		}
+		return hash, originCmd, nil
+	})
+	return removed, err
+}
+
+// HIncrBy adds delta to the integer in field of the hash in key.
+func (db *DB) HIncrBy(originCmd []byte, key, field []byte, delta int64) (result int64, err error) {
+	err = db.updateHash(key, func(hash []hashField) ([]hashField, []byte, error) {
+		at := findHashField(hash, field)
+
+		var n int64
+		if at != -1 {
+			var err error
+			n, err = strconv.ParseInt(string(hash[at].value), 10, 64)
+			if err != nil {
+				return nil, nil, errHashNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, nil, errOverflow
+		}
+		result = n + delta
+
+		hash = setHashField(hash, at, field, []byte(strconv.FormatInt(result, 10)))
+		return hash, originCmd, nil
+	})
+	return result, err
+}
+
+// HIncrByFloat adds delta to the number in field of the hash in key. It is
+// logged to wal as HSET of the result, so that replay gives the same value.
+func (db *DB) HIncrByFloat(key, field []byte, delta float64) (result string, err error) {
+	err = db.updateHash(key, func(hash []hashField) ([]hashField, []byte, error) {
+		at := findHashField(hash, field)
+
+		var f float64
+		if at != -1 {
+			var err error
+			f, err = strconv.ParseFloat(string(hash[at].value), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, nil, errHashNotFloat
+			}
+		}
+		f += delta
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, nil, errNaNOrInf
+		}
+		result = strconv.FormatFloat(f, 'f', -1, 64)
+
+		hash = setHashField(hash, at, field, []byte(result))
+		return hash, encodeCommand("hset", string(key), string(field), result), nil
+	})
+	return result, err
+}
+
+func setHashField(hash []hashField, at int, field, value []byte) []hashField {
+	if at == -1 {
+		return append(hash, hashField{field: field, value: value})
+	}
+	hash[at].value = value
+	return hash
+}
+
+// parseScanArgs parses cursor [MATCH pattern] [COUNT count] of the SCAN
+// family. It returns an error message if they are invalid.
+func parseScanArgs(args []string) (cursor uint64, pattern string, count int, errMsg string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, "", 0, "ERR invalid cursor"
+	}
+
+	pattern = "*"
+	count = 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, "", 0, errSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return 0, "", 0, errNotInteger
+			}
+			if count < 1 {
+				return 0, "", 0, errSyntax
+			}
+		default:
+			return 0, "", 0, errSyntax
+		}
+	}
+	return cursor, pattern, count, ""
+}
+
+// hsetCmd handles HSET key field value [field value ...] and HMSET, which
+// replies OK instead of the number of fields added.
+func hsetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd)%2 != 0 {
+		return cmdhdr.replyError(errWrongArgs(strings.ToLower(cmd[0])))
+	}
+
+	fieldVals := make([][]byte, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		fieldVals = append(fieldVals, []byte(arg))
+	}
+
+	added, err := db.HSet(originCmd, []byte(cmd[1]), false, fieldVals...)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(cmd[0]) == "hmset" {
+		return cmdhdr.replyOK()
+	}
+	return cmdhdr.replyInt(int64(added))
+}
+
+func hsetnxCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	added, err := db.HSet(originCmd, []byte(cmd[1]), true, []byte(cmd[2]), []byte(cmd[3]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(added))
+}
+
+func hgetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	val, err := db.HGet([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replyNull()
+		}
+		return err
+	}
+	return cmdhdr.replyBulk(string(val))
+}
+
+func hmgetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	fields := make([][]byte, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		fields = append(fields, []byte(arg))
+	}
+
+	vals, err := db.HMGet([]byte(cmd[1]), fields...)
+	if err != nil {
+		return err
+	}
+
+	err = cmdhdr.replyArrayLen(len(vals))
+	if err != nil {
+		return err
+	}
+	for _, val := range vals {
+		if val == nil {
+			err = cmdhdr.replyNull()
+		} else {
+			err = cmdhdr.replyBulk(string(val))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hdelCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	fields := make([][]byte, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		fields = append(fields, []byte(arg))
+	}
+
+	removed, err := db.HDel(originCmd, []byte(cmd[1]), fields...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(removed))
+}
+
+func hlenCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	hash, err := db.HGetAll([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(len(hash)))
+}
+
+func hexistsCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	_, err := db.HGet([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil && err != NotFoundError {
+		return err
+	}
+	return cmdhdr.replyInt(boolInt(err == nil))
+}
+
+func hstrlenCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	val, err := db.HGet([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil && err != NotFoundError {
+		return err
+	}
+	return cmdhdr.replyInt(int64(len(val)))
+}
+
+// hgetallCmd handles HGETALL, HKEYS and HVALS.
+func hgetallCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	hash, err := db.HGetAll([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+
+	name := strings.ToLower(cmd[0])
+	if name == "hgetall" {
+		err = cmdhdr.replyMapLen(len(hash))
+	} else {
+		err = cmdhdr.replyArrayLen(len(hash))
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range hash {
+		if name != "hvals" {
+			err = cmdhdr.replyBulk(string(f.field))
+			if err != nil {
+				return err
+			}
+		}
+		if name != "hkeys" {
+			err = cmdhdr.replyBulk(string(f.value))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hincrbyCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	delta, err := strconv.ParseInt(cmd[3], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	n, err := db.HIncrBy(originCmd, []byte(cmd[1]), []byte(cmd[2]), delta)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(n)
+}
+
+func hincrbyfloatCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	delta, err := strconv.ParseFloat(cmd[3], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return cmdhdr.replyError("ERR value is not a valid float")
+	}
+
+	result, err := db.HIncrByFloat([]byte(cmd[1]), []byte(cmd[2]), delta)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyBulk(result)
+}
+
+// hscanCmd handles HSCAN key cursor [MATCH pattern] [COUNT count]. The cursor
+// is the position of the next field in the hash.
+func hscanCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	cursor, pattern, count, errMsg := parseScanArgs(cmd[2:])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	hash, err := db.HGetAll([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+
+	var found []hashField
+	i := cursor
+	for ; i < uint64(len(hash)) && i < cursor+uint64(count); i++ {
+		if pattern == "*" || globMatch(pattern, string(hash[i].field)) {
+			found = append(found, hash[i])
+		}
+	}
+	if i >= uint64(len(hash)) {
+		i = 0
+	}
+
+	err = cmdhdr.replyArrayLen(2)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk(strconv.FormatUint(i, 10))
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyArrayLen(2 * len(found))
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		err = cmdhdr.replyBulk(string(f.field))
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(string(f.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hashEncoding(t *testing.T) {
+	fields := []hashField{
+		{[]byte("f1"), []byte("v1")},
+		{[]byte(""), []byte("")},
+		{[]byte("f3"), make([]byte, 300)},
+	}
+
+	decoded, err := decodeHash(encodeHash(fields))
+	assert.Nil(t, err)
+	assert.Equal(t, fields, decoded)
+
+	_, err = decodeHash([]byte{5, 'a'})
+	assert.Equal(t, errCorruptHash, err)
+}
+
+func Test_hashCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"hset", "h", "f1", "v1", "f2", "v2"}, ":2\r\n"},
+		{[]string{"hset", "h", "f1", "v11", "f3", "v3"}, ":1\r\n"},
+		{[]string{"hset", "h", "f1"}, "-ERR wrong number of arguments for 'hset' command\r\n"},
+		{[]string{"hmset", "h", "f4", "v4"}, "+OK\r\n"},
+		{[]string{"hsetnx", "h", "f1", "x"}, ":0\r\n"},
+		{[]string{"hget", "h", "f1"}, "$3\r\nv11\r\n"},
+		{[]string{"hget", "h", "nosuch"}, "$-1\r\n"},
+		{[]string{"hget", "nosuch", "f1"}, "$-1\r\n"},
+		{[]string{"hmget", "h", "f2", "nosuch"}, "*2\r\n$2\r\nv2\r\n$-1\r\n"},
+		{[]string{"hlen", "h"}, ":4\r\n"},
+		{[]string{"hexists", "h", "f2"}, ":1\r\n"},
+		{[]string{"hstrlen", "h", "f1"}, ":3\r\n"},
+		{[]string{"hdel", "h", "f2", "f4", "nosuch"}, ":2\r\n"},
+		{[]string{"hgetall", "h"}, "*4\r\n$2\r\nf1\r\n$3\r\nv11\r\n$2\r\nf3\r\n$2\r\nv3\r\n"},
+		{[]string{"hkeys", "h"}, "*2\r\n$2\r\nf1\r\n$2\r\nf3\r\n"},
+		{[]string{"hvals", "h"}, "*2\r\n$3\r\nv11\r\n$2\r\nv3\r\n"},
+		{[]string{"hincrby", "h", "n", "5"}, ":5\r\n"},
+		{[]string{"hincrby", "h", "n", "-7"}, ":-2\r\n"},
+		{[]string{"hincrby", "h", "f1", "1"}, "-ERR hash value is not an integer\r\n"},
+		{[]string{"hincrby", "h", "n", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"hincrby", "h", "n", "-9223372036854775807"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"hincrbyfloat", "h", "n", "2.5"}, "$3\r\n0.5\r\n"},
+		{[]string{"hincrbyfloat", "h", "f1", "1"}, "-ERR hash value is not a float\r\n"},
+		{[]string{"type", "h"}, "+hash\r\n"},
+		{[]string{"type", "nosuch"}, "+none\r\n"},
+		{[]string{"hdel", "h", "f1", "f3", "n"}, ":3\r\n"},
+		{[]string{"type", "h"}, "+none\r\n"},
+		{[]string{"hgetall", "h"}, "*0\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+
+	cmdhdr.proto = resp3
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("hset", "h", "f", "v"))+string(encodeCommand("hgetall", "h")))
+	assert.Equal(t, ":1\r\n%1\r\n$1\r\nf\r\n$1\r\nv\r\n", out)
+}
+
+func Test_hashWrongType(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	input := string(encodeCommand("set", "s", "v")) +
+		string(encodeCommand("hset", "h", "f", "v")) +
+		string(encodeCommand("hget", "s", "f")) +
+		string(encodeCommand("hset", "s", "f", "v")) +
+		string(encodeCommand("get", "h")) +
+		string(encodeCommand("type", "s"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n:1\r\n"+wrongType+wrongType+wrongType+"+string\r\n", out)
+
+	// SET overwrites any type.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("set", "h", "v"))+string(encodeCommand("get", "h")))
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", out)
+
+	// a wrong type in a transaction fails only its command.
+	input = string(encodeCommand("multi")) +
+		string(encodeCommand("hset", "s", "f", "v")) +
+		string(encodeCommand("set", "k", "v")) +
+		string(encodeCommand("exec"))
+	out = runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n"+wrongType+"+OK\r\n", out)
+}
+
+func Test_hashScan(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	runCommands(t, db, cmdhdr, string(encodeCommand("hset", "h", "a1", "1", "b1", "2", "a2", "3")))
+
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("hscan", "h", "0", "count", "2")))
+	assert.Equal(t, "*2\r\n$1\r\n2\r\n*4\r\n$2\r\na1\r\n$1\r\n1\r\n$2\r\nb1\r\n$1\r\n2\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("hscan", "h", "2", "count", "2")))
+	assert.Equal(t, "*2\r\n$1\r\n0\r\n*2\r\n$2\r\na2\r\n$1\r\n3\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("hscan", "h", "0", "match", "a*")))
+	assert.Equal(t, "*2\r\n$1\r\n0\r\n*4\r\n$2\r\na1\r\n$1\r\n1\r\n$2\r\na2\r\n$1\r\n3\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("hscan", "h", "x"))+
+		string(encodeCommand("hscan", "h", "0", "count")))
+	assert.Equal(t, "-ERR invalid cursor\r\n-ERR syntax error\r\n", out)
+}
+
+func Test_recoverHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("hset", "h", "f1", "v1", "f2", "v2")) +
+		string(encodeCommand("hdel", "h", "f2")) +
+		string(encodeCommand("hincrby", "h", "n", "3")) +
+		string(encodeCommand("hincrbyfloat", "h", "x", "0.1"))
+	runCommands(t, db, cmdhdr, input)
+
+	// HINCRBYFLOAT is logged as HSET of its result.
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(wal), string(encodeCommand("hset", "h", "x", "0.1")))
+	assert.NotContains(t, string(wal), "hincrbyfloat")
+
+	// drop the pages so that the hash comes back from wal only.
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	fields, err := db.HGetAll([]byte("h"))
+	assert.Nil(t, err)
+	assert.Equal(t, []hashField{
+		{[]byte("f1"), []byte("v1")},
+		{[]byte("n"), []byte("3")},
+		{[]byte("x"), []byte("0.1")},
+	}, fields)
+}
+
+func Test_hashRollback(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.HSet(nil, []byte("h"), false, []byte("f"), []byte("v"))
+	assert.Nil(t, err)
+
+	err = db.Transaction(func(ctx context.Context, transactionID uint64) error {
+		_, err := db.HSet(nil, []byte("h"), false, []byte("f"), []byte("changed"), []byte("g"), []byte("v"))
+		assert.Nil(t, err)
+		_, err = db.HSet(nil, []byte("h2"), false, []byte("f"), []byte("v"))
+		assert.Nil(t, err)
+		return errors.New("rollback")
+	})
+	assert.NotNil(t, err)
+
+	fields, err := db.HGetAll([]byte("h"))
+	assert.Nil(t, err)
+	assert.Equal(t, []hashField{{[]byte("f"), []byte("v")}}, fields)
+
+	_, err = db.HGet([]byte("h"), []byte("f"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("h"))
+	assert.Equal(t, WrongTypeError, err)
+
+	fields, err = db.HGetAll([]byte("h2"))
+	assert.Nil(t, err)
+	assert.Empty(t, fields)
+}
+
+func Test_hashUpdateInPlace(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.HSet(nil, []byte("h"), false, []byte("f1"), []byte("aaaa"), []byte("f2"), []byte("10"), []byte("f3"), []byte("zzzz"))
+	assert.Nil(t, err)
+	_, ie := db.findIndexEleInChain([]byte("h"))
+	before := *ie
+	used := db.page(ie.pgid).usedSize()
+
+	// values of the same size are written over the old ones.
+	_, err = db.HIncrBy(nil, []byte("h"), []byte("f2"), 5)
+	assert.Nil(t, err)
+	_, err = db.HSet(nil, []byte("h"), false, []byte("f1"), []byte("bbbb"))
+	assert.Nil(t, err)
+	_, ie = db.findIndexEleInChain([]byte("h"))
+	assert.Equal(t, before, *ie)
+	assert.Equal(t, used, db.page(ie.pgid).usedSize())
+
+	err = db.Transaction(func(ctx context.Context, transactionID uint64) error {
+		_, err := db.HSet(nil, []byte("h"), false, []byte("f3"), []byte("yyyy"))
+		assert.Nil(t, err)
+		return errors.New("rollback")
+	})
+	assert.NotNil(t, err)
+
+	_, err = db.HIncrBy(nil, []byte("h"), []byte("f2"), 100)
+	assert.Nil(t, err)
+	fields, err := db.HGetAll([]byte("h"))
+	assert.Nil(t, err)
+	assert.Equal(t, []hashField{
+		{[]byte("f1"), []byte("bbbb")},
+		{[]byte("f2"), []byte("115")},
+		{[]byte("f3"), []byte("zzzz")},
+	}, fields)
+}
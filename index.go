@@ -0,0 +1,304 @@
+package main
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The index of a db is a linear hash table of base<<level+split buckets. It
+// grows by one bucket at a time: whenever there are more keys than buckets,
+// the chain of bucket split is divided between split and split+base<<level by
+// one more bit of the hash. A key is in the bucket given by the low
+// baseBits+level bits of its hash, or one bit more if that bucket is split
+// already. So the chains stay about one key long whatever the number of keys,
+// and no write pays for more than splitting a single chain.
+//
+// The buckets are kept in segments which never move. Segment 0 holds the base
+// buckets and segment i the base<<(i-1) buckets from base<<(i-1) on, so each
+// new segment doubles the table. The first page of the index is its directory,
+// dbMeta.indexPgid points to it.
+
+const (
+	indexDirPageFlag = 0x08
+
+	// a new index has 2^indexBaseBits buckets.
+	indexBaseBits    = 10
+	maxIndexSegments = 40
+
+	// files before version 4 have an index of 2^16 buckets at indexPgid,
+	// picked by the first two bytes of the md5 of the key.
+	legacyIndexBits = 16
+)
+
+type indexDir struct {
+	baseBits uint64
+	level    uint64
+	split    uint64                   // the next bucket to split
+	segments [maxIndexSegments]uint64 // first page of each segment, 0 until it is needed
+}
+
+// hashKey is the 64 bit FNV-1a of key, mixed by the murmur3 finalizer so that
+// the low bits the index uses depend on all of the key.
+func hashKey(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// lowBuckets returns the buckets of the table before this round of splits.
+func (d *indexDir) lowBuckets() uint64 {
+	return 1 << (d.baseBits + d.level)
+}
+
+func (d *indexDir) buckets() uint64 {
+	return d.lowBuckets() + d.split
+}
+
+// bucket returns the bucket of the keys with hash h.
+func (d *indexDir) bucket(h uint64) uint64 {
+	n := d.lowBuckets()
+	b := h & (n - 1)
+	if b < d.split {
+		b = h & (2*n - 1)
+	}
+	return b
+}
+
+// locate returns the segment of bucket b and the position of b in it.
+func (d *indexDir) locate(b uint64) (int, uint64) {
+	if b < 1<<d.baseBits {
+		return 0, b
+	}
+	high := uint64(bits.Len64(b) - 1)
+	return int(high - d.baseBits + 1), b - 1<<high
+}
+
+// indexDir returns the directory of the hash index of db, nil if db has none.
+func (db *DB) indexDir() *indexDir {
+	pgid := db.dbMeta().indexPgid
+	if pgid == 0 || db.page(pgid).flags != indexDirPageFlag {
+		return nil
+	}
+	return db.page(pgid).indexDir()
+}
+
+// indexBuckets returns the number of buckets in the index of db.
+func (db *DB) indexBuckets() uint64 {
+	dir := db.indexDir()
+	if dir == nil {
+		return 0
+	}
+	return dir.buckets()
+}
+
+// indexEle returns the head of the chain in the bucket-th slot of the index.
+func (db *DB) indexEle(bucket uint64) *IndexEle {
+	dir := db.indexDir()
+	if dir == nil {
+		// the db is empty, there is nothing to find.
+		return &IndexEle{}
+	}
+
+	seg, at := dir.locate(bucket)
+	return db.bucketAt(dir.segments[seg], at)
+}
+
+// keyIndexEle returns the head of the chain key is in.
+func (db *DB) keyIndexEle(key []byte) *IndexEle {
+	dir := db.indexDir()
+	if dir == nil {
+		return &IndexEle{}
+	}
+	return db.indexEle(dir.bucket(hashKey(key)))
+}
+
+func (db *DB) bucketAt(pgid, at uint64) *IndexEle {
+	pos := at*uint64(unsafe.Sizeof(IndexEle{})) + pgid*db.pageSize
+	return (*IndexEle)(unsafe.Pointer(&db.data[pos]))
+}
+
+func (db *DB) dbMeta() *dbMeta {
+	return &db.page(0).meta().dbs[db.num]
+}
+
+// segmentPages returns the pages holding n buckets.
+func (db *DB) segmentPages(n uint64) int {
+	size := n * uint64(unsafe.Sizeof(IndexEle{}))
+	return int((size + db.pageSize - 1) / db.pageSize)
+}
+
+// allocPages adds n zeroed pages to the end of the db file and returns the
+// first of them.
+func (db *DB) allocPages(n int) (uint64, error) {
+	fstat, err := db.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	pgid := uint64(fstat.Size()) / db.pageSize
+	err = db.resizeFile(fstat.Size() + int64(n)*int64(db.pageSize))
+	if err != nil {
+		return 0, err
+	}
+	return pgid, nil
+}
+
+// newIndexDir allocates a directory page for an index whose segment 0 of
+// 2^baseBits buckets is at seg0 and points db to it.
+func (db *DB) newIndexDir(baseBits, seg0 uint64) error {
+	pgid, err := db.allocPages(1)
+	if err != nil {
+		return err
+	}
+
+	pg := db.page(pgid)
+	pg.id = int(pgid)
+	pg.flags = indexDirPageFlag
+	dir := pg.indexDir()
+	dir.baseBits = baseBits
+	dir.segments[0] = seg0
+
+	db.dbMeta().indexPgid = pgid
+	return nil
+}
+
+// allocIndex creates the index of db, a B+tree if db is ordered or a hash
+// index with its first segment.
+func (db *DB) allocIndex() error {
+	if db.ordered() {
+		return db.allocBtree()
+	}
+
+	seg0, err := db.allocPages(db.segmentPages(1 << indexBaseBits))
+	if err != nil {
+		return err
+	}
+
+	err = db.newIndexDir(indexBaseBits, seg0)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("index of db %d allocated at page %d", db.num, db.dbMeta().indexPgid)
+	return nil
+}
+
+// indexAdd adds key, which is just created at ie, to the index.
+func (db *DB) indexAdd(key []byte, ie IndexEle) error {
+	if db.ordered() {
+		return db.btreePut(key, ie)
+	}
+	// the chains have it already, they may need more buckets now.
+	return db.growIndex()
+}
+
+// growIndex splits buckets until there are no more keys than buckets.
+func (db *DB) growIndex() error {
+	for db.indexBuckets() < db.dbMeta().keyCount {
+		ok, err := db.splitBucket()
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBucket divides the chain of the bucket split between it and the new
+// bucket split+base<<level. The deleted eles are dropped from the chains on the
+// way. It returns false if the index cannot grow any more.
+func (db *DB) splitBucket() (bool, error) {
+	dir := db.indexDir()
+	n := dir.lowBuckets()
+	seg, _ := dir.locate(dir.split + n)
+	if seg >= maxIndexSegments {
+		return false, nil
+	}
+
+	if dir.segments[seg] == 0 {
+		// the first bucket of the next segment, which is as large as the
+		// table before this round.
+		pgid, err := db.allocPages(db.segmentPages(n))
+		if err != nil {
+			return false, err
+		}
+		dir = db.indexDir()
+		dir.segments[seg] = pgid
+		logrus.Infof("index of db %d grows to %d buckets", db.num, 2*n)
+	}
+
+	from := db.indexEle(dir.split)
+	ie := *from
+	*from = IndexEle{}
+
+	// the eles keep their order in the chain they go to.
+	tails := [2]*IndexEle{from, db.indexEle(dir.split + n)}
+	for ie.pgid > 0 {
+		ele := db.ele(&ie)
+		next := ele.next
+		if !ele.isDeleted() {
+			i := 0
+			if hashKey(ele.key())&n != 0 {
+				i = 1
+			}
+			*tails[i] = ie
+			tails[i] = &ele.next
+		}
+		ie = next
+	}
+	*tails[0] = IndexEle{}
+	*tails[1] = IndexEle{}
+
+	dir.split++
+	if dir.split == n {
+		dir.level++
+		dir.split = 0
+	}
+	return true, nil
+}
+
+// migrateIndex moves the keys of db from the legacy index at indexPgid to an
+// index of this version. The legacy buckets become its segment 0, so only the
+// directory page is added.
+func (db *DB) migrateIndex() error {
+	legacy := db.dbMeta().indexPgid
+
+	var ies []IndexEle
+	for b := uint64(0); b < 1<<legacyIndexBits; b++ {
+		slot := db.bucketAt(legacy, b)
+		ie := *slot
+		for ie.pgid > 0 {
+			ele := db.ele(&ie)
+			if !ele.isDeleted() {
+				ies = append(ies, ie)
+			}
+			ie = ele.next
+		}
+		*slot = IndexEle{}
+	}
+
+	err := db.newIndexDir(legacyIndexBits, legacy)
+	if err != nil {
+		return err
+	}
+
+	dir := db.indexDir()
+	for i := range ies {
+		ele := db.ele(&ies[i])
+		head := db.indexEle(dir.bucket(hashKey(ele.key())))
+		ele.next = *head
+		*head = ies[i]
+	}
+
+	logrus.Infof("index of db %d migrated, %d keys rehashed", db.num, len(ies))
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeLegacyIndex links the keys of db into an index of the files before
+// version 4 at pgid and points db to it.
+func writeLegacyIndex(db *DB, pgid uint64) {
+	var ies []IndexEle
+	for b := uint64(0); b < db.indexBuckets(); b++ {
+		ie := *db.indexEle(b)
+		for ie.pgid > 0 {
+			ele := db.ele(&ie)
+			if !ele.isDeleted() {
+				ies = append(ies, ie)
+			}
+			ie = ele.next
+		}
+	}
+
+	for i := range ies {
+		ele := db.ele(&ies[i])
+		hbs := md5.Sum(ele.key())
+		slot := db.bucketAt(pgid, uint64(binary.BigEndian.Uint16(hbs[:])))
+		ele.next = *slot
+		*slot = ies[i]
+	}
+	db.dbMeta().indexPgid = pgid
+}
+
+func Test_indexLocate(t *testing.T) {
+	d := &indexDir{baseBits: 2}
+
+	cases := []struct {
+		bucket uint64
+		seg    int
+		at     uint64
+	}{
+		{0, 0, 0},
+		{3, 0, 3},
+		{4, 1, 0},
+		{7, 1, 3},
+		{8, 2, 0},
+		{15, 2, 7},
+		{16, 3, 0},
+	}
+	for _, c := range cases {
+		seg, at := d.locate(c.bucket)
+		assert.Equal(t, c.seg, seg, c.bucket)
+		assert.Equal(t, c.at, at, c.bucket)
+	}
+
+	// bucket 1 is split, the keys of 1 and 5 are told apart by bit 2.
+	d.split = 2
+	assert.Equal(t, uint64(6), d.buckets())
+	assert.Equal(t, uint64(5), d.bucket(0x0d))
+	assert.Equal(t, uint64(1), d.bucket(0x09))
+	assert.Equal(t, uint64(2), d.bucket(0x0e))
+	assert.Equal(t, uint64(3), d.bucket(0x0f))
+}
+
+func Test_indexGrows(t *testing.T) {
+	db := newTestDB(t)
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+	// deleted eles are dropped from the chains by the splits.
+	for i := 0; i < n; i += 2 {
+		ok, err := db.Delete(nil, []byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []bool{true}, ok)
+	}
+	for i := n; i < 2*n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+
+	dir := db.indexDir()
+	assert.Equal(t, uint64(indexBaseBits), dir.baseBits)
+	assert.GreaterOrEqual(t, dir.buckets(), uint64(n*3/2))
+	assert.NotZero(t, dir.segments[dir.level])
+
+	for i := 0; i < 2*n; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if i < n && i%2 == 0 {
+			assert.Equal(t, NotFoundError, err, i)
+		} else {
+			assert.Nil(t, err, i)
+		}
+	}
+
+	// every key is in the bucket its hash leads to, and the chains are short.
+	longest := 0
+	for b := uint64(0); b < dir.buckets(); b++ {
+		length := 0
+		db.eachKeyInBucket(b, nowMillis(), func(ele *Ele) {
+			assert.Equal(t, b, dir.bucket(hashKey(ele.key())))
+			length++
+		})
+		if length > longest {
+			longest = length
+		}
+	}
+	assert.Less(t, longest, 16)
+	assert.Equal(t, uint64(n*3/2), db.countKeys())
+}
+
+func Test_scanWhileGrowing(t *testing.T) {
+	db := newTestDB(t)
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+
+	seen := make(map[string]bool)
+	cursor := uint64(0)
+	added := 0
+	for {
+		var keys [][]byte
+		cursor, keys = db.Scan(cursor, scanOptions{pattern: "*", count: 50, typ: -1})
+		for _, key := range keys {
+			seen[string(key)] = true
+		}
+
+		// enough keys between the calls to split many buckets.
+		for i := 0; i < 40; i++ {
+			added++
+			assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("new-%d", added)), []byte("v")))
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Greater(t, db.indexBuckets(), uint64(2*n))
+
+	for i := 0; i < n; i++ {
+		assert.True(t, seen[fmt.Sprintf("key-%d", i)], i)
+	}
+}
+
+func Test_indexMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+		assert.Nil(t, db.dbs[2].Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("two")))
+	}
+	_, err = db.Delete(nil, []byte("key-0"))
+	assert.Nil(t, err)
+
+	// a file of version 4.
+	for _, d := range []*DB{db, db.dbs[2]} {
+		pgid, err := d.allocPages(d.segmentPages(1 << legacyIndexBits))
+		assert.Nil(t, err)
+		writeLegacyIndex(d, pgid)
+	}
+	db.page(0).meta().version = 4
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Equal(t, uint32(dbVersion), db.page(0).meta().version)
+	assert.Equal(t, uint64(legacyIndexBits), db.indexDir().baseBits)
+	assert.Equal(t, int64(99), db.DBSize())
+	assert.Equal(t, int64(100), db.dbs[2].DBSize())
+	for i := 1; i < 100; i++ {
+		val, err := db.dbs[2].Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "two", string(val))
+		_, err = db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get([]byte("key-0"))
+	assert.Equal(t, NotFoundError, err)
+	assert.Nil(t, db.Set(nil, []byte("after"), []byte("v")))
+	assert.Equal(t, int64(100), db.DBSize())
+}
+
+func Test_indexUpgradeFromV1(t *testing.T) {
+	path := openFixtureDir(t, "v1.db.gz")
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+
+	// the md5 index of the first version is rehashed into a growable one.
+	assert.Equal(t, uint32(dbVersion), db.page(0).meta().version)
+	assert.Equal(t, uint64(legacyIndexBits), db.indexDir().baseBits)
+	assert.Equal(t, int64(232), db.DBSize())
+	rawExecuteCases(t, db, v1FixtureCases())
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("new-%d", i)), []byte("v")))
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Equal(t, int64(2232), db.DBSize())
+	rawExecuteCases(t, db, v1FixtureCases())
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("new-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "v", string(val))
+	}
+}
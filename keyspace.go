@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// The keyspace is walked bucket by bucket in the index. A SCAN cursor is the
+// next bucket with its bits reversed, and it is increased from the high bit,
+// like redis does. A key which is in the db for the whole scan is returned at
+// least once even if the index gets more buckets in between: the cursor walks
+// the buckets of the table before the current round of splits, together with
+// the new bucket of each one which is split already.
+//
+// An ordered db is walked in key order instead, and its SCAN cursor is the key
+// to continue from in hex. So a key is returned exactly once however the db
+// changes, and a MATCH pattern starting with a literal prefix only walks the
+// keys with that prefix.
+
+var errNotOrderedDB = commandError("the selected database is not ordered, see ordered-databases")
+
+// scanOptions are the filters of SCAN. typ is -1 for keys of any type.
+type scanOptions struct {
+	pattern string
+	count   int
+	typ     int
+}
+
+// nextScanCursor returns the cursor after cursor for an index of mask+1
+// buckets, 0 when all buckets are walked.
+func nextScanCursor(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// eachKeyInBucket calls fn for the live keys in the chain of bucket.
+func (db *DB) eachKeyInBucket(bucket uint64, now int64, fn func(ele *Ele)) {
+	ie := db.indexEle(bucket)
+	for ie.pgid > 0 {
+		ele := db.ele(ie)
+		if !ele.isDeleted() && !ele.isExpired(now) {
+			fn(ele)
+		}
+		ie = &ele.next
+	}
+}
+
+// eachKey calls fn for the live keys in the db, in key order if the db is
+// ordered. fn must not change the index.
+func (db *DB) eachKey(now int64, fn func(ele *Ele)) {
+	if db.dbMeta().indexPgid == 0 {
+		return
+	}
+
+	if db.ordered() {
+		db.btreeWalk(nil, now, func(ele *Ele) bool {
+			fn(ele)
+			return true
+		})
+		return
+	}
+
+	for b := uint64(0); b < db.indexBuckets(); b++ {
+		db.eachKeyInBucket(b, now, fn)
+	}
+}
+
+// countKeys counts the keys in the db by walking the whole index.
+func (db *DB) countKeys() uint64 {
+	var n uint64
+	db.eachKey(nowMillis(), func(ele *Ele) {
+		n++
+	})
+	return n
+}
+
+// Scan returns the keys in the buckets from cursor on, until about opts.count
+// keys are walked, and the cursor to continue with. The keys of a bucket are
+// never split between two calls.
+func (db *DB) Scan(cursor uint64, opts scanOptions) (uint64, [][]byte) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dbMeta().keyCount == 0 {
+		return 0, nil
+	}
+
+	dir := db.indexDir()
+	mask := dir.lowBuckets() - 1
+	now := nowMillis()
+
+	var keys [][]byte
+	walked := 0
+	visit := func(ele *Ele) {
+		walked++
+		if opts.typ >= 0 && int(ele.typ()) != opts.typ {
+			return
+		}
+		if opts.pattern != "*" && !globMatch(opts.pattern, string(ele.key())) {
+			return
+		}
+		keys = append(keys, append([]byte{}, ele.key()...))
+	}
+
+	// empty buckets are cheap but not free, so a call is bounded by them too.
+	for budget := opts.count * 10; budget > 0; budget-- {
+		// a split bucket has the rest of its keys in its new bucket.
+		b := cursor & mask
+		db.eachKeyInBucket(b, now, visit)
+		if b < dir.split {
+			db.eachKeyInBucket(b+mask+1, now, visit)
+		}
+
+		cursor = nextScanCursor(cursor, mask)
+		if cursor == 0 || walked >= opts.count {
+			break
+		}
+	}
+	return cursor, keys
+}
+
+// ScanOrdered returns the keys of an ordered db from the key from on, until
+// opts.count keys are walked, and the key to continue with, nil when all keys
+// are walked.
+func (db *DB) ScanOrdered(from []byte, opts scanOptions) ([]byte, [][]byte) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dbMeta().indexPgid == 0 || !db.ordered() {
+		return nil, nil
+	}
+
+	prefix := []byte(globPrefix(opts.pattern))
+	if bytes.Compare(from, prefix) < 0 {
+		from = prefix
+	}
+
+	var next []byte
+	var keys [][]byte
+	walked := 0
+	db.btreeWalk(from, nowMillis(), func(ele *Ele) bool {
+		key := ele.key()
+		if !bytes.HasPrefix(key, prefix) {
+			// the keys after it have not the prefix either.
+			return false
+		}
+		if walked == opts.count {
+			next = append([]byte{}, key...)
+			return false
+		}
+
+		walked++
+		if opts.typ >= 0 && int(ele.typ()) != opts.typ {
+			return true
+		}
+		if opts.pattern != "*" && !globMatch(opts.pattern, string(key)) {
+			return true
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	return next, keys
+}
+
+// Ordered tells if db has keys in order, which SCAN and RANGE need to know.
+func (db *DB) Ordered() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.ordered()
+}
+
+// Range returns the keys between min and max in order, skipping the first
+// offset of them and returning at most count, all if count is negative.
+func (db *DB) Range(min, max lexBound, offset, count int64) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.ordered() {
+		return nil, errNotOrderedDB
+	}
+	if db.dbMeta().indexPgid == 0 || count == 0 || min.inf > 0 || max.inf < 0 {
+		return nil, nil
+	}
+
+	var keys [][]byte
+	db.btreeWalk(min.member, nowMillis(), func(ele *Ele) bool {
+		key := ele.key()
+		if !min.aboveMin(key) {
+			return true
+		}
+		if !max.belowMax(key) {
+			return false
+		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+
+		keys = append(keys, append([]byte{}, key...))
+		return count < 0 || int64(len(keys)) < count
+	})
+	return keys, nil
+}
+
+// Keys returns all keys matching the glob pattern, in order if the db is
+// ordered.
+func (db *DB) Keys(pattern string) [][]byte {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var keys [][]byte
+	db.eachKey(nowMillis(), func(ele *Ele) {
+		if pattern == "*" || globMatch(pattern, string(ele.key())) {
+			keys = append(keys, append([]byte{}, ele.key()...))
+		}
+	})
+	return keys
+}
+
+// DBSize returns the number of keys, which is kept in the meta page.
+func (db *DB) DBSize() int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return int64(db.dbMeta().keyCount)
+}
+
+// RandomKey returns a random key, NotFoundError if the db is empty. It starts
+// from a random bucket and takes a random key of the first bucket with keys.
+// An ordered db takes it from a random leaf.
+func (db *DB) RandomKey() ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dbMeta().keyCount == 0 {
+		return nil, NotFoundError
+	}
+
+	now := nowMillis()
+	if db.ordered() {
+		return db.btreeRandomKey(now)
+	}
+
+	n := db.indexBuckets()
+	start := uint64(rand.Int63n(int64(n)))
+	for i := uint64(0); i < n; i++ {
+		var keys [][]byte
+		db.eachKeyInBucket((start+i)%n, now, func(ele *Ele) {
+			keys = append(keys, ele.key())
+		})
+		if len(keys) > 0 {
+			return append([]byte{}, keys[rand.Intn(len(keys))]...), nil
+		}
+	}
+	// only expired keys are left.
+	return nil, NotFoundError
+}
+
+// btreeRandomKey tries a few random leaves, then takes the first key, as the
+// leaves may be empty after their keys are deleted.
+func (db *DB) btreeRandomKey(now int64) ([]byte, error) {
+	for i := 0; i < 8; i++ {
+		var keys [][]byte
+		db.btreeSample(func(ele *Ele) {
+			if !ele.isExpired(now) {
+				keys = append(keys, ele.key())
+			}
+		})
+		if len(keys) > 0 {
+			return append([]byte{}, keys[rand.Intn(len(keys))]...), nil
+		}
+	}
+
+	var key []byte
+	db.btreeWalk(nil, now, func(ele *Ele) bool {
+		key = append([]byte{}, ele.key()...)
+		return false
+	})
+	if key == nil {
+		return nil, NotFoundError
+	}
+	return key, nil
+}
+
+// scanCmd handles SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+func scanCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	opts := scanOptions{typ: -1}
+
+	// TYPE is taken out here, the rest is the same as the other SCANs.
+	args := []string{cmd[1]}
+	for i := 2; i < len(cmd); i += 2 {
+		if strings.ToLower(cmd[i]) != "type" || i+1 >= len(cmd) {
+			args = append(args, cmd[i])
+			if i+1 < len(cmd) {
+				args = append(args, cmd[i+1])
+			}
+			continue
+		}
+
+		opts.typ = -2
+		for typ, name := range typeNames {
+			if strings.EqualFold(name, cmd[i+1]) {
+				opts.typ = int(typ)
+			}
+		}
+		if opts.typ == -2 {
+			return cmdhdr.replyError(fmt.Sprintf("ERR unknown type name '%s'", cmd[i+1]))
+		}
+	}
+
+	ordered := db.Ordered()
+	var from []byte
+	if ordered {
+		// the cursor is a key, the rest of the arguments are checked as usual.
+		var errMsg string
+		from, errMsg = decodeOrderedCursor(args[0])
+		if errMsg != "" {
+			return cmdhdr.replyError(errMsg)
+		}
+		args[0] = "0"
+	}
+
+	cursor, pattern, count, errMsg := parseScanArgs(args)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+	opts.pattern = pattern
+	opts.count = count
+
+	var next string
+	var keys [][]byte
+	if ordered {
+		var key []byte
+		key, keys = db.ScanOrdered(from, opts)
+		next = encodeOrderedCursor(key)
+	} else {
+		var n uint64
+		n, keys = db.Scan(cursor, opts)
+		next = strconv.FormatUint(n, 10)
+	}
+
+	err := cmdhdr.replyArrayLen(2)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk(next)
+	if err != nil {
+		return err
+	}
+	return replyItems(cmdhdr, keys)
+}
+
+// encodeOrderedCursor returns the SCAN cursor of an ordered db which continues
+// from key. Keys are in hex, which has an even length, so "0" is left for the
+// start and the end of the scan.
+func encodeOrderedCursor(key []byte) string {
+	if key == nil {
+		return "0"
+	}
+	return hex.EncodeToString(key)
+}
+
+func decodeOrderedCursor(cursor string) ([]byte, string) {
+	if cursor == "0" {
+		return nil, ""
+	}
+	key, err := hex.DecodeString(cursor)
+	if err != nil {
+		return nil, "ERR invalid cursor"
+	}
+	return key, ""
+}
+
+// rangeCmd handles RANGE min max [LIMIT offset count], which returns the keys
+// of an ordered db between min and max. The bounds are the ones of ZRANGEBYLEX.
+func rangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	min, err := parseLexBound(cmd[1])
+	if err != nil {
+		return cmdhdr.replyError("ERR " + err.Error())
+	}
+	max, err := parseLexBound(cmd[2])
+	if err != nil {
+		return cmdhdr.replyError("ERR " + err.Error())
+	}
+
+	offset, count := int64(0), int64(-1)
+	switch {
+	case len(cmd) == 3:
+	case len(cmd) == 6 && strings.ToLower(cmd[3]) == "limit":
+		var err1, err2 error
+		offset, err1 = strconv.ParseInt(cmd[4], 10, 64)
+		count, err2 = strconv.ParseInt(cmd[5], 10, 64)
+		if err1 != nil || err2 != nil {
+			return cmdhdr.replyError(errNotInteger)
+		}
+		if offset < 0 {
+			return replyItems(cmdhdr, nil)
+		}
+	default:
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	keys, err := db.Range(min, max, offset, count)
+	if err != nil {
+		return err
+	}
+	return replyItems(cmdhdr, keys)
+}
+
+func keysCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	return replyItems(cmdhdr, db.Keys(cmd[1]))
+}
+
+func dbsizeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	return cmdhdr.replyInt(db.DBSize())
+}
+
+func randomkeyCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	key, err := db.RandomKey()
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replyNull()
+		}
+		return err
+	}
+	return cmdhdr.replyBulk(string(key))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nextScanCursor(t *testing.T) {
+	mask := uint64(7)
+	var order []uint64
+	cursor := uint64(0)
+	for {
+		order = append(order, cursor&mask)
+		cursor = nextScanCursor(cursor, mask)
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Equal(t, []uint64{0, 4, 2, 6, 1, 5, 3, 7}, order)
+
+	// a cursor of a smaller index goes on in a larger one without missing
+	// buckets. 6 covers 6 and 14 when the mask becomes 15.
+	var rest []uint64
+	cursor = 6
+	for cursor != 0 {
+		rest = append(rest, cursor&15)
+		cursor = nextScanCursor(cursor, 15)
+	}
+	assert.Equal(t, []uint64{6, 14, 1, 9, 5, 13, 3, 11, 7, 15}, rest)
+}
+
+func Test_keyspaceCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"dbsize"}, ":0\r\n"},
+		{[]string{"randomkey"}, "$-1\r\n"},
+		{[]string{"scan", "0"}, "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{[]string{"set", "one", "1"}, "+OK\r\n"},
+		{[]string{"randomkey"}, "$3\r\none\r\n"},
+		{[]string{"mset", "two", "2", "three", "3"}, "+OK\r\n"},
+		{[]string{"hset", "hash", "f", "v"}, ":1\r\n"},
+		{[]string{"set", "one", "again"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":4\r\n"},
+		{[]string{"keys", "t*"}, ""},
+		{[]string{"del", "two", "nosuch"}, ":1\r\n"},
+		{[]string{"dbsize"}, ":3\r\n"},
+		{[]string{"scan", "0", "count", "100000", "type", "hash"}, "*2\r\n$1\r\n0\r\n*1\r\n$4\r\nhash\r\n"},
+		{[]string{"scan", "0", "count", "100000", "match", "o*"}, "*2\r\n$1\r\n0\r\n*1\r\n$3\r\none\r\n"},
+		{[]string{"scan", "0", "match", "type", "count", "100000"}, "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{[]string{"scan", "0", "type", "nosuch"}, "-ERR unknown type name 'nosuch'\r\n"},
+		{[]string{"scan", "x"}, "-ERR invalid cursor\r\n"},
+		{[]string{"scan", "0", "count"}, "-ERR syntax error\r\n"},
+		{[]string{"set", "tmp", "v", "px", "1"}, "+OK\r\n"},
+		{[]string{"dbsize"}, ":4\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		if c.cmd[0] == "keys" {
+			// the order of KEYS follows the index.
+			assert.Contains(t, []string{"*2\r\n$3\r\ntwo\r\n$5\r\nthree\r\n", "*2\r\n$5\r\nthree\r\n$3\r\ntwo\r\n"}, out)
+			continue
+		}
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_dbsizeCounter(t *testing.T) {
+	db := newTestDB(t)
+
+	assert.Nil(t, db.Set(nil, []byte("k1"), []byte("v")))
+	// a value which does not fit its page any more is moved.
+	assert.Nil(t, db.Set(nil, []byte("k1"), []byte(strings.Repeat("v", 3000))))
+	assert.Nil(t, db.Set(nil, []byte("k2"), []byte("v")))
+	_, _, err := db.SetWithOptions(nil, []byte("k3"), []byte("v"), setOptions{expireAt: nowMillis() - 1})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), db.DBSize())
+
+	// lazily expired.
+	_, err = db.Get([]byte("k3"))
+	assert.Equal(t, NotFoundError, err)
+	assert.Equal(t, int64(2), db.DBSize())
+
+	err = db.Transaction(func(ctx context.Context, txid uint64) error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.set([]byte("k4"), []byte("v"), 0)
+		db.del([]byte("k1"))
+		return errors.New("rollback")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(2), db.DBSize())
+	assert.Equal(t, uint64(2), db.countKeys())
+}
+
+func Test_scanAll(t *testing.T) {
+	db := newTestDB(t)
+
+	n := 500
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	calls := 0
+	for {
+		var keys [][]byte
+		cursor, keys = db.Scan(cursor, scanOptions{pattern: "*", count: 10, typ: -1})
+		calls++
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+
+		// keys written while scanning do not stop the scan.
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("new-%d", calls)), []byte("v")))
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Greater(t, calls, 1)
+
+	for i := 0; i < n; i++ {
+		assert.Equal(t, 1, seen[fmt.Sprintf("key-%d", i)], i)
+	}
+
+	all := db.Keys("key-*")
+	assert.Equal(t, n, len(all))
+	names := make([]string, len(all))
+	for i, key := range all {
+		names[i] = string(key)
+	}
+	sort.Strings(names)
+	assert.Equal(t, "key-0", names[0])
+}
+
+func Test_dbsizeUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	// the index of files before version 3 is right after the freelist page.
+	pgid, err := db.allocPages(db.segmentPages(1 << legacyIndexBits))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(metaPageCount+freelistPageCount), pgid)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte("v")))
+	}
+
+	// a file written before the counter.
+	writeLegacyIndex(db, pgid)
+	meta := db.page(0).meta()
+	meta.version = 2
+	meta.keyCount = 0
+	meta.dbs[0] = dbMeta{}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, int64(10), db.DBSize())
+	assert.Equal(t, uint32(dbVersion), db.page(0).meta().version)
+}
+
+func Test_dbsizeUpgradeFromV1(t *testing.T) {
+	path := openFixtureDir(t, "v1.db.gz")
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(232), db.DBSize())
+	assert.Equal(t, 9, len(db.Keys("small-00?")))
+	assert.Equal(t, []byte("big"), db.Keys("b*")[0])
+
+	assert.Nil(t, db.Set(nil, []byte("new"), []byte("v")))
+	_, err = db.Delete(nil, []byte("small-001"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, int64(232), db.DBSize())
+	assert.Equal(t, uint32(dbVersion), db.page(0).meta().version)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"unsafe"
+)
+
+const (
+	// buckets of the md5 index of version 1 files, which is at the page right
+	// after the freelist page.
+	legacyIndexBucketCount = 1 << legacyIndexBits
+)
+
+// legacyEle is the slot of an ele in db files of version 1, which have no
+// expireAt.
+type legacyEle struct {
+	flags byte
+	next  IndexEle
+	pos   uint32
+	kSize uint32
+	vSize uint32
+}
+
+func (e *legacyEle) key() []byte {
+	bs := (*[maxAllocSize]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(e)) + uintptr(e.pos)))
+	return (*bs)[:e.kSize]
+}
+
+func (e *legacyEle) val() []byte {
+	bs := (*[maxAllocSize]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(e)) + uintptr(e.pos)))
+	return (*bs)[e.kSize:(e.kSize + e.vSize)]
+}
+
+func (e *legacyEle) isDeleted() bool {
+	return e.flags&0x01 == 1
+}
+
+type legacyElements struct {
+	eles [elementsCountInOnePage]legacyEle
+}
+
+type legacyKV struct {
+	key []byte
+	val []byte
+}
+
+func (db *DB) legacyIndexEle(bucket int) *IndexEle {
+	pos := uint64(bucket)*uint64(unsafe.Sizeof(IndexEle{})) + (metaPageCount+freelistPageCount)*db.pageSize
+	return (*IndexEle)(unsafe.Pointer(&db.data[pos]))
+}
+
+func (db *DB) legacyEle(ie *IndexEle) *legacyEle {
+	es := (*legacyElements)(unsafe.Pointer(&db.page(ie.pgid).ptr))
+	return &es.eles[ie.at]
+}
+
+// upgradeEles rewrites the eles of a version 1 file with the current slot
+// layout. The live eles are read into memory chain by chain, all element
+// pages are emptied and the eles are created again in the same buckets.
+func (db *DB) upgradeEles() error {
+	chains := make([][]legacyKV, legacyIndexBucketCount)
+	var eleCount int
+	for bucket := 0; bucket < legacyIndexBucketCount; bucket++ {
+		ie := *db.legacyIndexEle(bucket)
+		for ie.pgid > 0 {
+			ele := db.legacyEle(&ie)
+			if !ele.isDeleted() {
+				chains[bucket] = append(chains[bucket], legacyKV{
+					key: append([]byte{}, ele.key()...),
+					val: append([]byte{}, ele.val()...),
+				})
+				eleCount++
+			}
+			ie = ele.next
+		}
+	}
+
+	// every element page is empty from now on, so all of them are unfull. The
+	// single freelist page of the file is started again as the head of a chain.
+	meta := db.page(0).meta()
+	flPg := db.page(meta.freelistPgid)
+	flPg.freelist().next = 0
+	flPg.count = 0
+	meta.freeCount = 0
+	meta.freePages = 1
+
+	indexPageCount := legacyIndexBucketCount * uint64(unsafe.Sizeof(IndexEle{})) / db.pageSize
+	firstElePgid := metaPageCount + freelistPageCount + indexPageCount
+	endElePgid := firstElePgid + meta.elePageCount
+	for pgid := firstElePgid; pgid < endElePgid; {
+		pg := db.page(pgid)
+		if pg.flags != elePageFlag || uint64(pg.id) != pgid {
+			pgid++
+			continue
+		}
+
+		pg.count = 0
+		overflow := uint64(pg.overflow)
+		err := db.addUnfullPgid(pgid)
+		if err != nil {
+			return err
+		}
+
+		if overflow == 0 {
+			pgid++
+		} else {
+			pgid += overflow
+		}
+	}
+
+	for bucket := 0; bucket < legacyIndexBucketCount; bucket++ {
+		*db.legacyIndexEle(bucket) = IndexEle{}
+	}
+
+	for bucket, chain := range chains {
+		var prev IndexEle
+		for i, kv := range chain {
+			// the file may be remapped by createEle, so the link is written
+			// after it returns.
+			var ie IndexEle
+			var preIe *IndexEle
+			if i > 0 {
+				preIe = &prev
+			}
+			err := db.createEle(kv.key, kv.val, preIe, &ie)
+			if err != nil {
+				return err
+			}
+
+			if i == 0 {
+				*db.legacyIndexEle(bucket) = ie
+			} else {
+				db.ele(&prev).next = ie
+			}
+			prev = ie
+		}
+	}
+
+	logrus.Infof("upgraded %d eles to the slot layout of version %d", eleCount, dbVersion)
+
+	return db.flush()
+}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xumc/miniRedis/queue"
+)
+
+// A list is kept in the value of its ele as a sequence of items, each one
+// uvarint(len(item)) item, from the head to the tail. Every write decodes the
+// whole list and writes it back.
+
+var (
+	errNoSuchKey       = commandError("no such key")
+	errIndexOutOfRange = commandError("index out of range")
+
+	errCorruptList = errors.New("corrupt list encoding")
+)
+
+func encodeList(items [][]byte) []byte {
+	size := 0
+	for _, item := range items {
+		size += binary.MaxVarintLen32 + len(item)
+	}
+
+	buf := make([]byte, 0, size)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, item := range items {
+		n := binary.PutUvarint(tmp, uint64(len(item)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+// decodeList returns the items of an encoded list. They point into b.
+func decodeList(b []byte) ([][]byte, error) {
+	items := make([][]byte, 0)
+	for len(b) > 0 {
+		item, rest, ok := decodeString(b)
+		if !ok {
+			return nil, errCorruptList
+		}
+		items = append(items, item)
+		b = rest
+	}
+	return items, nil
+}
+
+// readList returns a copy of the items of the list in key, nil if key does not
+// exist. db.mu must be held.
+func (db *DB) readList(key []byte) ([][]byte, error) {
+	ie, err := db.lookup(key, typeList)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+
+	items, err := decodeList(db.ele(ie).val())
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i] = append([]byte{}, items[i]...)
+	}
+	return items, nil
+}
+
+// writeList replaces the list in key with items, the key is removed if there
+// is no item left. db.mu must be held.
+func (db *DB) writeList(key []byte, items [][]byte) error {
+	if len(items) == 0 {
+		_, err := db.del(key)
+		return err
+	}
+	return db.setValue(key, encodeList(items), typeList, keepTTL)
+}
+
+// updateList runs fn on the items of the list in key, writes back the items it
+// returns and logs the wal record it returns. fn returns nil items if nothing
+// is changed.
+func (db *DB) updateList(key []byte, fn func(items [][]byte) ([][]byte, []byte, error)) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	items, err := db.readList(key)
+	if err != nil {
+		return err
+	}
+
+	items, record, err := fn(items)
+	if err != nil || items == nil {
+		return err
+	}
+
+	err = db.writeList(key, items)
+	if err != nil {
+		return err
+	}
+	return db.persist(record)
+}
+
+func pushList(items [][]byte, left bool, vals ...[]byte) [][]byte {
+	if !left {
+		return append(items, vals...)
+	}
+
+	pushed := make([][]byte, 0, len(vals)+len(items))
+	for i := len(vals) - 1; i >= 0; i-- {
+		pushed = append(pushed, vals[i])
+	}
+	return append(pushed, items...)
+}
+
+// listRange turns the start and stop indexes of redis, which count from the
+// tail if negative, into the slice bounds of a list of n items.
+func listRange(n int, start, stop int64) (int, int) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= int64(n) {
+		stop = int64(n) - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop) + 1
+}
+
+// listIndex returns the position of index in a list of n items, -1 if it is
+// out of range.
+func listIndex(n int, index int64) int {
+	if index < 0 {
+		index += int64(n)
+	}
+	if index < 0 || index >= int64(n) {
+		return -1
+	}
+	return int(index)
+}
+
+func listSide(left bool) string {
+	if left {
+		return "left"
+	}
+	return "right"
+}
+
+// signalList wakes the readers blocked on key for n pushed items. db.mu must
+// be held.
+func (db *DB) signalList(key []byte, n int) {
+	db.blocked.Signal(db.dbKey(string(key)), n)
+	blockedClientsMetric.Set(float64(db.blocked.Len()))
+}
+
+// Push adds vals to the head of the list in key if left is set, else to the
+// tail, and returns the length of the list. Nothing is pushed to a missing key
+// if exists is set. Readers blocked on key are woken.
+func (db *DB) Push(originCmd []byte, key []byte, left, exists bool, vals ...[]byte) (n int, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	items, err := db.readList(key)
+	if err != nil {
+		return 0, err
+	}
+	if exists && items == nil {
+		return 0, nil
+	}
+
+	items = pushList(items, left, vals...)
+	err = db.writeList(key, items)
+	if err != nil {
+		return 0, err
+	}
+	err = db.persist(originCmd)
+	if err != nil {
+		return 0, err
+	}
+
+	db.signalList(key, len(vals))
+	return len(items), nil
+}
+
+// Pop removes up to count items from the head of the list in key if left is
+// set, else from the tail. It returns nil if key does not exist.
+func (db *DB) Pop(originCmd []byte, key []byte, left bool, count int) (popped [][]byte, err error) {
+	err = db.updateList(key, func(items [][]byte) ([][]byte, []byte, error) {
+		if items == nil {
+			return nil, nil, nil
+		}
+		if count == 0 {
+			popped = [][]byte{}
+			return nil, nil, nil
+		}
+		if count > len(items) {
+			count = len(items)
+		}
+
+		if left {
+			popped = items[:count]
+			items = items[count:]
+		} else {
+			popped = make([][]byte, 0, count)
+			for i := len(items) - 1; i >= len(items)-count; i-- {
+				popped = append(popped, items[i])
+			}
+			items = items[:len(items)-count]
+		}
+
+		if len(items) == 0 {
+			// an empty non-nil slice removes the key.
+			items = [][]byte{}
+		}
+		return items, originCmd, nil
+	})
+	return popped, err
+}
+
+// popFirst pops an item from the first non empty list of keys. It returns nil
+// if all of them are empty. db.mu must be held.
+func (db *DB) popFirst(keys [][]byte, left bool) ([]byte, []byte, error) {
+	for _, key := range keys {
+		items, err := db.readList(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(items) == 0 {
+			continue
+		}
+
+		var val []byte
+		if left {
+			val, items = items[0], items[1:]
+		} else {
+			val, items = items[len(items)-1], items[:len(items)-1]
+		}
+
+		err = db.writeList(key, items)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := "rpop"
+		if left {
+			name = "lpop"
+		}
+		err = db.persist(encodeCommand(name, string(key)))
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, val, nil
+	}
+	return nil, nil, nil
+}
+
+// move pops an item from src and pushes it to dst, it returns nil if src is
+// empty. db.mu must be held.
+func (db *DB) move(src, dst []byte, srcLeft, dstLeft bool) ([]byte, error) {
+	// dst must be checked first, nothing is popped if it is of another type.
+	_, err := db.lookup(dst, typeList)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := db.readList(src)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	var val []byte
+	if srcLeft {
+		val, items = items[0], items[1:]
+	} else {
+		val, items = items[len(items)-1], items[:len(items)-1]
+	}
+	err = db.writeList(src, items)
+	if err != nil {
+		return nil, err
+	}
+
+	// read after the write as src and dst may be the same list.
+	items, err = db.readList(dst)
+	if err != nil {
+		return nil, err
+	}
+	err = db.writeList(dst, pushList(items, dstLeft, val))
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.persist(encodeCommand("lmove", string(src), string(dst), listSide(srcLeft), listSide(dstLeft)))
+	if err != nil {
+		return nil, err
+	}
+
+	db.signalList(dst, 1)
+	return val, nil
+}
+
+// PopFirst pops an item from the first non empty list of keys and returns its
+// key and the item. It returns nil if all of them are empty.
+func (db *DB) PopFirst(keys [][]byte, left bool) (key, val []byte, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	return db.popFirst(keys, left)
+}
+
+// Move pops an item from src and pushes it to dst. It returns nil if src is
+// empty.
+func (db *DB) Move(src, dst []byte, srcLeft, dstLeft bool) (val []byte, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	return db.move(src, dst, srcLeft, dstLeft)
+}
+
+// BlockingPopFirst is PopFirst which waits up to timeout for an item to be
+// pushed if all the lists are empty, 0 waits for ever. It returns nil if none
+// is pushed in time.
+func (db *DB) BlockingPopFirst(keys [][]byte, left bool, timeout time.Duration) (key, val []byte, err error) {
+	err = db.block(keys, timeout, func() ([]byte, error) {
+		var err error
+		key, val, err = db.popFirst(keys, left)
+		return key, err
+	})
+	return key, val, err
+}
+
+// BlockingMove is Move which waits up to timeout for an item to be pushed to
+// src if it is empty, 0 waits for ever. It returns nil if none is pushed in
+// time.
+func (db *DB) BlockingMove(src, dst []byte, srcLeft, dstLeft bool, timeout time.Duration) (val []byte, err error) {
+	err = db.block([][]byte{src}, timeout, func() ([]byte, error) {
+		var err error
+		val, err = db.move(src, dst, srcLeft, dstLeft)
+		if val == nil {
+			return nil, err
+		}
+		return src, err
+	})
+	return val, err
+}
+
+// block runs try until it takes an item, the connection is parked on keys
+// between the runs until one of them is pushed to. It gives up when timeout
+// passes, 0 means no timeout, or the db is closed. A negative timeout runs try
+// once without waiting. try runs with db.mu held and returns the key it took an
+// item from, nil if there is none yet.
+//
+// A blocked connection does not hold db.txMu, so transactions of other
+// connections can push to the keys. It must not be called inside a
+// transaction.
+func (db *DB) block(keys [][]byte, timeout time.Duration, try func() ([]byte, error)) error {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	skeys := make([]string, len(keys))
+	for i, key := range keys {
+		skeys[i] = db.dbKey(string(key))
+	}
+
+	var woken string
+	for {
+		w, done, err := db.tryOrWait(skeys, woken, try, timeout >= 0)
+		if err != nil || done || w == nil {
+			return err
+		}
+
+		select {
+		case woken = <-w.C:
+			continue
+		case <-deadline:
+		case <-db.closing:
+		}
+
+		if db.blocked.Cancel(w) {
+			blockedClientsMetric.Set(float64(db.blocked.Len()))
+			return nil
+		}
+		// woken at the same time, the pushed item must not be left to no one.
+		_, _, err = db.tryOrWait(skeys, <-w.C, try, false)
+		return err
+	}
+}
+
+// tryOrWait runs try and parks the connection on keys if try took nothing and
+// wait is set. Both are under db.mu, so no push is missed in between. woken is
+// the key the connection was woken for, if try took an item of another key the
+// wakeup is passed on to the next connection blocked on woken.
+func (db *DB) tryOrWait(keys []string, woken string, try func() ([]byte, error), wait bool) (w *queue.Waiter, done bool, err error) {
+	db.txMu.RLock()
+	defer db.txMu.RUnlock()
+
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	taken, err := try()
+	done = taken != nil
+	if done && woken != "" && db.dbKey(string(taken)) != woken {
+		key := []byte(strings.TrimPrefix(woken, db.dbKey("")))
+		ie, lerr := db.lookup(key, typeList)
+		if lerr == nil && ie.pgid != 0 {
+			db.signalList(key, 1)
+		}
+	}
+	if err != nil || done || !wait {
+		return nil, done, err
+	}
+
+	w = db.blocked.Wait(keys...)
+	blockedClientsMetric.Set(float64(db.blocked.Len()))
+	return w, false, nil
+}
+
+// LLen returns the length of the list in key, 0 if key does not exist.
+func (db *DB) LLen(key []byte) (int, error) {
+	items, err := db.LRange(key, 0, -1)
+	return len(items), err
+}
+
+// LRange returns the items of the list in key from start to stop, both
+// included. Negative indexes count from the tail, -1 is the last item.
+func (db *DB) LRange(key []byte, start, stop int64) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	items, err := db.readList(key)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to := listRange(len(items), start, stop)
+	return items[from:to], nil
+}
+
+// LIndex returns the item at index of the list in key, NotFoundError if it is
+// out of range.
+func (db *DB) LIndex(key []byte, index int64) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	items, err := db.readList(key)
+	if err != nil {
+		return nil, err
+	}
+
+	at := listIndex(len(items), index)
+	if at == -1 {
+		return nil, NotFoundError
+	}
+	return items[at], nil
+}
+
+// LSet replaces the item at index of the list in key.
+func (db *DB) LSet(originCmd []byte, key []byte, index int64, val []byte) error {
+	return db.updateList(key, func(items [][]byte) ([][]byte, []byte, error) {
+		if items == nil {
+			return nil, nil, errNoSuchKey
+		}
+
+		at := listIndex(len(items), index)
+		if at == -1 {
+			return nil, nil, errIndexOutOfRange
+		}
+		items[at] = val
+		return items, originCmd, nil
+	})
+}
+
+// LInsert inserts val before or after the first pivot in the list in key and
+// returns the length of the list. It returns -1 if pivot is not found and 0 if
+// key does not exist.
+func (db *DB) LInsert(originCmd []byte, key []byte, before bool, pivot, val []byte) (n int, err error) {
+	err = db.updateList(key, func(items [][]byte) ([][]byte, []byte, error) {
+		if items == nil {
+			return nil, nil, nil
+		}
+
+		n = -1
+		for i, item := range items {
+			if string(item) != string(pivot) {
+				continue
+			}
+
+			at := i
+			if !before {
+				at++
+			}
+			items = append(items, nil)
+			copy(items[at+1:], items[at:])
+			items[at] = val
+
+			n = len(items)
+			return items, originCmd, nil
+		}
+		return nil, nil, nil
+	})
+	return n, err
+}
+
+// LRem removes the first count items equal to val from the list in key, the
+// last ones if count is negative and all of them if it is 0. It returns the
+// number removed.
+func (db *DB) LRem(originCmd []byte, key []byte, count int64, val []byte) (removed int, err error) {
+	err = db.updateList(key, func(items [][]byte) ([][]byte, []byte, error) {
+		limit := count
+		if limit < 0 {
+			limit = -limit
+		}
+
+		kept := make([][]byte, len(items))
+		k := len(items)
+		if count >= 0 {
+			k = 0
+		}
+		for i := range items {
+			at := i
+			if count < 0 {
+				at = len(items) - 1 - i
+			}
+
+			if string(items[at]) == string(val) && (limit == 0 || int64(removed) < limit) {
+				removed++
+				continue
+			}
+			if count >= 0 {
+				kept[k] = items[at]
+				k++
+			} else {
+				k--
+				kept[k] = items[at]
+			}
+		}
+
+		if removed == 0 {
+			return nil, nil, nil
+		}
+		if count >= 0 {
+			return kept[:k], originCmd, nil
+		}
+		return kept[k:], originCmd, nil
+	})
+	return removed, err
+}
+
+// LTrim keeps the items of the list in key from start to stop only.
+func (db *DB) LTrim(originCmd []byte, key []byte, start, stop int64) error {
+	return db.updateList(key, func(items [][]byte) ([][]byte, []byte, error) {
+		if items == nil {
+			return nil, nil, nil
+		}
+
+		from, to := listRange(len(items), start, stop)
+		if to-from == len(items) {
+			return nil, nil, nil
+		}
+		return append([][]byte{}, items[from:to]...), originCmd, nil
+	})
+}
+
+// parseTimeout parses the timeout of the blocking commands in seconds.
+func parseTimeout(s string) (time.Duration, string) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, "ERR timeout is not a float or out of range"
+	}
+	if f < 0 {
+		return 0, "ERR timeout is negative"
+	}
+	return time.Duration(f * float64(time.Second)), ""
+}
+
+// parseListSide parses the LEFT or RIGHT of LMOVE and BLMOVE.
+func parseListSide(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "left":
+		return true, true
+	case "right":
+		return false, true
+	}
+	return false, false
+}
+
+func replyItems(cmdhdr *commandHandler, items [][]byte) error {
+	err := cmdhdr.replyArrayLen(len(items))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		err = cmdhdr.replyBulk(string(item))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushCmd handles LPUSH, RPUSH, LPUSHX and RPUSHX.
+func pushCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	name := strings.ToLower(cmd[0])
+
+	vals := make([][]byte, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		vals = append(vals, []byte(arg))
+	}
+
+	n, err := db.Push(originCmd, []byte(cmd[1]), name[0] == 'l', strings.HasSuffix(name, "x"), vals...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+// popCmd handles LPOP and RPOP key [count]. The reply is an item without
+// count and an array of items with it.
+func popCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd) > 3 {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	count := int64(1)
+	if len(cmd) == 3 {
+		var err error
+		count, err = strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil || count < 0 {
+			return cmdhdr.replyError("ERR value is out of range, must be positive")
+		}
+		if count > math.MaxInt32 {
+			count = math.MaxInt32
+		}
+	}
+
+	left := strings.ToLower(cmd[0]) == "lpop"
+	items, err := db.Pop(originCmd, []byte(cmd[1]), left, int(count))
+	if err != nil {
+		return err
+	}
+
+	if len(cmd) == 3 {
+		if items == nil {
+			return cmdhdr.replyNullArray()
+		}
+		return replyItems(cmdhdr, items)
+	}
+	if len(items) == 0 {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyBulk(string(items[0]))
+}
+
+func llenCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	n, err := db.LLen([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func lrangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	start, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+	stop, err := strconv.ParseInt(cmd[3], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	items, err := db.LRange([]byte(cmd[1]), start, stop)
+	if err != nil {
+		return err
+	}
+	return replyItems(cmdhdr, items)
+}
+
+func lindexCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	index, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	item, err := db.LIndex([]byte(cmd[1]), index)
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replyNull()
+		}
+		return err
+	}
+	return cmdhdr.replyBulk(string(item))
+}
+
+func lsetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	index, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	err = db.LSet(originCmd, []byte(cmd[1]), index, []byte(cmd[3]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
+
+// linsertCmd handles LINSERT key BEFORE|AFTER pivot element.
+func linsertCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	var before bool
+	switch strings.ToLower(cmd[2]) {
+	case "before":
+		before = true
+	case "after":
+	default:
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	n, err := db.LInsert(originCmd, []byte(cmd[1]), before, []byte(cmd[3]), []byte(cmd[4]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func lremCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	count, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	removed, err := db.LRem(originCmd, []byte(cmd[1]), count, []byte(cmd[3]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(removed))
+}
+
+func ltrimCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	start, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+	stop, err := strconv.ParseInt(cmd[3], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	err = db.LTrim(originCmd, []byte(cmd[1]), start, stop)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyOK()
+}
+
+// moveCmd handles LMOVE source destination LEFT|RIGHT LEFT|RIGHT and
+// RPOPLPUSH source destination, and their blocking BLMOVE and BRPOPLPUSH with
+// a timeout at the end.
+func moveCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	name := strings.ToLower(cmd[0])
+
+	srcLeft, dstLeft := false, true
+	if strings.HasSuffix(name, "lmove") {
+		var ok1, ok2 bool
+		srcLeft, ok1 = parseListSide(cmd[3])
+		dstLeft, ok2 = parseListSide(cmd[4])
+		if !ok1 || !ok2 {
+			return cmdhdr.replyError(errSyntax)
+		}
+	}
+
+	var val []byte
+	var err error
+	if name[0] == 'b' && !cmdhdr.inExec {
+		timeout, errMsg := parseTimeout(cmd[len(cmd)-1])
+		if errMsg != "" {
+			return cmdhdr.replyError(errMsg)
+		}
+		val, err = db.BlockingMove([]byte(cmd[1]), []byte(cmd[2]), srcLeft, dstLeft, timeout)
+	} else {
+		// blocking commands do not block inside EXEC, the same as redis.
+		val, err = db.Move([]byte(cmd[1]), []byte(cmd[2]), srcLeft, dstLeft)
+	}
+	if err != nil {
+		return err
+	}
+
+	if val == nil {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyBulk(string(val))
+}
+
+// bpopCmd handles BLPOP and BRPOP key [key ...] timeout. It replies the key
+// and the item popped, a null array if none is pushed in time.
+func bpopCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	timeout, errMsg := parseTimeout(cmd[len(cmd)-1])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	keys := make([][]byte, 0, len(cmd)-2)
+	for _, arg := range cmd[1 : len(cmd)-1] {
+		keys = append(keys, []byte(arg))
+	}
+
+	left := strings.ToLower(cmd[0]) == "blpop"
+	var key, val []byte
+	var err error
+	if cmdhdr.inExec {
+		key, val, err = db.PopFirst(keys, left)
+	} else {
+		key, val, err = db.BlockingPopFirst(keys, left, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return cmdhdr.replyNullArray()
+	}
+	return replyItems(cmdhdr, [][]byte{key, val})
+}
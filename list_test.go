@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_listCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"rpushx", "l", "a"}, ":0\r\n"},
+		{[]string{"rpush", "l", "a", "b"}, ":2\r\n"},
+		{[]string{"lpush", "l", "y", "z"}, ":4\r\n"},
+		{[]string{"lpushx", "l", "x"}, ":5\r\n"},
+		{[]string{"lrange", "l", "0", "-1"}, "*5\r\n$1\r\nx\r\n$1\r\nz\r\n$1\r\ny\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"lrange", "l", "-2", "100"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"lrange", "l", "3", "1"}, "*0\r\n"},
+		{[]string{"llen", "l"}, ":5\r\n"},
+		{[]string{"lindex", "l", "-1"}, "$1\r\nb\r\n"},
+		{[]string{"lindex", "l", "5"}, "$-1\r\n"},
+		{[]string{"lset", "l", "1", "Z"}, "+OK\r\n"},
+		{[]string{"lset", "l", "9", "Z"}, "-ERR index out of range\r\n"},
+		{[]string{"lset", "nosuch", "0", "Z"}, "-ERR no such key\r\n"},
+		{[]string{"linsert", "l", "before", "a", "b"}, ":6\r\n"},
+		{[]string{"linsert", "l", "after", "nosuch", "b"}, ":-1\r\n"},
+		{[]string{"linsert", "nosuch", "after", "a", "b"}, ":0\r\n"},
+		{[]string{"lrange", "l", "0", "-1"}, "*6\r\n$1\r\nx\r\n$1\r\nZ\r\n$1\r\ny\r\n$1\r\nb\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"lrem", "l", "-1", "b"}, ":1\r\n"},
+		{[]string{"lrange", "l", "0", "-1"}, "*5\r\n$1\r\nx\r\n$1\r\nZ\r\n$1\r\ny\r\n$1\r\nb\r\n$1\r\na\r\n"},
+		{[]string{"ltrim", "l", "1", "-2"}, "+OK\r\n"},
+		{[]string{"lrange", "l", "0", "-1"}, "*3\r\n$1\r\nZ\r\n$1\r\ny\r\n$1\r\nb\r\n"},
+		{[]string{"lpop", "l"}, "$1\r\nZ\r\n"},
+		{[]string{"rpop", "l", "5"}, "*2\r\n$1\r\nb\r\n$1\r\ny\r\n"},
+		{[]string{"type", "l"}, "+none\r\n"},
+		{[]string{"lpop", "l"}, "$-1\r\n"},
+		{[]string{"lpop", "l", "1"}, "*-1\r\n"},
+		{[]string{"lpop", "l", "-1"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"rpush", "src", "1", "2", "3"}, ":3\r\n"},
+		{[]string{"rpoplpush", "src", "dst"}, "$1\r\n3\r\n"},
+		{[]string{"lmove", "src", "dst", "left", "right"}, "$1\r\n1\r\n"},
+		{[]string{"lmove", "src", "src", "left", "right"}, "$1\r\n2\r\n"},
+		{[]string{"lmove", "src", "dst", "up", "right"}, "-ERR syntax error\r\n"},
+		{[]string{"lrange", "dst", "0", "-1"}, "*2\r\n$1\r\n3\r\n$1\r\n1\r\n"},
+		{[]string{"rpoplpush", "nosuch", "dst"}, "$-1\r\n"},
+		{[]string{"type", "dst"}, "+list\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_listWrongType(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	input := string(encodeCommand("set", "s", "v")) +
+		string(encodeCommand("rpush", "l", "a")) +
+		string(encodeCommand("lpush", "s", "a")) +
+		string(encodeCommand("rpoplpush", "l", "s")) +
+		string(encodeCommand("blpop", "s", "0")) +
+		string(encodeCommand("llen", "l"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n:1\r\n"+wrongType+wrongType+wrongType+":1\r\n", out)
+}
+
+// runBlocking runs input on a new connection in the background and waits
+// until it is blocked.
+func runBlocking(t *testing.T, db *DB, input string) chan string {
+	waiting := db.blocked.Len()
+	replies := make(chan string, 1)
+	go func() {
+		replies <- runCommands(t, db, newCommandHandler(nil, nil, nil), input)
+	}()
+
+	for db.blocked.Len() == waiting {
+		time.Sleep(time.Millisecond)
+	}
+	return replies
+}
+
+func Test_blockingPop(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	// an item pushed already is popped at once.
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("rpush", "l2", "a"))+
+		string(encodeCommand("blpop", "l1", "l2", "0")))
+	assert.Equal(t, ":1\r\n*2\r\n$2\r\nl2\r\n$1\r\na\r\n", out)
+
+	// the connections blocked first are served first.
+	c1 := runBlocking(t, db, string(encodeCommand("blpop", "l1", "l2", "0")))
+	c2 := runBlocking(t, db, string(encodeCommand("brpop", "l2", "0")))
+	c3 := runBlocking(t, db, string(encodeCommand("blpop", "l2", "0")))
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("rpush", "l2", "x", "y")))
+	assert.Equal(t, ":2\r\n", out)
+	assert.Equal(t, "*2\r\n$2\r\nl2\r\n$1\r\nx\r\n", <-c1)
+	assert.Equal(t, "*2\r\n$2\r\nl2\r\n$1\r\ny\r\n", <-c2)
+	assert.Len(t, c3, 0)
+	assert.Equal(t, 1, db.blocked.Len())
+
+	// a transaction of another connection wakes it.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("multi"))+
+		string(encodeCommand("lpush", "l2", "z"))+
+		string(encodeCommand("exec")))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*1\r\n:1\r\n", out)
+	assert.Equal(t, "*2\r\n$2\r\nl2\r\n$1\r\nz\r\n", <-c3)
+	assert.Equal(t, 0, db.blocked.Len())
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("llen", "l2")))
+	assert.Equal(t, ":0\r\n", out)
+}
+
+func Test_blockingTimeout(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	start := time.Now()
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("blpop", "l", "0.05"))+
+		string(encodeCommand("brpoplpush", "l", "dst", "0.05")))
+	assert.Equal(t, "*-1\r\n$-1\r\n", out)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.Equal(t, 0, db.blocked.Len())
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("blpop", "l", "x"))+
+		string(encodeCommand("blpop", "l", "-1")))
+	assert.Equal(t, "-ERR timeout is not a float or out of range\r\n-ERR timeout is negative\r\n", out)
+
+	// blocking commands do not block inside a transaction.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("multi"))+
+		string(encodeCommand("blpop", "l", "0"))+
+		string(encodeCommand("blmove", "l", "dst", "left", "left", "0"))+
+		string(encodeCommand("exec")))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n*-1\r\n$-1\r\n", out)
+}
+
+func Test_blockingMove(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	c1 := runBlocking(t, db, string(encodeCommand("brpoplpush", "src", "dst", "0")))
+	c2 := runBlocking(t, db, string(encodeCommand("blpop", "dst", "0")))
+
+	// the item moved to dst wakes the next one.
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("rpush", "src", "a")))
+	assert.Equal(t, ":1\r\n", out)
+	assert.Equal(t, "$1\r\na\r\n", <-c1)
+	assert.Equal(t, "*2\r\n$3\r\ndst\r\n$1\r\na\r\n", <-c2)
+}
+
+func Test_recoverList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("rpush", "l", "a", "b", "c", "d")) +
+		string(encodeCommand("brpop", "nosuch", "l", "0")) +
+		string(encodeCommand("blmove", "l", "l2", "left", "left", "0")) +
+		string(encodeCommand("lrem", "l", "0", "b"))
+	runCommands(t, db, cmdhdr, input)
+
+	// blocking commands are logged as what they did.
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(wal), string(encodeCommand("rpop", "l")))
+	assert.Contains(t, string(wal), string(encodeCommand("lmove", "l", "l2", "left", "left")))
+	assert.NotContains(t, string(wal), "brpop")
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	items, err := db.LRange([]byte("l"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("c")}, items)
+	items, err = db.LRange([]byte("l2"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, items)
+}
@@ -4,10 +4,11 @@ import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,10 +17,21 @@ type meta struct {
 	freelistPgid uint64
 	checkpoint   uint64
 	elePageCount uint64
+	keyCount     uint64 // keys of db 0 in files of version 2, dbs[0].keyCount since
+	checkpointDB uint64 // the db which the wal records after checkpoint are for
+	dbs          [maxDatabases]dbMeta
+	freeCount    uint64 // element pages in the freelist
+	freePages    uint64 // pages of the freelist itself
+}
+
+type dbMeta struct {
+	indexPgid uint64 // directory page of the index, 0 until the db gets its first key
+	keyCount  uint64 // keys in the db, expired ones not deleted yet included
 }
 
 type freelist struct {
-	ids [maxAllocSize]uint64
+	next uint64 // the next page of the freelist, 0 for the last one
+	ids  [maxAllocSize]uint64
 }
 
 type timeFormatter struct{}
@@ -30,58 +42,38 @@ func (s *timeFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return []byte(msg), nil
 }
 func main() {
-	err := os.RemoveAll("data")
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
-		panic(err)
-	}
-	err = os.MkdirAll("data", 0777)
-	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "invalid config. %s\n", err.Error())
+		os.Exit(1)
 	}
 
 	logrus.SetFormatter(&timeFormatter{})
-	logrus.SetLevel(logrus.DebugLevel)
+	logrus.SetLevel(cfg.LogLevel)
 
-	db, err := LoadOrCreateDbFromDir("data")
+	srv, err := startServer(cfg)
 	if err != nil {
-		logrus.Fatalf("error when load db file. %s\n", err.Error())
+		logrus.Fatalf("error when start server. %s\n", err.Error())
 	}
-	defer func() {
-		err = db.Close()
-		if err != nil {
-			logrus.Fatalf("db close error. %s\n", err.Error())
-		}
-	}()
-
-	port := 6379
-
-	logrus.Infof("listen on port %d", port)
-
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		logrus.Fatalf("listen tcp failed. %s\n", err.Error())
-	}
-	defer l.Close()
 
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(":8082", nil)
+		err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.MetricsPort), nil)
 		logrus.Fatalf("unpected error when listen http server. %s", err.Error())
 	}()
-	startMonitor()
+	startMonitor(cfg.Dir)
 
-	db.serving = true
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		logrus.Infof("received signal %s, shutting down", <-sig)
 
-	for {
-		conn, err := l.Accept()
+		err := srv.Close()
 		if err != nil {
-			logrus.Errorf("accept tcp failed. %s\n", err.Error())
+			logrus.Fatalf("server close error. %s\n", err.Error())
 		}
+		os.Exit(0)
+	}()
 
-		connCounterMetric.Inc()
-
-		logrus.Debugf("accept conn: remote addr: %s", conn.RemoteAddr().String())
-
-		go handleConn(conn, db)
-	}
+	srv.serve()
 }
@@ -160,6 +160,101 @@ func Test_update(t *testing.T) {
 
 		executeCases(t, cases)
 	})
+
+	t.Run("non-last ele in a full page", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), t.Name()+"_db")
+		err := os.MkdirAll(path, 0777)
+		assert.Nil(t, err)
+
+		db, err := LoadOrCreateDbFromDir(path)
+		assert.Nil(t, err)
+		defer db.Close()
+
+		pgid, err := db.growPages(0)
+		assert.Nil(t, err)
+		pg := db.page(pgid)
+		nextPg := *db.page(pgid + 1)
+
+		val := func(ie *IndexEle) string {
+			return string(db.page(ie.pgid).elements().eles[ie.at].val())
+		}
+
+		var ies [3]IndexEle
+		err = db.createEleInPage([]byte("k0"), []byte("v0"), &ies[0], pg)
+		assert.Nil(t, err)
+		err = db.createEleInPage([]byte("k1"), []byte("v1"), &ies[1], pg)
+		assert.Nil(t, err)
+		lastVal := strings.Repeat("x", int(db.pageSize)-int(pg.usedSize())-len("k2")-8)
+		err = db.createEleInPage([]byte("k2"), []byte(lastVal), &ies[2], pg)
+		assert.Nil(t, err)
+
+		// the page is nearly full after the first ele grows.
+		err = db.updateExistingEle([]byte("k0"), []byte("v0-grown"), &ies[0])
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(db.pageSize)-2, pg.usedSize())
+
+		assert.Equal(t, "v0-grown", val(&ies[0]))
+		assert.Equal(t, "v1", val(&ies[1]))
+		assert.Equal(t, lastVal, val(&ies[2]))
+		assert.Equal(t, nextPg.id, db.page(pgid+1).id)
+		assert.Equal(t, nextPg.flags, db.page(pgid+1).flags)
+
+		err = db.updateExistingEle([]byte("k1"), []byte("v"), &ies[1])
+		assert.Nil(t, err)
+		assert.Equal(t, "v0-grown", val(&ies[0]))
+		assert.Equal(t, "v", val(&ies[1]))
+		assert.Equal(t, lastVal, val(&ies[2]))
+	})
+
+	t.Run("empty page", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), t.Name()+"_db")
+		err := os.MkdirAll(path, 0777)
+		assert.Nil(t, err)
+
+		db, err := LoadOrCreateDbFromDir(path)
+		assert.Nil(t, err)
+		defer db.Close()
+
+		pgid, err := db.growPages(0)
+		assert.Nil(t, err)
+		pg := db.page(pgid)
+
+		// the slots of an empty page leave no room for a value of half a page.
+		var ie IndexEle
+		err = db.createEleInPage([]byte("key"), []byte(strings.Repeat("x", int(db.pageSize)/2)), &ie, pg)
+		assert.Equal(t, insufficientFreeSpaceInPageError, err)
+		assert.Equal(t, uint16(0), pg.count)
+	})
+}
+
+func Test_updateAcrossRemaps(t *testing.T) {
+	// the file grows, and is mapped again, by a page at a time.
+	cfg := defaultConfig()
+	cfg.ElePageIncrementCount = 1
+	db := newServingTestDB(t, cfg)
+	defer db.Close()
+
+	small := strings.Repeat("s", 100)
+	large := strings.Repeat("l", 3000)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(small)))
+	}
+	// too large for their pages, the eles move to new pages at the end of
+	// the file and are linked where the old ones were in their chains.
+	for i := 0; i < 500; i += 2 {
+		assert.Nil(t, db.Set(nil, []byte(fmt.Sprintf("key-%d", i)), []byte(large)))
+	}
+
+	assert.Equal(t, int64(500), db.DBSize())
+	for i := 0; i < 500; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err, i)
+		if i%2 == 0 {
+			assert.Equal(t, large, string(val), i)
+		} else {
+			assert.Equal(t, small, string(val), i)
+		}
+	}
 }
 
 func Test_delete(t *testing.T) {
@@ -38,46 +38,144 @@ var (
 		Help:      "wal checkpoint size",
 	})
 
+	walFsyncDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "wal_fsync_duration",
+		Help:      "wal fsync duration",
+	})
+
+	walFsyncLagMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "wal_fsync_lag",
+		Help:      "seconds the oldest wal write not yet fsynced has been waiting",
+	})
+
+	blockedClientsMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "conn",
+		Name:      "blocked_clients",
+		Help:      "connections blocked on lists",
+	})
+
+	walBatchSizeMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "wal_batch_size",
+		Help:      "bytes written to wal by one group commit",
+	})
+
 	pureSetDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "mini_redis",
 		Subsystem: "storage",
-		Name:       "pure_set_duration",
-		Help:       "pure set duration",
+		Name:      "pure_set_duration",
+		Help:      "pure set duration",
 	})
 
 	lockSetDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "mini_redis",
 		Subsystem: "storage",
-		Name:       "lock_set_duration",
-		Help:       "lock set duration",
+		Name:      "lock_set_duration",
+		Help:      "lock set duration",
 	})
 
 	pureGetDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "mini_redis",
 		Subsystem: "storage",
-		Name:       "pure_get_duration",
-		Help:       "pure get duration",
+		Name:      "pure_get_duration",
+		Help:      "pure get duration",
 	})
 
 	lockGetDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "mini_redis",
 		Subsystem: "storage",
-		Name:       "lock_get_duration",
-		Help:       "lock get duration",
+		Name:      "lock_get_duration",
+		Help:      "lock get duration",
 	})
 
 	pureDelDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "mini_redis",
 		Subsystem: "storage",
-		Name:       "pure_del_duration",
-		Help:       "pure del duration",
+		Name:      "pure_del_duration",
+		Help:      "pure del duration",
 	})
 
 	lockDelDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "mini_redis",
 		Subsystem: "storage",
-		Name:       "lock_del_duration",
-		Help:       "lock del duration",
+		Name:      "lock_del_duration",
+		Help:      "lock del duration",
+	})
+
+	expiredKeysMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "expired_keys_count",
+		Help:      "expired keys count",
+	})
+
+	compactProgressMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "compact_progress",
+		Help:      "part of the db file walked by the current compaction pass, from 0 to 1",
+	})
+
+	compactedPagesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "compacted_pages_count",
+		Help:      "element pages rewritten by compaction",
+	})
+
+	compactReclaimedBytesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "compact_reclaimed_bytes",
+		Help:      "bytes of deleted elements reclaimed by compaction",
+	})
+
+	freelistPagesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "freelist_pages",
+		Help:      "pages of the freelist",
+	})
+
+	freeElePagesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "free_element_pages",
+		Help:      "element pages in the freelist",
+	})
+
+	emptyElePagesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "empty_element_pages",
+		Help:      "element pages without elements, as the last compaction pass has seen them",
+	})
+
+	eleFreeBytesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "element_free_bytes",
+		Help:      "bytes left in the element pages which are not empty, as the last compaction pass has seen them",
+	})
+
+	eleGarbageBytesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "element_garbage_bytes",
+		Help:      "bytes of deleted elements, as the last compaction pass has seen them",
+	})
+
+	fragmentationRatioMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mini_redis",
+		Subsystem: "storage",
+		Name:      "fragmentation_ratio",
+		Help:      "part of the element pages which are not empty that is free or garbage, from 0 to 1",
 	})
 
 	recvCmdCountMetric = prometheus.NewCounter(prometheus.CounterOpts{
@@ -91,9 +189,13 @@ var (
 func init() {
 	// handler
 	prometheus.MustRegister(connCounterMetric)
+	prometheus.MustRegister(blockedClientsMetric)
 	prometheus.MustRegister(dbFileSizeMetric)
 	prometheus.MustRegister(walFileSizeMetric)
 	prometheus.MustRegister(walCheckpointMetric)
+	prometheus.MustRegister(walFsyncDurationMetric)
+	prometheus.MustRegister(walFsyncLagMetric)
+	prometheus.MustRegister(walBatchSizeMetric)
 
 	// storage
 	prometheus.MustRegister(pureSetDurationMetric)
@@ -102,16 +204,25 @@ func init() {
 	prometheus.MustRegister(lockGetDurationMetric)
 	prometheus.MustRegister(pureDelDurationMetric)
 	prometheus.MustRegister(lockDelDurationMetric)
+	prometheus.MustRegister(expiredKeysMetric)
+	prometheus.MustRegister(compactProgressMetric)
+	prometheus.MustRegister(compactedPagesMetric)
+	prometheus.MustRegister(compactReclaimedBytesMetric)
+	prometheus.MustRegister(freelistPagesMetric)
+	prometheus.MustRegister(freeElePagesMetric)
+	prometheus.MustRegister(emptyElePagesMetric)
+	prometheus.MustRegister(eleFreeBytesMetric)
+	prometheus.MustRegister(eleGarbageBytesMetric)
+	prometheus.MustRegister(fragmentationRatioMetric)
 
 	// misc
 	prometheus.MustRegister(recvCmdCountMetric)
 
-
 }
 
-func startMonitor() {
+func startMonitor(dir string) {
 	go func() {
-		dbPath := filepath.Join("data", "db")
+		dbPath := filepath.Join(dir, "db")
 		dbfile, err := os.OpenFile(dbPath, os.O_CREATE|os.O_RDONLY, 0644)
 		if err != nil {
 			logrus.Errorf("monitor checkpoint error. %s", err.Error())
@@ -123,7 +234,7 @@ func startMonitor() {
 		for {
 
 			select {
-			case <- tick.C:
+			case <-tick.C:
 				bs := make([]byte, os.Getpagesize())
 				n, err := dbfile.ReadAt(bs, 0)
 				if err != nil {
@@ -20,15 +20,21 @@ func (p *page) freelist() *freelist {
 	return (*freelist)(unsafe.Pointer(&p.ptr))
 }
 
+func (p *page) indexDir() *indexDir {
+	return (*indexDir)(unsafe.Pointer(&p.ptr))
+}
+
 func (p *page) elements() *Elements {
 	return (*Elements)(unsafe.Pointer(&p.ptr))
 }
 
+// usedSize returns the bytes from the start of the page to the end of the data
+// of its last ele. The slots of the eles are taken even if it has none.
 func (p *page) usedSize() uint32 {
 	es := p.elements()
 	if p.count == 0 {
-		return  0
+		return uint32(unsafe.Offsetof(p.ptr)) + uint32(unsafe.Sizeof(es.eles))
 	}
 	lastEle := &es.eles[p.count-1]
-	return uint32(uintptr(unsafe.Pointer(lastEle)) - uintptr(unsafe.Pointer(p))) + lastEle.pos + lastEle.kSize + lastEle.vSize
-}
\ No newline at end of file
+	return uint32(uintptr(unsafe.Pointer(lastEle))-uintptr(unsafe.Pointer(p))) + lastEle.pos + lastEle.kSize + lastEle.vSize
+}
@@ -1 +1,116 @@
+// Package queue parks the readers of keys until a writer signals that one of
+// the keys has data for them. Readers are woken first come first served.
+//
+// The queue only passes wakeups, the data stays with the caller. To not miss a
+// wakeup a reader must check its keys and call Wait under the same lock the
+// writer holds when it calls Signal.
 package queue
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Waiter is a reader parked on some keys.
+type Waiter struct {
+	// C receives the key which got data, at most once.
+	C chan string
+
+	elems map[string]*list.Element
+}
+
+type Queue struct {
+	mu      sync.Mutex
+	waiters map[string]*list.List // key -> *Waiter in arrival order
+	count   int
+}
+
+func New() *Queue {
+	return &Queue{
+		waiters: make(map[string]*list.List),
+	}
+}
+
+// Wait parks a reader on keys, it is woken by a Signal of any of them.
+func (q *Queue) Wait(keys ...string) *Waiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := &Waiter{
+		C:     make(chan string, 1),
+		elems: make(map[string]*list.Element, len(keys)),
+	}
+	for _, key := range keys {
+		if _, ok := w.elems[key]; ok {
+			continue
+		}
+
+		l, ok := q.waiters[key]
+		if !ok {
+			l = list.New()
+			q.waiters[key] = l
+		}
+		w.elems[key] = l.PushBack(w)
+	}
+	q.count++
+	return w
+}
+
+// Cancel unparks w. It returns false if w was woken already, then the data it
+// was woken for must be taken or passed on with another Signal.
+func (q *Queue) Cancel(w *Waiter) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(w.elems) == 0 {
+		return false
+	}
+	q.remove(w)
+	return true
+}
+
+// Signal wakes the first n readers parked on key.
+func (q *Queue) Signal(key string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, ok := q.waiters[key]
+	for ok && n > 0 && l.Len() > 0 {
+		w := l.Front().Value.(*Waiter)
+		q.remove(w)
+		w.C <- key
+		n--
+	}
+}
+
+// Len returns the number of parked readers.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.count
+}
+
+// Keys returns the keys readers are parked on.
+func (q *Queue) Keys() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := make([]string, 0, len(q.waiters))
+	for key := range q.waiters {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (q *Queue) remove(w *Waiter) {
+	for key, e := range w.elems {
+		l := q.waiters[key]
+		l.Remove(e)
+		if l.Len() == 0 {
+			delete(q.waiters, key)
+		}
+	}
+	w.elems = nil
+	q.count--
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_signalOrder(t *testing.T) {
+	q := New()
+
+	w1 := q.Wait("a")
+	w2 := q.Wait("a", "b")
+	w3 := q.Wait("a")
+	assert.Equal(t, 3, q.Len())
+
+	q.Signal("b", 1)
+	assert.Equal(t, "b", <-w2.C)
+
+	// w2 is not parked on a anymore.
+	q.Signal("a", 1)
+	assert.Equal(t, "a", <-w1.C)
+	assert.Len(t, w3.C, 0)
+
+	q.Signal("nosuch", 1)
+	assert.Equal(t, 1, q.Len())
+
+	assert.True(t, q.Cancel(w3))
+	assert.False(t, q.Cancel(w3))
+	assert.False(t, q.Cancel(w1))
+	assert.Equal(t, 0, q.Len())
+	assert.Empty(t, q.waiters)
+}
+
+func Test_signalMany(t *testing.T) {
+	q := New()
+
+	ws := []*Waiter{q.Wait("a", "a"), q.Wait("a"), q.Wait("a")}
+	q.Signal("a", 2)
+
+	assert.Len(t, ws[0].C, 1)
+	assert.Len(t, ws[1].C, 1)
+	assert.Len(t, ws[2].C, 0)
+	assert.Equal(t, 1, q.Len())
+}
+
+func Test_keys(t *testing.T) {
+	q := New()
+	assert.Empty(t, q.Keys())
+
+	w := q.Wait("a", "b")
+	q.Wait("b")
+	assert.ElementsMatch(t, []string{"a", "b"}, q.Keys())
+
+	q.Cancel(w)
+	assert.Equal(t, []string{"b"}, q.Keys())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// protocol versions of a connection, switched by HELLO.
+const (
+	resp2 = 2
+	resp3 = 3
+)
+
+// The reply* methods write a reply in the protocol of the connection. RESP3
+// types are written in their RESP2 form to RESP2 connections: maps and sets as
+// flat arrays, doubles, verbatim strings and big numbers as bulk strings,
+// booleans as 1 and 0, and nulls as the null bulk string or null array.
+
+func (cmdhdr *commandHandler) resp3() bool {
+	return cmdhdr.proto == resp3
+}
+
+func (cmdhdr *commandHandler) replyOK() error {
+	return cmdhdr.replySimple("OK")
+}
+
+func (cmdhdr *commandHandler) replySimple(s string) error {
+	return cmdhdr.WriteString("+" + s + "\r\n")
+}
+
+// replyError writes msg as an error, msg starts with the error code like
+// "ERR syntax error".
+func (cmdhdr *commandHandler) replyError(msg string) error {
+	return cmdhdr.WriteString("-" + msg + "\r\n")
+}
+
+func (cmdhdr *commandHandler) replyInt(n int64) error {
+	return cmdhdr.writeHeader(':', n)
+}
+
+func (cmdhdr *commandHandler) replyBulk(s string) error {
+	err := cmdhdr.writeHeader('$', int64(len(s)))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.WriteString(s + "\r\n")
+}
+
+// replyNull writes the null reply of a missing value.
+func (cmdhdr *commandHandler) replyNull() error {
+	if cmdhdr.resp3() {
+		return cmdhdr.WriteString("_\r\n")
+	}
+	return cmdhdr.WriteString("$-1\r\n")
+}
+
+// replyNullArray writes the null reply of a missing array, like EXEC of a
+// transaction aborted by WATCH.
+func (cmdhdr *commandHandler) replyNullArray() error {
+	if cmdhdr.resp3() {
+		return cmdhdr.WriteString("_\r\n")
+	}
+	return cmdhdr.WriteString("*-1\r\n")
+}
+
+// replyArrayLen starts an array of n elements, which are written next.
+func (cmdhdr *commandHandler) replyArrayLen(n int) error {
+	return cmdhdr.writeHeader('*', int64(n))
+}
+
+// replyMapLen starts a map of n key value pairs, 2*n elements are written next.
+func (cmdhdr *commandHandler) replyMapLen(n int) error {
+	if cmdhdr.resp3() {
+		return cmdhdr.writeHeader('%', int64(n))
+	}
+	return cmdhdr.writeHeader('*', int64(2*n))
+}
+
+// replySetLen starts a set of n elements.
+func (cmdhdr *commandHandler) replySetLen(n int) error {
+	if cmdhdr.resp3() {
+		return cmdhdr.writeHeader('~', int64(n))
+	}
+	return cmdhdr.writeHeader('*', int64(n))
+}
+
+// replyPushLen starts an out of band push message of n elements.
+func (cmdhdr *commandHandler) replyPushLen(n int) error {
+	if cmdhdr.resp3() {
+		return cmdhdr.writeHeader('>', int64(n))
+	}
+	return cmdhdr.writeHeader('*', int64(n))
+}
+
+// formatDouble formats f the way redis replies doubles, the shortest form
+// that reads back as f, in exponent notation only if it is very large or small.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	case f == math.Trunc(f) && math.Abs(f) < 1e17:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (cmdhdr *commandHandler) replyDouble(f float64) error {
+	s := formatDouble(f)
+	if cmdhdr.resp3() {
+		return cmdhdr.WriteString("," + s + "\r\n")
+	}
+	return cmdhdr.replyBulk(s)
+}
+
+func (cmdhdr *commandHandler) replyBool(b bool) error {
+	if cmdhdr.resp3() {
+		if b {
+			return cmdhdr.WriteString("#t\r\n")
+		}
+		return cmdhdr.WriteString("#f\r\n")
+	}
+
+	if b {
+		return cmdhdr.replyInt(1)
+	}
+	return cmdhdr.replyInt(0)
+}
+
+// replyVerbatim writes s as a verbatim string of format, a three letters type
+// like txt or mkd.
+func (cmdhdr *commandHandler) replyVerbatim(format, s string) error {
+	if !cmdhdr.resp3() {
+		return cmdhdr.replyBulk(s)
+	}
+
+	err := cmdhdr.writeHeader('=', int64(len(format)+1+len(s)))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.WriteString(format + ":" + s + "\r\n")
+}
+
+// replyBigNumber writes n, an integer in decimal which may not fit in 64 bits.
+func (cmdhdr *commandHandler) replyBigNumber(n string) error {
+	if cmdhdr.resp3() {
+		return cmdhdr.WriteString("(" + n + "\r\n")
+	}
+	return cmdhdr.replyBulk(n)
+}
+
+func (cmdhdr *commandHandler) writeHeader(typ byte, n int64) error {
+	buf := make([]byte, 0, 24)
+	buf = append(buf, typ)
+	buf = strconv.AppendInt(buf, n, 10)
+	buf = append(buf, separator...)
+	return cmdhdr.Write(buf)
+}
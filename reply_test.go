@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_reply(t *testing.T) {
+	cases := []struct {
+		write func(cmdhdr *commandHandler) error
+		resp2 string
+		resp3 string
+	}{
+		{func(c *commandHandler) error { return c.replyNull() }, "$-1\r\n", "_\r\n"},
+		{func(c *commandHandler) error { return c.replyNullArray() }, "*-1\r\n", "_\r\n"},
+		{func(c *commandHandler) error { return c.replyMapLen(2) }, "*4\r\n", "%2\r\n"},
+		{func(c *commandHandler) error { return c.replySetLen(2) }, "*2\r\n", "~2\r\n"},
+		{func(c *commandHandler) error { return c.replyPushLen(2) }, "*2\r\n", ">2\r\n"},
+		{func(c *commandHandler) error { return c.replyDouble(1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{func(c *commandHandler) error { return c.replyDouble(math.Inf(-1)) }, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{func(c *commandHandler) error { return c.replyDouble(1e6) }, "$7\r\n1000000\r\n", ",1000000\r\n"},
+		{func(c *commandHandler) error { return c.replyDouble(1e20) }, "$5\r\n1e+20\r\n", ",1e+20\r\n"},
+		{func(c *commandHandler) error { return c.replyBool(true) }, ":1\r\n", "#t\r\n"},
+		{func(c *commandHandler) error { return c.replyBool(false) }, ":0\r\n", "#f\r\n"},
+		{func(c *commandHandler) error { return c.replyVerbatim("txt", "hi") }, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{func(c *commandHandler) error { return c.replyBigNumber("12345678901234567890") },
+			"$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{func(c *commandHandler) error { return c.replyInt(-2) }, ":-2\r\n", ":-2\r\n"},
+		{func(c *commandHandler) error { return c.replyBulk("") }, "$0\r\n\r\n", "$0\r\n\r\n"},
+		{func(c *commandHandler) error { return c.replyError(errSyntax) }, "-ERR syntax error\r\n", "-ERR syntax error\r\n"},
+	}
+
+	for _, c := range cases {
+		var out bytes.Buffer
+		cmdhdr := newCommandHandler(nil, &out, nil)
+
+		err := c.write(cmdhdr)
+		assert.Nil(t, err)
+		assert.Equal(t, c.resp2, out.String())
+
+		out.Reset()
+		cmdhdr.proto = resp3
+		err = c.write(cmdhdr)
+		assert.Nil(t, err)
+		assert.Equal(t, c.resp3, out.String())
+	}
+}
+
+func Test_hello(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	id := fmt.Sprintf("$2\r\nid\r\n:%d\r\n", cmdhdr.id)
+
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("hello", "3", "setname", "c1")))
+	assert.Equal(t, "%7\r\n"+
+		"$6\r\nserver\r\n$5\r\nredis\r\n"+
+		"$7\r\nversion\r\n$5\r\n"+serverVersion+"\r\n"+
+		"$5\r\nproto\r\n:3\r\n"+
+		id+
+		"$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+		"$4\r\nrole\r\n$6\r\nmaster\r\n"+
+		"$7\r\nmodules\r\n*0\r\n", out)
+	assert.Equal(t, "c1", cmdhdr.name)
+
+	// replies are RESP3 from now on.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("get", "k"))+string(encodeCommand("config", "get", "port")))
+	assert.Equal(t, "_\r\n%1\r\n$4\r\nport\r\n$4\r\n6379\r\n", out)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("hello", "2"))+string(encodeCommand("get", "k")))
+	assert.Contains(t, out, "*14\r\n")
+	assert.Contains(t, out, "$5\r\nproto\r\n:2\r\n")
+	assert.True(t, len(out) > 5 && out[len(out)-5:] == "$-1\r\n")
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("hello", "4"))+
+		string(encodeCommand("hello", "x"))+
+		string(encodeCommand("hello", "3", "auth", "someone", "pass"))+
+		string(encodeCommand("hello", "3", "foo")))
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n"+
+		"-ERR Protocol version is not an integer or out of range\r\n"+
+		"-WRONGPASS invalid username-password pair or user is disabled.\r\n"+
+		"-ERR Syntax error in HELLO option 'foo'\r\n", out)
+	assert.Equal(t, resp2, cmdhdr.proto)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// limits of a request, the same as redis.
+	maxInlineSize   = 64 * 1024
+	maxMultiBulkLen = 1024 * 1024
+	maxBulkLen      = 512 * 1024 * 1024
+
+	// the buffer of a bulk grows by at most this much, or by what it holds,
+	// before more of the bulk arrives. A client can not make the server
+	// allocate a length it never sends.
+	bulkGrowSize = 64 * 1024
+	// args preallocated for a multibulk, more are appended as they arrive.
+	maxPreallocArgs = 1024
+)
+
+// protocolError is returned by Next when a client sends something which is not
+// RESP. The rest of the stream can not be parsed, so the connection is closed
+// after the error is replied.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+func isProtocolError(err error) bool {
+	var perr protocolError
+	return errors.As(err, &perr)
+}
+
+// Next reads the next command. A command is either a RESP array of bulk
+// strings, or an inline command, a line of arguments separated by spaces as
+// typed into telnet. The returned originCmd is the RESP encoding of the
+// command, it is only valid until the next call of Next.
+//
+// io.EOF is returned if the stream ends between two commands, and
+// io.ErrUnexpectedEOF if it ends inside of one.
+func (crd *commandHandler) Next() ([]byte, []string, error) {
+	if crd.reader == nil {
+		bufSize := connectionBufSize
+		if crd.bufSize > 0 {
+			bufSize = crd.bufSize
+		}
+		crd.reader = bufio.NewReaderSize(crd.Reader, bufSize)
+	}
+
+	for {
+		crd.stream = crd.stream[:0]
+
+		b, err := crd.reader.Peek(1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if b[0] != '*' {
+			args, err := crd.readInline()
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(args) == 0 {
+				// empty lines are ignored like redis does.
+				continue
+			}
+			return encodeCommand(args...), args, nil
+		}
+
+		args, err := crd.readMultiBulk()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(args) == 0 {
+			// *0 and *-1 are ignored.
+			continue
+		}
+		return crd.stream, args, nil
+	}
+}
+
+// buffered reports whether more input is already read from the connection, so
+// that replies of a pipeline are written once it is all handled.
+func (crd *commandHandler) buffered() bool {
+	return crd.reader != nil && crd.reader.Buffered() > 0
+}
+
+func (crd *commandHandler) readInline() ([]string, error) {
+	line, err := crd.readLine("too big inline request")
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+
+	args, err := splitArgs(string(line))
+	if err != nil {
+		return nil, protocolError("unbalanced quotes in request")
+	}
+	return args, nil
+}
+
+func (crd *commandHandler) readMultiBulk() ([]string, error) {
+	n, err := crd.readLength("too big mbulk count string", "invalid multibulk length", maxMultiBulkLen)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	prealloc := n
+	if prealloc > maxPreallocArgs {
+		prealloc = maxPreallocArgs
+	}
+	args := make([]string, 0, prealloc)
+	for i := int64(0); i < n; i++ {
+		b, err := crd.reader.Peek(1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if b[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%c'", b[0]))
+		}
+
+		argLen, err := crd.readLength("too big bulk count string", "invalid bulk length", maxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		if argLen < 0 {
+			return nil, protocolError("invalid bulk length")
+		}
+
+		// the value is read as a whole, so it may contain anything, CRLF included.
+		start := len(crd.stream)
+		end := start + int(argLen) + len(separator)
+		err = crd.readFull(end)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if !bytes.Equal(crd.stream[end-len(separator):end], separator) {
+			return nil, protocolError("invalid bulk string terminator")
+		}
+
+		args = append(args, string(crd.stream[start:end-len(separator)]))
+	}
+
+	return args, nil
+}
+
+// readFull reads into crd.stream until it is end bytes long. The stream grows
+// as the data arrives.
+func (crd *commandHandler) readFull(end int) error {
+	for len(crd.stream) < end {
+		if len(crd.stream) == cap(crd.stream) {
+			grow := len(crd.stream)
+			if grow < bulkGrowSize {
+				grow = bulkGrowSize
+			}
+			if grow > end-len(crd.stream) {
+				grow = end - len(crd.stream)
+			}
+			stream := make([]byte, len(crd.stream), len(crd.stream)+grow)
+			copy(stream, crd.stream)
+			crd.stream = stream
+		}
+
+		limit := cap(crd.stream)
+		if limit > end {
+			limit = end
+		}
+		n, err := crd.reader.Read(crd.stream[len(crd.stream):limit])
+		crd.stream = crd.stream[:len(crd.stream)+n]
+		if err != nil && len(crd.stream) < end {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLength reads a line like *3 or $5 and returns the number in it.
+func (crd *commandHandler) readLength(tooBig, invalid string, max int64) (int64, error) {
+	line, err := crd.readLine(tooBig)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[len(line)-1] != '\r' {
+		return 0, protocolError(invalid)
+	}
+
+	n, err := strconv.ParseInt(string(line[1:len(line)-1]), 10, 64)
+	if err != nil || n > max {
+		return 0, protocolError(invalid)
+	}
+	return n, nil
+}
+
+// readLine reads up to and including the next \n into crd.stream and returns
+// the line without the \n.
+func (crd *commandHandler) readLine(tooBig string) ([]byte, error) {
+	start := len(crd.stream)
+	for {
+		frag, err := crd.reader.ReadSlice('\n')
+		crd.stream = append(crd.stream, frag...)
+		if len(crd.stream)-start > maxInlineSize {
+			return nil, protocolError(tooBig)
+		}
+
+		if err == nil {
+			return crd.stream[start : len(crd.stream)-1], nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, unexpectedEOF(err)
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// splitArgs splits an inline command into arguments the way redis
+// sdssplitargs does. Arguments are separated by spaces, and may be quoted.
+// Double quoted arguments support the escapes \n, \r, \t, \b, \a, \xhh and \
+// followed by any other character, single quoted ones only \'. A closing quote
+// must be followed by a space or the end of line.
+func splitArgs(line string) ([]string, error) {
+	args := make([]string, 0, 4)
+
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		var inDouble, inSingle, done bool
+		for !done {
+			if inDouble {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+
+				c := line[i]
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+					arg = append(arg, c)
+				} else if c == '"' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			} else if inSingle {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+
+				c := line[i]
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+
+				switch c := line[i]; c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
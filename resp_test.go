@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nextBulkWithCRLF(t *testing.T) {
+	input := "*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$9\r\nva\r\nl\r\nue\r\n"
+	cmdhdr := &commandHandler{Reader: strings.NewReader(input)}
+
+	oriCmd, cmd, err := cmdhdr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, input, string(oriCmd))
+	assert.EqualValues(t, []string{"set", "key", "va\r\nl\r\nue"}, cmd)
+
+	_, _, err = cmdhdr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_nextInline(t *testing.T) {
+	cases := []struct {
+		str    string
+		expect []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"set key value\n", []string{"set", "key", "value"}},
+		{"  set   key  \"a b\\r\\n\\x41\"  \r\n", []string{"set", "key", "a b\r\nA"}},
+		{"set key 'it\\'s'\r\n", []string{"set", "key", "it's"}},
+		{"set key \"\"\r\n", []string{"set", "key", ""}},
+	}
+
+	for _, c := range cases {
+		cmdhdr := &commandHandler{Reader: strings.NewReader(c.str)}
+
+		oriCmd, cmd, err := cmdhdr.Next()
+		assert.Nil(t, err)
+		assert.EqualValues(t, c.expect, cmd)
+		// inline commands are logged to wal as RESP.
+		assert.Equal(t, encodeCommand(c.expect...), oriCmd)
+	}
+
+	// empty lines and empty arrays are skipped.
+	cmdhdr := &commandHandler{Reader: strings.NewReader("\r\n\n*0\r\nget k\r\n")}
+	_, cmd, err := cmdhdr.Next()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"get", "k"}, cmd)
+}
+
+func Test_nextSmallBuffer(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	input := string(encodeCommand("set", "key", value)) + "set key " + value + "\r\n"
+	cmdhdr := &commandHandler{Reader: strings.NewReader(input), bufSize: 16}
+
+	for i := 0; i < 2; i++ {
+		_, cmd, err := cmdhdr.Next()
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{"set", "key", value}, cmd)
+	}
+}
+
+func Test_nextLargeBulkLength(t *testing.T) {
+	// a bulk announced as 512MB which never arrives.
+	cmdhdr := &commandHandler{Reader: strings.NewReader("*2\r\n$3\r\nget\r\n$536870912\r\nabc")}
+	_, _, err := cmdhdr.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.True(t, cap(cmdhdr.stream) <= 2*bulkGrowSize)
+
+	// a bulk larger than the grow size is read as it arrives, and the
+	// command after it is untouched.
+	value := strings.Repeat("v", 3*bulkGrowSize+1)
+	input := string(encodeCommand("set", "key", value)) + string(encodeCommand("get", "key"))
+	cmdhdr = &commandHandler{Reader: strings.NewReader(input), bufSize: 16}
+
+	_, cmd, err := cmdhdr.Next()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"set", "key", value}, cmd)
+	_, cmd, err = cmdhdr.Next()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"get", "key"}, cmd)
+}
+
+func Test_nextError(t *testing.T) {
+	cases := []struct {
+		str string
+		err error
+	}{
+		{"*x\r\n", protocolError("invalid multibulk length")},
+		{"*2000000\r\n", protocolError("invalid multibulk length")},
+		{"*1\r\n:1\r\n", protocolError("expected '$', got ':'")},
+		{"*1\r\n$-1\r\n", protocolError("invalid bulk length")},
+		{"*1\r\n$abc\r\n", protocolError("invalid bulk length")},
+		{"*1\r\n$3\r\nabcd\r\n", protocolError("invalid bulk string terminator")},
+		{"set key \"value\r\n", protocolError("unbalanced quotes in request")},
+		{"set key \"a\"b\r\n", protocolError("unbalanced quotes in request")},
+		{strings.Repeat("a", maxInlineSize+1), protocolError("too big inline request")},
+		{"*2\r\n$3\r\nget\r\n", io.ErrUnexpectedEOF},
+		{"*1\r\n$3\r\nge", io.ErrUnexpectedEOF},
+		{"get", io.ErrUnexpectedEOF},
+	}
+
+	for _, c := range cases {
+		cmdhdr := &commandHandler{Reader: strings.NewReader(c.str)}
+
+		_, _, err := cmdhdr.Next()
+		assert.Equal(t, c.err, err, c.str)
+	}
+}
+
+func Test_protocolErrorReply(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("set", "k", "v")) + "*1\r\n$x\r\n" + string(encodeCommand("get", "k"))
+	var out bytes.Buffer
+	cmdhdr.Reader = strings.NewReader(input)
+	cmdhdr.Writer = &out
+	cmdhdr.Closer = ioutil.NopCloser(nil)
+
+	err := executeLoop(cmdhdr, db)
+	assert.Nil(t, err)
+	// the connection is closed after the error, the rest is not run.
+	assert.Equal(t, "+OK\r\n-ERR Protocol error: invalid bulk length\r\n", out.String())
+}
+
+func Test_pipeline(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	var input, expect string
+	for i := 0; i < 100; i++ {
+		input += string(encodeCommand("set", "k", "v")) + "get k\r\n"
+		expect += "+OK\r\n$1\r\nv\r\n"
+	}
+
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, expect, out)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type server struct {
+	db       *DB
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// startServer opens the db in cfg.Dir, recovering it from wal and undo log if it
+// exists, and listens on cfg.addr(). The data in cfg.Dir is removed first if
+// cfg.FlushAllOnStart is set.
+func startServer(cfg *Config) (*server, error) {
+	dir := cfg.Dir
+	if cfg.FlushAllOnStart {
+		logrus.Infof("flushall on start, removing %s", dir)
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := LoadOrCreateDbWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", cfg.addr())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	logrus.Infof("listen on %s", l.Addr().String())
+
+	db.serving = true
+	db.startActiveExpire()
+	db.startCompaction()
+
+	return &server{
+		db:       db,
+		listener: l,
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// serve accepts connections until the server is closed.
+func (s *server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			logrus.Errorf("accept tcp failed. %s\n", err.Error())
+			continue
+		}
+
+		connCounterMetric.Inc()
+
+		logrus.Debugf("accept conn: remote addr: %s", conn.RemoteAddr().String())
+
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+
+		go func() {
+			defer s.untrack(conn)
+			handleConn(conn, s.db)
+		}()
+	}
+}
+
+func (s *server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+func (s *server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// Close stops accepting connections, closes the open ones and then closes the
+// db, so that everything written is on disk for the next start.
+func (s *server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	if err != nil {
+		return err
+	}
+
+	s.wg.Wait()
+
+	return s.db.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, srv *server) *testClient {
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	assert.Nil(t, err)
+	return &testClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends args as one command and returns the raw reply, bulk and simple replies only.
+func (c *testClient) do(t *testing.T, args ...string) string {
+	_, err := c.conn.Write(encodeCommand(args...))
+	assert.Nil(t, err)
+
+	line, err := c.r.ReadString('\n')
+	assert.Nil(t, err)
+	if line[0] != '$' || line == "$-1\r\n" {
+		return line
+	}
+
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	assert.Nil(t, err)
+	bulk := make([]byte, n+2)
+	_, err = io.ReadFull(c.r, bulk)
+	assert.Nil(t, err)
+	return line + string(bulk)
+}
+
+func Test_restartServer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	cfg := defaultConfig()
+	cfg.Dir = dir
+	cfg.Bind = "127.0.0.1"
+	cfg.Port = 0
+
+	srv, err := startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+
+	c := dialTestServer(t, srv)
+	assert.Equal(t, "+OK\r\n", c.do(t, "set", "k1", "v1"))
+	assert.Equal(t, "+OK\r\n", c.do(t, "set", "k2", "v2", "ex", "1000"))
+	assert.Equal(t, "+OK\r\n", c.do(t, "set", "k3", "v3"))
+	assert.Equal(t, ":1\r\n", c.do(t, "del", "k3"))
+
+	// the client is still connected when the server goes down.
+	err = srv.Close()
+	assert.Nil(t, err)
+
+	srv, err = startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+
+	c = dialTestServer(t, srv)
+	assert.Equal(t, "$2\r\nv1\r\n", c.do(t, "get", "k1"))
+	assert.Equal(t, "$2\r\nv2\r\n", c.do(t, "get", "k2"))
+	assert.Equal(t, ":1000\r\n", c.do(t, "ttl", "k2"))
+	assert.Equal(t, "$-1\r\n", c.do(t, "get", "k3"))
+
+	err = srv.Close()
+	assert.Nil(t, err)
+
+	cfg.FlushAllOnStart = true
+	srv, err = startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+	defer srv.Close()
+
+	c = dialTestServer(t, srv)
+	assert.Equal(t, "$-1\r\n", c.do(t, "get", "k1"))
+}
+
+func Test_faultyClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Dir = filepath.Join(t.TempDir(), "data")
+	cfg.Bind = "127.0.0.1"
+	cfg.Port = 0
+
+	srv, err := startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+	defer srv.Close()
+
+	c := dialTestServer(t, srv)
+	assert.Equal(t, "+OK\r\n", c.do(t, "set", "k", "v"))
+
+	// a protocol error closes the connection of the faulty client only.
+	faulty := dialTestServer(t, srv)
+	_, err = faulty.conn.Write([]byte("*1\r\n$x\r\n"))
+	assert.Nil(t, err)
+	line, err := faulty.r.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", line)
+	_, err = faulty.r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+
+	// a client going away in the middle of a command.
+	gone := dialTestServer(t, srv)
+	_, err = gone.conn.Write([]byte("*2\r\n$3\r\nget\r\n"))
+	assert.Nil(t, err)
+	gone.conn.Close()
+
+	assert.Equal(t, "$1\r\nv\r\n", c.do(t, "get", "k"))
+	assert.Equal(t, "-ERR unknown command 'foo', with args beginning with: \r\n", c.do(t, "foo"))
+	assert.Equal(t, "$1\r\nv\r\n", c.do(t, "get", "k"))
+}
+
+func Test_pipelineBeforeBlockingCommand(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Dir = filepath.Join(t.TempDir(), "data")
+	cfg.Bind = "127.0.0.1"
+	cfg.Port = 0
+
+	srv, err := startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+	defer srv.Close()
+
+	// the reply of SET is sent while BLPOP is blocked.
+	c := dialTestServer(t, srv)
+	_, err = c.conn.Write(append(encodeCommand("set", "a", "1"), encodeCommand("blpop", "q", "0")...))
+	assert.Nil(t, err)
+	err = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.Nil(t, err)
+	line, err := c.r.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", line)
+
+	other := dialTestServer(t, srv)
+	assert.Equal(t, ":1\r\n", other.do(t, "rpush", "q", "x"))
+	reply := make([]byte, len("*2\r\n$1\r\nq\r\n$1\r\nx\r\n"))
+	_, err = io.ReadFull(c.r, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "*2\r\n$1\r\nq\r\n$1\r\nx\r\n", string(reply))
+}
+
+func Test_restartServerOnV1DataDir(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Dir = openFixtureDir(t, "v1.db.gz")
+	cfg.Bind = "127.0.0.1"
+	cfg.Port = 0
+
+	srv, err := startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+
+	c := dialTestServer(t, srv)
+	assert.Equal(t, "$5\r\nv-001\r\n", c.do(t, "get", "small-001"))
+	assert.Equal(t, "$5\r\nw-005\r\n", c.do(t, "get", "small-005"))
+	assert.Equal(t, "$-1\r\n", c.do(t, "get", "small-010"))
+	assert.Equal(t, ":-1\r\n", c.do(t, "ttl", "small-001"))
+	assert.Equal(t, "+OK\r\n", c.do(t, "set", "small-002", "v2", "ex", "1000"))
+	assert.Equal(t, "+OK\r\n", c.do(t, "set", "new", "v"))
+
+	err = srv.Close()
+	assert.Nil(t, err)
+
+	srv, err = startServer(cfg)
+	assert.Nil(t, err)
+	go srv.serve()
+	defer srv.Close()
+
+	c = dialTestServer(t, srv)
+	assert.Equal(t, "$5\r\nv-001\r\n", c.do(t, "get", "small-001"))
+	assert.Equal(t, "$2\r\nv2\r\n", c.do(t, "get", "small-002"))
+	assert.Equal(t, ":1000\r\n", c.do(t, "ttl", "small-002"))
+	assert.Equal(t, "$1\r\nv\r\n", c.do(t, "get", "new"))
+	assert.Equal(t, "$-1\r\n", c.do(t, "get", "mid-007"))
+}
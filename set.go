@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A set is kept in the value of its ele in one of two encodings, told apart by
+// the first byte:
+//
+//	setEncodingStrings: uvarint(len(member)) member ..., sorted by bytes.
+//	setEncodingIntset:  width, then the members as width bytes little endian
+//	                    integers sorted by value. width is 2, 4 or 8, the
+//	                    smallest one all members fit in.
+//
+// The intset is used if all members are integers in their canonical form and
+// there are at most set-max-intset-entries of them. Every write decodes the
+// whole set and writes it back in the encoding it fits.
+const (
+	setEncodingStrings = 0
+	setEncodingIntset  = 1
+)
+
+var errCorruptSet = errors.New("corrupt set encoding")
+
+// setInt returns the integer member s is the canonical form of.
+func setInt(s []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != string(s) {
+		return 0, false
+	}
+	return n, true
+}
+
+func intsetWidth(n int64) int {
+	switch {
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return 2
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return 4
+	}
+	return 8
+}
+
+// encodeSet encodes members, which must be unique, in the intset encoding if
+// they fit it with maxIntset members at most.
+func encodeSet(members [][]byte, maxIntset int) []byte {
+	if len(members) <= maxIntset {
+		ints := make([]int64, 0, len(members))
+		width := 2
+		for _, m := range members {
+			n, ok := setInt(m)
+			if !ok {
+				break
+			}
+			ints = append(ints, n)
+			if w := intsetWidth(n); w > width {
+				width = w
+			}
+		}
+
+		if len(ints) == len(members) {
+			sort.Slice(ints, func(i, j int) bool { return ints[i] < ints[j] })
+
+			buf := make([]byte, 2, 2+width*len(ints))
+			buf[0] = setEncodingIntset
+			buf[1] = byte(width)
+			tmp := make([]byte, 8)
+			for _, n := range ints {
+				binary.LittleEndian.PutUint64(tmp, uint64(n))
+				buf = append(buf, tmp[:width]...)
+			}
+			return buf
+		}
+	}
+
+	sorted := append([][]byte{}, members...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	size := 1
+	for _, m := range sorted {
+		size += binary.MaxVarintLen32 + len(m)
+	}
+	buf := make([]byte, 1, size)
+	buf[0] = setEncodingStrings
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, m := range sorted {
+		n := binary.PutUvarint(tmp, uint64(len(m)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, m...)
+	}
+	return buf
+}
+
+// decodeSet returns the members of an encoded set in the order they are
+// encoded. Members of the strings encoding point into b.
+func decodeSet(b []byte) ([][]byte, error) {
+	if len(b) == 0 {
+		return nil, errCorruptSet
+	}
+
+	members := make([][]byte, 0)
+	switch b[0] {
+	case setEncodingStrings:
+		b = b[1:]
+		for len(b) > 0 {
+			m, rest, ok := decodeString(b)
+			if !ok {
+				return nil, errCorruptSet
+			}
+			members = append(members, m)
+			b = rest
+		}
+	case setEncodingIntset:
+		if len(b) < 2 {
+			return nil, errCorruptSet
+		}
+		width := int(b[1])
+		b = b[2:]
+		if (width != 2 && width != 4 && width != 8) || len(b)%width != 0 {
+			return nil, errCorruptSet
+		}
+
+		tmp := make([]byte, 8)
+		for ; len(b) > 0; b = b[width:] {
+			// sign extend to 64 bits.
+			fill := byte(0)
+			if b[width-1]&0x80 != 0 {
+				fill = 0xff
+			}
+			for i := range tmp {
+				tmp[i] = fill
+			}
+			copy(tmp, b[:width])
+			n := int64(binary.LittleEndian.Uint64(tmp))
+			members = append(members, []byte(strconv.FormatInt(n, 10)))
+		}
+	default:
+		return nil, errCorruptSet
+	}
+	return members, nil
+}
+
+// readSet returns a copy of the members of the set in key, nil if key does not
+// exist. db.mu must be held.
+func (db *DB) readSet(key []byte) ([][]byte, error) {
+	ie, err := db.lookup(key, typeSet)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+
+	members, err := decodeSet(db.ele(ie).val())
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		members[i] = append([]byte{}, members[i]...)
+	}
+	return members, nil
+}
+
+// writeSet replaces the value in key with the set of members, the key is
+// removed if there is no member left. db.mu must be held.
+func (db *DB) writeSet(key []byte, members [][]byte, expireAt int64) error {
+	if len(members) == 0 {
+		_, err := db.del(key)
+		return err
+	}
+	return db.setValue(key, encodeSet(members, db.cfg.SetMaxIntsetEntries), typeSet, expireAt)
+}
+
+// updateSet runs fn on the members of the set in key, writes back the members
+// it returns and logs the wal record it returns. fn returns nil members if
+// nothing is changed.
+func (db *DB) updateSet(key []byte, fn func(members [][]byte) ([][]byte, []byte, error)) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	members, err := db.readSet(key)
+	if err != nil {
+		return err
+	}
+
+	members, record, err := fn(members)
+	if err != nil || members == nil {
+		return err
+	}
+
+	err = db.writeSet(key, members, keepTTL)
+	if err != nil {
+		return err
+	}
+	return db.persist(record)
+}
+
+func setContains(members [][]byte, m []byte) int {
+	for i, member := range members {
+		if bytes.Equal(member, m) {
+			return i
+		}
+	}
+	return -1
+}
+
+// SAdd adds members to the set in key and returns the number added.
+func (db *DB) SAdd(originCmd []byte, key []byte, members ...[]byte) (added int, err error) {
+	err = db.updateSet(key, func(set [][]byte) ([][]byte, []byte, error) {
+		for _, m := range members {
+			if setContains(set, m) == -1 {
+				set = append(set, m)
+				added++
+			}
+		}
+
+		if added == 0 {
+			return nil, nil, nil
+		}
+		return set, originCmd, nil
+	})
+	return added, err
+}
+
+// SRem removes members from the set in key and returns the number removed.
+func (db *DB) SRem(originCmd []byte, key []byte, members ...[]byte) (removed int, err error) {
+	err = db.updateSet(key, func(set [][]byte) ([][]byte, []byte, error) {
+		for _, m := range members {
+			if at := setContains(set, m); at != -1 {
+				set = append(set[:at], set[at+1:]...)
+				removed++
+			}
+		}
+
+		if removed == 0 {
+			return nil, nil, nil
+		}
+		if len(set) == 0 {
+			// an empty non-nil slice removes the key.
+			set = [][]byte{}
+		}
+		return set, originCmd, nil
+	})
+	return removed, err
+}
+
+// SPop removes up to count random members from the set in key and returns
+// them. It is logged to wal as SREM of them, so that replay removes the same.
+func (db *DB) SPop(key []byte, count int) (popped [][]byte, err error) {
+	err = db.updateSet(key, func(set [][]byte) ([][]byte, []byte, error) {
+		if len(set) == 0 || count == 0 {
+			return nil, nil, nil
+		}
+
+		rand.Shuffle(len(set), func(i, j int) { set[i], set[j] = set[j], set[i] })
+		if count > len(set) {
+			count = len(set)
+		}
+		popped = set[:count]
+
+		record := []string{"srem", string(key)}
+		for _, m := range popped {
+			record = append(record, string(m))
+		}
+
+		set = set[count:]
+		if len(set) == 0 {
+			set = [][]byte{}
+		}
+		return set, encodeCommand(record...), nil
+	})
+	return popped, err
+}
+
+// SMove moves member from the set in src to the set in dst. It returns false if
+// member is not in src.
+func (db *DB) SMove(originCmd []byte, src, dst, member []byte) (moved bool, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	srcSet, err := db.readSet(src)
+	if err != nil {
+		return false, err
+	}
+	dstSet, err := db.readSet(dst)
+	if err != nil {
+		return false, err
+	}
+
+	at := setContains(srcSet, member)
+	if at == -1 {
+		return false, nil
+	}
+	if bytes.Equal(src, dst) {
+		return true, nil
+	}
+
+	err = db.writeSet(src, append(srcSet[:at], srcSet[at+1:]...), keepTTL)
+	if err != nil {
+		return false, err
+	}
+	if setContains(dstSet, member) == -1 {
+		err = db.writeSet(dst, append(dstSet, member), keepTTL)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, db.persist(originCmd)
+}
+
+// SMembers returns the members of the set in key, none if key does not exist.
+func (db *DB) SMembers(key []byte) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.readSet(key)
+}
+
+// SIsMember tells for each of members if it is in the set in key.
+func (db *DB) SIsMember(key []byte, members ...[]byte) ([]bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	set, err := db.readSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]bool, len(members))
+	for i, m := range members {
+		found[i] = setContains(set, m) != -1
+	}
+	return found, nil
+}
+
+// set operations of SINTER, SUNION and SDIFF.
+const (
+	setInter = iota
+	setUnion
+	setDiff
+)
+
+// setOp returns the result of op on the sets of keys. db.mu must be held.
+func (db *DB) setOp(op int, keys [][]byte) ([][]byte, error) {
+	sets := make([][][]byte, len(keys))
+	for i, key := range keys {
+		set, err := db.readSet(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	in := func(m []byte, sets [][][]byte) (n int) {
+		for _, set := range sets {
+			if setContains(set, m) != -1 {
+				n++
+			}
+		}
+		return n
+	}
+
+	result := make([][]byte, 0)
+	switch op {
+	case setInter:
+		for _, m := range sets[0] {
+			if in(m, sets[1:]) == len(sets)-1 {
+				result = append(result, m)
+			}
+		}
+	case setUnion:
+		for _, set := range sets {
+			for _, m := range set {
+				if setContains(result, m) == -1 {
+					result = append(result, m)
+				}
+			}
+		}
+	case setDiff:
+		for _, m := range sets[0] {
+			if in(m, sets[1:]) == 0 {
+				result = append(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+// SetOp returns the result of op on the sets of keys in the order of the set
+// encoding.
+func (db *DB) SetOp(op int, keys ...[]byte) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	result, err := db.setOp(op, keys)
+	if err != nil || len(result) == 0 {
+		return result, err
+	}
+	return decodeSet(encodeSet(result, db.cfg.SetMaxIntsetEntries))
+}
+
+// SetOpStore stores the result of op on the sets of keys in dst, replacing
+// what dst holds, and returns the size of the result.
+func (db *DB) SetOpStore(originCmd []byte, op int, dst []byte, keys ...[]byte) (n int, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	result, err := db.setOp(op, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.writeSet(dst, result, 0)
+	if err != nil {
+		return 0, err
+	}
+	return len(result), db.persist(originCmd)
+}
+
+func replyMembers(cmdhdr *commandHandler, members [][]byte) error {
+	err := cmdhdr.replySetLen(len(members))
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		err = cmdhdr.replyBulk(string(m))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func argsBytes(args []string) [][]byte {
+	bs := make([][]byte, len(args))
+	for i, arg := range args {
+		bs[i] = []byte(arg)
+	}
+	return bs
+}
+
+func saddCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	added, err := db.SAdd(originCmd, []byte(cmd[1]), argsBytes(cmd[2:])...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(added))
+}
+
+func sremCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	removed, err := db.SRem(originCmd, []byte(cmd[1]), argsBytes(cmd[2:])...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(removed))
+}
+
+func smembersCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	members, err := db.SMembers([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return replyMembers(cmdhdr, members)
+}
+
+func scardCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	members, err := db.SMembers([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(len(members)))
+}
+
+func sismemberCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	found, err := db.SIsMember([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(boolInt(found[0]))
+}
+
+func smismemberCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	found, err := db.SIsMember([]byte(cmd[1]), argsBytes(cmd[2:])...)
+	if err != nil {
+		return err
+	}
+
+	err = cmdhdr.replyArrayLen(len(found))
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		err = cmdhdr.replyInt(boolInt(f))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spopCmd handles SPOP key [count]. The reply is a member without count and a
+// set of members with it.
+func spopCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd) > 3 {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	count := int64(1)
+	if len(cmd) == 3 {
+		var err error
+		count, err = strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil || count < 0 {
+			return cmdhdr.replyError("ERR value is out of range, must be positive")
+		}
+		if count > math.MaxInt32 {
+			count = math.MaxInt32
+		}
+	}
+
+	popped, err := db.SPop([]byte(cmd[1]), int(count))
+	if err != nil {
+		return err
+	}
+
+	if len(cmd) == 3 {
+		return replyMembers(cmdhdr, popped)
+	}
+	if len(popped) == 0 {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyBulk(string(popped[0]))
+}
+
+// srandmemberCmd handles SRANDMEMBER key [count]. A negative count may return
+// the same member more than once.
+func srandmemberCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd) > 3 {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	members, err := db.SMembers([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+
+	if len(cmd) == 2 {
+		if len(members) == 0 {
+			return cmdhdr.replyNull()
+		}
+		return cmdhdr.replyBulk(string(members[rand.Intn(len(members))]))
+	}
+
+	count, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil || count < -math.MaxInt32 || count > math.MaxInt32 {
+		return cmdhdr.replyError("ERR value is out of range")
+	}
+
+	var picked [][]byte
+	if count < 0 && len(members) > 0 {
+		for i := int64(0); i < -count; i++ {
+			picked = append(picked, members[rand.Intn(len(members))])
+		}
+	} else {
+		rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+		if int(count) < len(members) {
+			members = members[:count]
+		}
+		picked = members
+	}
+	return replyItems(cmdhdr, picked)
+}
+
+func smoveCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	moved, err := db.SMove(originCmd, []byte(cmd[1]), []byte(cmd[2]), []byte(cmd[3]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(boolInt(moved))
+}
+
+var setOps = map[string]int{
+	"sinter": setInter,
+	"sunion": setUnion,
+	"sdiff":  setDiff,
+}
+
+// setOpCmd handles SINTER, SUNION and SDIFF key [key ...].
+func setOpCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	op := setOps[strings.ToLower(cmd[0])]
+	result, err := db.SetOp(op, argsBytes(cmd[1:])...)
+	if err != nil {
+		return err
+	}
+	return replyMembers(cmdhdr, result)
+}
+
+// setOpStoreCmd handles SINTERSTORE, SUNIONSTORE and SDIFFSTORE destination
+// key [key ...].
+func setOpStoreCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	name := strings.ToLower(cmd[0])
+	op := setOps[strings.TrimSuffix(name, "store")]
+
+	n, err := db.SetOpStore(originCmd, op, []byte(cmd[1]), argsBytes(cmd[2:])...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+// sscanCmd handles SSCAN key cursor [MATCH pattern] [COUNT count]. The cursor
+// is the position of the next member in the set encoding.
+func sscanCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	cursor, pattern, count, errMsg := parseScanArgs(cmd[2:])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	members, err := db.SMembers([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+
+	var found [][]byte
+	i := cursor
+	for ; i < uint64(len(members)) && i < cursor+uint64(count); i++ {
+		if pattern == "*" || globMatch(pattern, string(members[i])) {
+			found = append(found, members[i])
+		}
+	}
+	if i >= uint64(len(members)) {
+		i = 0
+	}
+
+	err = cmdhdr.replyArrayLen(2)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk(strconv.FormatUint(i, 10))
+	if err != nil {
+		return err
+	}
+	return replyItems(cmdhdr, found)
+}
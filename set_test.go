@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setEncoding(t *testing.T) {
+	cases := []struct {
+		members  []string
+		encoding byte
+		width    byte
+		decoded  []string
+	}{
+		{[]string{"3", "-1", "2"}, setEncodingIntset, 2, []string{"-1", "2", "3"}},
+		{[]string{"-32769", "1"}, setEncodingIntset, 4, []string{"-32769", "1"}},
+		{[]string{"1", "-9223372036854775808", "9223372036854775807"}, setEncodingIntset, 8,
+			[]string{"-9223372036854775808", "1", "9223372036854775807"}},
+		// not canonical integers.
+		{[]string{"1", "01"}, setEncodingStrings, 0, []string{"01", "1"}},
+		{[]string{"b", "a", "10"}, setEncodingStrings, 0, []string{"10", "a", "b"}},
+		// too many for an intset.
+		{[]string{"1", "2", "3", "4", "5"}, setEncodingStrings, 0, []string{"1", "2", "3", "4", "5"}},
+	}
+
+	for _, c := range cases {
+		members := argsBytes(c.members)
+		b := encodeSet(members, 4)
+		assert.Equal(t, c.encoding, b[0], c.members)
+		if c.encoding == setEncodingIntset {
+			assert.Equal(t, c.width, b[1], c.members)
+			assert.Len(t, b, 2+int(c.width)*len(members), c.members)
+		}
+
+		decoded, err := decodeSet(b)
+		assert.Nil(t, err)
+		assert.Equal(t, argsBytes(c.decoded), decoded, c.members)
+	}
+
+	for _, b := range [][]byte{{}, {9}, {setEncodingIntset, 3, 0, 0, 0}, {setEncodingIntset, 2, 0}, {setEncodingStrings, 5, 'a'}} {
+		_, err := decodeSet(b)
+		assert.Equal(t, errCorruptSet, err, b)
+	}
+}
+
+func Test_setCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"sadd", "s1", "a", "b", "c", "a"}, ":3\r\n"},
+		{[]string{"sadd", "s1", "c", "d"}, ":1\r\n"},
+		{[]string{"sadd", "s2", "c", "d", "e"}, ":3\r\n"},
+		{[]string{"scard", "s1"}, ":4\r\n"},
+		{[]string{"smembers", "s1"}, "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{[]string{"sismember", "s1", "a"}, ":1\r\n"},
+		{[]string{"sismember", "nosuch", "a"}, ":0\r\n"},
+		{[]string{"smismember", "s1", "a", "x"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"srem", "s1", "a", "x"}, ":1\r\n"},
+		{[]string{"sinter", "s1", "s2"}, "*2\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{[]string{"sinter", "s1", "nosuch"}, "*0\r\n"},
+		{[]string{"sunion", "s1", "s2"}, "*4\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{[]string{"sdiff", "s1", "s2"}, "*1\r\n$1\r\nb\r\n"},
+		{[]string{"sdiffstore", "dst", "s2", "s1"}, ":1\r\n"},
+		{[]string{"smembers", "dst"}, "*1\r\n$1\r\ne\r\n"},
+		{[]string{"sinterstore", "dst", "s1", "nosuch"}, ":0\r\n"},
+		{[]string{"type", "dst"}, "+none\r\n"},
+		{[]string{"set", "str", "v"}, "+OK\r\n"},
+		{[]string{"sunionstore", "str", "s1"}, ":3\r\n"},
+		{[]string{"type", "str"}, "+set\r\n"},
+		{[]string{"smove", "s1", "s2", "b"}, ":1\r\n"},
+		{[]string{"smove", "s1", "s2", "b"}, ":0\r\n"},
+		{[]string{"sismember", "s2", "b"}, ":1\r\n"},
+		{[]string{"spop", "nosuch"}, "$-1\r\n"},
+		{[]string{"spop", "s1", "0"}, "*0\r\n"},
+		{[]string{"srandmember", "nosuch"}, "$-1\r\n"},
+		{[]string{"sadd", "ints", "3", "1", "2"}, ":3\r\n"},
+		{[]string{"smembers", "ints"}, "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n"},
+		{[]string{"sscan", "ints", "0", "count", "2"}, "*2\r\n$1\r\n2\r\n*2\r\n$1\r\n1\r\n$1\r\n2\r\n"},
+		{[]string{"sscan", "ints", "2", "match", "[34]"}, "*2\r\n$1\r\n0\r\n*1\r\n$1\r\n3\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+
+	// s1 is {c, d}, a negative count may repeat members.
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("srandmember", "s1", "-3")))
+	assert.Regexp(t, "^\\*3\r\n(\\$1\r\n[cd]\r\n){3}$", out)
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("srandmember", "s1", "5")))
+	assert.Regexp(t, "^\\*2\r\n(\\$1\r\n[cd]\r\n){2}$", out)
+
+	// sets are sets in RESP3.
+	cmdhdr.proto = resp3
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("smembers", "ints")))
+	assert.Equal(t, "~3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n", out)
+}
+
+func Test_setWrongType(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	input := string(encodeCommand("set", "str", "v")) +
+		string(encodeCommand("sadd", "s", "a")) +
+		string(encodeCommand("sadd", "str", "a")) +
+		string(encodeCommand("sinter", "s", "str")) +
+		string(encodeCommand("smove", "s", "str", "a")) +
+		string(encodeCommand("scard", "s"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n:1\r\n"+wrongType+wrongType+wrongType+":1\r\n", out)
+}
+
+func Test_setIntsetGrows(t *testing.T) {
+	db := newTestDB(t)
+	db.cfg.SetMaxIntsetEntries = 3
+
+	encoding := func() byte {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		ie, err := db.lookup([]byte("s"), typeSet)
+		assert.Nil(t, err)
+		return db.ele(ie).val()[0]
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := db.SAdd(nil, []byte("s"), []byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, byte(setEncodingIntset), encoding())
+
+	_, err := db.SAdd(nil, []byte("s"), []byte("3"))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(setEncodingStrings), encoding())
+
+	// back to an intset when it is small again.
+	_, err = db.SRem(nil, []byte("s"), []byte("3"))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(setEncodingIntset), encoding())
+
+	_, err = db.SAdd(nil, []byte("s"), []byte("x"))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(setEncodingStrings), encoding())
+}
+
+func Test_recoverSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("sadd", "s1", "1", "2", "3", "4")) +
+		string(encodeCommand("sadd", "s2", "3", "4", "5")) +
+		string(encodeCommand("sunionstore", "u", "s1", "s2")) +
+		string(encodeCommand("spop", "s1", "2"))
+	runCommands(t, db, cmdhdr, input)
+
+	left, err := db.SMembers([]byte("s1"))
+	assert.Nil(t, err)
+	assert.Len(t, left, 2)
+
+	// SPOP is logged as SREM of what it popped.
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(wal), "srem")
+	assert.NotContains(t, string(wal), "spop")
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	members, err := db.SMembers([]byte("s1"))
+	assert.Nil(t, err)
+	assert.Equal(t, left, members)
+	members, err = db.SMembers([]byte("u"))
+	assert.Nil(t, err)
+	assert.Equal(t, argsBytes([]string{"1", "2", "3", "4", "5"}), members)
+}
@@ -0,0 +1,1655 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stream is kept in the value of its ele as
+//
+//	lastID   the greatest ID ever added
+//	entries  uvarint(n), then each one ID, uvarint(len(fields)) fields
+//	groups   uvarint(n), then each one name, last delivered ID, consumers
+//	         and pending entries
+//
+// An ID is two little endian uint64, milliseconds and sequence number. A
+// consumer is name and the unix milliseconds it was last seen, a pending entry
+// is ID, consumer name, delivery time and delivery count. Strings are uvarint
+// length prefixed, entries and pending entries are in ID order.
+//
+// The consumer groups live in the same value as the entries, so they are kept
+// by the wal and the undo log the same way. Every write decodes the whole
+// stream and writes it back.
+
+var (
+	errStreamIDZero      = errors.New("The ID specified in XADD must be greater than 0-0")
+	errStreamIDTooSmall  = errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamExhausted   = errors.New("The stream has exhausted the last possible ID, unable to add more items")
+	errBusyGroup         = errors.New("BUSYGROUP Consumer Group name already exists")
+	errXGroupKeyRequired = errors.New("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+
+	errCorruptStream = errors.New("corrupt stream encoding")
+)
+
+const errInvalidStreamID = "ERR Invalid stream ID specified as stream command argument"
+
+// noGroupError is returned when a consumer group or its stream does not exist.
+type noGroupError struct {
+	key, group []byte
+}
+
+func (e *noGroupError) Error() string {
+	return fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", e.key, e.group)
+}
+
+type streamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(other streamID) bool {
+	if id.ms != other.ms {
+		return id.ms < other.ms
+	}
+	return id.seq < other.seq
+}
+
+// next returns the smallest ID greater than id, false if id is the greatest.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the greatest ID less than id, false if id is 0-0.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses ms-seq, or ms with seq as the sequence number.
+func parseStreamID(s string, seq uint64) (streamID, bool) {
+	msPart, seqPart := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		msPart, seqPart = s[:i], s[i+1:]
+	}
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if seqPart != "" || len(msPart) < len(s) {
+		seq, err = strconv.ParseUint(seqPart, 10, 64)
+		if err != nil {
+			return streamID{}, false
+		}
+	}
+	return streamID{ms, seq}, true
+}
+
+type streamEntry struct {
+	id     streamID
+	fields [][]byte // field and value pairs, nil if the entry is deleted
+}
+
+type streamConsumer struct {
+	name   []byte
+	seenAt int64
+}
+
+type streamPending struct {
+	id          streamID
+	consumer    []byte
+	deliveredAt int64
+	deliveries  uint64
+}
+
+type streamGroup struct {
+	name      []byte
+	lastID    streamID // the last entry delivered to the group
+	consumers []streamConsumer
+	pending   []streamPending
+}
+
+type stream struct {
+	lastID  streamID
+	entries []streamEntry
+	groups  []*streamGroup
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendStreamString(buf []byte, s []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendStreamID(buf []byte, id streamID) []byte {
+	var tmp [16]byte
+	binary.LittleEndian.PutUint64(tmp[:], id.ms)
+	binary.LittleEndian.PutUint64(tmp[8:], id.seq)
+	return append(buf, tmp[:]...)
+}
+
+func encodeStream(s *stream) []byte {
+	buf := appendStreamID(nil, s.lastID)
+
+	buf = appendUvarint(buf, uint64(len(s.entries)))
+	for _, e := range s.entries {
+		buf = appendStreamID(buf, e.id)
+		buf = appendUvarint(buf, uint64(len(e.fields)))
+		for _, f := range e.fields {
+			buf = appendStreamString(buf, f)
+		}
+	}
+
+	buf = appendUvarint(buf, uint64(len(s.groups)))
+	for _, g := range s.groups {
+		buf = appendStreamString(buf, g.name)
+		buf = appendStreamID(buf, g.lastID)
+
+		buf = appendUvarint(buf, uint64(len(g.consumers)))
+		for _, c := range g.consumers {
+			buf = appendStreamString(buf, c.name)
+			buf = appendUvarint(buf, uint64(c.seenAt))
+		}
+
+		buf = appendUvarint(buf, uint64(len(g.pending)))
+		for _, p := range g.pending {
+			buf = appendStreamID(buf, p.id)
+			buf = appendStreamString(buf, p.consumer)
+			buf = appendUvarint(buf, uint64(p.deliveredAt))
+			buf = appendUvarint(buf, p.deliveries)
+		}
+	}
+	return buf
+}
+
+// streamDecoder reads an encoded stream, corrupt is set once it runs short.
+type streamDecoder struct {
+	b       []byte
+	corrupt bool
+}
+
+func (d *streamDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.corrupt = true
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// count reads the number of the items which follow, each one at least a byte.
+func (d *streamDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.corrupt = true
+		d.b = nil
+		return 0
+	}
+	return int(n)
+}
+
+func (d *streamDecoder) id() streamID {
+	if len(d.b) < 16 {
+		d.corrupt = true
+		d.b = nil
+		return streamID{}
+	}
+	id := streamID{binary.LittleEndian.Uint64(d.b), binary.LittleEndian.Uint64(d.b[8:])}
+	d.b = d.b[16:]
+	return id
+}
+
+func (d *streamDecoder) string() []byte {
+	s, rest, ok := decodeString(d.b)
+	if !ok {
+		d.corrupt = true
+		d.b = nil
+		return nil
+	}
+	d.b = rest
+	return s
+}
+
+// decodeStream returns the stream encoded in b. Its strings point into b.
+func decodeStream(b []byte) (*stream, error) {
+	d := &streamDecoder{b: b}
+	s := &stream{lastID: d.id()}
+
+	s.entries = make([]streamEntry, d.count())
+	for i := range s.entries {
+		e := &s.entries[i]
+		e.id = d.id()
+		e.fields = make([][]byte, d.count())
+		for j := range e.fields {
+			e.fields[j] = d.string()
+		}
+	}
+
+	s.groups = make([]*streamGroup, d.count())
+	for i := range s.groups {
+		g := &streamGroup{name: d.string(), lastID: d.id()}
+		g.consumers = make([]streamConsumer, d.count())
+		for j := range g.consumers {
+			g.consumers[j] = streamConsumer{name: d.string(), seenAt: int64(d.uvarint())}
+		}
+		g.pending = make([]streamPending, d.count())
+		for j := range g.pending {
+			g.pending[j] = streamPending{id: d.id(), consumer: d.string(), deliveredAt: int64(d.uvarint()), deliveries: d.uvarint()}
+		}
+		s.groups[i] = g
+	}
+
+	if d.corrupt || len(d.b) > 0 {
+		return nil, errCorruptStream
+	}
+	return s, nil
+}
+
+// seek returns the position of the first entry whose ID is not less than id.
+func (s *stream) seek(id streamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(id)
+	})
+}
+
+// after returns up to count entries whose IDs are greater than id, all of them
+// if count is not positive.
+func (s *stream) after(id streamID, count int) []streamEntry {
+	from := len(s.entries)
+	if next, ok := id.next(); ok {
+		from = s.seek(next)
+	}
+
+	entries := s.entries[from:]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
+
+func (s *stream) entry(id streamID) (streamEntry, bool) {
+	at := s.seek(id)
+	if at < len(s.entries) && s.entries[at].id == id {
+		return s.entries[at], true
+	}
+	return streamEntry{}, false
+}
+
+func (s *stream) group(name []byte) *streamGroup {
+	for _, g := range s.groups {
+		if string(g.name) == string(name) {
+			return g
+		}
+	}
+	return nil
+}
+
+// streamIDSpec is the ID argument of XADD.
+type streamIDSpec struct {
+	id      streamID
+	autoMs  bool // *, the ID is made of the current time
+	autoSeq bool // ms-*, the sequence number is the next one of ms
+}
+
+func parseStreamIDSpec(s string) (streamIDSpec, bool) {
+	if s == "*" {
+		return streamIDSpec{autoMs: true}, true
+	}
+	if strings.HasSuffix(s, "-*") {
+		ms, err := strconv.ParseUint(strings.TrimSuffix(s, "-*"), 10, 64)
+		return streamIDSpec{id: streamID{ms: ms}, autoSeq: true}, err == nil
+	}
+
+	id, ok := parseStreamID(s, 0)
+	return streamIDSpec{id: id}, ok
+}
+
+// nextID returns the ID of an entry added to s as spec at now.
+func (s *stream) nextID(spec streamIDSpec, now int64) (streamID, error) {
+	last := s.lastID
+	switch {
+	case spec.autoMs:
+		if uint64(now) > last.ms {
+			return streamID{uint64(now), 0}, nil
+		}
+		id, ok := last.next()
+		if !ok {
+			return id, errStreamExhausted
+		}
+		return id, nil
+	case spec.autoSeq:
+		if spec.id.ms > last.ms {
+			return spec.id, nil
+		}
+		if spec.id.ms < last.ms || last.seq == math.MaxUint64 {
+			return spec.id, errStreamIDTooSmall
+		}
+		return streamID{last.ms, last.seq + 1}, nil
+	}
+
+	if spec.id == (streamID{}) {
+		return spec.id, errStreamIDZero
+	}
+	if !last.less(spec.id) {
+		return spec.id, errStreamIDTooSmall
+	}
+	return spec.id, nil
+}
+
+const (
+	trimMaxLen = iota + 1
+	trimMinID
+)
+
+// streamTrim is the MAXLEN|MINID [=|~] threshold [LIMIT count] of XADD and
+// XTRIM. Trimming is always exact, ~ only allows LIMIT.
+type streamTrim struct {
+	strategy int
+	maxLen   int64
+	minID    streamID
+	approx   bool
+	limit    int64 // at most limit entries are removed, 0 means no limit
+}
+
+// trim removes the entries of s out of t and returns how many.
+func (s *stream) trim(t *streamTrim) int {
+	var n int
+	switch t.strategy {
+	case trimMaxLen:
+		if int64(len(s.entries)) > t.maxLen {
+			n = len(s.entries) - int(t.maxLen)
+		}
+	case trimMinID:
+		n = s.seek(t.minID)
+	}
+	if t.limit > 0 && int64(n) > t.limit {
+		n = int(t.limit)
+	}
+
+	s.entries = s.entries[n:]
+	return n
+}
+
+// args returns t as the arguments of XADD and XTRIM.
+func (t *streamTrim) args() []string {
+	args := []string{"maxlen"}
+	threshold := strconv.FormatInt(t.maxLen, 10)
+	if t.strategy == trimMinID {
+		args[0] = "minid"
+		threshold = t.minID.String()
+	}
+
+	if t.approx {
+		args = append(args, "~")
+	}
+	args = append(args, threshold)
+	if t.limit > 0 {
+		args = append(args, "limit", strconv.FormatInt(t.limit, 10))
+	}
+	return args
+}
+
+// consumer returns the consumer of g named name, which is created if it does
+// not exist, and marks it seen at now.
+func (g *streamGroup) consumer(name []byte, now int64) (c *streamConsumer, created bool) {
+	for i := range g.consumers {
+		if string(g.consumers[i].name) == string(name) {
+			g.consumers[i].seenAt = now
+			return &g.consumers[i], false
+		}
+	}
+
+	g.consumers = append(g.consumers, streamConsumer{name: name, seenAt: now})
+	return &g.consumers[len(g.consumers)-1], true
+}
+
+// findPending returns the position of id in the pending entries of g, or where
+// it would be inserted.
+func (g *streamGroup) findPending(id streamID) (int, bool) {
+	at := sort.Search(len(g.pending), func(i int) bool {
+		return !g.pending[i].id.less(id)
+	})
+	return at, at < len(g.pending) && g.pending[at].id == id
+}
+
+// deliver adds the entry id to the pending entries of consumer.
+func (g *streamGroup) deliver(id streamID, consumer []byte, now int64) {
+	p := streamPending{id: id, consumer: consumer, deliveredAt: now, deliveries: 1}
+
+	at, found := g.findPending(id)
+	if found {
+		g.pending[at] = p
+		return
+	}
+	g.pending = append(g.pending, streamPending{})
+	copy(g.pending[at+1:], g.pending[at:])
+	g.pending[at] = p
+}
+
+// readStream returns the stream in key, nil if key does not exist. db.mu must
+// be held.
+func (db *DB) readStream(key []byte) (*stream, error) {
+	ie, err := db.lookup(key, typeStream)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+
+	// decoded from a copy, the value moves when it is written back.
+	return decodeStream(append([]byte{}, db.ele(ie).val()...))
+}
+
+// writeStream replaces the stream in key with s. Unlike the other types an
+// empty stream is kept. db.mu must be held.
+func (db *DB) writeStream(key []byte, s *stream) error {
+	return db.setValue(key, encodeStream(s), typeStream, keepTTL)
+}
+
+// updateStream runs fn on the stream in key, nil if key does not exist, writes
+// back the stream it returns and logs the wal record it returns. fn returns a
+// nil stream if nothing is changed.
+func (db *DB) updateStream(key []byte, fn func(s *stream) (*stream, []byte, error)) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	s, err := db.readStream(key)
+	if err != nil {
+		return err
+	}
+
+	s, record, err := fn(s)
+	if err != nil || s == nil {
+		return err
+	}
+
+	err = db.writeStream(key, s)
+	if err != nil {
+		return err
+	}
+	return db.persist(record)
+}
+
+// signalStream wakes all the readers blocked on key, a new entry is for every
+// one of them. db.mu must be held.
+func (db *DB) signalStream(key []byte) {
+	db.blocked.Signal(db.dbKey(string(key)), math.MaxInt32)
+	blockedClientsMetric.Set(float64(db.blocked.Len()))
+}
+
+// XAdd adds an entry of fields to the stream in key and returns its ID, then
+// trims the stream if trim is not nil. ok is false if key does not exist and
+// noMkStream is set. The entry is logged with the ID it got, so that replaying
+// the wal adds the same one.
+func (db *DB) XAdd(key []byte, spec streamIDSpec, noMkStream bool, trim *streamTrim, fields [][]byte) (id streamID, ok bool, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	s, err := db.readStream(key)
+	if err != nil {
+		return id, false, err
+	}
+	if s == nil {
+		if noMkStream {
+			return id, false, nil
+		}
+		s = &stream{}
+	}
+
+	id, err = s.nextID(spec, nowMillis())
+	if err != nil {
+		return id, false, err
+	}
+
+	s.lastID = id
+	s.entries = append(s.entries, streamEntry{id: id, fields: fields})
+	record := []string{"xadd", string(key)}
+	if trim != nil {
+		s.trim(trim)
+		record = append(record, trim.args()...)
+	}
+	record = append(record, id.String())
+	for _, f := range fields {
+		record = append(record, string(f))
+	}
+
+	err = db.writeStream(key, s)
+	if err != nil {
+		return id, false, err
+	}
+	err = db.persist(encodeCommand(record...))
+	if err != nil {
+		return id, false, err
+	}
+
+	db.signalStream(key)
+	return id, true, nil
+}
+
+// XTrim trims the stream in key and returns the number of entries removed.
+func (db *DB) XTrim(originCmd []byte, key []byte, trim *streamTrim) (n int, err error) {
+	err = db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			return nil, nil, nil
+		}
+
+		n = s.trim(trim)
+		if n == 0 {
+			return nil, nil, nil
+		}
+		return s, originCmd, nil
+	})
+	return n, err
+}
+
+// XDel removes the entries of ids from the stream in key and returns the
+// number removed.
+func (db *DB) XDel(originCmd []byte, key []byte, ids ...streamID) (n int, err error) {
+	err = db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			return nil, nil, nil
+		}
+
+		for _, id := range ids {
+			at := s.seek(id)
+			if at < len(s.entries) && s.entries[at].id == id {
+				s.entries = append(s.entries[:at], s.entries[at+1:]...)
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, nil, nil
+		}
+		return s, originCmd, nil
+	})
+	return n, err
+}
+
+// XLen returns the number of entries in the stream in key.
+func (db *DB) XLen(key []byte) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, err := db.readStream(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	return len(s.entries), nil
+}
+
+// XRange returns up to count entries of the stream in key from start to end,
+// both included, all of them if count is negative. They are in reverse order
+// if rev is set.
+func (db *DB) XRange(key []byte, start, end streamID, count int, rev bool) ([]streamEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, err := db.readStream(key)
+	if err != nil || s == nil || end.less(start) {
+		return nil, err
+	}
+
+	var entries []streamEntry
+	from, to := s.seek(start), len(s.entries)
+	if next, ok := end.next(); ok {
+		to = s.seek(next)
+	}
+	entries = s.entries[from:to]
+
+	if rev {
+		reversed := make([]streamEntry, len(entries))
+		for i, e := range entries {
+			reversed[len(entries)-1-i] = e
+		}
+		entries = reversed
+	}
+	if count >= 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
+// streamCursor is where XREAD and XREADGROUP read a stream from.
+type streamCursor struct {
+	id     streamID // the entries after id are read
+	latest bool     // $, the last ID of the stream when the read starts
+	fresh  bool     // >, the entries never delivered to the group
+}
+
+// streamRead holds the entries read from the stream in key.
+type streamRead struct {
+	key     []byte
+	entries []streamEntry
+}
+
+// xread reads up to count entries after the cursors from the streams in keys.
+// The $ cursors are turned to the last IDs of the streams by the first read.
+// db.mu must be held.
+func (db *DB) xread(keys [][]byte, cursors []streamCursor, count int) ([]streamRead, error) {
+	var reads []streamRead
+	for i, key := range keys {
+		s, err := db.readStream(key)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &cursors[i]
+		if c.latest {
+			c.latest = false
+			if s != nil {
+				c.id = s.lastID
+			}
+			continue
+		}
+		if s == nil {
+			continue
+		}
+
+		entries := s.after(c.id, count)
+		if len(entries) > 0 {
+			reads = append(reads, streamRead{key: key, entries: entries})
+		}
+	}
+	return reads, nil
+}
+
+// XRead returns up to count entries after the cursors of the streams in keys,
+// nil if there is none.
+func (db *DB) XRead(keys [][]byte, cursors []streamCursor, count int) ([]streamRead, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.xread(keys, cursors, count)
+}
+
+// BlockingXRead is XRead which waits up to timeout for an entry to be added if
+// there is none, 0 waits for ever and a negative timeout does not wait.
+func (db *DB) BlockingXRead(keys [][]byte, cursors []streamCursor, count int, timeout time.Duration) (reads []streamRead, err error) {
+	err = db.block(keys, timeout, func() ([]byte, error) {
+		var err error
+		reads, err = db.xread(keys, cursors, count)
+		if len(reads) == 0 {
+			return nil, err
+		}
+		return reads[0].key, err
+	})
+	return reads, err
+}
+
+// xreadGroup reads up to count entries of the streams in keys for consumer of
+// group, which is created if it does not exist. A > cursor reads the entries
+// never delivered to the group, which are added to the pending entries of
+// consumer unless noAck is set. Another cursor reads the pending entries of
+// consumer after it again, a stream is in the result even if it has none.
+//
+// The read of every stream is logged as an XREADGROUP of the number of entries
+// read, that replays the same delivery. db.mu must be held.
+func (db *DB) xreadGroup(group, consumer []byte, keys [][]byte, cursors []streamCursor, count int, noAck bool) ([]streamRead, error) {
+	streams := make([]*stream, len(keys))
+	for i, key := range keys {
+		s, err := db.readStream(key)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil || s.group(group) == nil {
+			return nil, &noGroupError{key, group}
+		}
+		streams[i] = s
+	}
+
+	now := nowMillis()
+	var reads []streamRead
+	for i, s := range streams {
+		g := s.group(group)
+		_, created := g.consumer(consumer, now)
+
+		c := cursors[i]
+		var entries []streamEntry
+		if c.fresh {
+			entries = s.after(g.lastID, count)
+			for _, e := range entries {
+				g.lastID = e.id
+				if !noAck {
+					g.deliver(e.id, consumer, now)
+				}
+			}
+		} else {
+			entries = make([]streamEntry, 0)
+			for j := range g.pending {
+				p := &g.pending[j]
+				if string(p.consumer) != string(consumer) || !c.id.less(p.id) {
+					continue
+				}
+				if count > 0 && len(entries) == count {
+					break
+				}
+
+				p.deliveredAt = now
+				p.deliveries++
+				e, ok := s.entry(p.id)
+				if !ok {
+					e = streamEntry{id: p.id}
+				}
+				entries = append(entries, e)
+			}
+		}
+
+		var record []byte
+		switch {
+		case len(entries) > 0:
+			args := []string{"xreadgroup", "group", string(group), string(consumer), "count", strconv.Itoa(len(entries))}
+			if noAck {
+				args = append(args, "noack")
+			}
+			from := ">"
+			if !c.fresh {
+				from = c.id.String()
+			}
+			record = encodeCommand(append(args, "streams", string(keys[i]), from)...)
+		case created:
+			record = encodeCommand("xgroup", "createconsumer", string(keys[i]), string(group), string(consumer))
+		}
+		if record != nil {
+			err := db.writeStream(keys[i], s)
+			if err != nil {
+				return nil, err
+			}
+			err = db.persist(record)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(entries) > 0 || !c.fresh {
+			reads = append(reads, streamRead{key: keys[i], entries: entries})
+		}
+	}
+	return reads, nil
+}
+
+// XReadGroup reads the streams in keys for consumer of group, see xreadGroup.
+// It returns nil if there is nothing to read.
+func (db *DB) XReadGroup(group, consumer []byte, keys [][]byte, cursors []streamCursor, count int, noAck bool) (reads []streamRead, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	return db.xreadGroup(group, consumer, keys, cursors, count, noAck)
+}
+
+// BlockingXReadGroup is XReadGroup which waits up to timeout for an entry to be
+// added if there is nothing to read, 0 waits for ever and a negative timeout
+// does not wait.
+func (db *DB) BlockingXReadGroup(group, consumer []byte, keys [][]byte, cursors []streamCursor, count int, noAck bool, timeout time.Duration) (reads []streamRead, err error) {
+	err = db.block(keys, timeout, func() ([]byte, error) {
+		var err error
+		reads, err = db.xreadGroup(group, consumer, keys, cursors, count, noAck)
+		if len(reads) == 0 {
+			return nil, err
+		}
+		return reads[0].key, err
+	})
+	return reads, err
+}
+
+// XAck removes ids from the pending entries of group and returns the number
+// removed.
+func (db *DB) XAck(originCmd []byte, key, group []byte, ids ...streamID) (n int, err error) {
+	err = db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil || s.group(group) == nil {
+			return nil, nil, nil
+		}
+
+		g := s.group(group)
+		for _, id := range ids {
+			at, found := g.findPending(id)
+			if found {
+				g.pending = append(g.pending[:at], g.pending[at+1:]...)
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, nil, nil
+		}
+		return s, originCmd, nil
+	})
+	return n, err
+}
+
+// XPending returns the pending entries of group in ID order.
+func (db *DB) XPending(key, group []byte) ([]streamPending, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, err := db.readStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.group(group) == nil {
+		return nil, &noGroupError{key, group}
+	}
+	return s.group(group).pending, nil
+}
+
+// XGroupCreate creates group of the stream in key, which is created too if
+// mkStream is set. The group starts after the cursor. It is logged with the
+// ID it starts after.
+func (db *DB) XGroupCreate(key, group []byte, cursor streamCursor, mkStream bool) error {
+	return db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			if !mkStream {
+				return nil, nil, errXGroupKeyRequired
+			}
+			s = &stream{}
+		}
+		if s.group(group) != nil {
+			return nil, nil, errBusyGroup
+		}
+
+		id := cursor.id
+		if cursor.latest {
+			id = s.lastID
+		}
+		s.groups = append(s.groups, &streamGroup{name: group, lastID: id})
+
+		record := []string{"xgroup", "create", string(key), string(group), id.String()}
+		if mkStream {
+			record = append(record, "mkstream")
+		}
+		return s, encodeCommand(record...), nil
+	})
+}
+
+// XGroupSetID sets the last delivered ID of group to the cursor. It is logged
+// with the ID it is set to.
+func (db *DB) XGroupSetID(key, group []byte, cursor streamCursor) error {
+	return db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			return nil, nil, errXGroupKeyRequired
+		}
+		g := s.group(group)
+		if g == nil {
+			return nil, nil, &noGroupError{key, group}
+		}
+
+		g.lastID = cursor.id
+		if cursor.latest {
+			g.lastID = s.lastID
+		}
+		return s, encodeCommand("xgroup", "setid", string(key), string(group), g.lastID.String()), nil
+	})
+}
+
+// XGroupDestroy removes group with its consumers and pending entries.
+func (db *DB) XGroupDestroy(originCmd []byte, key, group []byte) (destroyed bool, err error) {
+	err = db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			return nil, nil, errXGroupKeyRequired
+		}
+
+		for i, g := range s.groups {
+			if string(g.name) == string(group) {
+				s.groups = append(s.groups[:i], s.groups[i+1:]...)
+				destroyed = true
+				return s, originCmd, nil
+			}
+		}
+		return nil, nil, nil
+	})
+	return destroyed, err
+}
+
+// XGroupCreateConsumer creates consumer in group, created is false if it
+// exists already.
+func (db *DB) XGroupCreateConsumer(originCmd []byte, key, group, consumer []byte) (created bool, err error) {
+	err = db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			return nil, nil, errXGroupKeyRequired
+		}
+		g := s.group(group)
+		if g == nil {
+			return nil, nil, &noGroupError{key, group}
+		}
+
+		_, created = g.consumer(consumer, nowMillis())
+		if !created {
+			return nil, nil, nil
+		}
+		return s, originCmd, nil
+	})
+	return created, err
+}
+
+// XGroupDelConsumer removes consumer from group with its pending entries and
+// returns the number of pending entries it had.
+func (db *DB) XGroupDelConsumer(originCmd []byte, key, group, consumer []byte) (pending int, err error) {
+	err = db.updateStream(key, func(s *stream) (*stream, []byte, error) {
+		if s == nil {
+			return nil, nil, errXGroupKeyRequired
+		}
+		g := s.group(group)
+		if g == nil {
+			return nil, nil, &noGroupError{key, group}
+		}
+
+		found := false
+		for i, c := range g.consumers {
+			if string(c.name) == string(consumer) {
+				g.consumers = append(g.consumers[:i], g.consumers[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, nil
+		}
+
+		kept := g.pending[:0]
+		for _, p := range g.pending {
+			if string(p.consumer) == string(consumer) {
+				pending++
+				continue
+			}
+			kept = append(kept, p)
+		}
+		g.pending = kept
+		return s, originCmd, nil
+	})
+	return pending, err
+}
+
+// streamCmdError replies the errors of the stream commands which are the
+// fault of the command, it returns false for the others.
+func streamCmdError(cmdhdr *commandHandler, err error) (bool, error) {
+	switch err {
+	case errStreamIDZero, errStreamIDTooSmall, errStreamExhausted, errXGroupKeyRequired:
+		return true, cmdhdr.replyError("ERR " + err.Error())
+	case errBusyGroup:
+		return true, cmdhdr.replyError(err.Error())
+	}
+	if e, ok := err.(*noGroupError); ok {
+		return true, cmdhdr.replyError(e.Error())
+	}
+	return false, nil
+}
+
+func replyStreamEntries(cmdhdr *commandHandler, entries []streamEntry) error {
+	err := cmdhdr.replyArrayLen(len(entries))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = cmdhdr.replyArrayLen(2)
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(e.id.String())
+		if err != nil {
+			return err
+		}
+		if e.fields == nil {
+			err = cmdhdr.replyNullArray()
+		} else {
+			err = replyItems(cmdhdr, e.fields)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replyStreamReads writes the entries read from every stream, a map of key to
+// entries in RESP3 and an array of key and entries pairs in RESP2.
+func replyStreamReads(cmdhdr *commandHandler, reads []streamRead) error {
+	var err error
+	if cmdhdr.resp3() {
+		err = cmdhdr.replyMapLen(len(reads))
+	} else {
+		err = cmdhdr.replyArrayLen(len(reads))
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reads {
+		if !cmdhdr.resp3() {
+			err = cmdhdr.replyArrayLen(2)
+			if err != nil {
+				return err
+			}
+		}
+		err = cmdhdr.replyBulk(string(r.key))
+		if err != nil {
+			return err
+		}
+		err = replyStreamEntries(cmdhdr, r.entries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStreamTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] at
+// args[i] and returns the position after it.
+func parseStreamTrim(args []string, i int) (*streamTrim, int, string) {
+	t := &streamTrim{strategy: trimMaxLen}
+	if strings.ToLower(args[i]) == "minid" {
+		t.strategy = trimMinID
+	}
+	i++
+
+	if i < len(args) && (args[i] == "=" || args[i] == "~") {
+		t.approx = args[i] == "~"
+		i++
+	}
+	if i >= len(args) {
+		return nil, 0, errSyntax
+	}
+
+	if t.strategy == trimMaxLen {
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			return nil, 0, errNotInteger
+		}
+		if n < 0 {
+			return nil, 0, "ERR The MAXLEN argument must be >= 0."
+		}
+		t.maxLen = n
+	} else {
+		id, ok := parseStreamID(args[i], 0)
+		if !ok {
+			return nil, 0, errInvalidStreamID
+		}
+		t.minID = id
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToLower(args[i]) == "limit" {
+		if !t.approx {
+			return nil, 0, "ERR syntax error, LIMIT cannot be used without the special ~ option"
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return nil, 0, errNotInteger
+		}
+		if n < 0 {
+			return nil, 0, "ERR The LIMIT argument must be >= 0."
+		}
+		t.limit = n
+		i += 2
+	}
+	return t, i, ""
+}
+
+// xaddCmd handles XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold
+// [LIMIT count]] *|id field value [field value ...].
+func xaddCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	var noMkStream bool
+	var trim *streamTrim
+
+	i := 2
+	for i < len(cmd) {
+		switch strings.ToLower(cmd[i]) {
+		case "nomkstream":
+			noMkStream = true
+			i++
+			continue
+		case "maxlen", "minid":
+			var errMsg string
+			trim, i, errMsg = parseStreamTrim(cmd, i)
+			if errMsg != "" {
+				return cmdhdr.replyError(errMsg)
+			}
+			continue
+		}
+		break
+	}
+
+	args := cmd[i:]
+	if len(args) < 3 || len(args)%2 == 0 {
+		return cmdhdr.replyError(errWrongArgs("xadd"))
+	}
+	spec, ok := parseStreamIDSpec(args[0])
+	if !ok {
+		return cmdhdr.replyError(errInvalidStreamID)
+	}
+
+	id, ok, err := db.XAdd([]byte(cmd[1]), spec, noMkStream, trim, argsBytes(args[1:]))
+	if err != nil {
+		if replied, rerr := streamCmdError(cmdhdr, err); replied {
+			return rerr
+		}
+		return err
+	}
+	if !ok {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyBulk(id.String())
+}
+
+// xtrimCmd handles XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count].
+func xtrimCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	name := strings.ToLower(cmd[2])
+	if name != "maxlen" && name != "minid" {
+		return cmdhdr.replyError(errSyntax)
+	}
+	trim, i, errMsg := parseStreamTrim(cmd, 2)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+	if i != len(cmd) {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	n, err := db.XTrim(originCmd, []byte(cmd[1]), trim)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func parseStreamIDs(args []string) ([]streamID, bool) {
+	ids := make([]streamID, 0, len(args))
+	for _, arg := range args {
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+func xdelCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	ids, ok := parseStreamIDs(cmd[2:])
+	if !ok {
+		return cmdhdr.replyError(errInvalidStreamID)
+	}
+
+	n, err := db.XDel(originCmd, []byte(cmd[1]), ids...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func xlenCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	n, err := db.XLen([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+// parseRangeID parses the start or end of XRANGE, - and + are the smallest and
+// the greatest IDs and a ( in front excludes the ID.
+func parseRangeID(s string, start bool) (streamID, string) {
+	switch s {
+	case "-":
+		return streamID{}, ""
+	case "+":
+		return maxStreamID, ""
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	seq := uint64(0)
+	if !start {
+		seq = math.MaxUint64
+	}
+	id, ok := parseStreamID(strings.TrimPrefix(s, "("), seq)
+	if !ok {
+		return id, errInvalidStreamID
+	}
+	if !exclusive {
+		return id, ""
+	}
+
+	if start {
+		id, ok = id.next()
+		if !ok {
+			return id, "ERR invalid start ID for the interval"
+		}
+		return id, ""
+	}
+	id, ok = id.prev()
+	if !ok {
+		return id, "ERR invalid end ID for the interval"
+	}
+	return id, ""
+}
+
+// xrangeCmd handles XRANGE key start end [COUNT count] and XREVRANGE key end
+// start [COUNT count].
+func xrangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	rev := strings.ToLower(cmd[0]) == "xrevrange"
+	startArg, endArg := cmd[2], cmd[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, errMsg := parseRangeID(startArg, true)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+	end, errMsg := parseRangeID(endArg, false)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	count := int64(-1)
+	switch {
+	case len(cmd) == 6 && strings.ToLower(cmd[4]) == "count":
+		var err error
+		count, err = strconv.ParseInt(cmd[5], 10, 64)
+		if err != nil {
+			return cmdhdr.replyError(errNotInteger)
+		}
+		if count < 0 {
+			count = 0
+		}
+		if count > math.MaxInt32 {
+			count = math.MaxInt32
+		}
+	case len(cmd) != 4:
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	entries, err := db.XRange([]byte(cmd[1]), start, end, int(count), rev)
+	if err != nil {
+		return err
+	}
+	return replyStreamEntries(cmdhdr, entries)
+}
+
+type xreadArgs struct {
+	group, consumer []byte
+	count           int
+	block           bool
+	timeout         time.Duration
+	noAck           bool
+	keys            [][]byte
+	cursors         []streamCursor
+}
+
+// parseXread parses the arguments of XREAD [COUNT count] [BLOCK milliseconds]
+// STREAMS key [key ...] id [id ...] and of XREADGROUP, which starts with
+// GROUP group consumer and may have NOACK.
+func parseXread(cmd []string) (*xreadArgs, string) {
+	name := strings.ToLower(cmd[0])
+	group := name == "xreadgroup"
+	a := &xreadArgs{}
+
+	i := 1
+	for ; i < len(cmd); i++ {
+		opt := strings.ToLower(cmd[i])
+		if opt == "streams" {
+			break
+		}
+
+		switch {
+		case opt == "group" && group && i+2 < len(cmd):
+			a.group, a.consumer = []byte(cmd[i+1]), []byte(cmd[i+2])
+			i += 2
+		case opt == "count" && i+1 < len(cmd):
+			n, err := strconv.ParseInt(cmd[i+1], 10, 64)
+			if err != nil {
+				return nil, errNotInteger
+			}
+			if n > math.MaxInt32 {
+				n = math.MaxInt32
+			}
+			a.count = int(n)
+			i++
+		case opt == "block" && i+1 < len(cmd):
+			ms, err := strconv.ParseInt(cmd[i+1], 10, 64)
+			if err != nil {
+				return nil, "ERR timeout is not an integer or out of range"
+			}
+			if ms < 0 {
+				return nil, "ERR timeout is negative"
+			}
+			a.block = true
+			a.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case opt == "noack" && group:
+			a.noAck = true
+		default:
+			return nil, errSyntax
+		}
+	}
+	if group && a.group == nil {
+		return nil, "ERR Missing GROUP option for XREADGROUP"
+	}
+
+	args := cmd[i:]
+	if len(args) < 3 || len(args)%2 == 0 {
+		if len(args) == 0 {
+			return nil, errSyntax
+		}
+		return nil, fmt.Sprintf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", name)
+	}
+
+	n := len(args) / 2
+	for j := 1; j <= n; j++ {
+		a.keys = append(a.keys, []byte(args[j]))
+
+		var c streamCursor
+		switch id := args[n+j]; {
+		case id == "$" && !group:
+			c.latest = true
+		case id == "$":
+			return nil, "ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."
+		case id == ">" && group:
+			c.fresh = true
+		case id == ">":
+			return nil, "ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option."
+		default:
+			var ok bool
+			c.id, ok = parseStreamID(id, 0)
+			if !ok {
+				return nil, errInvalidStreamID
+			}
+		}
+		a.cursors = append(a.cursors, c)
+	}
+	return a, ""
+}
+
+// xreadCmd handles XREAD and XREADGROUP. It replies the entries read from
+// every stream, a null array if there is none.
+func xreadCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	a, errMsg := parseXread(cmd)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	timeout := time.Duration(-1)
+	if a.block {
+		timeout = a.timeout
+	}
+
+	var reads []streamRead
+	var err error
+	switch {
+	case a.group == nil && cmdhdr.inExec:
+		// blocking commands do not block inside EXEC, the same as redis.
+		reads, err = db.XRead(a.keys, a.cursors, a.count)
+	case a.group == nil:
+		reads, err = db.BlockingXRead(a.keys, a.cursors, a.count, timeout)
+	case cmdhdr.inExec:
+		reads, err = db.XReadGroup(a.group, a.consumer, a.keys, a.cursors, a.count, a.noAck)
+	default:
+		reads, err = db.BlockingXReadGroup(a.group, a.consumer, a.keys, a.cursors, a.count, a.noAck, timeout)
+	}
+	if err != nil {
+		if e, ok := err.(*noGroupError); ok {
+			return cmdhdr.replyError(e.Error() + " in XREADGROUP with GROUP option")
+		}
+		return err
+	}
+
+	if len(reads) == 0 {
+		return cmdhdr.replyNullArray()
+	}
+	return replyStreamReads(cmdhdr, reads)
+}
+
+func xackCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	ids, ok := parseStreamIDs(cmd[3:])
+	if !ok {
+		return cmdhdr.replyError(errInvalidStreamID)
+	}
+
+	n, err := db.XAck(originCmd, []byte(cmd[1]), []byte(cmd[2]), ids...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+// xpendingCmd handles XPENDING key group [[IDLE min-idle-time] start end count
+// [consumer]]. Without a range it replies the number of pending entries, the
+// smallest and the greatest of their IDs and the number of them of every
+// consumer.
+func xpendingCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	args := cmd[3:]
+	var minIdle int64
+	if len(args) > 0 && strings.ToLower(args[0]) == "idle" {
+		if len(args) < 2 {
+			return cmdhdr.replyError(errSyntax)
+		}
+		var err error
+		minIdle, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return cmdhdr.replyError(errNotInteger)
+		}
+		args = args[2:]
+		if len(args) == 0 {
+			return cmdhdr.replyError(errSyntax)
+		}
+	}
+	if len(args) != 0 && len(args) != 3 && len(args) != 4 {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	pending, err := db.XPending([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil {
+		if replied, rerr := streamCmdError(cmdhdr, err); replied {
+			return rerr
+		}
+		return err
+	}
+
+	if len(args) == 0 {
+		return replyPendingSummary(cmdhdr, pending)
+	}
+
+	start, errMsg := parseRangeID(args[0], true)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+	end, errMsg := parseRangeID(args[1], false)
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+	count, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	now := nowMillis()
+	var found []streamPending
+	for _, p := range pending {
+		if int64(len(found)) >= count {
+			break
+		}
+		if p.id.less(start) || end.less(p.id) || now-p.deliveredAt < minIdle {
+			continue
+		}
+		if len(args) == 4 && string(p.consumer) != args[3] {
+			continue
+		}
+		found = append(found, p)
+	}
+
+	err = cmdhdr.replyArrayLen(len(found))
+	if err != nil {
+		return err
+	}
+	for _, p := range found {
+		err = cmdhdr.replyArrayLen(4)
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(p.id.String())
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(string(p.consumer))
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyInt(now - p.deliveredAt)
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyInt(int64(p.deliveries))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replyPendingSummary(cmdhdr *commandHandler, pending []streamPending) error {
+	err := cmdhdr.replyArrayLen(4)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyInt(int64(len(pending)))
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		for i := 0; i < 2; i++ {
+			err = cmdhdr.replyNull()
+			if err != nil {
+				return err
+			}
+		}
+		return cmdhdr.replyNullArray()
+	}
+
+	err = cmdhdr.replyBulk(pending[0].id.String())
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk(pending[len(pending)-1].id.String())
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, p := range pending {
+		counts[string(p.consumer)]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err = cmdhdr.replyArrayLen(len(names))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = replyItems(cmdhdr, [][]byte{[]byte(name), []byte(strconv.Itoa(counts[name]))})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseGroupCursor parses the ID of XGROUP CREATE and SETID, $ is the last ID
+// of the stream.
+func parseGroupCursor(s string) (streamCursor, bool) {
+	if s == "$" {
+		return streamCursor{latest: true}, true
+	}
+	id, ok := parseStreamID(s, 0)
+	return streamCursor{id: id}, ok
+}
+
+// xgroupCmd handles XGROUP CREATE key group id|$ [MKSTREAM], XGROUP SETID key
+// group id|$, XGROUP DESTROY key group, XGROUP CREATECONSUMER key group
+// consumer and XGROUP DELCONSUMER key group consumer.
+func xgroupCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	sub := strings.ToLower(cmd[1])
+	arities := map[string][2]int{
+		"create":         {5, 6},
+		"setid":          {5, 5},
+		"destroy":        {4, 4},
+		"createconsumer": {5, 5},
+		"delconsumer":    {5, 5},
+	}
+	arity, ok := arities[sub]
+	if !ok {
+		return cmdhdr.replyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", cmd[1]))
+	}
+	if len(cmd) < arity[0] || len(cmd) > arity[1] {
+		return cmdhdr.replyError(errWrongArgs("xgroup|" + sub))
+	}
+
+	key, group := []byte(cmd[2]), []byte(cmd[3])
+	var err error
+	var n int64
+	switch sub {
+	case "create", "setid":
+		cursor, ok := parseGroupCursor(cmd[4])
+		if !ok {
+			return cmdhdr.replyError(errInvalidStreamID)
+		}
+
+		if sub == "setid" {
+			err = db.XGroupSetID(key, group, cursor)
+			break
+		}
+		if len(cmd) == 6 && strings.ToLower(cmd[5]) != "mkstream" {
+			return cmdhdr.replyError(errSyntax)
+		}
+		err = db.XGroupCreate(key, group, cursor, len(cmd) == 6)
+	case "destroy":
+		var destroyed bool
+		destroyed, err = db.XGroupDestroy(originCmd, key, group)
+		n = boolInt(destroyed)
+	case "createconsumer":
+		var created bool
+		created, err = db.XGroupCreateConsumer(originCmd, key, group, []byte(cmd[4]))
+		n = boolInt(created)
+	case "delconsumer":
+		var pending int
+		pending, err = db.XGroupDelConsumer(originCmd, key, group, []byte(cmd[4]))
+		n = int64(pending)
+	}
+	if err != nil {
+		if replied, rerr := streamCmdError(cmdhdr, err); replied {
+			return rerr
+		}
+		return err
+	}
+
+	if sub == "create" || sub == "setid" {
+		return cmdhdr.replyOK()
+	}
+	return cmdhdr.replyInt(n)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_streamEncoding(t *testing.T) {
+	s := &stream{
+		lastID: streamID{5, 1},
+		entries: []streamEntry{
+			{streamID{1, 0}, argsBytes([]string{"f", "v"})},
+			{streamID{5, 1}, argsBytes([]string{"a", "", "b", "2"})},
+		},
+		groups: []*streamGroup{{
+			name:      []byte("g"),
+			lastID:    streamID{1, 0},
+			consumers: []streamConsumer{{[]byte("c1"), 1000}, {[]byte("c2"), 2000}},
+			pending:   []streamPending{{streamID{1, 0}, []byte("c1"), 1500, 3}},
+		}},
+	}
+
+	decoded, err := decodeStream(encodeStream(s))
+	assert.Nil(t, err)
+	assert.Equal(t, s, decoded)
+
+	empty, err := decodeStream(encodeStream(&stream{}))
+	assert.Nil(t, err)
+	assert.Len(t, empty.entries, 0)
+
+	b := encodeStream(s)
+	for _, bad := range [][]byte{{}, b[:len(b)-1], append(b, 0), append(b[:16:16], 100)} {
+		_, err := decodeStream(bad)
+		assert.Equal(t, errCorruptStream, err, bad)
+	}
+}
+
+func Test_streamID(t *testing.T) {
+	cases := []struct {
+		arg string
+		id  streamID
+		ok  bool
+	}{
+		{"1-2", streamID{1, 2}, true},
+		{"7", streamID{7, 9}, true},
+		{"18446744073709551615-18446744073709551615", maxStreamID, true},
+		{"1-", streamID{}, false},
+		{"-1", streamID{}, false},
+		{"1-2-3", streamID{}, false},
+		{"x", streamID{}, false},
+	}
+	for _, c := range cases {
+		id, ok := parseStreamID(c.arg, 9)
+		assert.Equal(t, c.ok, ok, c.arg)
+		if ok {
+			assert.Equal(t, c.id, id, c.arg)
+		}
+	}
+
+	s := &stream{lastID: streamID{10, 5}}
+	next := func(spec string, now int64) string {
+		parsed, ok := parseStreamIDSpec(spec)
+		assert.True(t, ok, spec)
+		id, err := s.nextID(parsed, now)
+		if err != nil {
+			return err.Error()
+		}
+		return id.String()
+	}
+	assert.Equal(t, "20-0", next("*", 20))
+	assert.Equal(t, "10-6", next("*", 3))
+	assert.Equal(t, "10-6", next("10-*", 0))
+	assert.Equal(t, "11-0", next("11-*", 0))
+	assert.Equal(t, errStreamIDTooSmall.Error(), next("9-*", 0))
+	assert.Equal(t, errStreamIDTooSmall.Error(), next("10-5", 0))
+	assert.Equal(t, "10-7", next("10-7", 0))
+
+	s.lastID = streamID{}
+	assert.Equal(t, "0-1", next("0-*", 0))
+	assert.Equal(t, errStreamIDZero.Error(), next("0-0", 0))
+	s.lastID = maxStreamID
+	assert.Equal(t, errStreamExhausted.Error(), next("*", 0))
+}
+
+func Test_streamCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"xadd", "s", "nomkstream", "*", "f", "v"}, "$-1\r\n"},
+		{[]string{"type", "s"}, "+none\r\n"},
+		{[]string{"xadd", "s", "1-1", "a", "1"}, "$3\r\n1-1\r\n"},
+		{[]string{"xadd", "s", "1-*", "b", "2"}, "$3\r\n1-2\r\n"},
+		{[]string{"xadd", "s", "2", "c", "3", "d", "4"}, "$3\r\n2-0\r\n"},
+		{[]string{"xadd", "s", "2-0", "e", "5"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"xadd", "s", "0-0", "e", "5"}, "-ERR The ID specified in XADD must be greater than 0-0\r\n"},
+		{[]string{"xadd", "s", "x-1", "e", "5"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{[]string{"xadd", "s", "3-0", "e"}, "-ERR wrong number of arguments for 'xadd' command\r\n"},
+		{[]string{"xlen", "s"}, ":3\r\n"},
+		{[]string{"type", "s"}, "+stream\r\n"},
+		{[]string{"xrange", "s", "-", "+"}, "*3\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n" +
+			"*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n" +
+			"*2\r\n$3\r\n2-0\r\n*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n"},
+		{[]string{"xrange", "s", "1", "1", "count", "1"}, "*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"xrange", "s", "(1-1", "(2-0"}, "*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"xrevrange", "s", "+", "-", "count", "1"}, "*1\r\n*2\r\n$3\r\n2-0\r\n*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n"},
+		{[]string{"xrange", "s", "2", "1"}, "*0\r\n"},
+		{[]string{"xrange", "s", "(0-0", "+", "count", "0"}, "*0\r\n"},
+		{[]string{"xrange", "nosuch", "-", "+"}, "*0\r\n"},
+		{[]string{"xrange", "s", "-", "+", "limit", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"xdel", "s", "1-2", "9-9"}, ":1\r\n"},
+		{[]string{"xlen", "s"}, ":2\r\n"},
+		{[]string{"xadd", "s", "maxlen", "2", "3-0", "e", "5"}, "$3\r\n3-0\r\n"},
+		{[]string{"xrange", "s", "-", "+", "count", "1"}, "*1\r\n*2\r\n$3\r\n2-0\r\n*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n"},
+		{[]string{"xadd", "s", "maxlen", "1", "limit", "1", "*", "f", "v"}, "-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n"},
+		{[]string{"xadd", "s", "maxlen", "-1", "*", "f", "v"}, "-ERR The MAXLEN argument must be >= 0.\r\n"},
+		{[]string{"xtrim", "s", "minid", "3"}, ":1\r\n"},
+		{[]string{"xtrim", "s", "maxlen", "~", "0", "limit", "5"}, ":1\r\n"},
+		{[]string{"xlen", "s"}, ":0\r\n"},
+		// an empty stream is kept with its last ID.
+		{[]string{"type", "s"}, "+stream\r\n"},
+		{[]string{"xadd", "s", "3-0", "e", "5"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"xtrim", "s", "size", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"xread", "streams", "s", "nosuch", "0", "0"}, "*-1\r\n"},
+		{[]string{"xadd", "s", "4-0", "f", "v"}, "$3\r\n4-0\r\n"},
+		{[]string{"xadd", "s2", "1-0", "g", "w"}, "$3\r\n1-0\r\n"},
+		{[]string{"xread", "count", "5", "streams", "s", "s2", "0", "0"}, "*2\r\n" +
+			"*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n4-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n" +
+			"*2\r\n$2\r\ns2\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\ng\r\n$1\r\nw\r\n"},
+		{[]string{"xread", "streams", "s", "s2", "4-0", "$"}, "*-1\r\n"},
+		{[]string{"xread", "streams", "s", "s2", "0"}, "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n"},
+		{[]string{"xread", "streams", "s", ">"}, "-ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.\r\n"},
+		{[]string{"xread", "block", "-1", "streams", "s", "0"}, "-ERR timeout is negative\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+
+	// the streams read are a map in RESP3.
+	cmdhdr.proto = resp3
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("xread", "streams", "s2", "0")))
+	assert.Equal(t, "%1\r\n$2\r\ns2\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\ng\r\n$1\r\nw\r\n", out)
+}
+
+func Test_streamGroups(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"xgroup", "create", "s", "g", "$"}, "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n"},
+		{[]string{"xgroup", "create", "s", "g", "$", "mkstream"}, "+OK\r\n"},
+		{[]string{"xgroup", "create", "s", "g", "0"}, "-BUSYGROUP Consumer Group name already exists\r\n"},
+		{[]string{"xgroup", "create", "s", "g2", "x"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{[]string{"xgroup", "create", "s"}, "-ERR wrong number of arguments for 'xgroup|create' command\r\n"},
+		{[]string{"xgroup", "help2"}, "-ERR unknown subcommand 'help2'. Try XGROUP HELP.\r\n"},
+		{[]string{"xadd", "s", "1-0", "a", "1"}, "$3\r\n1-0\r\n"},
+		{[]string{"xadd", "s", "2-0", "b", "2"}, "$3\r\n2-0\r\n"},
+		{[]string{"xadd", "s", "3-0", "c", "3"}, "$3\r\n3-0\r\n"},
+		{[]string{"xreadgroup", "group", "nosuch", "c1", "streams", "s", ">"}, "-NOGROUP No such key 's' or consumer group 'nosuch' in XREADGROUP with GROUP option\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c1", "streams", "s", "$"}, "-ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c1", "count", "2", "streams", "s", ">"}, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n" +
+			"*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c2", "streams", "s", ">"}, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n" +
+			"*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c2", "streams", "s", ">"}, "*-1\r\n"},
+		{[]string{"xpending", "s", "g"}, "*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n" +
+			"*2\r\n$2\r\nc1\r\n$1\r\n2\r\n*2\r\n$2\r\nc2\r\n$1\r\n1\r\n"},
+		// the history of c1 is read again.
+		{[]string{"xreadgroup", "group", "g", "c1", "streams", "s", "0"}, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n" +
+			"*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"xdel", "s", "2-0"}, ":1\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c1", "streams", "s", "1-0"}, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*-1\r\n"},
+		{[]string{"xack", "s", "g", "1-0", "2-0", "9-0"}, ":2\r\n"},
+		{[]string{"xack", "s", "nosuch", "3-0"}, ":0\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c1", "streams", "s", "0"}, "*1\r\n*2\r\n$1\r\ns\r\n*0\r\n"},
+		{[]string{"xpending", "s", "g", "-", "+", "10", "c1"}, "*0\r\n"},
+		{[]string{"xpending", "s", "g", "idle", "100000", "-", "+", "10"}, "*0\r\n"},
+		{[]string{"xpending", "s", "nosuch"}, "-NOGROUP No such key 's' or consumer group 'nosuch'\r\n"},
+		{[]string{"xgroup", "createconsumer", "s", "g", "c3"}, ":1\r\n"},
+		{[]string{"xgroup", "createconsumer", "s", "g", "c3"}, ":0\r\n"},
+		{[]string{"xgroup", "delconsumer", "s", "g", "c2"}, ":1\r\n"},
+		{[]string{"xpending", "s", "g"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{[]string{"xgroup", "setid", "s", "g", "0"}, "+OK\r\n"},
+		{[]string{"xreadgroup", "group", "g", "c3", "noack", "streams", "s", ">"}, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n" +
+			"*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{[]string{"xpending", "s", "g"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{[]string{"xgroup", "setid", "s", "nosuch", "0"}, "-NOGROUP No such key 's' or consumer group 'nosuch'\r\n"},
+		{[]string{"xgroup", "destroy", "s", "g"}, ":1\r\n"},
+		{[]string{"xgroup", "destroy", "s", "g"}, ":0\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("xgroup", "create", "s", "g", "0"))+
+		string(encodeCommand("xreadgroup", "group", "g", "c", "count", "1", "streams", "s", ">"))+
+		string(encodeCommand("xpending", "s", "g", "-", "+", "10")))
+	assert.Regexp(t, "\\*1\r\n\\*4\r\n\\$3\r\n1-0\r\n\\$1\r\nc\r\n:\\d+\r\n:1\r\n$", out)
+}
+
+func Test_streamWrongType(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	input := string(encodeCommand("set", "str", "v")) +
+		string(encodeCommand("xadd", "str", "*", "f", "v")) +
+		string(encodeCommand("xread", "streams", "str", "0")) +
+		string(encodeCommand("xgroup", "create", "str", "g", "0")) +
+		string(encodeCommand("xadd", "s", "1-0", "f", "v")) +
+		string(encodeCommand("lpush", "s", "a"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n"+wrongType+wrongType+wrongType+"$3\r\n1-0\r\n"+wrongType, out)
+}
+
+func Test_blockingXread(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("xgroup", "create", "s", "g", "$", "mkstream")))
+	assert.Equal(t, "+OK\r\n", out)
+
+	// all the readers of a stream get a new entry, and one consumer of a group.
+	c1 := runBlocking(t, db, string(encodeCommand("xread", "block", "0", "streams", "other", "s", "$", "$")))
+	c2 := runBlocking(t, db, string(encodeCommand("xread", "block", "0", "streams", "s", "$")))
+	c3 := runBlocking(t, db, string(encodeCommand("xreadgroup", "group", "g", "c3", "block", "0", "streams", "s", ">")))
+	c4 := runBlocking(t, db, string(encodeCommand("xreadgroup", "group", "g", "c4", "block", "0", "streams", "s", ">")))
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("xadd", "s", "1-0", "f", "v")))
+	assert.Equal(t, "$3\r\n1-0\r\n", out)
+
+	entry := func(id string) string {
+		return "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n" + id + "\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"
+	}
+	assert.Equal(t, entry("1-0"), <-c1)
+	assert.Equal(t, entry("1-0"), <-c2)
+
+	// the consumer which found nothing left is blocked again.
+	var first, second chan string
+	select {
+	case out = <-c3:
+		first, second = c3, c4
+	case out = <-c4:
+		first, second = c4, c3
+	}
+	assert.Equal(t, entry("1-0"), out)
+	for db.blocked.Len() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, first, 0)
+
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("xadd", "s", "2-0", "f", "v")))
+	assert.Equal(t, "$3\r\n2-0\r\n", out)
+	assert.Equal(t, entry("2-0"), <-second)
+
+	start := time.Now()
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("xread", "block", "50", "streams", "s", "$")))
+	assert.Equal(t, "*-1\r\n", out)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, 0, db.blocked.Len())
+
+	// blocking commands do not block inside a transaction.
+	out = runCommands(t, db, cmdhdr, string(encodeCommand("multi"))+
+		string(encodeCommand("xread", "block", "0", "streams", "s", "$"))+
+		string(encodeCommand("xreadgroup", "group", "g", "c", "block", "0", "streams", "s", ">"))+
+		string(encodeCommand("exec")))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n*-1\r\n*-1\r\n", out)
+}
+
+func Test_recoverStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("xadd", "s", "*", "a", "1")) +
+		string(encodeCommand("xadd", "s", "*", "b", "2")) +
+		string(encodeCommand("xadd", "s", "maxlen", "2", "*", "c", "3")) +
+		string(encodeCommand("xgroup", "create", "s", "g", "0")) +
+		string(encodeCommand("xreadgroup", "group", "g", "c1", "count", "1", "block", "10", "streams", "s", ">")) +
+		string(encodeCommand("xreadgroup", "group", "g", "c2", "streams", "s", ">")) +
+		string(encodeCommand("xack", "s", "g", "0-0"))
+	runCommands(t, db, cmdhdr, input)
+
+	entries, err := db.XRange([]byte("s"), streamID{}, maxStreamID, -1, false)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	pending, err := db.XPending([]byte("s"), []byte("g"))
+	assert.Nil(t, err)
+	assert.Len(t, pending, 2)
+
+	// the IDs are logged as they were made, the blocking read without BLOCK.
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(wal), string(encodeCommand("xadd", "s", "maxlen", "2", entries[1].id.String(), "c", "3")))
+	assert.Contains(t, string(wal), string(encodeCommand("xreadgroup", "group", "g", "c1", "count", "1", "streams", "s", ">")))
+	assert.NotContains(t, string(wal), "block")
+
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// the consumer group survives a restart.
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	restarted, err := db.XPending([]byte("s"), []byte("g"))
+	assert.Nil(t, err)
+	assert.Equal(t, pending, restarted)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// and a crash which lost the db file.
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	recovered, err := db.XRange([]byte("s"), streamID{}, maxStreamID, -1, false)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, recovered)
+	pending, err = db.XPending([]byte("s"), []byte("g"))
+	assert.Nil(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, []byte("c1"), pending[0].consumer)
+	assert.Equal(t, entries[0].id, pending[0].id)
+	assert.Equal(t, []byte("c2"), pending[1].consumer)
+	assert.Equal(t, entries[1].id, pending[1].id)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The read-modify-write string commands run under db.mu, so no write of
+// another connection can come in between the read and the write. They are
+// logged to wal as SET of the value they write, or DEL, so that replay gives
+// the same value whatever it starts from.
+
+var (
+	errStringNotInteger = commandError("value is not an integer or out of range")
+	errStringTooLong    = commandError("string exceeds maximum allowed size (proto-max-bulk-len)")
+)
+
+// updateString runs fn on the string in key, nil if key does not exist, and
+// writes back the value fn returns with the expire time of key kept. fn
+// returns a nil value if nothing is changed.
+func (db *DB) updateString(key []byte, fn func(old []byte) ([]byte, error)) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	ie, err := db.lookup(key, typeString)
+	if err != nil {
+		return err
+	}
+
+	var old []byte
+	if ie.pgid != 0 {
+		old = append([]byte{}, db.ele(ie).val()...)
+	}
+
+	val, err := fn(old)
+	if err != nil || val == nil {
+		return err
+	}
+
+	err = db.set(key, val, keepTTL)
+	if err != nil {
+		return err
+	}
+	return db.persist(encodeCommand("set", string(key), string(val), "keepttl"))
+}
+
+// IncrBy adds delta to the integer in key, a missing key counts as 0, and
+// returns the result.
+func (db *DB) IncrBy(key []byte, delta int64) (n int64, err error) {
+	err = db.updateString(key, func(old []byte) ([]byte, error) {
+		if old != nil {
+			var err error
+			n, err = strconv.ParseInt(string(old), 10, 64)
+			if err != nil {
+				return nil, errStringNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, errOverflow
+		}
+
+		n += delta
+		return []byte(strconv.FormatInt(n, 10)), nil
+	})
+	return n, err
+}
+
+// IncrByFloat adds delta to the number in key, a missing key counts as 0, and
+// returns the result.
+func (db *DB) IncrByFloat(key []byte, delta float64) (result string, err error) {
+	err = db.updateString(key, func(old []byte) ([]byte, error) {
+		var f float64
+		if old != nil {
+			var err error
+			f, err = strconv.ParseFloat(string(old), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, errNotFloat
+			}
+		}
+		f += delta
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errNaNOrInf
+		}
+
+		result = strconv.FormatFloat(f, 'f', -1, 64)
+		return []byte(result), nil
+	})
+	return result, err
+}
+
+// Append appends val to the string in key, which is created if it does not
+// exist, and returns the length of the result.
+func (db *DB) Append(key, val []byte) (n int, err error) {
+	err = db.updateString(key, func(old []byte) ([]byte, error) {
+		if len(old)+len(val) > maxBulkLen {
+			return nil, errStringTooLong
+		}
+
+		result := append(append(make([]byte, 0, len(old)+len(val)), old...), val...)
+		n = len(result)
+		return result, nil
+	})
+	return n, err
+}
+
+// SetRange overwrites the string in key from offset with val, padding it with
+// zero bytes if it is shorter than offset, and returns the length of the
+// result. A missing key is not created for an empty val.
+func (db *DB) SetRange(key []byte, offset int, val []byte) (n int, err error) {
+	err = db.updateString(key, func(old []byte) ([]byte, error) {
+		n = len(old)
+		if len(val) == 0 {
+			return nil, nil
+		}
+		if offset+len(val) > maxBulkLen {
+			return nil, errStringTooLong
+		}
+
+		result := old
+		if offset+len(val) > len(result) {
+			result = make([]byte, offset+len(val))
+			copy(result, old)
+		}
+		copy(result[offset:], val)
+		n = len(result)
+		return result, nil
+	})
+	return n, err
+}
+
+// GetSet sets key to val and returns the string it held before, nil if it did
+// not exist. The expire time of key is removed like SET does.
+func (db *DB) GetSet(key, val []byte) (old []byte, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	ie, err := db.lookup(key, typeString)
+	if err != nil {
+		return nil, err
+	}
+	if ie.pgid != 0 {
+		old = append([]byte{}, db.ele(ie).val()...)
+	}
+
+	err = db.set(key, val, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = db.persist(encodeCommand("set", string(key), string(val)))
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// GetDel removes key and returns the string it held, NotFoundError if it does
+// not exist.
+func (db *DB) GetDel(key []byte) (val []byte, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	ie, err := db.lookup(key, typeString)
+	if err != nil {
+		return nil, err
+	}
+	if ie.pgid == 0 {
+		return nil, NotFoundError
+	}
+	val = append([]byte{}, db.ele(ie).val()...)
+
+	_, err = db.del(key)
+	if err != nil {
+		return nil, err
+	}
+	err = db.persist(encodeCommand("del", string(key)))
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// StrLen returns the length of the string in key, 0 if it does not exist.
+func (db *DB) StrLen(key []byte) (int, error) {
+	val, err := db.Get(key)
+	if err == NotFoundError {
+		return 0, nil
+	}
+	return len(val), err
+}
+
+// GetRange returns the substring of the string in key from start to end, both
+// included. Negative offsets count from the end, -1 is the last byte.
+func (db *DB) GetRange(key []byte, start, end int64) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ie, err := db.lookup(key, typeString)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+	val := db.ele(ie).val()
+
+	n := int64(len(val))
+	if start < 0 && end < 0 && start > end {
+		return nil, nil
+	}
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || n == 0 {
+		return nil, nil
+	}
+	return append([]byte{}, val[start:end+1]...), nil
+}
+
+// incrCmd handles INCR, DECR, INCRBY and DECRBY.
+func incrCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	name := strings.ToLower(cmd[0])
+
+	delta := int64(1)
+	if len(cmd) == 3 {
+		var err error
+		delta, err = strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil {
+			return cmdhdr.replyError(errNotInteger)
+		}
+	}
+	if strings.HasPrefix(name, "decr") {
+		if delta == math.MinInt64 {
+			return cmdhdr.replyError("ERR decrement would overflow")
+		}
+		delta = -delta
+	}
+
+	n, err := db.IncrBy([]byte(cmd[1]), delta)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(n)
+}
+
+func incrbyfloatCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	delta, err := strconv.ParseFloat(cmd[2], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return cmdhdr.replyError("ERR value is not a valid float")
+	}
+
+	result, err := db.IncrByFloat([]byte(cmd[1]), delta)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyBulk(result)
+}
+
+func appendCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	n, err := db.Append([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func setrangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	offset, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+	if offset < 0 {
+		return cmdhdr.replyError("ERR offset is out of range")
+	}
+	if offset > maxBulkLen {
+		return cmdhdr.replyError("ERR " + errStringTooLong.Error())
+	}
+
+	n, err := db.SetRange([]byte(cmd[1]), int(offset), []byte(cmd[3]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func getrangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	start, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+	end, err := strconv.ParseInt(cmd[3], 10, 64)
+	if err != nil {
+		return cmdhdr.replyError(errNotInteger)
+	}
+
+	val, err := db.GetRange([]byte(cmd[1]), start, end)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyBulk(string(val))
+}
+
+func getsetCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	old, err := db.GetSet([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyBulk(string(old))
+}
+
+func getdelCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	val, err := db.GetDel([]byte(cmd[1]))
+	if err != nil {
+		if err == NotFoundError {
+			return cmdhdr.replyNull()
+		}
+		return err
+	}
+	return cmdhdr.replyBulk(string(val))
+}
+
+func strlenCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	n, err := db.StrLen([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
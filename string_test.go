@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_stringCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"incr", "n"}, ":1\r\n"},
+		{[]string{"incrby", "n", "41"}, ":42\r\n"},
+		{[]string{"decr", "n"}, ":41\r\n"},
+		{[]string{"decrby", "n", "-9"}, ":50\r\n"},
+		{[]string{"incrby", "n", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"decrby", "n", "-9223372036854775808"}, "-ERR decrement would overflow\r\n"},
+		{[]string{"set", "max", "9223372036854775807"}, "+OK\r\n"},
+		{[]string{"incr", "max"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"set", "s", "abc"}, "+OK\r\n"},
+		{[]string{"incr", "s"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"set", "sp", " 1"}, "+OK\r\n"},
+		{[]string{"incr", "sp"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"incrbyfloat", "f", "10.5"}, "$4\r\n10.5\r\n"},
+		{[]string{"incrbyfloat", "f", "0.1"}, "$4\r\n10.6\r\n"},
+		{[]string{"incrbyfloat", "f", "-5e3"}, "$7\r\n-4989.4\r\n"},
+		{[]string{"incrbyfloat", "f", "x"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"incrbyfloat", "s", "1"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"incrbyfloat", "max", "1.7e308"}, "$309\r\n17" + strings.Repeat("0", 307) + "\r\n"},
+		{[]string{"incrbyfloat", "max", "1.7e308"}, "-ERR increment would produce NaN or Infinity\r\n"},
+		{[]string{"append", "a", "hello"}, ":5\r\n"},
+		{[]string{"append", "a", " world"}, ":11\r\n"},
+		{[]string{"get", "a"}, "$11\r\nhello world\r\n"},
+		{[]string{"strlen", "a"}, ":11\r\n"},
+		{[]string{"strlen", "nosuch"}, ":0\r\n"},
+		{[]string{"getrange", "a", "0", "4"}, "$5\r\nhello\r\n"},
+		{[]string{"getrange", "a", "-5", "-1"}, "$5\r\nworld\r\n"},
+		{[]string{"getrange", "a", "-1", "-5"}, "$0\r\n\r\n"},
+		{[]string{"getrange", "a", "-100", "100"}, "$11\r\nhello world\r\n"},
+		{[]string{"getrange", "nosuch", "0", "-1"}, "$0\r\n\r\n"},
+		{[]string{"setrange", "a", "6", "redis"}, ":11\r\n"},
+		{[]string{"get", "a"}, "$11\r\nhello redis\r\n"},
+		{[]string{"setrange", "pad", "3", "x"}, ":4\r\n"},
+		{[]string{"get", "pad"}, "$4\r\n\x00\x00\x00x\r\n"},
+		{[]string{"setrange", "empty", "5", ""}, ":0\r\n"},
+		{[]string{"type", "empty"}, "+none\r\n"},
+		{[]string{"setrange", "a", "-1", "x"}, "-ERR offset is out of range\r\n"},
+		{[]string{"setrange", "a", "536870912", "x"}, "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+		{[]string{"getset", "a", "new"}, "$11\r\nhello redis\r\n"},
+		{[]string{"getset", "g", "v"}, "$-1\r\n"},
+		{[]string{"getdel", "g"}, "$1\r\nv\r\n"},
+		{[]string{"getdel", "g"}, "$-1\r\n"},
+		{[]string{"type", "g"}, "+none\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_stringKeepTTL(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	input := string(encodeCommand("set", "n", "1", "ex", "100")) +
+		string(encodeCommand("incr", "n")) +
+		string(encodeCommand("append", "n", "0")) +
+		string(encodeCommand("ttl", "n")) +
+		string(encodeCommand("getset", "n", "1")) +
+		string(encodeCommand("ttl", "n"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n:2\r\n:2\r\n:100\r\n$2\r\n20\r\n:-1\r\n", out)
+}
+
+func Test_stringWrongType(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	input := string(encodeCommand("hset", "h", "f", "1")) +
+		string(encodeCommand("incr", "h")) +
+		string(encodeCommand("incrbyfloat", "h", "1")) +
+		string(encodeCommand("append", "h", "x")) +
+		string(encodeCommand("getset", "h", "x")) +
+		string(encodeCommand("getdel", "h")) +
+		string(encodeCommand("strlen", "h")) +
+		string(encodeCommand("getrange", "h", "0", "-1")) +
+		string(encodeCommand("setrange", "h", "0", "x"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, ":1\r\n"+strings.Repeat(wrongType, 8), out)
+}
+
+func Test_concurrentIncr(t *testing.T) {
+	db := newTestDB(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := db.IncrBy([]byte("counter"), 1)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := db.GetString("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, "800", v)
+}
+
+func Test_recoverString(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("incrby", "n", "5")) +
+		string(encodeCommand("incrbyfloat", "f", "1.5")) +
+		string(encodeCommand("append", "a", "ab")) +
+		string(encodeCommand("setrange", "a", "3", "c")) +
+		string(encodeCommand("set", "d", "v")) +
+		string(encodeCommand("getdel", "d"))
+	runCommands(t, db, cmdhdr, input)
+
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(wal), "incr")
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	// replay must not depend on what is in the db before.
+	err = os.WriteFile(filepath.Join(path, "wal"), append(wal, wal...), 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for key, expect := range map[string]string{"n": "5", "f": "1.5", "a": "ab\x00c"} {
+		v, err := db.GetString(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expect, v, key)
+	}
+	_, err = db.GetString("d")
+	assert.Equal(t, NotFoundError, err)
+}
+
+func Test_msetCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"mset", "k1", "v1", "k2", "v2", "k1", "v3"}, "+OK\r\n"},
+		{[]string{"mset", "k1", "v1", "k2"}, "-ERR wrong number of arguments for 'mset' command\r\n"},
+		{[]string{"mget", "k1", "k2", "nosuch"}, "*3\r\n$2\r\nv3\r\n$2\r\nv2\r\n$-1\r\n"},
+		{[]string{"msetnx", "k3", "v3", "k1", "x"}, ":0\r\n"},
+		{[]string{"mget", "k1", "k3"}, "*2\r\n$2\r\nv3\r\n$-1\r\n"},
+		{[]string{"msetnx", "k3", "v3", "k4", "v4"}, ":1\r\n"},
+		{[]string{"msetnx", "k5"}, "-ERR wrong number of arguments for 'msetnx' command\r\n"},
+		{[]string{"setnx", "k3", "x"}, ":0\r\n"},
+		{[]string{"setnx", "k5", "v5"}, ":1\r\n"},
+		{[]string{"mget", "k3", "k4", "k5"}, "*3\r\n$2\r\nv3\r\n$2\r\nv4\r\n$2\r\nv5\r\n"},
+		{[]string{"hset", "h", "f", "v"}, ":1\r\n"},
+		{[]string{"mget", "h", "k1"}, "*2\r\n$-1\r\n$2\r\nv3\r\n"},
+		{[]string{"msetnx", "h", "v"}, ":0\r\n"},
+		{[]string{"set", "t", "v", "ex", "100"}, "+OK\r\n"},
+		{[]string{"mset", "t", "v"}, "+OK\r\n"},
+		{[]string{"ttl", "t"}, ":-1\r\n"},
+		{[]string{"mset", "h", "v"}, "+OK\r\n"},
+		{[]string{"type", "h"}, "+string\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+}
+
+func Test_recoverMset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("mset", "k1", "v1", "k2", "v2")) +
+		string(encodeCommand("msetnx", "k1", "x", "k3", "x")) +
+		string(encodeCommand("msetnx", "k3", "v3", "k4", "v4")) +
+		string(encodeCommand("setnx", "k1", "x"))
+	runCommands(t, db, cmdhdr, input)
+
+	// one record for each batch which is applied.
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(encodeCommand("mset", "k1", "v1", "k2", "v2"))+string(encodeCommand("mset", "k3", "v3", "k4", "v4")), string(wal))
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	vals := db.MGet([]byte("k1"), []byte("k2"), []byte("k3"), []byte("k4"))
+	assert.Equal(t, [][]byte{[]byte("v1"), []byte("v2"), []byte("v3"), []byte("v4")}, vals)
+}
@@ -1,28 +1,70 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
 	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	undoImageRecord    = 0x01 // image of a key in db 0, written before there were dbs
+	undoCommitRecord   = 0x02
+	undoRollbackRecord = 0x03
+	undoDBImageRecord  = 0x04 // image of a key, its header starts with the db number
+	undoSwapRecord     = 0x05 // SWAPDB, followed by the two db numbers
+
+	// kind(1) + txid(8)
+	undoRecordHeaderSize = 9
+	// found(1) + expireAt(8) + kSize(4) + vSize(4). found is 0 if the key did
+	// not exist, or 1 + the type of its value.
+	undoImageHeaderSize = 17
 )
 
 var (
-	transactionID uint64
+	multiRecord = encodeCommand("multi")
+	execRecord  = encodeCommand("exec")
 )
-func (db *DB) Transaction(fn func(ctx context.Context, transactionID uint64) error) error {
+
+// undoImage is the before-image of a key modified inside a transaction, or a
+// SWAPDB of db and other if swap is set.
+type undoImage struct {
+	txid     uint64
+	db       int
+	swap     bool
+	other    int
+	found    bool
+	typ      byte
+	expireAt int64
+	key      []byte
+	val      []byte
+}
+
+func (db *DB) Transaction(fn func(ctx context.Context, transactionID uint64) error) (err error) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+
 	txid := db.getTransactionID()
+	db.beginTx(txid)
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := db.rollback(txid)
-			if err != nil {
-				panic(err)
+			nerr := db.rollback(txid)
+			if nerr != nil {
+				panic(nerr)
 			}
+			err = fmt.Errorf("transaction %d panicked: %v", txid, r)
 		}
 	}()
 
 	ctx := context.Background()
 
-	err := fn(ctx, txid)
+	err = fn(ctx, txid)
 	if err != nil {
 		nerr := db.rollback(txid)
 		if nerr != nil {
@@ -32,16 +74,383 @@ func (db *DB) Transaction(fn func(ctx context.Context, transactionID uint64) err
 		}
 	}
 
-	return nil
+	return db.commit(txid)
 }
 
 func (db *DB) getTransactionID() uint64 {
-	txid := atomic.AddUint64(&transactionID, 1)
+	txid := atomic.AddUint64(&db.transactionID, 1)
 	return txid
 }
 
+func (db *DB) beginTx(txid uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.activeTx = txid
+	db.txImages = db.txImages[:0]
+	db.txWal = db.txWal[:0]
+}
+
+func (db *DB) commit(txid uint64) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	db.activeTx = 0
+	db.txImages = db.txImages[:0]
+
+	if len(db.txWal) > 0 {
+		// wrapped in MULTI/EXEC so that recovery never replays a half written
+		// transaction. The wal may be rotated since txWal was begun, so the db
+		// of its first record is only known now.
+		record := make([]byte, 0, len(multiRecord)+len(db.txWal)+len(execRecord))
+		record = append(record, multiRecord...)
+		if db.txFirstDB != db.walDB {
+			record = append(record, encodeCommand("select", strconv.Itoa(db.txFirstDB))...)
+		}
+		record = append(record, db.txWal...)
+		record = append(record, execRecord...)
+		db.walDB = db.txWalDB
+
+		err = db.appendWal(record)
+		if err != nil {
+			return err
+		}
+	}
+	db.txWal = db.txWal[:0]
+
+	return db.finishUndo(txid, undoCommitRecord)
+}
+
+// rollback restores the before-images of txid in reverse order.
 func (db *DB) rollback(txid uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	images := db.txImages
+	db.activeTx = 0
+	db.txImages = nil
+	db.txWal = db.txWal[:0]
+
+	err := db.restoreImages(images)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("transaction %d rolled back, %d images restored", txid, len(images))
+	return db.finishUndo(txid, undoRollbackRecord)
+}
 
+func (db *DB) restoreImages(images []undoImage) error {
+	for i := len(images) - 1; i >= 0; i-- {
+		img := images[i]
+		d := db.dbs[img.db]
+		if img.swap {
+			db.swapIndexes(img.db, img.other)
+		} else if img.found {
+			err := d.setValue(img.key, img.val, img.typ, img.expireAt)
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err := d.del(img.key)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// saveUndo writes the before-image of key to the undo file if a transaction is running.
+func (db *DB) saveUndo(key []byte) error {
+	if db.activeTx == 0 || db.undo == nil {
+		return nil
+	}
+
+	img := undoImage{
+		txid: db.activeTx,
+		db:   db.num,
+		key:  append([]byte{}, key...),
+	}
+
+	_, ie := db.findIndexEleInChain(key)
+	if ie.pgid != 0 {
+		ele := &db.page(ie.pgid).elements().eles[ie.at]
+		img.found = true
+		img.typ = ele.typ()
+		img.expireAt = ele.expireAt
+		img.val = append([]byte{}, ele.val()...)
+	}
+
+	_, err := db.undo.Write(encodeUndoImage(img))
+	if err != nil {
+		return err
+	}
+
+	err = syncFile(db.undo)
+	if err != nil {
+		return err
+	}
+
+	db.txImages = append(db.txImages, img)
+	return nil
+}
+
+// saveSwapUndo writes the undo record of SWAPDB a b if a transaction is running.
+func (db *DB) saveSwapUndo(a, b int) error {
+	if db.activeTx == 0 || db.undo == nil {
+		return nil
+	}
+
+	img := undoImage{txid: db.activeTx, db: a, swap: true, other: b}
+	_, err := db.undo.Write(encodeUndoImage(img))
+	if err != nil {
+		return err
+	}
+
+	err = syncFile(db.undo)
+	if err != nil {
+		return err
+	}
+
+	db.txImages = append(db.txImages, img)
+	return nil
+}
+
+// finishUndo marks txid as done so that it is not rolled back on startup.
+func (db *DB) finishUndo(txid uint64, kind byte) error {
+	if db.undo == nil {
+		return nil
+	}
+
+	_, err := db.undo.Write(encodeUndoHeader(kind, txid))
+	if err != nil {
+		return err
+	}
+
+	stat, err := db.undo.Stat()
+	if err != nil {
+		return err
+	}
+
+	// no transaction is running here, the whole undo file can be dropped.
+	if stat.Size() > db.cfg.WalMaxSize {
+		return db.undo.Truncate(0)
+	}
+
+	return syncFile(db.undo)
+}
+
+func encodeUndoHeader(kind byte, txid uint64) []byte {
+	buf := make([]byte, undoRecordHeaderSize)
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:], txid)
+	return buf
+}
+
+func encodeUndoImage(img undoImage) []byte {
+	if img.swap {
+		buf := encodeUndoHeader(undoSwapRecord, img.txid)
+		return append(buf, byte(img.db), byte(img.other))
+	}
+
+	buf := encodeUndoHeader(undoDBImageRecord, img.txid)
+	buf = append(buf, byte(img.db))
+
+	hdr := make([]byte, undoImageHeaderSize)
+	if img.found {
+		hdr[0] = 1 + img.typ
+	}
+	binary.BigEndian.PutUint64(hdr[1:], uint64(img.expireAt))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(img.key)))
+	binary.BigEndian.PutUint32(hdr[13:], uint32(len(img.val)))
+
+	buf = append(buf, hdr...)
+	buf = append(buf, img.key...)
+	buf = append(buf, img.val...)
+	return buf
+}
+
+// decodeUndoLog returns the before-images of all transactions which have neither
+// commit record nor rollback record, in the order they were written.
+func decodeUndoLog(r io.Reader) ([]undoImage, error) {
+	images := make([]undoImage, 0)
+	finished := make(map[uint64]bool)
+
+	for {
+		hdr := make([]byte, undoRecordHeaderSize)
+		_, err := io.ReadFull(r, hdr)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+
+		kind := hdr[0]
+		txid := binary.BigEndian.Uint64(hdr[1:])
+
+		if kind == undoCommitRecord || kind == undoRollbackRecord {
+			finished[txid] = true
+			continue
+		}
+
+		if kind == undoSwapRecord {
+			dbs := make([]byte, 2)
+			_, err = io.ReadFull(r, dbs)
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				return nil, err
+			}
+			if dbs[0] >= maxDatabases || dbs[1] >= maxDatabases {
+				return nil, fmt.Errorf("invalid dbs %d and %d in undo record", dbs[0], dbs[1])
+			}
+			images = append(images, undoImage{txid: txid, db: int(dbs[0]), swap: true, other: int(dbs[1])})
+			continue
+		}
+
+		if kind != undoImageRecord && kind != undoDBImageRecord {
+			return nil, fmt.Errorf("invalid undo record kind %d", kind)
+		}
+
+		imgHdr := make([]byte, undoImageHeaderSize)
+		dbNum := 0
+		if kind == undoDBImageRecord {
+			imgHdr = make([]byte, 1+undoImageHeaderSize)
+		}
+		_, err = io.ReadFull(r, imgHdr)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// torn write, the data page was not touched yet.
+				break
+			}
+			return nil, err
+		}
+		if kind == undoDBImageRecord {
+			dbNum = int(imgHdr[0])
+			imgHdr = imgHdr[1:]
+		}
+		if dbNum >= maxDatabases {
+			return nil, fmt.Errorf("invalid db %d in undo record", dbNum)
+		}
+
+		kSize := binary.BigEndian.Uint32(imgHdr[9:])
+		kv := make([]byte, kSize+binary.BigEndian.Uint32(imgHdr[13:]))
+		_, err = io.ReadFull(r, kv)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+
+		images = append(images, undoImage{
+			txid:     txid,
+			db:       dbNum,
+			found:    imgHdr[0] != 0,
+			typ:      imgHdr[0] - 1,
+			expireAt: int64(binary.BigEndian.Uint64(imgHdr[1:])),
+			key:      kv[:kSize],
+			val:      kv[kSize:],
+		})
+	}
+
+	pending := images[:0]
+	for _, img := range images {
+		if !finished[img.txid] {
+			pending = append(pending, img)
+		}
+	}
+
+	return pending, nil
+}
+
+func (db *DB) rollbackUndoLog(undoLog []byte) error {
+	images, err := decodeUndoLog(bytes.NewReader(undoLog))
+	if err != nil {
+		return err
+	}
+
+	if len(images) == 0 {
+		return nil
+	}
+
+	logrus.Infof("rolling back %d undo images of unfinished transactions", len(images))
+	return db.restoreImages(images)
+}
+
+type watchedKey struct {
+	version uint64
+	refs    int
+}
+
+// dbKey qualifies key with the number of db. State shared by the dbs which is
+// kept by key, like watched keys and blocked connections, uses it.
+func (db *DB) dbKey(key string) string {
+	return strconv.Itoa(db.num) + ":" + key
+}
+
+// watch starts tracking modifications of key, which is qualified by dbKey, and
+// returns its current version.
+func (db *DB) watch(key string) uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.watched == nil {
+		db.watched = make(map[string]*watchedKey)
+	}
+
+	wk, ok := db.watched[key]
+	if !ok {
+		wk = &watchedKey{version: db.watchVersion}
+		db.watched[key] = wk
+	}
+	wk.refs++
+
+	return wk.version
+}
+
+func (db *DB) unwatch(keys map[string]uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key := range keys {
+		wk, ok := db.watched[key]
+		if !ok {
+			continue
+		}
+		wk.refs--
+		if wk.refs <= 0 {
+			delete(db.watched, key)
+		}
+	}
+}
+
+// checkWatched reports whether none of the keys is modified since they were watched.
+func (db *DB) checkWatched(keys map[string]uint64) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, version := range keys {
+		wk, ok := db.watched[key]
+		if !ok || wk.version != version {
+			return false
+		}
+	}
+	return true
+}
+
+// touch bumps the version of key if someone is watching it.
+func (db *DB) touch(key []byte) {
+	if len(db.watched) == 0 {
+		return
+	}
+	wk, ok := db.watched[db.dbKey(string(key))]
+	if !ok {
+		return
+	}
+	db.watchVersion++
+	wk.version = db.watchVersion
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const a = "A_ACCOUNT_MONEY"
@@ -32,7 +35,7 @@ func getCurrentValues(db *DB) (av, bv int, err error) {
 		return 0, 0, err
 	}
 
-	return aami,  bami, nil
+	return aami, bami, nil
 }
 
 func buildNormalTransaction(db *DB) func(ctx context.Context, transactionID uint64) error {
@@ -131,10 +134,115 @@ func TestDB_Transaction(t *testing.T) {
 }
 
 func Test_getTransactionID(t *testing.T) {
-	db := &DB{}
+	db := &DB{store: &store{}}
 	txid := db.getTransactionID()
 	assert.Equal(t, uint64(1), txid)
 
 	txid = db.getTransactionID()
 	assert.Equal(t, uint64(2), txid)
-}
\ No newline at end of file
+}
+
+func TestDB_TransactionPanic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, t.Name()+"_db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	rawExecuteCases(t, db, []op{{"S", a, "100"}})
+
+	oerr := db.Transaction(func(ctx context.Context, transactionID uint64) error {
+		err := db.SetString([]byte{}, a, "99")
+		assert.Nil(t, err)
+		err = db.SetString([]byte{}, b, "1")
+		assert.Nil(t, err)
+		panic("boom")
+	})
+	assert.NotNil(t, oerr)
+
+	rawExecuteCases(t, db, []op{
+		{"G", a, "100"},
+		{"G", b, "not found"},
+	})
+}
+
+func TestDB_TransactionIsolatesOtherConns(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, t.Name()+"_db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	done := make(chan struct{})
+	oerr := db.Transaction(func(ctx context.Context, transactionID uint64) error {
+		err := db.SetString([]byte{}, a, "99")
+		assert.Nil(t, err)
+
+		// a write of another connection arrives while the transaction runs.
+		go func() {
+			defer close(done)
+			cmd := "*3\r\n$3\r\nset\r\n$1\r\nc\r\n$1\r\n1\r\n"
+			cmdhdr := newCommandHandler(bytes.NewReader([]byte(cmd)), ioutil.Discard, nil)
+			originCmd, args, err := cmdhdr.Next()
+			err = executeCmd(cmdhdr, db, originCmd, args, err)
+			assert.Nil(t, err)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		return errors.New("abort")
+	})
+	assert.NotNil(t, oerr)
+	<-done
+
+	rawExecuteCases(t, db, []op{
+		{"G", a, "not found"},
+		{"G", "c", "1"},
+	})
+}
+
+func TestDB_RollbackUndoOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, t.Name()+"_db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+
+	rawExecuteCases(t, db, []op{
+		{"S", a, "100"},
+		{"S", b, "0"},
+	})
+
+	// a committed transaction followed by one interrupted by a crash.
+	err = db.Transaction(buildNormalTransaction(db))
+	assert.Nil(t, err)
+
+	db.beginTx(db.getTransactionID())
+	err = db.SetString([]byte{}, a, "98")
+	assert.Nil(t, err)
+	err = db.SetString([]byte{}, "C_ACCOUNT_MONEY", "1")
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	rawExecuteCases(t, db, []op{
+		{"G", a, "99"},
+		{"G", b, "1"},
+		{"G", "C_ACCOUNT_MONEY", "not found"},
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openFixtureDir returns a data dir holding testdata/name as its db file.
+//
+// testdata/v1.db.gz is written by the first version of miniRedis:
+// small-000..small-199 => v-NNN, mid-000..mid-059 => 400 times the
+// letter 'a'+i%26, big => 10000 'b', then small-N with N%10 == 0 and
+// mid-N with N%7 == 0 are deleted and small-N with N%10 == 5 are set to
+// w-NNN.
+func openFixtureDir(t *testing.T, name string) string {
+	if os.Getpagesize() != 4096 {
+		t.Skipf("fixture %s is written with 4096 bytes pages", name)
+	}
+
+	path := filepath.Join(t.TempDir(), t.Name()+"_db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	src, err := os.Open(filepath.Join("testdata", name))
+	assert.Nil(t, err)
+	defer src.Close()
+
+	zr, err := gzip.NewReader(src)
+	assert.Nil(t, err)
+
+	dst, err := os.Create(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	defer dst.Close()
+
+	_, err = io.Copy(dst, zr)
+	assert.Nil(t, err)
+
+	return path
+}
+
+func v1FixtureCases() []op {
+	var cases []op
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("small-%03d", i)
+		switch i % 10 {
+		case 0:
+			cases = append(cases, op{"G", key, "not found"})
+		case 5:
+			cases = append(cases, op{"G", key, fmt.Sprintf("w-%03d", i)})
+		default:
+			cases = append(cases, op{"G", key, fmt.Sprintf("v-%03d", i)})
+		}
+	}
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("mid-%03d", i)
+		if i%7 == 0 {
+			cases = append(cases, op{"G", key, "not found"})
+		} else {
+			cases = append(cases, op{"G", key, strings.Repeat(string(rune('a'+i%26)), 400)})
+		}
+	}
+	return append(cases, op{"G", "big", strings.Repeat("b", 10000)})
+}
+
+func Test_upgradeFromV1(t *testing.T) {
+	path := openFixtureDir(t, "v1.db.gz")
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint32(dbVersion), db.page(0).meta().version)
+	rawExecuteCases(t, db, v1FixtureCases())
+
+	// upgraded eles never expire until told so.
+	_, ie := db.findIndexEleInChain([]byte("small-001"))
+	assert.NotEqual(t, uint64(0), ie.pgid)
+	assert.Equal(t, int64(0), db.ele(ie).expireAt)
+
+	_, _, err = db.SetWithOptions(nil, []byte("small-002"), []byte("x"), setOptions{expireAt: nowMillis() - 1})
+	assert.Nil(t, err)
+	rawExecuteCases(t, db, []op{
+		{"G", "small-002", "not found"},
+		{"S", "small-003", strings.Repeat("c", 2000)},
+		{"S", "new", "1"},
+	})
+
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	rawExecuteCases(t, db, []op{
+		{"G", "small-001", "v-001"},
+		{"G", "small-002", "not found"},
+		{"G", "small-003", strings.Repeat("c", 2000)},
+		{"G", "small-005", "w-005"},
+		{"G", "mid-001", strings.Repeat("b", 400)},
+		{"G", "big", strings.Repeat("b", 10000)},
+		{"G", "new", "1"},
+	})
+}
+
+func Test_refuseNewerVersion(t *testing.T) {
+	path := openFixtureDir(t, "v1.db.gz")
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.page(0).meta().version = dbVersion + 1
+	err = db.Close()
+	assert.Nil(t, err)
+
+	_, err = LoadOrCreateDbFromDir(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Writes are group committed. A write appends its wal record to a shared buffer
+// while it holds db.mu, then releases db.mu and waits. A single writer goroutine
+// takes the whole buffer, writes it to the wal file and fsyncs it once for the
+// batch, then wakes up everyone waiting for it.
+//
+// Positions in wal are log sequence numbers (lsn), which never go back. The wal
+// file starts at walFileBase, so the position of lsn in the file is
+// lsn - walFileBase.
+
+const (
+	fsyncAlways   = "always"
+	fsyncEverysec = "everysec"
+	fsyncNo       = "no"
+
+	walSyncInterval = time.Second
+	// with everysec, the wal writer fsyncs by itself once the background fsync
+	// is this much behind, which bounds the data that can be lost.
+	walMaxFsyncDelay = 2 * time.Second
+)
+
+// initWal sets up the wal writer state for a wal file of walSize bytes and
+// starts the wal writer and the background syncer.
+func (db *DB) initWal(walSize int64) {
+	db.walAppended = walSize
+	db.walWritten = walSize
+	db.walSynced = walSize
+	db.walPending = sync.NewCond(&db.mu)
+	db.walCond = sync.NewCond(&db.walMu)
+	db.walWriterDone = make(chan struct{})
+
+	go db.walWriterLoop()
+	db.startWalSyncer()
+}
+
+// persist appends originCmd to the wal buffer. The caller waits for it with
+// unlockAndWaitWal. A SELECT record goes first if the record before is for
+// another db, so that replay runs originCmd in db as redis AOF does.
+func (db *DB) persist(originCmd []byte) error {
+	if !db.serving || len(originCmd) == 0 {
+		return nil
+	}
+
+	if db.activeTx != 0 {
+		// written to wal as a whole when the transaction commits.
+		if len(db.txWal) == 0 {
+			db.txFirstDB = db.num
+		} else if db.num != db.txWalDB {
+			db.txWal = append(db.txWal, encodeCommand("select", strconv.Itoa(db.num))...)
+		}
+		db.txWalDB = db.num
+		db.txWal = append(db.txWal, originCmd...)
+		return nil
+	}
+
+	if db.num != db.walDB {
+		originCmd = append(encodeCommand("select", strconv.Itoa(db.num)), originCmd...)
+		db.walDB = db.num
+	}
+
+	return db.appendWal(originCmd)
+}
+
+// appendWal appends record to the wal buffer as it is.
+func (db *DB) appendWal(originCmd []byte) error {
+	db.walBuf = append(db.walBuf, originCmd...)
+	db.walAppended += int64(len(originCmd))
+
+	if len(db.crashKey) > 0 && bytes.Contains(originCmd, db.crashKey) {
+		// crash right after the record reaches the wal file. failWal keeps the
+		// deferred unlockAndWaitWal from waiting for the wal writer.
+		db.wal.Write(db.walBuf)
+		db.failWal(errors.New("db crashed"))
+		panic("db crashed")
+	}
+
+	db.walPending.Signal()
+	return nil
+}
+
+// unlockAndWaitWal releases db.mu held by a write, then waits until the wal
+// records appended by it are written, and fsynced if appendfsync is always.
+// A wal error is stored in *err unless it already holds one.
+func (db *DB) unlockAndWaitWal(err *error) {
+	lsn := db.walAppended
+	policy := db.cfg.AppendFsync
+	db.mu.Unlock()
+
+	werr := db.waitWal(lsn, policy)
+	if *err == nil {
+		*err = werr
+	}
+}
+
+func (db *DB) waitWal(lsn int64, policy string) error {
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+
+	for {
+		if db.walErr != nil {
+			return db.walErr
+		}
+
+		done := db.walWritten
+		if policy == fsyncAlways {
+			done = db.walSynced
+		}
+		if done >= lsn {
+			return nil
+		}
+
+		db.walCond.Wait()
+	}
+}
+
+func (db *DB) walWriterLoop() {
+	defer close(db.walWriterDone)
+
+	for {
+		db.mu.Lock()
+		for len(db.walBuf) == 0 && !db.isClosing() {
+			db.walPending.Wait()
+		}
+		if len(db.walBuf) == 0 {
+			// closing and everything is written.
+			db.mu.Unlock()
+			return
+		}
+
+		batch := db.walBuf
+		db.walBuf = db.walSpare[:0]
+		end := db.walAppended
+		endDB := db.walDB
+		policy := db.cfg.AppendFsync
+		maxSize := db.cfg.WalMaxSize
+		size := end - db.walFileBase
+		db.mu.Unlock()
+
+		err := db.writeWalBatch(batch, end, policy)
+		if err != nil {
+			logrus.Errorf("wal writer error, writes fail from now on. %s", err.Error())
+			db.failWal(err)
+			return
+		}
+		db.walSpare = batch[:0]
+		walFileSizeMetric.Set(float64(size))
+
+		// the db file already holds everything in the batch, and the wal file
+		// does too from now on.
+		db.mu.Lock()
+		meta := db.page(0).meta()
+		meta.checkpoint = uint64(end - db.walFileBase)
+		meta.checkpointDB = uint64(endDB)
+		walCheckpointMetric.Set(float64(meta.checkpoint))
+		db.mu.Unlock()
+
+		if size > maxSize {
+			err = db.rotateWal()
+			if err != nil {
+				logrus.Errorf("wal rotation error, writes fail from now on. %s", err.Error())
+				db.failWal(err)
+				return
+			}
+		}
+	}
+}
+
+// writeWalBatch writes batch which ends at lsn end to the wal file, and fsyncs
+// it as policy says.
+func (db *DB) writeWalBatch(batch []byte, end int64, policy string) error {
+	// rotation is done by this goroutine only, so db.wal does not change here.
+	_, err := db.wal.Write(batch)
+	if err != nil {
+		return err
+	}
+	walBatchSizeMetric.Set(float64(len(batch)))
+
+	db.walMu.Lock()
+	if db.walWritten == db.walSynced {
+		db.walDirtySince = time.Now()
+	}
+	db.walWritten = end
+	lag := db.walLag()
+	db.walCond.Broadcast()
+	db.walMu.Unlock()
+
+	switch policy {
+	case fsyncAlways:
+		return db.syncWal(end)
+	case fsyncEverysec:
+		walFsyncLagMetric.Set(lag.Seconds())
+		if lag > walMaxFsyncDelay {
+			logrus.Warnf("wal fsync is %s behind, syncing in the wal writer", lag)
+			return db.syncWal(end)
+		}
+	}
+	return nil
+}
+
+// syncWal fsyncs the wal file which has been written up to lsn end.
+func (db *DB) syncWal(end int64) error {
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+
+	start := time.Now()
+	err := syncFile(db.wal)
+	if err != nil {
+		return err
+	}
+	walFsyncDurationMetric.Set(time.Now().Sub(start).Seconds())
+
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+
+	if end > db.walSynced {
+		db.walSynced = end
+	}
+	if db.walSynced >= db.walWritten {
+		db.walDirtySince = time.Time{}
+	} else {
+		// everything left was written after the sync started.
+		db.walDirtySince = start
+	}
+	walFsyncLagMetric.Set(db.walLag().Seconds())
+	db.walCond.Broadcast()
+
+	return nil
+}
+
+// rotateWal empties the wal file once it is larger than wal-max-size. The wal
+// buffer is written and the db file is flushed first, as the records dropped
+// exist nowhere else after that.
+func (db *DB) rotateWal() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the background syncer must not sync the file being truncated.
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+
+	if len(db.walBuf) > 0 {
+		_, err := db.wal.Write(db.walBuf)
+		if err != nil {
+			return err
+		}
+		db.walBuf = db.walBuf[:0]
+	}
+
+	err := syncFile(db.wal)
+	if err != nil {
+		return err
+	}
+
+	err = db.flush()
+	if err != nil {
+		return err
+	}
+
+	err = db.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	db.walFileBase = db.walAppended
+	meta := db.page(0).meta()
+	meta.checkpoint = 0
+	// replay of the new wal starts in db 0.
+	meta.checkpointDB = 0
+	db.walDB = 0
+	walFileSizeMetric.Set(0)
+	walCheckpointMetric.Set(0)
+
+	db.walMu.Lock()
+	db.walWritten = db.walAppended
+	db.walSynced = db.walAppended
+	db.walDirtySince = time.Time{}
+	db.walCond.Broadcast()
+	db.walMu.Unlock()
+
+	logrus.Infof("wal rotated at lsn %d", db.walAppended)
+	return nil
+}
+
+func (db *DB) failWal(err error) {
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+
+	db.walErr = err
+	db.walCond.Broadcast()
+}
+
+// walLag is how long the oldest write not yet synced has been waiting, with walMu held.
+func (db *DB) walLag() time.Duration {
+	if db.walSynced >= db.walWritten {
+		return 0
+	}
+	return time.Now().Sub(db.walDirtySince)
+}
+
+// startWalSyncer fsyncs wal every second in the background when appendfsync is everysec.
+func (db *DB) startWalSyncer() {
+	go func() {
+		tick := time.NewTicker(walSyncInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+				err := db.backgroundSyncWal()
+				if err != nil {
+					logrus.Errorf("background wal fsync error. %s", err.Error())
+				}
+			case <-db.closing:
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) backgroundSyncWal() error {
+	db.mu.Lock()
+	policy := db.cfg.AppendFsync
+	db.mu.Unlock()
+
+	db.walMu.Lock()
+	written, synced := db.walWritten, db.walSynced
+	walFsyncLagMetric.Set(db.walLag().Seconds())
+	db.walMu.Unlock()
+
+	if policy != fsyncEverysec || written == synced {
+		return nil
+	}
+
+	return db.syncWal(written)
+}
+
+// closeWal waits for the wal writer to write everything appended, then fsyncs
+// and closes the wal file.
+func (db *DB) closeWal() error {
+	db.mu.Lock()
+	db.walPending.Broadcast()
+	db.mu.Unlock()
+
+	<-db.walWriterDone
+
+	db.walMu.Lock()
+	err := db.walErr
+	written := db.walWritten
+	db.walMu.Unlock()
+	if err != nil {
+		db.wal.Close()
+		return err
+	}
+
+	err = db.syncWal(written)
+	if err != nil {
+		return err
+	}
+
+	return db.wal.Close()
+}
+
+func (db *DB) isClosing() bool {
+	select {
+	case <-db.closing:
+		return true
+	default:
+		return false
+	}
+}
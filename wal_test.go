@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newServingTestDB(t *testing.T, cfg *Config) *DB {
+	cfg.Dir = filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(cfg.Dir, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbWithConfig(cfg)
+	assert.Nil(t, err)
+	db.serving = true
+
+	return db
+}
+
+// walState returns the lsn appended, written and fsynced.
+func walState(db *DB) (int64, int64, int64) {
+	db.mu.Lock()
+	appended := db.walAppended
+	db.mu.Unlock()
+
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+	return appended, db.walWritten, db.walSynced
+}
+
+func Test_appendFsync(t *testing.T) {
+	t.Run("always", func(t *testing.T) {
+		db := newServingTestDB(t, defaultConfig())
+		defer db.Close()
+
+		err := db.SetString(encodeCommand("set", "k", "v"), "k", "v")
+		assert.Nil(t, err)
+		appended, written, synced := walState(db)
+		assert.Equal(t, appended, written)
+		assert.Equal(t, appended, synced)
+	})
+
+	t.Run("everysec", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.AppendFsync = fsyncEverysec
+		db := newServingTestDB(t, cfg)
+		defer db.Close()
+
+		cmd := encodeCommand("set", "k", "v")
+		err := db.SetString(cmd, "k", "v")
+		assert.Nil(t, err)
+		appended, written, synced := walState(db)
+		assert.Equal(t, appended, written)
+		assert.Equal(t, appended-int64(len(cmd)), synced)
+
+		err = db.backgroundSyncWal()
+		assert.Nil(t, err)
+		appended, _, synced = walState(db)
+		assert.Equal(t, appended, synced)
+
+		// the background syncer is stuck, the wal writer syncs by itself.
+		err = db.SetString(cmd, "k", "v")
+		assert.Nil(t, err)
+		db.walMu.Lock()
+		db.walDirtySince = time.Now().Add(-walMaxFsyncDelay - time.Second)
+		db.walMu.Unlock()
+		err = db.SetString(cmd, "k", "v")
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			appended, _, synced := walState(db)
+			return appended == synced
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("no", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.AppendFsync = fsyncNo
+		db := newServingTestDB(t, cfg)
+		defer db.Close()
+
+		cmd := encodeCommand("set", "k", "v")
+		err := db.SetString(cmd, "k", "v")
+		assert.Nil(t, err)
+		err = db.backgroundSyncWal()
+		assert.Nil(t, err)
+		appended, written, synced := walState(db)
+		assert.Equal(t, appended, written)
+		assert.Equal(t, appended-int64(len(cmd)), synced)
+	})
+}
+
+func Test_groupCommit(t *testing.T) {
+	db := newServingTestDB(t, defaultConfig())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			err := db.SetString(encodeCommand("set", key, "value"), key, "value")
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	appended, written, synced := walState(db)
+	assert.Equal(t, appended, written)
+	assert.Equal(t, appended, synced)
+
+	err := db.Close()
+	assert.Nil(t, err)
+
+	// every record is in wal exactly once.
+	wal, err := os.ReadFile(filepath.Join(db.dataDir, "wal"))
+	assert.Nil(t, err)
+	assert.Equal(t, appended, int64(len(wal)))
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 1, bytes.Count(wal, encodeCommand("set", fmt.Sprintf("key%d", i), "value")))
+	}
+}
+
+func BenchmarkDB_Set(b *testing.B) {
+	newDB := func(b *testing.B) *DB {
+		cfg := defaultConfig()
+		cfg.Dir = filepath.Join(b.TempDir(), "db")
+		err := os.MkdirAll(cfg.Dir, 0777)
+		if err != nil {
+			b.Fatal(err)
+		}
+		db, err := LoadOrCreateDbWithConfig(cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		db.serving = true
+		return db
+	}
+
+	// one connection at a time, every write pays a fsync.
+	b.Run("serial", func(b *testing.B) {
+		db := newDB(b)
+		defer db.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := strconv.Itoa(i)
+			err := db.SetString(encodeCommand("set", key, "value"), key, "value")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// many connections, writes waiting together share a fsync.
+	b.Run("parallel", func(b *testing.B) {
+		db := newDB(b)
+		defer db.Close()
+
+		var n int64
+		b.SetParallelism(1000 / runtime.GOMAXPROCS(0))
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key := strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+				err := db.SetString(encodeCommand("set", key, "value"), key, "value")
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func Test_rotateWal(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.WalMaxSize = 1024
+	db := newServingTestDB(t, cfg)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		err := db.SetString(encodeCommand("set", key, "value"), key, "value")
+		assert.Nil(t, err)
+	}
+
+	err := db.Close()
+	assert.Nil(t, err)
+
+	// the wal writer rotates after the write which makes wal too large.
+	stat, err := os.Stat(filepath.Join(cfg.Dir, "wal"))
+	assert.Nil(t, err)
+	assert.True(t, stat.Size() <= cfg.WalMaxSize)
+
+	db, err = LoadOrCreateDbWithConfig(cfg)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		v, err := db.GetString(fmt.Sprintf("key%d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, "value", v)
+	}
+}
+
+func Test_checkpointAfterWalWrite(t *testing.T) {
+	db := newServingTestDB(t, defaultConfig())
+	defer db.Close()
+
+	checkpoint := func() uint64 {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.page(0).meta().checkpoint
+	}
+
+	// the wal writer can write but not fsync the record.
+	db.syncMu.Lock()
+	cmd := encodeCommand("set", "k", "v")
+	done := make(chan error)
+	go func() {
+		done <- db.SetString(cmd, "k", "v")
+	}()
+
+	for {
+		appended, written, _ := walState(db)
+		if appended > 0 && written == appended {
+			break
+		}
+		runtime.Gosched()
+	}
+	assert.Equal(t, uint64(0), checkpoint())
+
+	db.syncMu.Unlock()
+	assert.Nil(t, <-done)
+	assert.Eventually(t, func() bool {
+		return checkpoint() == uint64(len(cmd))
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,1075 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A sorted set is kept in the value of its ele as an ordered array which is
+// searched in place in the mmap'd page, without decoding it:
+//
+//	n         uint32
+//	byScore   n uint32 offsets of the entries ordered by score, then member
+//	byMember  n uint32 offsets of the entries ordered by member
+//	entries   score float64 bits, uvarint(len(member)) member
+//
+// Offsets are from the start of the value. Ranks, score and lex ranges are
+// binary searches of byScore and members are found by a binary search of
+// byMember. It is a value like any other, so the undo log, relocation and
+// expiry need nothing special. Every write decodes the whole set and writes it
+// back.
+
+var (
+	errCorruptZset  = errors.New("corrupt sorted set encoding")
+	errNotFloat     = commandError("value is not a valid float")
+	errScoreNaN     = commandError("resulting score is not a number (NaN)")
+	errMinMaxFloat  = errors.New("min or max is not a float")
+	errMinMaxString = errors.New("min or max not valid string range item")
+)
+
+type zsetEntry struct {
+	score  float64
+	member []byte
+}
+
+func zsetLess(a, b zsetEntry) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return bytes.Compare(a.member, b.member) < 0
+}
+
+// encodeZset encodes entries, whose members must be unique.
+func encodeZset(entries []zsetEntry) []byte {
+	byScore := append([]zsetEntry{}, entries...)
+	sort.Slice(byScore, func(i, j int) bool { return zsetLess(byScore[i], byScore[j]) })
+
+	n := len(byScore)
+	size := 4 + 8*n
+	for _, e := range byScore {
+		size += 8 + binary.MaxVarintLen32 + len(e.member)
+	}
+
+	buf := make([]byte, 4+8*n, size)
+	binary.LittleEndian.PutUint32(buf, uint32(n))
+
+	offsets := make([]uint32, n)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for i, e := range byScore {
+		offsets[i] = uint32(len(buf))
+		binary.LittleEndian.PutUint32(buf[4+4*i:], offsets[i])
+
+		binary.LittleEndian.PutUint64(tmp, math.Float64bits(e.score))
+		buf = append(buf, tmp[:8]...)
+		l := binary.PutUvarint(tmp, uint64(len(e.member)))
+		buf = append(buf, tmp[:l]...)
+		buf = append(buf, e.member...)
+	}
+
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.Slice(perm, func(i, j int) bool { return bytes.Compare(byScore[perm[i]].member, byScore[perm[j]].member) < 0 })
+	for j, i := range perm {
+		binary.LittleEndian.PutUint32(buf[4+4*n+4*j:], offsets[i])
+	}
+	return buf
+}
+
+// zsetView reads an encoded sorted set in place. A bad offset or entry sets
+// corrupt instead of failing every read, it must be checked when done.
+type zsetView struct {
+	b       []byte
+	n       int
+	corrupt bool
+}
+
+func newZsetView(b []byte) (*zsetView, error) {
+	if len(b) < 4 {
+		return nil, errCorruptZset
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if uint64(len(b)) < 4+8*uint64(n) {
+		return nil, errCorruptZset
+	}
+	return &zsetView{b: b, n: n}, nil
+}
+
+func (z *zsetView) entryAt(off uint32) zsetEntry {
+	if uint64(off)+8 > uint64(len(z.b)) {
+		z.corrupt = true
+		return zsetEntry{}
+	}
+
+	score := math.Float64frombits(binary.LittleEndian.Uint64(z.b[off:]))
+	member, _, ok := decodeString(z.b[off+8:])
+	if !ok {
+		z.corrupt = true
+		return zsetEntry{}
+	}
+	return zsetEntry{score: score, member: member}
+}
+
+// byScore returns the entry of rank i.
+func (z *zsetView) byScore(i int) zsetEntry {
+	return z.entryAt(binary.LittleEndian.Uint32(z.b[4+4*i:]))
+}
+
+// byMember returns the i-th entry in the order of members.
+func (z *zsetView) byMember(i int) zsetEntry {
+	return z.entryAt(binary.LittleEndian.Uint32(z.b[4+4*z.n+4*i:]))
+}
+
+func (z *zsetView) find(member []byte) (zsetEntry, bool) {
+	i := sort.Search(z.n, func(i int) bool { return bytes.Compare(z.byMember(i).member, member) >= 0 })
+	if i == z.n {
+		return zsetEntry{}, false
+	}
+	e := z.byMember(i)
+	return e, bytes.Equal(e.member, member)
+}
+
+// rank returns the rank of an entry in the set.
+func (z *zsetView) rank(e zsetEntry) int {
+	return sort.Search(z.n, func(i int) bool { return !zsetLess(z.byScore(i), e) })
+}
+
+func (z *zsetView) entries(from, to int) []zsetEntry {
+	entries := make([]zsetEntry, 0, to-from)
+	for i := from; i < to; i++ {
+		entries = append(entries, z.byScore(i))
+	}
+	return entries
+}
+
+func decodeZset(b []byte) ([]zsetEntry, error) {
+	z, err := newZsetView(b)
+	if err != nil {
+		return nil, err
+	}
+	entries := z.entries(0, z.n)
+	if z.corrupt {
+		return nil, errCorruptZset
+	}
+	return entries, nil
+}
+
+// scoreBound is the min or max of a score range, like 1.5, (1.5 or -inf.
+type scoreBound struct {
+	score float64
+	excl  bool
+}
+
+func parseScoreBound(s string) (scoreBound, error) {
+	var b scoreBound
+	if strings.HasPrefix(s, "(") {
+		b.excl = true
+		s = s[1:]
+	}
+
+	var err error
+	b.score, err = strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(b.score) {
+		return b, errMinMaxFloat
+	}
+	return b, nil
+}
+
+// lexBound is the min or max of a lex range, [a or (a, or - and + for the
+// lowest and the highest member.
+type lexBound struct {
+	member []byte
+	excl   bool
+	inf    int // -1 for -, 1 for +
+}
+
+func parseLexBound(s string) (lexBound, error) {
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, nil
+	case s == "+":
+		return lexBound{inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{member: []byte(s[1:])}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{member: []byte(s[1:]), excl: true}, nil
+	}
+	return lexBound{}, errMinMaxString
+}
+
+// aboveMin tells if member is above the bound as a min.
+func (b lexBound) aboveMin(member []byte) bool {
+	if b.inf != 0 {
+		return b.inf < 0
+	}
+	c := bytes.Compare(member, b.member)
+	return c > 0 || (c == 0 && !b.excl)
+}
+
+// belowMax tells if member is below the bound as a max.
+func (b lexBound) belowMax(member []byte) bool {
+	if b.inf != 0 {
+		return b.inf > 0
+	}
+	c := bytes.Compare(member, b.member)
+	return c < 0 || (c == 0 && !b.excl)
+}
+
+// kinds of a range of ZRANGE and friends.
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+type zrangeSpec struct {
+	by          int
+	start, stop int64 // by rank, negative ones count from the highest
+	min, max    scoreBound
+	lmin, lmax  lexBound
+	rev         bool
+	// LIMIT of by score and by lex, a negative count means all.
+	offset, count int64
+}
+
+// window returns the ranks [from, to) the range covers before LIMIT.
+func (z *zsetView) window(spec *zrangeSpec) (int, int) {
+	switch spec.by {
+	case zrangeByScore:
+		from := sort.Search(z.n, func(i int) bool {
+			s := z.byScore(i).score
+			return s > spec.min.score || (s == spec.min.score && !spec.min.excl)
+		})
+		to := sort.Search(z.n, func(i int) bool {
+			s := z.byScore(i).score
+			return s > spec.max.score || (s == spec.max.score && spec.max.excl)
+		})
+		if to < from {
+			to = from
+		}
+		return from, to
+	case zrangeByLex:
+		// lex ranges are for sets of one score, so the order of members is
+		// the order of ranks.
+		from := sort.Search(z.n, func(i int) bool { return spec.lmin.aboveMin(z.byScore(i).member) })
+		to := sort.Search(z.n, func(i int) bool { return !spec.lmax.belowMax(z.byScore(i).member) })
+		if to < from {
+			to = from
+		}
+		return from, to
+	}
+
+	from, to := listRange(z.n, spec.start, spec.stop)
+	if spec.rev {
+		// the ranks count from the highest.
+		from, to = z.n-to, z.n-from
+	}
+	return from, to
+}
+
+// rangeOf returns the entries of the range in the order asked for.
+func (z *zsetView) rangeOf(spec *zrangeSpec) []zsetEntry {
+	from, to := z.window(spec)
+
+	if spec.by != zrangeByRank {
+		if spec.offset < 0 || spec.offset >= int64(to-from) {
+			return []zsetEntry{}
+		}
+		if spec.count >= 0 && spec.count < int64(to-from)-spec.offset {
+			if spec.rev {
+				from = to - int(spec.offset) - int(spec.count)
+			} else {
+				to = from + int(spec.offset) + int(spec.count)
+			}
+		}
+		if spec.rev {
+			to -= int(spec.offset)
+		} else {
+			from += int(spec.offset)
+		}
+	}
+
+	entries := z.entries(from, to)
+	if spec.rev {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries
+}
+
+func copyEntries(entries []zsetEntry) []zsetEntry {
+	for i := range entries {
+		entries[i].member = append([]byte{}, entries[i].member...)
+	}
+	return entries
+}
+
+// zset returns a view of the sorted set in key, nil if key does not exist. It
+// points into the page and is valid while db.mu is held.
+func (db *DB) zset(key []byte) (*zsetView, error) {
+	ie, err := db.lookup(key, typeZset)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+	return newZsetView(db.ele(ie).val())
+}
+
+// readZset returns a copy of the entries of the sorted set in key in the order
+// of ranks, nil if key does not exist. db.mu must be held.
+func (db *DB) readZset(key []byte) ([]zsetEntry, error) {
+	ie, err := db.lookup(key, typeZset)
+	if err != nil || ie.pgid == 0 {
+		return nil, err
+	}
+
+	entries, err := decodeZset(db.ele(ie).val())
+	if err != nil {
+		return nil, err
+	}
+	return copyEntries(entries), nil
+}
+
+// writeZset replaces the value in key with the sorted set of entries, the key
+// is removed if there is no entry left. db.mu must be held.
+func (db *DB) writeZset(key []byte, entries []zsetEntry, expireAt int64) error {
+	if len(entries) == 0 {
+		_, err := db.del(key)
+		return err
+	}
+	return db.setValue(key, encodeZset(entries), typeZset, expireAt)
+}
+
+// updateZset runs fn on the entries of the sorted set in key, writes back the
+// entries it returns and logs originCmd. fn returns nil entries if nothing is
+// changed.
+func (db *DB) updateZset(originCmd []byte, key []byte, fn func(entries []zsetEntry) ([]zsetEntry, error)) (err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	entries, err := db.readZset(key)
+	if err != nil {
+		return err
+	}
+
+	entries, err = fn(entries)
+	if err != nil || entries == nil {
+		return err
+	}
+
+	err = db.writeZset(key, entries, keepTTL)
+	if err != nil {
+		return err
+	}
+	return db.persist(originCmd)
+}
+
+// viewZset runs fn on a view of the sorted set in key, nil if key does not
+// exist, with db.mu held.
+func (db *DB) viewZset(key []byte, fn func(z *zsetView)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	z, err := db.zset(key)
+	if err != nil {
+		return err
+	}
+	fn(z)
+	if z != nil && z.corrupt {
+		return errCorruptZset
+	}
+	return nil
+}
+
+type zaddFlags struct {
+	nx, xx, gt, lt bool
+	ch             bool // count changed scores too
+	incr           bool
+}
+
+// ZAdd adds entries to the sorted set in key or updates their scores and
+// returns the number added, changed ones included if flags.ch is set. With
+// flags.incr the score of the only entry is added to the one in the set and
+// the new score is returned, n is 0 if the entry is left alone because of
+// NX, XX, GT or LT.
+func (db *DB) ZAdd(originCmd []byte, key []byte, flags zaddFlags, entries ...zsetEntry) (n int, score float64, err error) {
+	err = db.updateZset(originCmd, key, func(zset []zsetEntry) ([]zsetEntry, error) {
+		at := make(map[string]int, len(zset))
+		for i, e := range zset {
+			at[string(e.member)] = i
+		}
+
+		var changed bool
+		for _, e := range entries {
+			i, found := at[string(e.member)]
+			if (found && flags.nx) || (!found && flags.xx) {
+				continue
+			}
+
+			if !found {
+				if math.IsNaN(e.score) {
+					return nil, errScoreNaN
+				}
+				at[string(e.member)] = len(zset)
+				zset = append(zset, e)
+				n++
+				score = e.score
+				changed = true
+				continue
+			}
+
+			old := zset[i].score
+			newScore := e.score
+			if flags.incr {
+				newScore += old
+				if math.IsNaN(newScore) {
+					return nil, errScoreNaN
+				}
+			}
+			if (flags.gt && newScore <= old) || (flags.lt && newScore >= old) {
+				continue
+			}
+
+			score = newScore
+			if newScore != old {
+				zset[i].score = newScore
+				changed = true
+				if flags.ch {
+					n++
+				}
+			}
+			if flags.incr {
+				n = 1
+			}
+		}
+
+		if !changed {
+			return nil, nil
+		}
+		return zset, nil
+	})
+	return n, score, err
+}
+
+// ZRem removes members from the sorted set in key and returns the number
+// removed.
+func (db *DB) ZRem(originCmd []byte, key []byte, members ...[]byte) (removed int, err error) {
+	err = db.updateZset(originCmd, key, func(zset []zsetEntry) ([]zsetEntry, error) {
+		drop := make(map[string]bool, len(members))
+		for _, m := range members {
+			drop[string(m)] = true
+		}
+
+		kept := make([]zsetEntry, 0, len(zset))
+		for _, e := range zset {
+			if drop[string(e.member)] {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+
+		if removed == 0 {
+			return nil, nil
+		}
+		return kept, nil
+	})
+	return removed, err
+}
+
+// ZScore returns the scores of members in the sorted set in key, found tells
+// which members are in it.
+func (db *DB) ZScore(key []byte, members ...[]byte) (scores []float64, found []bool, err error) {
+	scores = make([]float64, len(members))
+	found = make([]bool, len(members))
+	err = db.viewZset(key, func(z *zsetView) {
+		if z == nil {
+			return
+		}
+		for i, m := range members {
+			var e zsetEntry
+			e, found[i] = z.find(m)
+			scores[i] = e.score
+		}
+	})
+	return scores, found, err
+}
+
+// ZRank returns the rank of member in the sorted set in key, counted from the
+// highest score if rev is set. rank is -1 if member is not in it.
+func (db *DB) ZRank(key, member []byte, rev bool) (rank int, score float64, err error) {
+	rank = -1
+	err = db.viewZset(key, func(z *zsetView) {
+		if z == nil {
+			return
+		}
+		e, ok := z.find(member)
+		if !ok {
+			return
+		}
+
+		score = e.score
+		rank = z.rank(e)
+		if rev {
+			rank = z.n - 1 - rank
+		}
+	})
+	return rank, score, err
+}
+
+// ZCard returns the number of entries of the sorted set in key.
+func (db *DB) ZCard(key []byte) (n int, err error) {
+	err = db.viewZset(key, func(z *zsetView) {
+		if z != nil {
+			n = z.n
+		}
+	})
+	return n, err
+}
+
+// ZCount returns the number of entries in a score or lex range of the sorted
+// set in key, found by binary searches of its bounds.
+func (db *DB) ZCount(key []byte, spec *zrangeSpec) (n int, err error) {
+	err = db.viewZset(key, func(z *zsetView) {
+		if z != nil {
+			from, to := z.window(spec)
+			n = to - from
+		}
+	})
+	return n, err
+}
+
+// ZRange returns the entries of a range of the sorted set in key.
+func (db *DB) ZRange(key []byte, spec *zrangeSpec) (entries []zsetEntry, err error) {
+	err = db.viewZset(key, func(z *zsetView) {
+		if z != nil {
+			entries = copyEntries(z.rangeOf(spec))
+		}
+	})
+	return entries, err
+}
+
+// ZRangeStore stores a range of the sorted set in src as the sorted set in dst,
+// replacing what dst holds, and returns the number of entries stored.
+func (db *DB) ZRangeStore(originCmd []byte, dst, src []byte, spec *zrangeSpec) (n int, err error) {
+	db.mu.Lock()
+	defer db.unlockAndWaitWal(&err)
+
+	var entries []zsetEntry
+	z, err := db.zset(src)
+	if err != nil {
+		return 0, err
+	}
+	if z != nil {
+		entries = copyEntries(z.rangeOf(spec))
+		if z.corrupt {
+			return 0, errCorruptZset
+		}
+	}
+
+	err = db.writeZset(dst, entries, 0)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), db.persist(originCmd)
+}
+
+// ZRemRange removes the entries of a range of the sorted set in key and
+// returns the number removed.
+func (db *DB) ZRemRange(originCmd []byte, key []byte, spec *zrangeSpec) (removed int, err error) {
+	err = db.updateZset(originCmd, key, func(zset []zsetEntry) ([]zsetEntry, error) {
+		z, err := newZsetView(encodeZset(zset))
+		if err != nil {
+			return nil, err
+		}
+
+		from, to := z.window(spec)
+		removed = to - from
+		if removed == 0 {
+			return nil, nil
+		}
+		return append(zset[:from:from], zset[to:]...), nil
+	})
+	return removed, err
+}
+
+// ZPop removes up to count entries of the lowest scores from the sorted set in
+// key, of the highest if max is set, and returns them.
+func (db *DB) ZPop(originCmd []byte, key []byte, max bool, count int) (popped []zsetEntry, err error) {
+	popped = []zsetEntry{}
+	err = db.updateZset(originCmd, key, func(zset []zsetEntry) ([]zsetEntry, error) {
+		if len(zset) == 0 || count == 0 {
+			return nil, nil
+		}
+		if count > len(zset) {
+			count = len(zset)
+		}
+
+		if max {
+			for i := len(zset) - 1; i >= len(zset)-count; i-- {
+				popped = append(popped, zset[i])
+			}
+			return zset[:len(zset)-count], nil
+		}
+		popped = append(popped, zset[:count]...)
+		return zset[count:], nil
+	})
+	return popped, err
+}
+
+// replyEntries writes the members of entries, with their scores if withScores
+// is set: a flat array in RESP2 and an array of pairs in RESP3.
+func replyEntries(cmdhdr *commandHandler, entries []zsetEntry, withScores bool) error {
+	n := len(entries)
+	if withScores && !cmdhdr.resp3() {
+		n *= 2
+	}
+	err := cmdhdr.replyArrayLen(n)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if withScores && cmdhdr.resp3() {
+			err = cmdhdr.replyArrayLen(2)
+			if err != nil {
+				return err
+			}
+		}
+		err = cmdhdr.replyBulk(string(e.member))
+		if err != nil {
+			return err
+		}
+		if withScores {
+			err = cmdhdr.replyDouble(e.score)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zaddCmd handles ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member
+// [score member ...].
+func zaddCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	var flags zaddFlags
+	i := 2
+loop:
+	for ; i < len(cmd); i++ {
+		switch strings.ToLower(cmd[i]) {
+		case "nx":
+			flags.nx = true
+		case "xx":
+			flags.xx = true
+		case "gt":
+			flags.gt = true
+		case "lt":
+			flags.lt = true
+		case "ch":
+			flags.ch = true
+		case "incr":
+			flags.incr = true
+		default:
+			break loop
+		}
+	}
+
+	args := cmd[i:]
+	if len(args) == 0 || len(args)%2 != 0 {
+		return cmdhdr.replyError(errSyntax)
+	}
+	if flags.nx && flags.xx {
+		return cmdhdr.replyError("ERR XX and NX options at the same time are not compatible")
+	}
+	if (flags.gt && flags.lt) || (flags.nx && (flags.gt || flags.lt)) {
+		return cmdhdr.replyError("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if flags.incr && len(args) > 2 {
+		return cmdhdr.replyError("ERR INCR option supports a single increment-element pair")
+	}
+
+	entries := make([]zsetEntry, 0, len(args)/2)
+	for j := 0; j < len(args); j += 2 {
+		score, err := strconv.ParseFloat(args[j], 64)
+		if err != nil || math.IsNaN(score) {
+			return cmdhdr.replyError("ERR " + errNotFloat.Error())
+		}
+		entries = append(entries, zsetEntry{score: score, member: []byte(args[j+1])})
+	}
+
+	n, score, err := db.ZAdd(originCmd, []byte(cmd[1]), flags, entries...)
+	if err != nil {
+		return err
+	}
+
+	if flags.incr {
+		if n == 0 {
+			return cmdhdr.replyNull()
+		}
+		return cmdhdr.replyDouble(score)
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func zincrbyCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	delta, err := strconv.ParseFloat(cmd[2], 64)
+	if err != nil || math.IsNaN(delta) {
+		return cmdhdr.replyError("ERR " + errNotFloat.Error())
+	}
+
+	_, score, err := db.ZAdd(originCmd, []byte(cmd[1]), zaddFlags{incr: true}, zsetEntry{score: delta, member: []byte(cmd[3])})
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyDouble(score)
+}
+
+func zremCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	removed, err := db.ZRem(originCmd, []byte(cmd[1]), argsBytes(cmd[2:])...)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(removed))
+}
+
+func zcardCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	n, err := db.ZCard([]byte(cmd[1]))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+func zscoreCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	scores, found, err := db.ZScore([]byte(cmd[1]), []byte(cmd[2]))
+	if err != nil {
+		return err
+	}
+	if !found[0] {
+		return cmdhdr.replyNull()
+	}
+	return cmdhdr.replyDouble(scores[0])
+}
+
+func zmscoreCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	scores, found, err := db.ZScore([]byte(cmd[1]), argsBytes(cmd[2:])...)
+	if err != nil {
+		return err
+	}
+
+	err = cmdhdr.replyArrayLen(len(scores))
+	if err != nil {
+		return err
+	}
+	for i, score := range scores {
+		if found[i] {
+			err = cmdhdr.replyDouble(score)
+		} else {
+			err = cmdhdr.replyNull()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zrankCmd handles ZRANK and ZREVRANK key member [WITHSCORE].
+func zrankCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	withScore := false
+	if len(cmd) == 4 {
+		if strings.ToLower(cmd[3]) != "withscore" {
+			return cmdhdr.replyError(errSyntax)
+		}
+		withScore = true
+	} else if len(cmd) > 4 {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	rev := strings.ToLower(cmd[0]) == "zrevrank"
+	rank, score, err := db.ZRank([]byte(cmd[1]), []byte(cmd[2]), rev)
+	if err != nil {
+		return err
+	}
+
+	if rank == -1 {
+		if withScore {
+			return cmdhdr.replyNullArray()
+		}
+		return cmdhdr.replyNull()
+	}
+	if !withScore {
+		return cmdhdr.replyInt(int64(rank))
+	}
+
+	err = cmdhdr.replyArrayLen(2)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyInt(int64(rank))
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyDouble(score)
+}
+
+// zcountCmd handles ZCOUNT key min max and ZLEXCOUNT key min max.
+func zcountCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	spec := &zrangeSpec{by: zrangeByScore}
+	if strings.ToLower(cmd[0]) == "zlexcount" {
+		spec.by = zrangeByLex
+	}
+	err := spec.parseBounds(cmd[2], cmd[3])
+	if err != nil {
+		return cmdhdr.replyError("ERR " + err.Error())
+	}
+
+	n, err := db.ZCount([]byte(cmd[1]), spec)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+// parseBounds parses the min and max of a range, which are the start and stop
+// ranks of a range by rank.
+func (spec *zrangeSpec) parseBounds(min, max string) error {
+	var err error
+	switch spec.by {
+	case zrangeByScore:
+		spec.min, err = parseScoreBound(min)
+		if err != nil {
+			return err
+		}
+		spec.max, err = parseScoreBound(max)
+	case zrangeByLex:
+		spec.lmin, err = parseLexBound(min)
+		if err != nil {
+			return err
+		}
+		spec.lmax, err = parseLexBound(max)
+	default:
+		spec.start, err = strconv.ParseInt(min, 10, 64)
+		if err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+		spec.stop, err = strconv.ParseInt(max, 10, 64)
+		if err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+	}
+	return err
+}
+
+// parseZrange parses the arguments after the key of ZRANGE and its older
+// forms, which are all ZRANGE with some options fixed:
+//
+//	ZRANGE start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+//	ZREVRANGE start stop [WITHSCORES]
+//	ZRANGEBYSCORE min max [WITHSCORES] [LIMIT offset count]
+//	ZREVRANGEBYSCORE max min [WITHSCORES] [LIMIT offset count]
+//	ZRANGEBYLEX min max [LIMIT offset count]
+//	ZREVRANGEBYLEX max min [LIMIT offset count]
+//
+// It returns an error message if they are invalid.
+func parseZrange(name string, args []string) (spec *zrangeSpec, withScores bool, errMsg string) {
+	spec = &zrangeSpec{count: -1}
+	switch name {
+	case "zrevrange":
+		spec.rev = true
+	case "zrangebyscore":
+		spec.by = zrangeByScore
+	case "zrevrangebyscore":
+		spec.by, spec.rev = zrangeByScore, true
+	case "zrangebylex":
+		spec.by = zrangeByLex
+	case "zrevrangebylex":
+		spec.by, spec.rev = zrangeByLex, true
+	}
+	general := name == "zrange" || name == "zrangestore"
+
+	var limit bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "withscores" && name != "zrangebylex" && name != "zrevrangebylex" && name != "zrangestore":
+			withScores = true
+		case opt == "byscore" && general:
+			spec.by = zrangeByScore
+		case opt == "bylex" && general:
+			spec.by = zrangeByLex
+		case opt == "rev" && general:
+			spec.rev = true
+		case opt == "limit" && name != "zrevrange" && i+2 < len(args):
+			var err1, err2 error
+			spec.offset, err1 = strconv.ParseInt(args[i+1], 10, 64)
+			spec.count, err2 = strconv.ParseInt(args[i+2], 10, 64)
+			if err1 != nil || err2 != nil {
+				return nil, false, errNotInteger
+			}
+			limit = true
+			i += 2
+		default:
+			return nil, false, errSyntax
+		}
+	}
+
+	if limit && spec.by == zrangeByRank {
+		return nil, false, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+	}
+	if withScores && spec.by == zrangeByLex {
+		return nil, false, "ERR syntax error, WITHSCORES not supported in combination with BYLEX"
+	}
+
+	min, max := args[0], args[1]
+	if spec.rev && spec.by != zrangeByRank {
+		// the range is given from the highest.
+		min, max = max, min
+	}
+	err := spec.parseBounds(min, max)
+	if err != nil {
+		return nil, false, "ERR " + err.Error()
+	}
+	return spec, withScores, ""
+}
+
+// zrangeCmd handles ZRANGE, ZREVRANGE, ZRANGEBYSCORE, ZREVRANGEBYSCORE,
+// ZRANGEBYLEX and ZREVRANGEBYLEX.
+func zrangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	spec, withScores, errMsg := parseZrange(strings.ToLower(cmd[0]), cmd[2:])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	entries, err := db.ZRange([]byte(cmd[1]), spec)
+	if err != nil {
+		return err
+	}
+	return replyEntries(cmdhdr, entries, withScores)
+}
+
+// zrangestoreCmd handles ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV]
+// [LIMIT offset count].
+func zrangestoreCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	spec, _, errMsg := parseZrange("zrangestore", cmd[3:])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	n, err := db.ZRangeStore(originCmd, []byte(cmd[1]), []byte(cmd[2]), spec)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(n))
+}
+
+// zremrangeCmd handles ZREMRANGEBYRANK, ZREMRANGEBYSCORE and ZREMRANGEBYLEX
+// key min max.
+func zremrangeCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	spec := &zrangeSpec{count: -1}
+	switch strings.ToLower(cmd[0]) {
+	case "zremrangebyscore":
+		spec.by = zrangeByScore
+	case "zremrangebylex":
+		spec.by = zrangeByLex
+	}
+	err := spec.parseBounds(cmd[2], cmd[3])
+	if err != nil {
+		return cmdhdr.replyError("ERR " + err.Error())
+	}
+
+	removed, err := db.ZRemRange(originCmd, []byte(cmd[1]), spec)
+	if err != nil {
+		return err
+	}
+	return cmdhdr.replyInt(int64(removed))
+}
+
+// zpopCmd handles ZPOPMIN and ZPOPMAX key [count].
+func zpopCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	if len(cmd) > 3 {
+		return cmdhdr.replyError(errSyntax)
+	}
+
+	count := int64(1)
+	if len(cmd) == 3 {
+		var err error
+		count, err = strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil || count < 0 {
+			return cmdhdr.replyError("ERR value is out of range, must be positive")
+		}
+		if count > math.MaxInt32 {
+			count = math.MaxInt32
+		}
+	}
+
+	max := strings.ToLower(cmd[0]) == "zpopmax"
+	popped, err := db.ZPop(originCmd, []byte(cmd[1]), max, int(count))
+	if err != nil {
+		return err
+	}
+	return replyEntries(cmdhdr, popped, true)
+}
+
+// zscanCmd handles ZSCAN key cursor [MATCH pattern] [COUNT count]. The cursor
+// is the position of the next member in the order of members.
+func zscanCmd(cmdhdr *commandHandler, db *DB, originCmd []byte, cmd []string) error {
+	cursor, pattern, count, errMsg := parseScanArgs(cmd[2:])
+	if errMsg != "" {
+		return cmdhdr.replyError(errMsg)
+	}
+
+	var found []zsetEntry
+	next := uint64(0)
+	err := db.viewZset([]byte(cmd[1]), func(z *zsetView) {
+		if z == nil {
+			return
+		}
+
+		i := cursor
+		for ; i < uint64(z.n) && i < cursor+uint64(count); i++ {
+			e := z.byMember(int(i))
+			if pattern == "*" || globMatch(pattern, string(e.member)) {
+				found = append(found, e)
+			}
+		}
+		if i < uint64(z.n) {
+			next = i
+		}
+		found = copyEntries(found)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = cmdhdr.replyArrayLen(2)
+	if err != nil {
+		return err
+	}
+	err = cmdhdr.replyBulk(strconv.FormatUint(next, 10))
+	if err != nil {
+		return err
+	}
+
+	err = cmdhdr.replyArrayLen(2 * len(found))
+	if err != nil {
+		return err
+	}
+	for _, e := range found {
+		err = cmdhdr.replyBulk(string(e.member))
+		if err != nil {
+			return err
+		}
+		err = cmdhdr.replyBulk(formatDouble(e.score))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
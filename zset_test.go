@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_zsetEncoding(t *testing.T) {
+	entries := []zsetEntry{
+		{2, []byte("b")},
+		{1, []byte("z")},
+		{2, []byte("a")},
+		{-1.5, []byte("")},
+	}
+
+	b := encodeZset(entries)
+	z, err := newZsetView(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, z.n)
+
+	decoded, err := decodeZset(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []zsetEntry{{-1.5, []byte("")}, {1, []byte("z")}, {2, []byte("a")}, {2, []byte("b")}}, decoded)
+
+	for rank, e := range decoded {
+		found, ok := z.find(e.member)
+		assert.True(t, ok)
+		assert.Equal(t, e, found)
+		assert.Equal(t, rank, z.rank(found))
+	}
+	_, ok := z.find([]byte("nosuch"))
+	assert.False(t, ok)
+	assert.False(t, z.corrupt)
+
+	for _, bad := range [][]byte{{}, {1, 0, 0, 0}, {1, 0, 0, 0, 100, 0, 0, 0, 100, 0, 0, 0}} {
+		_, err := decodeZset(bad)
+		assert.Equal(t, errCorruptZset, err, bad)
+	}
+}
+
+func Test_zsetCommands(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	cases := []struct {
+		cmd    []string
+		expect string
+	}{
+		{[]string{"zadd", "z", "1", "a", "2", "b", "3", "c"}, ":3\r\n"},
+		{[]string{"zadd", "z", "nx", "10", "a", "4", "d"}, ":1\r\n"},
+		{[]string{"zadd", "z", "xx", "ch", "1.5", "a", "9", "nosuch"}, ":1\r\n"},
+		{[]string{"zadd", "z", "gt", "ch", "1", "a", "5", "d"}, ":1\r\n"},
+		{[]string{"zadd", "z", "incr", "1", "a"}, "$3\r\n2.5\r\n"},
+		{[]string{"zadd", "z", "lt", "incr", "1", "a"}, "$-1\r\n"},
+		{[]string{"zadd", "z", "nx", "xx", "1", "a"}, "-ERR XX and NX options at the same time are not compatible\r\n"},
+		{[]string{"zadd", "z", "1", "a", "2"}, "-ERR syntax error\r\n"},
+		{[]string{"zadd", "z", "x", "a"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"zincrby", "z", "-0.5", "a"}, "$1\r\n2\r\n"},
+		{[]string{"zcard", "z"}, ":4\r\n"},
+		{[]string{"zscore", "z", "d"}, "$1\r\n5\r\n"},
+		{[]string{"zscore", "z", "nosuch"}, "$-1\r\n"},
+		{[]string{"zmscore", "z", "c", "nosuch"}, "*2\r\n$1\r\n3\r\n$-1\r\n"},
+		// a=2 b=2 c=3 d=5
+		{[]string{"zrank", "z", "b"}, ":1\r\n"},
+		{[]string{"zrevrank", "z", "b", "withscore"}, "*2\r\n:2\r\n$1\r\n2\r\n"},
+		{[]string{"zrank", "z", "nosuch"}, "$-1\r\n"},
+		{[]string{"zrange", "z", "0", "-1"}, "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{[]string{"zrange", "z", "0", "1", "rev", "withscores"}, "*4\r\n$1\r\nd\r\n$1\r\n5\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{[]string{"zrevrange", "z", "-1", "-1"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"zrange", "z", "(2", "5", "byscore"}, "*2\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{[]string{"zrange", "z", "+inf", "2", "byscore", "rev", "limit", "1", "2"}, "*2\r\n$1\r\nc\r\n$1\r\nb\r\n"},
+		{[]string{"zrangebyscore", "z", "-inf", "+inf", "withscores", "limit", "1", "1"}, "*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"zrevrangebyscore", "z", "3", "(2"}, "*1\r\n$1\r\nc\r\n"},
+		{[]string{"zrangebyscore", "z", "x", "1"}, "-ERR min or max is not a float\r\n"},
+		{[]string{"zrange", "z", "0", "1", "limit", "0", "1"}, "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n"},
+		{[]string{"zcount", "z", "2", "(5"}, ":3\r\n"},
+		{[]string{"zadd", "lex", "0", "a", "0", "b", "0", "c", "0", "d"}, ":4\r\n"},
+		{[]string{"zrangebylex", "lex", "[b", "+"}, "*3\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{[]string{"zrevrangebylex", "lex", "(d", "-", "limit", "0", "2"}, "*2\r\n$1\r\nc\r\n$1\r\nb\r\n"},
+		{[]string{"zrange", "lex", "[a", "(c", "bylex"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"zrange", "lex", "[a", "(c", "bylex", "withscores"}, "-ERR syntax error, WITHSCORES not supported in combination with BYLEX\r\n"},
+		{[]string{"zlexcount", "lex", "-", "[b"}, ":2\r\n"},
+		{[]string{"zlexcount", "lex", "a", "[b"}, "-ERR min or max not valid string range item\r\n"},
+		{[]string{"zrangestore", "dst", "z", "2", "3", "byscore"}, ":3\r\n"},
+		{[]string{"zrange", "dst", "0", "-1", "withscores"}, "*6\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nb\r\n$1\r\n2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{[]string{"zrangestore", "dst", "z", "10", "20", "byscore"}, ":0\r\n"},
+		{[]string{"type", "dst"}, "+none\r\n"},
+		{[]string{"zremrangebylex", "lex", "(a", "[c"}, ":2\r\n"},
+		{[]string{"zremrangebyrank", "lex", "0", "0"}, ":1\r\n"},
+		{[]string{"zrange", "lex", "0", "-1"}, "*1\r\n$1\r\nd\r\n"},
+		{[]string{"zremrangebyscore", "z", "-inf", "(3"}, ":2\r\n"},
+		{[]string{"zpopmax", "z"}, "*2\r\n$1\r\nd\r\n$1\r\n5\r\n"},
+		{[]string{"zpopmin", "z", "5"}, "*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{[]string{"zpopmin", "z"}, "*0\r\n"},
+		{[]string{"type", "z"}, "+none\r\n"},
+		{[]string{"zrem", "lex", "d", "nosuch"}, ":1\r\n"},
+		{[]string{"zadd", "s", "1e6", "m1", "1", "m2"}, ":2\r\n"},
+		{[]string{"zscan", "s", "0", "count", "1"}, "*2\r\n$1\r\n1\r\n*2\r\n$2\r\nm1\r\n$7\r\n1000000\r\n"},
+		{[]string{"zscan", "s", "1", "match", "m*"}, "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nm2\r\n$1\r\n1\r\n"},
+	}
+
+	for _, c := range cases {
+		out := runCommands(t, db, cmdhdr, string(encodeCommand(c.cmd...)))
+		assert.Equal(t, c.expect, out, c.cmd)
+	}
+
+	// scores are doubles and pairs with their members in RESP3.
+	cmdhdr.proto = resp3
+	out := runCommands(t, db, cmdhdr, string(encodeCommand("zrange", "s", "0", "-1", "withscores"))+
+		string(encodeCommand("zscore", "s", "m2")))
+	assert.Equal(t, "*2\r\n*2\r\n$2\r\nm2\r\n,1\r\n*2\r\n$2\r\nm1\r\n,1000000\r\n,1\r\n", out)
+}
+
+func Test_zsetWrongType(t *testing.T) {
+	db := newTestDB(t)
+	cmdhdr := newCommandHandler(nil, nil, nil)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	input := string(encodeCommand("set", "str", "v")) +
+		string(encodeCommand("zadd", "str", "1", "a")) +
+		string(encodeCommand("zrange", "str", "0", "-1")) +
+		string(encodeCommand("zadd", "z", "1", "a")) +
+		string(encodeCommand("get", "z"))
+	out := runCommands(t, db, cmdhdr, input)
+	assert.Equal(t, "+OK\r\n"+wrongType+wrongType+":1\r\n"+wrongType, out)
+}
+
+func Test_zsetLarge(t *testing.T) {
+	db := newTestDB(t)
+
+	// larger than a page.
+	n := 2000
+	entries := make([]zsetEntry, 0, n)
+	for i := 0; i < n; i++ {
+		entries = append(entries, zsetEntry{score: float64(n - i), member: []byte(fmt.Sprintf("member-%04d", i))})
+	}
+	added, _, err := db.ZAdd(nil, []byte("z"), zaddFlags{}, entries...)
+	assert.Nil(t, err)
+	assert.Equal(t, n, added)
+
+	rank, score, err := db.ZRank([]byte("z"), []byte("member-0000"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, n-1, rank)
+	assert.Equal(t, float64(n), score)
+
+	got, err := db.ZRange([]byte("z"), &zrangeSpec{by: zrangeByScore, min: scoreBound{100, true}, max: scoreBound{103, false}, count: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, []zsetEntry{{101, []byte("member-1899")}, {102, []byte("member-1898")}, {103, []byte("member-1897")}}, got)
+
+	count, err := db.ZCount([]byte("z"), &zrangeSpec{by: zrangeByScore, min: scoreBound{1, false}, max: scoreBound{1000, false}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, count)
+}
+
+func Test_recoverZset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	err := os.MkdirAll(path, 0777)
+	assert.Nil(t, err)
+
+	db, err := LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	db.serving = true
+
+	cmdhdr := newCommandHandler(nil, nil, nil)
+	input := string(encodeCommand("zadd", "z", "1", "a", "2", "b", "3", "c")) +
+		string(encodeCommand("zincrby", "z", "0.1", "a")) +
+		string(encodeCommand("zpopmax", "z")) +
+		string(encodeCommand("zrangestore", "dst", "z", "0", "0"))
+	runCommands(t, db, cmdhdr, input)
+
+	wal, err := os.ReadFile(filepath.Join(path, "wal"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(path, "db"))
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(path, "wal"), wal, 0644)
+	assert.Nil(t, err)
+
+	db, err = LoadOrCreateDbFromDir(path)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	got, err := db.ZRange([]byte("z"), &zrangeSpec{start: 0, stop: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, []zsetEntry{{1.1, []byte("a")}, {2, []byte("b")}}, got)
+	got, err = db.ZRange([]byte("dst"), &zrangeSpec{start: 0, stop: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, []zsetEntry{{1.1, []byte("a")}}, got)
+	assert.Equal(t, "1.1", strconv.FormatFloat(got[0].score, 'g', -1, 64))
+}